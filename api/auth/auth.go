@@ -0,0 +1,128 @@
+// Package auth holds API key generation and the permission scopes checked by the routes.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+const (
+	ScopeInstancesRead  = "instances:read"
+	ScopeInstancesWrite = "instances:write"
+	ScopeSettingsRead   = "settings:read"
+	ScopeSettingsWrite  = "settings:write"
+	ScopeMessagesRead   = "messages:read"
+	ScopeMessagesSend   = "messages:send"
+	ScopeKeysManage     = "keys:manage"
+	// ScopeAdmin implies every other scope within the principal's tenant
+	ScopeAdmin = "admin"
+	// ScopeSuperAdmin implies every scope across all tenants
+	ScopeSuperAdmin = "superadmin"
+)
+
+var AllScopes = []string{
+	ScopeInstancesRead, ScopeInstancesWrite,
+	ScopeSettingsRead, ScopeSettingsWrite,
+	ScopeMessagesRead, ScopeMessagesSend,
+	ScopeKeysManage, ScopeAdmin, ScopeSuperAdmin,
+}
+
+const keyPrefix = "wak_"
+
+func ValidScope(scope string) bool {
+	return slices.Contains(AllScopes, scope)
+}
+
+// Principal is the authenticated caller of a request, either an API key or a user
+type Principal struct {
+	KeyID    uint     `json:"key_id,omitempty"`
+	Phone    string   `json:"phone,omitempty"` // Set for keys restricted to one instance
+	UserID   uint     `json:"user_id,omitempty"`
+	Name     string   `json:"name"`
+	TenantID string   `json:"tenant_id"`
+	Scopes   []string `json:"scopes"`
+
+	RateLimits map[string]int `json:"-"` // Per minute overrides by route class
+	DailyQuota int64          `json:"-"`
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	if slices.Contains(p.Scopes, ScopeSuperAdmin) || slices.Contains(p.Scopes, scope) {
+		return true
+	}
+	// admin covers everything but crossing tenants
+	return scope != ScopeSuperAdmin && slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+func (p *Principal) IsSuperAdmin() bool {
+	return slices.Contains(p.Scopes, ScopeSuperAdmin)
+}
+
+// CanAccess reports whether p may operate on resources owned by tenant
+func (p *Principal) CanAccess(tenant string) bool {
+	return p.IsSuperAdmin() || p.TenantID == tenant
+}
+
+// TenantFilter returns the tenant to restrict queries to, empty for super admins
+func (p *Principal) TenantFilter() string {
+	if p.IsSuperAdmin() {
+		return ""
+	}
+	return p.TenantID
+}
+
+// CanGrant reports whether p holds every scope in scopes
+func (p *Principal) CanGrant(scopes []string) bool {
+	for _, s := range scopes {
+		if !p.HasScope(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// MinKeyLength is the shortest key accepted from configuration
+const MinKeyLength = 32
+
+// generatedKeyLen is the length of keys returned by GenerateKey
+var generatedKeyLen = len(keyPrefix) + base64.RawURLEncoding.EncodedLen(32)
+
+// GenerateKey returns a new random API key and the short prefix used to identify it
+func GenerateKey() (key, prefix string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	key = keyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return key, KeyPrefix(key), nil
+}
+
+// KeyPrefix returns the identifier shown for key in listings. Generated keys show
+// their first random characters, other keys part of their hash, so no part of a
+// chosen secret is stored.
+func KeyPrefix(key string) string {
+	if strings.HasPrefix(key, keyPrefix) && len(key) == generatedKeyLen {
+		return key[:len(keyPrefix)+8]
+	}
+	return "sha256:" + HashKey(key)[:8]
+}
+
+// HashKey returns the hex SHA-256 of key. Keys are random 256 bit values,
+// so a fast hash is enough and allows lookups by hash.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// JoinScopes and SplitScopes convert between scope lists and their stored form
+func JoinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func SplitScopes(s string) []string {
+	return strings.Fields(s)
+}
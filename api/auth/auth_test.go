@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	generated, prefix, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != generated[:12] || KeyPrefix(generated) != prefix {
+		t.Fatalf("prefix %q of generated key %q", prefix, generated)
+	}
+
+	// Chosen keys, even ones that look generated, never store part of the secret
+	for _, key := range []string{
+		"short",
+		"my-long-admin-key-chosen-by-an-operator",
+		"wak_" + strings.Repeat("x", 20),
+	} {
+		got := KeyPrefix(key)
+		if !strings.HasPrefix(got, "sha256:") || strings.Contains(got, key[:5]) {
+			t.Errorf("KeyPrefix(%q) = %q", key, got)
+		}
+		if got != KeyPrefix(key) {
+			t.Errorf("KeyPrefix(%q) is not stable", key)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig configures single sign-on against an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // Optional for public clients, PKCE is always used
+	RedirectURL  string
+	Scopes       []string
+	GroupsClaim  string            // ID token claim listing the user's groups, "groups" by default
+	RoleMap      map[string]string // Group to role, "*" matches every authenticated user
+}
+
+// ParseRoleMap parses "group=role,group2=role2" as used by WHATSALY_OIDC_ROLE_MAP
+func ParseRoleMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || !ValidRole(role) {
+			return nil, fmt.Errorf("invalid role mapping %q", pair)
+		}
+		m[group] = role
+	}
+	return m, nil
+}
+
+// OIDCProvider runs the authorization code flow with PKCE and validates ID tokens
+type OIDCProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// OIDCIdentity is the validated result of a login
+type OIDCIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Role     string
+}
+
+// NewOIDCProvider loads the provider's discovery document
+func NewOIDCProvider(ctx context.Context, cfg OIDCConfig) (*OIDCProvider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("issuer, client id and redirect url are required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	p := &OIDCProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+
+	var doc struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &doc); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if doc.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("discovery: issuer mismatch %q", doc.Issuer)
+	}
+	if doc.AuthURL == "" || doc.TokenURL == "" || doc.JWKSURL == "" {
+		return nil, errors.New("discovery: missing endpoints")
+	}
+	p.authURL, p.tokenURL, p.jwksURL = doc.AuthURL, doc.TokenURL, doc.JWKSURL
+
+	return p, nil
+}
+
+// OIDCLogin holds the per-login secrets kept by the server until the callback
+type OIDCLogin struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewLogin generates state, nonce and PKCE verifier and returns them with the
+// provider URL to redirect the browser to
+func (p *OIDCProvider) NewLogin() (*OIDCLogin, string, error) {
+	var l OIDCLogin
+	var err error
+	if l.State, err = RandomToken(24); err != nil {
+		return nil, "", err
+	}
+	if l.Nonce, err = RandomToken(24); err != nil {
+		return nil, "", err
+	}
+	if l.Verifier, err = RandomToken(32); err != nil {
+		return nil, "", err
+	}
+
+	challenge := sha256.Sum256([]byte(l.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {l.State},
+		"nonce":                 {l.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	return &l, p.authURL + sep + q.Encode(), nil
+}
+
+// Exchange redeems code for tokens, validates the ID token against login and maps
+// the user's groups to a role
+func (p *OIDCProvider) Exchange(ctx context.Context, login *OIDCLogin, code string) (*OIDCIdentity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {login.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return nil, fmt.Errorf("token request failed: %s %s", resp.Status, tok.Error)
+	}
+
+	claims, err := p.verifyIDToken(ctx, tok.IDToken, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return p.identity(claims)
+}
+
+// verifyIDToken checks the RS256 signature, issuer, audience, expiry and nonce
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token: malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("id token: unsupported alg %q", header.Alg)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("id token: bad signature encoding")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("id token: invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.cfg.Issuer {
+		return nil, errors.New("id token: wrong issuer")
+	}
+	if !audienceContains(claims["aud"], p.cfg.ClientID) {
+		return nil, errors.New("id token: wrong audience")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.cfg.ClientID {
+		return nil, errors.New("id token: wrong authorized party")
+	}
+	if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return nil, errors.New("id token: nonce mismatch")
+	}
+
+	// Allow a minute of clock skew
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, errors.New("id token: expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(time.Minute)) {
+		return nil, errors.New("id token: issued in the future")
+	}
+
+	return claims, nil
+}
+
+// identity maps claims to a user, picking the most privileged role of their groups
+func (p *OIDCProvider) identity(claims map[string]any) (*OIDCIdentity, error) {
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("id token: missing subject")
+	}
+
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username, _ = claims["email"].(string)
+	}
+	if username == "" {
+		username = sub
+	}
+
+	var groups []string
+	switch g := claims[p.cfg.GroupsClaim].(type) {
+	case []any:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	case string:
+		groups = strings.Fields(g)
+	}
+	groups = append(groups, "*")
+
+	order := []string{RoleViewer, RoleOperator, RoleAdmin}
+	best := -1
+	for _, g := range groups {
+		if role, ok := p.cfg.RoleMap[g]; ok {
+			best = max(best, slices.Index(order, role))
+		}
+	}
+	if best < 0 {
+		return nil, ErrNoRole
+	}
+
+	return &OIDCIdentity{Issuer: p.cfg.Issuer, Subject: sub, Username: username, Role: order[best]}, nil
+}
+
+// ErrNoRole is returned when none of a user's groups maps to a role
+var ErrNoRole = errors.New("no role mapped for user's groups")
+
+// key returns the signing key kid, refetching the JWKS when it is unknown so
+// provider key rotation is picked up. Refetches are limited to one per minute.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k := p.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	if time.Since(p.fetched) < time.Minute {
+		return nil, errors.New("id token: unknown signing key")
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	p.fetched = time.Now()
+	if err := p.getJSON(ctx, p.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if k := p.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	return nil, errors.New("id token: unknown signing key")
+}
+
+// lookupKey finds kid, or the only key when the token names none. Callers hold p.mu.
+func (p *OIDCProvider) lookupKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k
+		}
+	}
+	return p.keys[kid]
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func audienceContains(aud any, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []any:
+		for _, v := range a {
+			if v == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
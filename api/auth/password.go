@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 10
+
+var ErrWeakPassword = errors.New("password must be at least 10 characters")
+
+func HashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// dummyHash is checked against for unknown users, so they take as long to reject
+// as a wrong password and usernames can't be probed by timing
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// CheckNoPassword spends the time of CheckPassword and always fails
+func CheckNoPassword(password string) bool {
+	bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+	return false
+}
+
+// RandomToken returns a URL safe random string of n bytes of entropy
+func RandomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
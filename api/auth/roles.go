@@ -0,0 +1,34 @@
+package auth
+
+import "slices"
+
+// Roles of dashboard users, mapped onto the same scopes API keys carry
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleScopes = map[string][]string{
+	RoleViewer: {
+		ScopeInstancesRead, ScopeSettingsRead, ScopeMessagesRead,
+	},
+	RoleOperator: {
+		ScopeInstancesRead, ScopeInstancesWrite,
+		ScopeSettingsRead, ScopeSettingsWrite,
+		ScopeMessagesRead, ScopeMessagesSend,
+	},
+	RoleAdmin: {
+		ScopeAdmin,
+	},
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// RoleScopes returns the scopes granted by role
+func RoleScopes(role string) []string {
+	return slices.Clone(roleScopes[role])
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_010, 0)
+	step := now.Unix() / totpPeriod
+	code := func(d int64) string {
+		c, err := TOTPCode(secret, now.Add(time.Duration(d*totpPeriod)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name string
+		code string
+		last int64
+		want int64
+		ok   bool
+	}{
+		{"current", code(0), 0, step, true},
+		{"previous period", code(-1), 0, step - 1, true},
+		{"next period", code(1), 0, step + 1, true},
+		{"too old", code(-2), 0, 0, false},
+		{"replayed", code(0), step, 0, false},
+		{"older than last used", code(-1), step, 0, false},
+		{"newer than last used", code(1), step, step + 1, true},
+		{"wrong length", "12345", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := VerifyTOTP(secret, tt.code, now, tt.last)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("VerifyTOTP = %d, %t, want %d, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
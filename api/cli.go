@@ -0,0 +1,536 @@
+package main
+
+import (
+	"api/auth"
+	"api/config"
+	"api/database"
+	"api/kvstore"
+	"api/manager"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: api [config flags] <command> [args]
+
+commands:
+  serve                                   run the server (default)
+  config print                            show the effective configuration
+  instances list                          list instances
+  instances start|pause|reset <phone>     control an instance
+  settings get <phone>                    show an instance's settings
+  settings set <phone> <key> <value>      change a setting
+  keys create <name> <scope>...           create an API key, printed once
+  keys revoke <id>                        revoke an API key
+  db migrate [up|down [n]|status]         apply, roll back or list schema migrations
+  db backup [file]|vacuum                 maintain the local database
+  db reindex [phone]                      rebuild the message search index
+  db purge [phone]                        apply message retention policies now
+  user create|passwd|reset-totp ...       manage dashboard users
+
+instances, settings and keys work on the local database, or on a running server
+with --remote <url> --key <api key> (or WHATSALY_REMOTE and WHATSALY_REMOTE_KEY).
+Instance processes belong to the server: while it runs, instances and settings
+are only changed through it. Locally started instances start with the server.`
+
+// runCommand runs a CLI command. It reports false when args ask to serve.
+func runCommand(cfg *config.Config, args []string) (bool, error) {
+	if len(args) == 0 || args[0] == "serve" {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "config":
+		if len(args) < 2 || args[1] != "print" {
+			return true, errors.New(usage)
+		}
+		cfg.Print(os.Stdout)
+		return true, nil
+	case "user":
+		database.InitDB(dbOptions(cfg))
+		return true, runUserCommand(args[1:])
+	case "db":
+		return true, runDBCommand(cfg, args[1:])
+	case "instances", "settings", "keys":
+		return true, runClientCommand(cfg, args[0], args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return true, nil
+	}
+	return true, fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+}
+
+func runDBCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	if args[0] == "migrate" {
+		return runMigrate(cfg, args[1:])
+	}
+
+	database.InitDB(dbOptions(cfg))
+
+	switch args[0] {
+	case "backup":
+		path := filepath.Join(filepath.Dir(cfg.DB.Path), "backups",
+			"whatsaly-"+time.Now().Format("20060102-150405")+".sqlite")
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := database.Backup(path); err != nil {
+			return err
+		}
+		fmt.Printf("Backed up to %s\n", path)
+	case "vacuum":
+		if err := database.Vacuum(); err != nil {
+			return err
+		}
+		fmt.Println("Database vacuumed")
+	case "reindex":
+		p := ""
+		if len(args) > 1 {
+			var err error
+			if p, err = manager.ResolvePhone(args[1]); err != nil {
+				return err
+			}
+		}
+		n, err := database.ReindexMessages(p)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Indexed %d messages\n", n)
+	case "purge":
+		return runPurge(cfg, args[1:])
+	default:
+		return errors.New(usage)
+	}
+	return nil
+}
+
+// runPurge applies the retention policy of phone, or every policy, in the foreground
+func runPurge(cfg *config.Config, args []string) error {
+	var policies []database.RetentionPolicy
+	if len(args) > 0 {
+		p, err := manager.ResolvePhone(args[0])
+		if err != nil {
+			return err
+		}
+		policy, err := database.GetRetentionPolicy(p)
+		if err != nil {
+			return err
+		}
+		if !policy.Enabled() {
+			return fmt.Errorf("%s has no retention limits", p)
+		}
+		policies = append(policies, *policy)
+	} else {
+		var err error
+		if policies, err = database.ListRetentionPolicies(); err != nil {
+			return err
+		}
+	}
+
+	opts := janitorOptions(cfg)
+	var purged int64
+	for _, policy := range policies {
+		run, err := database.PurgeMessages(policy, "cli", opts.Batch, opts.Pause)
+		if err != nil {
+			return fmt.Errorf("%s: %w", policy.SessionPhone, err)
+		}
+		fmt.Printf("%s: purged %d by age, %d over the chat limit, in %d chats\n",
+			policy.SessionPhone, run.ByAge, run.ByCount, run.Chats)
+		purged += run.ByAge + run.ByCount
+	}
+	if purged > 0 {
+		return database.IncrementalVacuum()
+	}
+	return nil
+}
+
+func runMigrate(cfg *config.Config, args []string) error {
+	database.Open(dbOptions(cfg))
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "up":
+		if err := database.Migrate(); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		if err := database.MigrateDown(steps); err != nil {
+			return err
+		}
+	case "status":
+		list, applied, err := database.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range list {
+			at := "pending"
+			if t, ok := applied[m.Version]; ok {
+				at = t.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, at)
+		}
+		w.Flush()
+		return database.CheckSchema()
+	default:
+		return errors.New(usage)
+	}
+
+	version, err := database.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema is at version %d of %d\n", version, database.LatestVersion())
+	return nil
+}
+
+// client is implemented against the database directly and against a remote server
+type client interface {
+	ListInstances() ([]map[string]any, error)
+	InstanceAction(phone, action string) (map[string]any, error)
+	GetSettings(phone string) (map[string]any, error)
+	SetSetting(phone, key string, value any) error
+	CreateKey(name, tenant string, scopes []string) (map[string]any, error)
+	RevokeKey(id uint) error
+}
+
+func runClientCommand(cfg *config.Config, group string, args []string) error {
+	fs := flag.NewFlagSet(group, flag.ContinueOnError)
+	remote := fs.String("remote", os.Getenv("WHATSALY_REMOTE"), "URL of a running server")
+	key := fs.String("key", os.Getenv("WHATSALY_REMOTE_KEY"), "API key for --remote")
+	tenant := fs.String("tenant", database.DefaultTenant, "Tenant for new instances and keys")
+	asJSON := fs.Bool("json", false, "Print JSON")
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	action := args[0]
+	rest, err := parseInterleaved(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	var cl client
+	if *remote != "" {
+		if *key == "" {
+			return errors.New("--remote needs --key")
+		}
+		cl = newRemoteClient(*remote, *key)
+	} else {
+		database.InitDB(dbOptions(cfg))
+		cl = &localClient{cfg: cfg, tenant: *tenant}
+	}
+
+	// Remote servers resolve the phone themselves, as they do for API calls
+	needPhone := func(n int) (string, error) {
+		if len(rest) < n {
+			return "", errors.New(usage)
+		}
+		if *remote != "" {
+			return rest[0], nil
+		}
+		return manager.ResolvePhone(rest[0])
+	}
+
+	// The running server owns the instances and the embedded kv store, changing them
+	// behind its back would be lost or conflict with it
+	if _, ok := cl.(*localClient); ok && mutating[group+" "+action] {
+		if addr, running := serverRunning(cfg); running {
+			return fmt.Errorf("the server is running on %s, use --remote http://%s with an API key to %s %s", addr, addr, group, action)
+		}
+	}
+
+	switch group + " " + action {
+	case "instances list":
+		list, err := cl.ListInstances()
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(list)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PHONE\tTENANT\tSTATUS\tNAME")
+		for _, in := range list {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", in["phone"], in["tenant_id"], in["status"], in["display_name"])
+		}
+		return w.Flush()
+
+	case "instances start", "instances pause", "instances reset":
+		p, err := needPhone(1)
+		if err != nil {
+			return err
+		}
+		res, err := cl.InstanceAction(p, action)
+		if err != nil {
+			return err
+		}
+		return printJSON(res)
+
+	case "settings get":
+		p, err := needPhone(1)
+		if err != nil {
+			return err
+		}
+		settings, err := cl.GetSettings(p)
+		if err != nil {
+			return err
+		}
+		return printJSON(settings)
+
+	case "settings set":
+		p, err := needPhone(3)
+		if err != nil {
+			return err
+		}
+		if !database.SettingKeys[rest[1]] {
+			return fmt.Errorf("unknown setting %q", rest[1])
+		}
+		if err := cl.SetSetting(p, rest[1], parseValue(rest[2])); err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s for %s\n", rest[1], p)
+		return nil
+
+	case "keys create":
+		if len(rest) < 2 {
+			return errors.New(usage)
+		}
+		for _, s := range rest[1:] {
+			if !auth.ValidScope(s) {
+				return fmt.Errorf("unknown scope %q", s)
+			}
+		}
+		k, err := cl.CreateKey(rest[0], *tenant, rest[1:])
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(k)
+		}
+		fmt.Printf("Created key %v (shown only once): %v\n", k["id"], k["key"])
+		return nil
+
+	case "keys revoke":
+		if len(rest) < 1 {
+			return errors.New(usage)
+		}
+		id, err := strconv.ParseUint(rest[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid key id %q", rest[0])
+		}
+		if err := cl.RevokeKey(uint(id)); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked key %d\n", id)
+		return nil
+	}
+	return errors.New(usage)
+}
+
+// mutating are the client commands that change state the server holds in memory
+var mutating = map[string]bool{
+	"instances start": true,
+	"instances pause": true,
+	"instances reset": true,
+	"settings set":    true,
+}
+
+// serverRunning reports whether a server accepts connections on the configured
+// listen address
+func serverRunning(cfg *config.Config) (string, bool) {
+	addr, err := localAddr(cfg.Server.Listen)
+	if err != nil {
+		return "", false
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return addr, false
+	}
+	conn.Close()
+	return addr, true
+}
+
+// parseInterleaved parses flags placed anywhere among the positional arguments
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseValue reads numbers, booleans and JSON values, anything else is a string
+func parseValue(s string) any {
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err == nil {
+		return v
+	}
+	return s
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// localClient works on the database of this machine
+type localClient struct {
+	cfg    *config.Config
+	tenant string
+}
+
+func (l *localClient) ListInstances() ([]map[string]any, error) {
+	sessions, err := database.ListSessions(database.SessionFilter{})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]map[string]any, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, map[string]any{
+			"phone":            s.Phone,
+			"tenant_id":        s.TenantID,
+			"status":           s.Status,
+			"display_name":     s.DisplayName,
+			"labels":           s.Labels,
+			"startup_priority": s.StartupPriority,
+		})
+	}
+	return out, nil
+}
+
+func (l *localClient) InstanceAction(phone, action string) (map[string]any, error) {
+	switch action {
+	case "start":
+		if _, err := database.ClaimSession(phone, l.tenant); err != nil {
+			return nil, err
+		}
+		if err := database.UpdateSessionMeta(phone, map[string]any{"status": "starting"}); err != nil {
+			return nil, err
+		}
+		return map[string]any{"phone": phone, "status": "starting", "note": "starts with the server"}, nil
+
+	case "pause":
+		if err := database.UpdateSessionMeta(phone, map[string]any{"status": "paused"}); err != nil {
+			return nil, err
+		}
+		return map[string]any{"phone": phone, "status": "paused"}, nil
+
+	case "reset":
+		if _, err := database.GetSession(phone); err != nil {
+			return nil, fmt.Errorf("instance %s not found", phone)
+		}
+		res, err := l.clearSession(phone)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"phone": phone, "status": "reset", "keys": res}, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", action)
+}
+
+// clearSession deletes the data of phone from the database and the configured kv
+// store, as the server does on reset
+func (l *localClient) clearSession(phone string) (kvstore.DeleteResult, error) {
+	var kv kvstore.Store
+	var err error
+	if l.cfg.Redis.Embedded {
+		kv, err = kvstore.NewPersistent(database.KVBackend{}, time.Second)
+	} else {
+		kv, err = kvstore.Open(l.cfg.Redis.URL)
+	}
+	if err != nil {
+		return kvstore.DeleteResult{}, err
+	}
+	defer kv.Close()
+
+	sm := manager.CreateSession(kv)
+	sm.ResetTimeout = time.Duration(l.cfg.Limits.ResetTimeoutS) * time.Second
+	return sm.ClearSession(phone)
+}
+
+func (l *localClient) GetSettings(phone string) (map[string]any, error) {
+	if _, err := database.GetSession(phone); err != nil {
+		return nil, fmt.Errorf("instance %s not found", phone)
+	}
+	s, err := database.GetUserSettings(phone)
+	if err != nil {
+		return nil, err
+	}
+	return toMap(s)
+}
+
+func (l *localClient) SetSetting(phone, key string, value any) error {
+	if _, err := database.GetSession(phone); err != nil {
+		return fmt.Errorf("instance %s not found", phone)
+	}
+	return database.UpdateUserSetting(phone, key, value)
+}
+
+func (l *localClient) CreateKey(name, tenant string, scopes []string) (map[string]any, error) {
+	if _, err := database.GetTenant(tenant); err != nil {
+		return nil, fmt.Errorf("unknown tenant %q", tenant)
+	}
+	plain, prefix, err := auth.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	record := database.APIKey{
+		Name:     name,
+		TenantID: tenant,
+		Prefix:   prefix,
+		Hash:     auth.HashKey(plain),
+		Scopes:   auth.JoinScopes(scopes),
+	}
+	if err := database.CreateAPIKey(&record); err != nil {
+		return nil, err
+	}
+	return map[string]any{"id": record.ID, "name": name, "tenant_id": tenant, "scopes": scopes, "key": plain}, nil
+}
+
+func (l *localClient) RevokeKey(id uint) error {
+	return database.RevokeAPIKey(id, "")
+}
+
+func toMap(v any) (map[string]any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
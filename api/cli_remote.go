@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// remoteClient calls the API of a running server
+type remoteClient struct {
+	base string
+	key  string
+	http *http.Client
+}
+
+func newRemoteClient(base, key string) *remoteClient {
+	return &remoteClient{
+		base: strings.TrimSuffix(base, "/"),
+		key:  key,
+		http: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// do sends body as JSON and decodes the response into out. Error responses are
+// returned as errors carrying the server's message.
+func (r *remoteClient) do(method, path string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, r.base+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.key)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error  string `json:"error"`
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(buf, &e) == nil && e.Error != "" {
+			if e.Detail != "" {
+				return fmt.Errorf("%s: %s (%s)", resp.Status, e.Error, e.Detail)
+			}
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
+
+func (r *remoteClient) ListInstances() ([]map[string]any, error) {
+	var list []map[string]any
+	err := r.do(http.MethodGet, "/api/instances", nil, &list)
+	return list, err
+}
+
+func (r *remoteClient) InstanceAction(phone, action string) (map[string]any, error) {
+	var res map[string]any
+	err := r.do(http.MethodPost, "/api/instances/"+url.PathEscape(phone)+"/"+action, nil, &res)
+	return res, err
+}
+
+func (r *remoteClient) GetSettings(phone string) (map[string]any, error) {
+	var res struct {
+		Settings map[string]any `json:"settings"`
+	}
+	err := r.do(http.MethodGet, "/api/settings/"+url.PathEscape(phone), nil, &res)
+	return res.Settings, err
+}
+
+func (r *remoteClient) SetSetting(phone, key string, value any) error {
+	return r.do(http.MethodPatch, "/api/settings/"+url.PathEscape(phone), map[string]any{"key": key, "value": value}, nil)
+}
+
+func (r *remoteClient) CreateKey(name, tenant string, scopes []string) (map[string]any, error) {
+	var res map[string]any
+	err := r.do(http.MethodPost, "/api/keys", map[string]any{"name": name, "tenant_id": tenant, "scopes": scopes}, &res)
+	return res, err
+}
+
+func (r *remoteClient) RevokeKey(id uint) error {
+	return r.do(http.MethodDelete, fmt.Sprintf("/api/keys/%d", id), nil, nil)
+}
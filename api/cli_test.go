@@ -0,0 +1,143 @@
+package main
+
+import (
+	"api/config"
+	"api/database"
+	"api/kvstore"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPhone = "2348012345678"
+
+// newTestConfig points the CLI at a fresh SQLite database with the embedded kv
+// store and a listen address nothing serves on
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := config.Default()
+	cfg.DB.Path = filepath.Join(t.TempDir(), "test.sqlite")
+	cfg.Redis.Embedded = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Server.Listen = l.Addr().String()
+	l.Close()
+
+	database.InitDB(dbOptions(cfg))
+	t.Cleanup(func() {
+		if db, err := database.DB.DB(); err == nil {
+			db.Close()
+		}
+	})
+	return cfg
+}
+
+func openKV(t *testing.T) *kvstore.Persistent {
+	t.Helper()
+	kv, err := kvstore.NewPersistent(database.KVBackend{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestLocalReset(t *testing.T) {
+	cfg := newTestConfig(t)
+	if _, err := database.ClaimSession(testPhone, database.DefaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	msg := database.UserMessage{ID: "m1", SessionPhone: testPhone, Data: "{}", Timestamp: database.FormatMessageTime(time.Now())}
+	if err := database.DB.Create(&msg).Error; err != nil {
+		t.Fatal(err)
+	}
+	kv := openKV(t)
+	ctx := context.Background()
+	kv.Set(ctx, "session:"+testPhone+":creds", "{}")
+	kv.Set(ctx, "session:2348087654321:creds", "{}")
+	kv.Close()
+
+	if err := runClientCommand(cfg, "instances", []string{"reset", testPhone}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.GetSession(testPhone); err == nil {
+		t.Error("session survived the reset")
+	}
+	var n int64
+	database.DB.Model(&database.UserMessage{}).Where("session_phone = ?", testPhone).Count(&n)
+	if n != 0 {
+		t.Errorf("%d messages survived the reset", n)
+	}
+	kv = openKV(t)
+	defer kv.Close()
+	if _, err := kv.Get(ctx, "session:"+testPhone+":creds"); !errors.Is(err, kvstore.ErrNotFound) {
+		t.Errorf("cached key survived the reset: %v", err)
+	}
+	if _, err := kv.Get(ctx, "session:2348087654321:creds"); err != nil {
+		t.Errorf("key of another instance was deleted: %v", err)
+	}
+}
+
+func TestLocalChangesWhileServing(t *testing.T) {
+	cfg := newTestConfig(t)
+	if _, err := database.ClaimSession(testPhone, database.DefaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", cfg.Server.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, args := range [][]string{
+		{"instances", "start", testPhone},
+		{"instances", "pause", testPhone},
+		{"instances", "reset", testPhone},
+		{"settings", "set", testPhone, "language", "fr"},
+	} {
+		err := runClientCommand(cfg, args[0], args[1:])
+		if err == nil || !strings.Contains(err.Error(), "server is running") {
+			t.Errorf("%v: error %v, want a refusal", args, err)
+		}
+	}
+	if s, _ := database.GetSession(testPhone); s == nil || s.Status == "paused" {
+		t.Fatalf("session changed while the server runs: %+v", s)
+	}
+
+	// Reading is fine
+	if err := runClientCommand(cfg, "instances", []string{"list"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalPhones(t *testing.T) {
+	cfg := newTestConfig(t)
+	for _, p := range []string{testPhone, "12345"} { // 12345 was stored before numbers were normalized
+		if err := database.DB.Create(&database.Session{Phone: p, TenantID: database.DefaultTenant}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runClientCommand(cfg, "settings", []string{"set", "+234 801 234 5678", "language", "fr"}); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := database.GetUserSettings(testPhone); s.Language != "fr" {
+		t.Errorf("language %q, want fr", s.Language)
+	}
+	if err := runClientCommand(cfg, "settings", []string{"get", "12345"}); err != nil {
+		t.Errorf("settings of a legacy session: %v", err)
+	}
+	if err := runDBCommand(cfg, []string{"reindex", "12345"}); err != nil {
+		t.Errorf("reindex of a legacy session: %v", err)
+	}
+	if err := runDBCommand(cfg, []string{"reindex", "54321"}); err == nil {
+		t.Error("reindex of an unknown, invalid number succeeded")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"api/auth"
+	"api/database"
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const userUsage = `usage:
+  api user create <username> <role> [tenant]   create a dashboard user
+  api user passwd <username>                   reset a password and sign out its sessions
+  api user reset-totp <username>               turn off a user's second factor
+The new password is read from stdin, a random one is generated and printed when stdin is empty.`
+
+// runUserCommand handles the "user" subcommands used to manage dashboard logins
+// from the shell, e.g. when the only admin is locked out
+func runUserCommand(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("%s", userUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 || !auth.ValidRole(args[2]) {
+			return fmt.Errorf("%s", userUsage)
+		}
+		tenant := database.DefaultTenant
+		if len(args) > 3 {
+			tenant = args[3]
+		}
+		if _, err := database.GetTenant(tenant); err != nil {
+			return fmt.Errorf("unknown tenant %q", tenant)
+		}
+		if _, err := database.GetUserByUsername(args[1]); err == nil {
+			return fmt.Errorf("user %q already exists", args[1])
+		}
+
+		hash, err := readPassword()
+		if err != nil {
+			return err
+		}
+		u := database.User{Username: args[1], PasswordHash: hash, Role: args[2], TenantID: tenant}
+		if err := database.CreateUser(&u); err != nil {
+			return err
+		}
+		fmt.Printf("Created %s user %s in tenant %s\n", u.Role, u.Username, u.TenantID)
+
+	case "passwd":
+		u, err := database.GetUserByUsername(args[1])
+		if err != nil {
+			return fmt.Errorf("user %q not found", args[1])
+		}
+		hash, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := database.UpdateUser(u.ID, map[string]any{"password_hash": hash}); err != nil {
+			return err
+		}
+		if err := database.DeleteUserSessions(u.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Password updated for %s\n", u.Username)
+
+	case "reset-totp":
+		u, err := database.GetUserByUsername(args[1])
+		if err != nil {
+			return fmt.Errorf("user %q not found", args[1])
+		}
+		if err := database.UpdateUser(u.ID, map[string]any{"totp_enabled": false, "totp_secret": ""}); err != nil {
+			return err
+		}
+		fmt.Printf("TOTP disabled for %s\n", u.Username)
+
+	default:
+		return fmt.Errorf("%s", userUsage)
+	}
+	return nil
+}
+
+// readPassword hashes the first line of stdin, or a generated password when it is empty
+func readPassword() (string, error) {
+	var password string
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		token, err := auth.RandomToken(12)
+		if err != nil {
+			return "", err
+		}
+		password = token
+		fmt.Printf("Generated password (shown only once): %s\n", password)
+	}
+	return auth.HashPassword(password)
+}
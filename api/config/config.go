@@ -0,0 +1,398 @@
+// Package config builds the effective configuration from, in increasing order of
+// precedence, built-in defaults, a TOML config file, the ../.env file, the process
+// environment and command line flags. Environment variables are prefixed with
+// WHATSALY_ so they don't pick up unrelated settings of the same name.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	Server struct {
+		Listen           string
+		ShutdownTimeoutS int
+		BodyLimitMB      int
+	}
+	DB struct {
+		Driver string // sqlite or postgres
+		Path   string // SQLite database file
+		DSN    string // Connection string for other drivers
+	}
+	Core struct {
+		Dir     string
+		Command string
+	}
+	Redis struct {
+		URL             string
+		Embedded        bool
+		Listen          string
+		Password        string
+		FlushIntervalMS int
+	}
+	Runtime struct {
+		GCPercent     int
+		MemoryLimitMB int
+	}
+	Startup struct {
+		Concurrency   int
+		DelayMS       int
+		JitterMS      int
+		ReadyTimeoutS int
+	}
+	Limits struct {
+		Rates           string // Per minute limits by route class, "class=n,..."
+		QuotaFlushS     int
+		ResetTimeoutS   int
+		BulkConcurrency int
+	}
+	Auth struct {
+		AdminAPIKey string
+	}
+	Search struct {
+		IndexIntervalMS int
+	}
+	Exports struct {
+		Dir        string
+		RetentionH int
+	}
+	Retention struct {
+		IntervalM       int
+		BatchSize       int
+		PauseMS         int
+		VacuumIntervalH int
+		AuditDays       int
+	}
+	OIDC struct {
+		Issuer       string
+		ClientID     string
+		ClientSecret string
+		RedirectURL  string
+		Scopes       string
+		GroupsClaim  string
+		RoleMap      string
+		Tenant       string
+	}
+
+	fields []*field
+}
+
+// EnvPrefix starts the name of every environment variable read by the config
+const EnvPrefix = "WHATSALY_"
+
+// Default returns the built-in configuration
+func Default() *Config {
+	c := &Config{}
+	c.Server.Listen = ":8080"
+	c.Server.ShutdownTimeoutS = 10
+	c.Server.BodyLimitMB = 4
+	c.DB.Driver = "sqlite"
+	c.DB.Path = "../whatsaly_dev.sqlite"
+	c.Core.Dir = "../core"
+	c.Core.Command = "bun"
+	c.Redis.URL = "redis://localhost:6379"
+	c.Redis.Listen = "127.0.0.1:6379"
+	c.Redis.FlushIntervalMS = 500
+	c.Runtime.GCPercent = 200
+	c.Runtime.MemoryLimitMB = 1024
+	c.Startup.Concurrency = 4
+	c.Startup.DelayMS = 500
+	c.Startup.JitterMS = 1500
+	c.Startup.ReadyTimeoutS = 60
+	c.Limits.QuotaFlushS = 10
+	c.Limits.ResetTimeoutS = 30
+	c.Limits.BulkConcurrency = 4
+	c.Search.IndexIntervalMS = 2000
+	c.Exports.Dir = "../exports"
+	c.Exports.RetentionH = 72
+	c.Retention.IntervalM = 60
+	c.Retention.BatchSize = 500
+	c.Retention.PauseMS = 100
+	c.Retention.VacuumIntervalH = 168
+	c.OIDC.GroupsClaim = "groups"
+	c.fields = c.registry()
+	return c
+}
+
+// field maps one setting to its file key, environment variable and flag
+type field struct {
+	key    string // section.name in the config file, also the flag name with dashes
+	env    string // Starts with EnvPrefix
+	help   string
+	secret bool
+	ptr    any // *string, *int or *bool
+	source string
+}
+
+func (c *Config) registry() []*field {
+	return []*field{
+		{key: "server.listen", env: "WHATSALY_LISTEN", help: "HTTP listen address", ptr: &c.Server.Listen},
+		{key: "server.shutdown_timeout_s", env: "WHATSALY_SHUTDOWN_TIMEOUT_S", help: "Seconds to wait for requests on shutdown", ptr: &c.Server.ShutdownTimeoutS},
+		{key: "server.body_limit_mb", env: "WHATSALY_BODY_LIMIT_MB", help: "Maximum request body size", ptr: &c.Server.BodyLimitMB},
+		{key: "db.driver", env: "WHATSALY_DB_DRIVER", help: "Database driver, sqlite or postgres", ptr: &c.DB.Driver},
+		{key: "db.path", env: "WHATSALY_DB_PATH", help: "SQLite database file", ptr: &c.DB.Path},
+		{key: "db.dsn", env: "WHATSALY_DATABASE_URL", help: "Database connection string", ptr: &c.DB.DSN, secret: true},
+		{key: "core.dir", env: "WHATSALY_CORE_DIR", help: "Directory of the WhatsApp core", ptr: &c.Core.Dir},
+		{key: "core.command", env: "WHATSALY_CORE_COMMAND", help: "Runtime used to start the core", ptr: &c.Core.Command},
+		{key: "redis.url", env: "WHATSALY_REDIS_URL", help: "Redis server used for the auth cache", ptr: &c.Redis.URL, secret: true},
+		{key: "redis.embedded", env: "WHATSALY_REDIS_EMBEDDED", help: "Serve an embedded Redis compatible server", ptr: &c.Redis.Embedded},
+		{key: "redis.listen", env: "WHATSALY_REDIS_LISTEN", help: "Listen address of the embedded server", ptr: &c.Redis.Listen},
+		{key: "redis.password", env: "WHATSALY_REDIS_PASSWORD", help: "Password of the embedded server", ptr: &c.Redis.Password, secret: true},
+		{key: "redis.flush_interval_ms", env: "WHATSALY_REDIS_FLUSH_INTERVAL_MS", help: "How often the embedded server persists changes", ptr: &c.Redis.FlushIntervalMS},
+		{key: "runtime.gc_percent", env: "WHATSALY_GC_PERCENT", help: "Go GC target percentage", ptr: &c.Runtime.GCPercent},
+		{key: "runtime.memory_limit_mb", env: "WHATSALY_MEMORY_LIMIT_MB", help: "Soft memory limit for the GC", ptr: &c.Runtime.MemoryLimitMB},
+		{key: "startup.concurrency", env: "WHATSALY_STARTUP_CONCURRENCY", help: "Instances started in parallel at boot", ptr: &c.Startup.Concurrency},
+		{key: "startup.delay_ms", env: "WHATSALY_STARTUP_DELAY_MS", help: "Delay between instance starts", ptr: &c.Startup.DelayMS},
+		{key: "startup.jitter_ms", env: "WHATSALY_STARTUP_JITTER_MS", help: "Random extra delay between starts", ptr: &c.Startup.JitterMS},
+		{key: "startup.ready_timeout_s", env: "WHATSALY_STARTUP_READY_TIMEOUT_S", help: "Wait for an instance to connect before the next", ptr: &c.Startup.ReadyTimeoutS},
+		{key: "limits.rates", env: "WHATSALY_RATE_LIMITS", help: "Per minute API limits by route class", ptr: &c.Limits.Rates},
+		{key: "limits.quota_flush_s", env: "WHATSALY_QUOTA_FLUSH_S", help: "How often daily quota counters are saved", ptr: &c.Limits.QuotaFlushS},
+		{key: "limits.reset_timeout_s", env: "WHATSALY_RESET_TIMEOUT_S", help: "Timeout for clearing a session's cached keys", ptr: &c.Limits.ResetTimeoutS},
+		{key: "limits.bulk_concurrency", env: "WHATSALY_BULK_CONCURRENCY", help: "Default parallelism of bulk actions", ptr: &c.Limits.BulkConcurrency},
+		{key: "auth.admin_api_key", env: "WHATSALY_ADMIN_API_KEY", help: "Super admin API key registered at boot", ptr: &c.Auth.AdminAPIKey, secret: true},
+		{key: "search.index_interval_ms", env: "WHATSALY_SEARCH_INDEX_INTERVAL_MS", help: "How often new messages are indexed for search", ptr: &c.Search.IndexIntervalMS},
+		{key: "exports.dir", env: "WHATSALY_EXPORTS_DIR", help: "Directory for files of export jobs", ptr: &c.Exports.Dir},
+		{key: "exports.retention_h", env: "WHATSALY_EXPORTS_RETENTION_H", help: "Hours export jobs and their files are kept", ptr: &c.Exports.RetentionH},
+		{key: "retention.interval_m", env: "WHATSALY_RETENTION_INTERVAL_M", help: "Minutes between message retention runs", ptr: &c.Retention.IntervalM},
+		{key: "retention.batch_size", env: "WHATSALY_RETENTION_BATCH_SIZE", help: "Messages deleted per transaction by retention", ptr: &c.Retention.BatchSize},
+		{key: "retention.pause_ms", env: "WHATSALY_RETENTION_PAUSE_MS", help: "Pause between retention batches", ptr: &c.Retention.PauseMS},
+		{key: "retention.vacuum_interval_h", env: "WHATSALY_VACUUM_INTERVAL_H", help: "Hours between full database vacuums, 0 disables", ptr: &c.Retention.VacuumIntervalH},
+		{key: "retention.audit_days", env: "WHATSALY_AUDIT_RETENTION_DAYS", help: "Days audit log entries are kept, 0 keeps them forever", ptr: &c.Retention.AuditDays},
+		{key: "oidc.issuer", env: "WHATSALY_OIDC_ISSUER", help: "OpenID Connect issuer, enables SSO", ptr: &c.OIDC.Issuer},
+		{key: "oidc.client_id", env: "WHATSALY_OIDC_CLIENT_ID", help: "OIDC client id", ptr: &c.OIDC.ClientID},
+		{key: "oidc.client_secret", env: "WHATSALY_OIDC_CLIENT_SECRET", help: "OIDC client secret", ptr: &c.OIDC.ClientSecret, secret: true},
+		{key: "oidc.redirect_url", env: "WHATSALY_OIDC_REDIRECT_URL", help: "OIDC callback URL", ptr: &c.OIDC.RedirectURL},
+		{key: "oidc.scopes", env: "WHATSALY_OIDC_SCOPES", help: "Space separated OIDC scopes", ptr: &c.OIDC.Scopes},
+		{key: "oidc.groups_claim", env: "WHATSALY_OIDC_GROUPS_CLAIM", help: "ID token claim holding groups", ptr: &c.OIDC.GroupsClaim},
+		{key: "oidc.role_map", env: "WHATSALY_OIDC_ROLE_MAP", help: "Group to role mapping, group=role,...", ptr: &c.OIDC.RoleMap},
+		{key: "oidc.tenant", env: "WHATSALY_OIDC_TENANT", help: "Tenant of SSO users", ptr: &c.OIDC.Tenant},
+	}
+}
+
+func (f *field) set(v, source string) error {
+	switch p := f.ptr.(type) {
+	case *string:
+		*p = v
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", f.key, v)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", f.key, v)
+		}
+		*p = b
+	}
+	f.source = source
+	return nil
+}
+
+// setValue sets f from a decoded config file value, which must have the field's type
+func (f *field) setValue(v any, source string) error {
+	switch p := f.ptr.(type) {
+	case *string:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a string", f.key, v)
+		}
+		*p = s
+	case *int:
+		n, ok := v.(int64)
+		if !ok || int64(int(n)) != n {
+			return fmt.Errorf("%s: %v is not a number", f.key, v)
+		}
+		*p = int(n)
+	case *bool:
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a boolean", f.key, v)
+		}
+		*p = b
+	}
+	f.source = source
+	return nil
+}
+
+func (f *field) String() string {
+	switch p := f.ptr.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *bool:
+		return strconv.FormatBool(*p)
+	}
+	return ""
+}
+
+func (f *field) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.key)
+}
+
+// flagValue lets a field be set from the command line
+type flagValue struct{ f *field }
+
+func (v flagValue) String() string {
+	if v.f == nil {
+		return ""
+	}
+	return v.f.String()
+}
+
+func (v flagValue) Set(s string) error { return v.f.set(s, "flag") }
+
+func (v flagValue) IsBoolFlag() bool {
+	_, ok := v.f.ptr.(*bool)
+	return ok
+}
+
+// Load builds the configuration for a command line. The config file is taken from
+// --config, WHATSALY_CONFIG_FILE or ../whatsaly.toml when it exists. It returns the
+// arguments left after the flags.
+func Load(args []string) (*Config, []string, error) {
+	c := Default()
+
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Config file (TOML)")
+	for _, f := range c.fields {
+		fs.Var(flagValue{f}, f.flagName(), f.help)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// Flags were applied while parsing, the other sources are applied below them.
+	// Remember flag values and reapply them last.
+	flagged := map[*field]string{}
+	for _, f := range c.fields {
+		if f.source == "flag" {
+			flagged[f] = f.String()
+		}
+	}
+
+	dotenv, _ := os.ReadFile("../.env")
+	envFile := ParseEnv(dotenv)
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv(EnvPrefix + "CONFIG_FILE")
+	}
+	if path == "" {
+		path, _ = lookupEnv(envFile, "CONFIG_FILE", true)
+	}
+	required := path != ""
+	if path == "" {
+		path = "../whatsaly.toml"
+	}
+	if buf, err := os.ReadFile(path); err == nil {
+		if err := c.applyFile(buf, path); err != nil {
+			return nil, nil, err
+		}
+	} else if required {
+		return nil, nil, fmt.Errorf("config file: %w", err)
+	}
+
+	if err := c.applyEnv(envFile, ".env", true); err != nil {
+		return nil, nil, err
+	}
+	if err := c.applyEnv(environ(), "env", false); err != nil {
+		return nil, nil, err
+	}
+
+	for f, v := range flagged {
+		f.set(v, "flag")
+	}
+
+	return c, fs.Args(), nil
+}
+
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// lookupEnv returns the variable name, given without EnvPrefix. With bare, as for the
+// .env file which belongs to this app alone, the name without the prefix is also
+// accepted.
+func lookupEnv(env map[string]string, name string, bare bool) (string, bool) {
+	if v, ok := env[EnvPrefix+name]; ok {
+		return v, true
+	}
+	if bare {
+		v, ok := env[name]
+		return v, ok
+	}
+	return "", false
+}
+
+func (c *Config) applyEnv(env map[string]string, source string, bare bool) error {
+	for _, f := range c.fields {
+		name := strings.TrimPrefix(f.env, EnvPrefix)
+		v, ok := lookupEnv(env, name, bare)
+		// PORT predates LISTEN and is still honoured
+		if port, set := lookupEnv(env, "PORT", bare); name == "LISTEN" && !ok && set {
+			v, ok = ":"+port, true
+		}
+		if ok {
+			if err := f.set(v, source); err != nil {
+				return fmt.Errorf("%s %s: %w", source, f.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) field(key string) *field {
+	for _, f := range c.fields {
+		if f.key == key {
+			return f
+		}
+	}
+	return nil
+}
+
+// Print writes the effective configuration as TOML, noting where each value came from.
+// Secrets are masked.
+func (c *Config) Print(w io.Writer) {
+	section := ""
+	for _, f := range c.fields {
+		sec, name, _ := strings.Cut(f.key, ".")
+		if sec != section {
+			if section != "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "[%s]\n", sec)
+			section = sec
+		}
+
+		value := f.String()
+		if f.secret && value != "" {
+			value = "********"
+		}
+		source := f.source
+		if source == "" {
+			source = "default"
+		}
+
+		var rendered string
+		if _, ok := f.ptr.(*string); ok {
+			rendered = strconv.Quote(value)
+		} else {
+			rendered = value
+		}
+		fmt.Fprintf(w, "%-22s = %-28s # %s, %s\n", name, rendered, source, f.env)
+	}
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// inDir runs the test from a directory whose parent holds files, as the api
+// directory sits next to .env and whatsaly.toml
+func inDir(t *testing.T, files map[string]string) {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(root, "api")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+}
+
+func TestLoadFile(t *testing.T) {
+	inDir(t, map[string]string{"whatsaly.toml": `
+# Comments and every TOML string form are understood
+[server]
+listen = "127.0.0.1:9000" # trailing comment
+body_limit_mb = 8
+
+[redis]
+embedded = true
+password = 'lit\eral#not-a-comment'
+
+[oidc]
+role_map = """
+admins=admin"""
+`})
+
+	c, _, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.Listen != "127.0.0.1:9000" || c.Server.BodyLimitMB != 8 || !c.Redis.Embedded {
+		t.Errorf("server %+v, redis embedded %t", c.Server, c.Redis.Embedded)
+	}
+	if c.Redis.Password != `lit\eral#not-a-comment` || c.OIDC.RoleMap != "admins=admin" {
+		t.Errorf("password %q, role map %q", c.Redis.Password, c.OIDC.RoleMap)
+	}
+	if f := c.field("server.listen"); f.source != "file" {
+		t.Errorf("listen from %q, want file", f.source)
+	}
+	if c.Server.ShutdownTimeoutS != 10 {
+		t.Errorf("default shutdown timeout lost: %d", c.Server.ShutdownTimeoutS)
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"unknown setting", "[server]\nport = 1", `unknown setting "server.port"`},
+		{"top level setting", "listen = \":80\"", `unknown setting "listen"`},
+		{"wrong type", "[server]\nbody_limit_mb = \"8\"", "server.body_limit_mb"},
+		{"syntax", "[server\nlisten = 1", "whatsaly.toml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inDir(t, map[string]string{"whatsaly.toml": tt.file})
+			_, _, err := Load(nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want one mentioning %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	inDir(t, map[string]string{
+		"whatsaly.toml": "[db]\npath = \"file.sqlite\"\n[core]\ndir = \"file-core\"",
+		".env":          "PORT=9100\nCORE_DIR=dotenv-core\nWHATSALY_STARTUP_CONCURRENCY=7",
+	})
+	// Unprefixed variables of the process environment belong to something else
+	t.Setenv("DB_PATH", "ignored.sqlite")
+	t.Setenv("WHATSALY_CORE_DIR", "env-core")
+	t.Setenv("WHATSALY_REDIS_EMBEDDED", "true")
+
+	c, args, err := Load([]string{"--startup-concurrency", "9", "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key, value, source string
+	}{
+		{"server.listen", ":9100", ".env"},
+		{"db.path", "file.sqlite", "file"},
+		{"core.dir", "env-core", "env"},
+		{"redis.embedded", "true", "env"},
+		{"startup.concurrency", "9", "flag"},
+	}
+	for _, tt := range tests {
+		f := c.field(tt.key)
+		if f.String() != tt.value || f.source != tt.source {
+			t.Errorf("%s = %q from %s, want %q from %s", tt.key, f.String(), f.source, tt.value, tt.source)
+		}
+	}
+	if len(args) != 1 || args[0] != "status" {
+		t.Errorf("args %v", args)
+	}
+
+	t.Setenv("WHATSALY_PORT", "9200")
+	if c, _, _ := Load(nil); c.Server.Listen != ":9200" {
+		t.Errorf("listen %q, want WHATSALY_PORT", c.Server.Listen)
+	}
+	t.Setenv("WHATSALY_LISTEN", "127.0.0.1:9300")
+	if c, _, _ := Load(nil); c.Server.Listen != "127.0.0.1:9300" {
+		t.Errorf("listen %q, WHATSALY_LISTEN should win over a port", c.Server.Listen)
+	}
+}
+
+func TestPrintMasksSecrets(t *testing.T) {
+	c := Default()
+	c.field("redis.password").set("hunter2", "env")
+	var b strings.Builder
+	c.Print(&b)
+	if strings.Contains(b.String(), "hunter2") || !strings.Contains(b.String(), "WHATSALY_REDIS_PASSWORD") {
+		t.Fatalf("printed:\n%s", b.String())
+	}
+}
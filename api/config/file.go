@@ -0,0 +1,61 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// applyFile applies a TOML config file. Settings are grouped in tables by section,
+// e.g. listen under [server]. Unknown settings are rejected.
+func (c *Config) applyFile(buf []byte, path string) error {
+	var doc map[string]any
+	if _, err := toml.Decode(string(buf), &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for section, v := range doc {
+		table, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", path, section)
+		}
+		for name, value := range table {
+			key := section + "." + name
+			f := c.field(key)
+			if f == nil {
+				return fmt.Errorf("%s: unknown setting %q", path, key)
+			}
+			if err := f.setValue(value, "file"); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseEnv parses KEY=value lines of a .env file
+func ParseEnv(buffer []byte) map[string]string {
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(buffer))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		val := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+		env[key] = val
+	}
+
+	return env
+}
@@ -0,0 +1,223 @@
+package database
+
+import (
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MessageRollup counts the indexed messages of one UTC hour by chat, sender,
+// direction and content type. Hours rather than days so any timezone with a
+// whole hour offset can be served from them.
+type MessageRollup struct {
+	SessionPhone string `gorm:"column:session_phone;primaryKey"`
+	Hour         int64  `gorm:"column:hour;primaryKey;autoIncrement:false"` // Unix seconds
+	Chat         string `gorm:"column:chat;primaryKey"`
+	Sender       string `gorm:"column:sender;primaryKey"`
+	FromMe       bool   `gorm:"column:from_me;primaryKey"`
+	ContentType  string `gorm:"column:content_type;primaryKey"`
+	Messages     int64  `gorm:"column:messages"`
+}
+
+func (MessageRollup) TableName() string {
+	return "message_rollups"
+}
+
+const hourExpr = "sent_at - sent_at % 3600"
+
+// rollupInsert aggregates message_index rows matching where into message_rollups
+func rollupInsert(where string) string {
+	if where != "" {
+		where = " WHERE " + where
+	}
+	return `INSERT INTO message_rollups (session_phone, hour, chat, sender, from_me, content_type, messages)
+		SELECT session_phone, ` + hourExpr + `, chat, sender, from_me, content_type, COUNT(*)
+		FROM message_index` + where + `
+		GROUP BY session_phone, ` + hourExpr + `, chat, sender, from_me, content_type`
+}
+
+// refreshRollups recomputes the rollups of the given hours of phone from message_index
+func refreshRollups(tx *gorm.DB, phone string, hours []int64) error {
+	if len(hours) == 0 {
+		return nil
+	}
+	err := tx.Where("session_phone = ? AND hour IN ?", phone, hours).Delete(&MessageRollup{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec(rollupInsert("session_phone = ? AND "+hourExpr+" IN ?"), phone, hours).Error
+}
+
+// refreshRollupsFor recomputes the hours touched by entries
+func refreshRollupsFor(tx *gorm.DB, entries []MessageIndex) error {
+	touched := make(map[string][]int64)
+	for _, e := range entries {
+		hour := e.SentAt - e.SentAt%3600
+		if !slices.Contains(touched[e.SessionPhone], hour) {
+			touched[e.SessionPhone] = append(touched[e.SessionPhone], hour)
+		}
+	}
+	return tx.Transaction(func(tx *gorm.DB) error {
+		for phone, hours := range touched {
+			if err := refreshRollups(tx, phone, hours); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AnalyticsFilter selects messages for aggregation. Rollups are used when From and
+// To fall on whole hours, otherwise message_index is aggregated directly.
+type AnalyticsFilter struct {
+	Phone string
+	Chat  string
+	From  time.Time
+	To    time.Time
+	Exact bool // Always aggregate message_index
+}
+
+// source is the table aggregates read from, with its time column and the number
+// of messages a row stands for
+type source struct {
+	table  string
+	time   string
+	weight string
+}
+
+func (f AnalyticsFilter) source() source {
+	if !f.Exact && f.From.Unix()%3600 == 0 && f.To.Unix()%3600 == 0 {
+		return source{"message_rollups", "hour", "messages"}
+	}
+	return source{"message_index", "sent_at", "1"}
+}
+
+func (f AnalyticsFilter) query(s source) *gorm.DB {
+	q := DB.Table(s.table).
+		Where("session_phone = ? AND "+s.time+" >= ? AND "+s.time+" < ?", f.Phone, f.From.Unix(), f.To.Unix()).
+		Where("chat <> ?", "status@broadcast")
+	if f.Chat != "" {
+		q = q.Where("chat = ?", f.Chat)
+	}
+	return q
+}
+
+// VolumeBucket counts messages in the step long bucket starting at Start
+type VolumeBucket struct {
+	Start    int64 `gorm:"column:start"`
+	FromMe   bool  `gorm:"column:from_me"`
+	Messages int64 `gorm:"column:messages"`
+}
+
+// MessageVolume counts messages by direction in buckets of step seconds, which must
+// divide an hour when reading rollups. Callers regroup them into calendar buckets.
+func MessageVolume(f AnalyticsFilter, step int64) ([]VolumeBucket, error) {
+	s := f.source()
+	if s.table == "message_rollups" {
+		step = 3600
+	}
+	var out []VolumeBucket
+	err := f.query(s).
+		Select(s.time+" - "+s.time+" % ? AS start, from_me, SUM("+s.weight+") AS messages", step).
+		Group("start, from_me").
+		Order("start").
+		Scan(&out).Error
+	return out, err
+}
+
+type Count struct {
+	Key      string `gorm:"column:group_key" json:"key"`
+	Messages int64  `gorm:"column:messages" json:"messages"`
+	Inbound  int64  `gorm:"column:inbound" json:"inbound"`
+	Outbound int64  `gorm:"column:outbound" json:"outbound"`
+}
+
+// CountBy groups messages by column, largest first. limit 0 returns every group.
+func CountBy(f AnalyticsFilter, column string, inboundOnly bool, limit int) ([]Count, error) {
+	s := f.source()
+	q := f.query(s).
+		Select(column+" AS group_key, SUM("+s.weight+") AS messages, "+
+			"SUM(CASE WHEN from_me = ? THEN "+s.weight+" ELSE 0 END) AS inbound, "+
+			"SUM(CASE WHEN from_me = ? THEN "+s.weight+" ELSE 0 END) AS outbound", false, true).
+		Group(column).
+		Order("messages DESC, group_key")
+	if inboundOnly {
+		q = q.Where("from_me = ?", false)
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	var out []Count
+	err := q.Scan(&out).Error
+	return out, err
+}
+
+// SenderNames returns the latest push name of each sender JID
+func SenderNames(phone string, senders []string) (map[string]string, error) {
+	var rows []struct {
+		Sender   string
+		PushName string
+		SentAt   int64
+	}
+	err := DB.Model(&MessageIndex{}).
+		Select("sender, push_name, MAX(sent_at) AS sent_at").
+		Where("session_phone = ? AND sender IN ? AND from_me = ? AND push_name <> ''", phone, senders, false).
+		Group("sender, push_name").
+		Scan(&rows).Error
+
+	names := make(map[string]string, len(rows))
+	latest := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		if _, ok := names[r.Sender]; !ok || r.SentAt > latest[r.Sender] {
+			names[r.Sender] = r.PushName
+			latest[r.Sender] = r.SentAt
+		}
+	}
+	return names, err
+}
+
+// ResponseTimes returns, in seconds, how long each inbound message in a direct
+// chat waited for the next outbound message. Runs of inbound messages count once,
+// from the first of the run.
+func ResponseTimes(f AnalyticsFilter) ([]int64, error) {
+	q := DB.Model(&MessageIndex{}).
+		Select("chat, from_me, sent_at").
+		Where("session_phone = ? AND sent_at >= ? AND sent_at < ?", f.Phone, f.From.Unix(), f.To.Unix()).
+		Where("(chat LIKE ? OR chat LIKE ?)", "%@s.whatsapp.net", "%@lid")
+	if f.Chat != "" {
+		q = q.Where("chat = ?", f.Chat)
+	}
+	rows, err := q.Order("chat, sent_at, id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		delays  []int64
+		chat    string
+		waiting int64 // Time of the first unanswered inbound message, 0 for none
+	)
+	for rows.Next() {
+		var (
+			c      string
+			fromMe bool
+			sentAt int64
+		)
+		if err := rows.Scan(&c, &fromMe, &sentAt); err != nil {
+			return nil, err
+		}
+		if c != chat {
+			chat, waiting = c, 0
+		}
+		switch {
+		case !fromMe && waiting == 0:
+			waiting = sentAt
+		case fromMe && waiting != 0:
+			delays = append(delays, sentAt-waiting)
+			waiting = 0
+		}
+	}
+	return delays, rows.Err()
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+const carolLID = "99999999999999@lid"
+
+// analyticsMessages spans several hours: a direct chat with two runs of inbound
+// messages, a group, an unanswered chat, a LID chat and a status update
+var analyticsMessages = []testMessage{
+	{id: "a1", chat: alice, content: text("are you there"), at: 0},
+	{id: "a2", chat: alice, content: text("hello?"), at: 2},
+	{id: "a3", chat: alice, fromMe: true, content: text("yes"), at: 5},
+	{id: "g1", chat: group, participant: bob, content: text("morning"), at: 10},
+	{id: "s1", chat: "status@broadcast", participant: bob, content: text("status"), at: 20},
+	{id: "g2", chat: group, participant: alice, content: `{"imageMessage":{"caption":"photo"}}`, at: 65},
+	{id: "a4", chat: alice, content: text("one more thing"), at: 70},
+	{id: "a5", chat: alice, fromMe: true, content: text("go on"), at: 100},
+	{id: "g3", chat: group, fromMe: true, content: text("nice"), at: 130},
+	{id: "b1", chat: bob, content: text("call me"), at: 200},
+	{id: "c1", chat: carolLID, content: text("hi"), at: 300},
+	{id: "c2", chat: carolLID, fromMe: true, content: text("hey"), at: 301},
+}
+
+func storeAnalytics(t *testing.T) {
+	t.Helper()
+	storeMessages(t, testPhone, analyticsMessages)
+	storeMessages(t, otherPhone, []testMessage{{id: "x1", chat: alice, content: text("other instance"), at: 0}})
+	if _, err := ReindexMessages(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkRollups fails unless message_rollups holds exactly what aggregating
+// message_index gives
+func checkRollups(t *testing.T) {
+	t.Helper()
+	var stored, want []MessageRollup
+	err := DB.Order("session_phone, hour, chat, sender, from_me, content_type").Find(&stored).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DB.Table("message_index").
+		Select("session_phone, sent_at - sent_at % 3600 AS hour, chat, sender, from_me, content_type, COUNT(*) AS messages").
+		Group("session_phone, hour, chat, sender, from_me, content_type").
+		Order("session_phone, hour, chat, sender, from_me, content_type").
+		Scan(&want).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stored, want) {
+		t.Fatalf("rollups %+v\nwant %+v", stored, want)
+	}
+}
+
+func TestAnalyticsSources(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeAnalytics(t)
+		from := testEpoch.Add(-time.Hour)
+		to := testEpoch.Add(6 * time.Hour)
+
+		for _, chat := range []string{"", alice, group} {
+			rollups := AnalyticsFilter{Phone: testPhone, Chat: chat, From: from, To: to}
+			exact := rollups
+			exact.Exact = true
+			if s := rollups.source(); s.table != "message_rollups" {
+				t.Fatalf("whole hours read %s", s.table)
+			}
+
+			v1, err := MessageVolume(rollups, 3600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v2, err := MessageVolume(exact, 3600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(v1, v2) {
+				t.Errorf("chat %q: volume from rollups %+v, from the index %+v", chat, v1, v2)
+			}
+			for _, column := range []string{"content_type", "chat", "sender"} {
+				c1, err := CountBy(rollups, column, false, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c2, err := CountBy(exact, column, false, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(c1, c2) {
+					t.Errorf("chat %q by %s: rollups %+v, index %+v", chat, column, c1, c2)
+				}
+			}
+		}
+
+		// Status updates and other instances aren't counted
+		total := func(f AnalyticsFilter) (n int64) {
+			t.Helper()
+			v, err := MessageVolume(f, 900)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range v {
+				n += b.Messages
+			}
+			return n
+		}
+		if n := total(AnalyticsFilter{Phone: testPhone, From: from, To: to}); n != int64(len(analyticsMessages)-1) {
+			t.Errorf("total %d, want %d", n, len(analyticsMessages)-1)
+		}
+
+		// Days of a +05:30 zone start on the half hour, those bounds read message_index
+		half := AnalyticsFilter{Phone: testPhone, From: testEpoch.Add(-30 * time.Minute), To: testEpoch.Add(90 * time.Minute)}
+		if s := half.source(); s.table != "message_index" {
+			t.Fatalf("half hour bounds read %s", s.table)
+		}
+		if n := total(half); n != 6 { // a1 to a4, g1 and g2 up to 13:30, without s1
+			t.Errorf("half hour range counted %d, want 6", n)
+		}
+		top, err := CountBy(half, "chat", true, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []Count{{Key: alice, Messages: 3, Inbound: 3}}; !slices.Equal(top, want) {
+			t.Errorf("top inbound chat %+v, want %+v", top, want)
+		}
+	})
+}
+
+func TestRollupsFollowIndex(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeAnalytics(t)
+		checkRollups(t)
+
+		// Messages indexed later join the hours already rolled up
+		storeMessages(t, testPhone, []testMessage{
+			{id: "a6", chat: alice, content: text("late"), at: 3, delay: 90},
+			{id: "n1", chat: bob, content: text("new hour"), at: 500},
+		})
+		var rows []UserMessage
+		if err := DB.Where("id IN ?", []string{"a6", "n1"}).Find(&rows).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := indexMessages(DB, rows); err != nil {
+			t.Fatal(err)
+		}
+		checkRollups(t)
+
+		// Refreshing an hour recomputes it from what is left in the index
+		var gone MessageIndex
+		if err := DB.Where("session_phone = ? AND message_id = ?", testPhone, "n1").First(&gone).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := DB.Delete(&gone).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := refreshRollupsFor(DB, []MessageIndex{gone}); err != nil {
+			t.Fatal(err)
+		}
+		checkRollups(t)
+
+		if _, err := PurgeMessages(RetentionPolicy{SessionPhone: testPhone, MaxPerChat: 1}, "manual", 2, 0); err != nil {
+			t.Fatal(err)
+		}
+		checkRollups(t)
+
+		if _, err := ReindexMessages(testPhone); err != nil {
+			t.Fatal(err)
+		}
+		checkRollups(t)
+	})
+}
+
+func TestResponseTimes(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeAnalytics(t)
+		tests := []struct {
+			name string
+			f    AnalyticsFilter
+			want []int64
+		}{
+			// a1 and a2 wait for a3 once, from a1. Groups and unanswered chats don't count.
+			{"direct chats", AnalyticsFilter{From: testEpoch, To: testEpoch.Add(6 * time.Hour)}, []int64{300, 1800, 60}},
+			{"chat", AnalyticsFilter{Chat: alice, From: testEpoch, To: testEpoch.Add(6 * time.Hour)}, []int64{300, 1800}},
+			{"run cut by the range", AnalyticsFilter{Chat: alice, From: testEpoch.Add(time.Minute), To: testEpoch.Add(time.Hour)}, []int64{180}},
+			{"answer outside the range", AnalyticsFilter{Chat: alice, From: testEpoch.Add(time.Hour), To: testEpoch.Add(90 * time.Minute)}, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.f.Phone = testPhone
+				got, err := ResponseTimes(tt.f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	})
+}
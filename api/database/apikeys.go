@@ -0,0 +1,146 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type APIKey struct {
+	ID         uint   `gorm:"primaryKey"`
+	Name       string `gorm:"not null"`
+	TenantID   string `gorm:"index;not null;default:'default'"`
+	Prefix     string `gorm:"not null"`             // First characters of the key, shown in listings
+	Hash       string `gorm:"uniqueIndex;not null"` // SHA-256 of the key, the key itself is never stored
+	Scopes     string `gorm:"type:text"`            // Space separated
+	RateLimits string `gorm:"type:text"`            // Per minute overrides by route class, "class=n,..."
+	DailyQuota int64  `gorm:"default:0"`            // Requests per UTC day, 0 for no quota
+	Phone      string `gorm:"index"`                // Set for keys restricted to one instance
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+func CreateAPIKey(key *APIKey) error {
+	return DB.Create(key).Error
+}
+
+// FindActiveAPIKey returns the non revoked key with the given hash
+func FindActiveAPIKey(hash string) (*APIKey, error) {
+	var key APIKey
+	err := DB.Where("hash = ? AND revoked_at IS NULL", hash).First(&key).Error
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// ListAPIKeys returns the keys of tenant, or of every tenant when tenant is empty
+func ListAPIKeys(tenant string) ([]APIKey, error) {
+	var keys []APIKey
+	query := DB.Order("id")
+	if tenant != "" {
+		query = query.Where("tenant_id = ?", tenant)
+	}
+	err := query.Find(&keys).Error
+	return keys, err
+}
+
+// RevokeAPIKey revokes a key of tenant, or of any tenant when tenant is empty
+func RevokeAPIKey(id uint, tenant string) error {
+	query := DB.Model(&APIKey{}).Where("id = ? AND revoked_at IS NULL", id)
+	if tenant != "" {
+		query = query.Where("tenant_id = ?", tenant)
+	}
+	res := query.Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// UpdateAPIKeyLimits changes the rate limits of a key of tenant, or of any tenant when tenant is empty
+func UpdateAPIKeyLimits(id uint, tenant string, updates map[string]any) error {
+	query := DB.Model(&APIKey{}).Where("id = ? AND revoked_at IS NULL", id)
+	if tenant != "" {
+		query = query.Where("tenant_id = ?", tenant)
+	}
+	res := query.Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetActiveAPIKey returns a non revoked key of tenant, or of any tenant when tenant is empty
+func GetActiveAPIKey(id uint, tenant string) (*APIKey, error) {
+	var key APIKey
+	query := DB.Where("id = ? AND revoked_at IS NULL", id)
+	if tenant != "" {
+		query = query.Where("tenant_id = ?", tenant)
+	}
+	if err := query.First(&key).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func GetAPIKey(id uint) (*APIKey, error) {
+	var key APIKey
+	if err := DB.First(&key, id).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// touchInterval is how stale last_used_at may get, so busy keys don't cause a
+// write per request
+const touchInterval = time.Minute
+
+// KeyNeedsTouch reports whether TouchAPIKey should be called for key
+func KeyNeedsTouch(key *APIKey) bool {
+	return key.LastUsedAt == nil || time.Since(*key.LastUsedAt) >= touchInterval
+}
+
+// TouchAPIKey records the last time a key was used, unless it was recorded less
+// than touchInterval ago
+func TouchAPIKey(id uint) {
+	now := time.Now()
+	DB.Model(&APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, now.Add(-touchInterval)).
+		Update("last_used_at", now)
+}
+
+func CountActiveAPIKeys() (int64, error) {
+	var count int64
+	err := DB.Model(&APIKey{}).Where("revoked_at IS NULL").Count(&count).Error
+	return count, err
+}
+
+// EnsureAPIKey creates a key with the given hash unless it already exists
+func EnsureAPIKey(key *APIKey) error {
+	return DB.Where(APIKey{Hash: key.Hash}).
+		Attrs(APIKey{Name: key.Name, TenantID: key.TenantID, Scopes: key.Scopes}).
+		Assign(APIKey{Prefix: key.Prefix}).
+		FirstOrCreate(key).Error
+}
+
+// ReplaceInstanceKey replaces the keys restricted to key.Phone with key
+func ReplaceInstanceKey(key *APIKey) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("phone = ?", key.Phone).Delete(&APIKey{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(key).Error
+	})
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuditEntry records one mutating API request. The table is append-only, entries
+// are never updated and only deleted by PurgeAudit once past retention.
+type AuditEntry struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	ActorType string    `gorm:"not null" json:"actor_type"` // key, user or anonymous
+	ActorID   uint      `json:"actor_id,omitempty"`
+	Actor     string    `gorm:"index" json:"actor"`
+	TenantID  string    `gorm:"index" json:"tenant_id"`
+	Method    string    `gorm:"not null" json:"method"`
+	Route     string    `gorm:"not null" json:"route"` // Route pattern, e.g. /api/instances/:phone/reset
+	Path      string    `gorm:"not null" json:"path"`
+	Phone     string    `gorm:"index" json:"phone,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"` // success or failure
+	IP        string    `json:"ip"`
+	Before    string    `gorm:"type:text" json:"before,omitempty"` // JSON, for changes that record it
+	After     string    `gorm:"type:text" json:"after,omitempty"`
+}
+
+func (AuditEntry) TableName() string {
+	return "audit_log"
+}
+
+// auditTriggers make the audit log append-only at the database level
+var auditTriggers = map[string][]string{
+	"sqlite": {
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+	},
+	"postgres": {
+		`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+		BEGIN RAISE EXCEPTION 'audit_log is append-only'; END $$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_log_no_change ON audit_log`,
+		`CREATE TRIGGER audit_log_no_change BEFORE UPDATE OR DELETE ON audit_log
+		FOR EACH ROW EXECUTE FUNCTION audit_log_append_only()`,
+	},
+}
+
+// dropAuditTriggers undo auditTriggers
+var dropAuditTriggers = map[string][]string{
+	"sqlite": {
+		"DROP TRIGGER IF EXISTS audit_log_no_update",
+		"DROP TRIGGER IF EXISTS audit_log_no_delete",
+	},
+	"postgres": {
+		"DROP TRIGGER IF EXISTS audit_log_no_change ON audit_log",
+	},
+}
+
+func AppendAudit(e *AuditEntry) error {
+	return DB.Create(e).Error
+}
+
+// AppendAudits writes entries in one statement
+func AppendAudits(entries []AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return DB.CreateInBatches(entries, 500).Error
+}
+
+// PurgeAudit deletes the entries created before cutoff. The append-only triggers
+// are dropped and recreated within the transaction, so other connections never see
+// the table without them.
+func PurgeAudit(cutoff time.Time) (int64, error) {
+	var n int64
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		dialect := tx.Dialector.Name()
+		for _, stmt := range dropAuditTriggers[dialect] {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		res := tx.Where("created_at < ?", cutoff).Delete(&AuditEntry{})
+		if res.Error != nil {
+			return res.Error
+		}
+		n = res.RowsAffected
+		for _, stmt := range auditTriggers[dialect] {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+type AuditFilter struct {
+	TenantID string // Empty for all tenants
+	Actor    string
+	Phone    string
+	From     time.Time
+	To       time.Time
+	BeforeID uint // Only entries older than this id, for paging
+	Limit    int  // 0 for no limit
+}
+
+// QueryAudit returns matching entries, newest first
+func QueryAudit(f AuditFilter) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := auditQuery(f).Find(&entries).Error
+	return entries, err
+}
+
+// EachAudit calls fn for every matching entry, newest first, loading them in batches
+func EachAudit(f AuditFilter, fn func(AuditEntry) error) error {
+	const batch = 500
+	for {
+		page := f
+		page.Limit = batch
+		if f.Limit > 0 {
+			page.Limit = min(batch, f.Limit)
+		}
+		entries, err := QueryAudit(page)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if len(entries) < page.Limit {
+			return nil
+		}
+		f.BeforeID = entries[len(entries)-1].ID
+		if f.Limit > 0 {
+			if f.Limit -= len(entries); f.Limit == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func auditQuery(f AuditFilter) *gorm.DB {
+	q := DB.Model(&AuditEntry{}).Order("id DESC")
+	if f.TenantID != "" {
+		q = q.Where("tenant_id = ?", f.TenantID)
+	}
+	if f.Actor != "" {
+		q = q.Where("actor = ?", f.Actor)
+	}
+	if f.Phone != "" {
+		q = q.Where("phone = ?", f.Phone)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("created_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Where("created_at < ?", f.To)
+	}
+	if f.BeforeID > 0 {
+		q = q.Where("id < ?", f.BeforeID)
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	return q
+}
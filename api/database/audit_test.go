@@ -0,0 +1,34 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurgeAudit(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		for _, days := range []int{40, 31, 5, 0} {
+			e := AuditEntry{CreatedAt: time.Now().AddDate(0, 0, -days), ActorType: "key", Method: "POST", Route: "/api/x", Path: "/api/x"}
+			if err := AppendAudit(&e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n, err := PurgeAudit(time.Now().AddDate(0, 0, -30))
+		if err != nil || n != 2 {
+			t.Fatalf("PurgeAudit = %d, %v, want 2", n, err)
+		}
+		left, err := QueryAudit(AuditFilter{})
+		if err != nil || len(left) != 2 {
+			t.Fatalf("%d entries left, %v", len(left), err)
+		}
+
+		// The log is append-only again afterwards
+		if err := DB.Where("1 = 1").Delete(&AuditEntry{}).Error; err == nil {
+			t.Fatal("delete succeeded after the purge")
+		}
+		if err := DB.Model(&AuditEntry{}).Where("1 = 1").Update("actor", "x").Error; err == nil {
+			t.Fatal("update succeeded after the purge")
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// ChatRead is how far the messages of a chat have been read through the API
+type ChatRead struct {
+	SessionPhone string `gorm:"column:session_phone;primaryKey"`
+	Chat         string `gorm:"column:chat;primaryKey"`
+	ReadAt       int64  `gorm:"column:read_at"` // Unix seconds of the last read message
+	UpdatedAt    time.Time
+}
+
+func (ChatRead) TableName() string {
+	return "chat_reads"
+}
+
+// Chat summarizes one conversation of an instance
+type Chat struct {
+	JID          string `gorm:"column:chat"`
+	MessageCount int64  `gorm:"column:message_count"`
+	UnreadCount  int64  `gorm:"column:unread_count"`
+	LastActivity int64  `gorm:"column:last_activity"`
+
+	Name        string       `gorm:"-"` // Group subject or the contact's push name
+	LastMessage MessageIndex `gorm:"-"`
+}
+
+// ListChats returns the chats of phone with messages, most recently active first
+func ListChats(phone string, limit, offset int) ([]Chat, error) {
+	var chats []Chat
+	err := DB.Table("message_index mi").
+		Select(`mi.chat, COUNT(*) AS message_count, MAX(mi.sent_at) AS last_activity,
+			SUM(CASE WHEN mi.from_me = ? AND mi.sent_at > COALESCE(r.read_at, 0) THEN 1 ELSE 0 END) AS unread_count`, false).
+		Joins("LEFT JOIN chat_reads r ON r.session_phone = mi.session_phone AND r.chat = mi.chat").
+		Where("mi.session_phone = ? AND mi.chat <> '' AND mi.chat <> ?", phone, "status@broadcast").
+		Group("mi.chat").
+		Order("last_activity DESC, mi.chat").
+		Limit(limit).Offset(offset).
+		Scan(&chats).Error
+	if err != nil || len(chats) == 0 {
+		return chats, err
+	}
+
+	jids := make([]string, len(chats))
+	for i, c := range chats {
+		jids[i] = c.JID
+	}
+	last, err := lastMessages(phone, jids)
+	if err != nil {
+		return nil, err
+	}
+	names, err := ChatNames(phone, jids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chats {
+		chats[i].LastMessage = last[chats[i].JID]
+		chats[i].Name = names[chats[i].JID]
+	}
+	return chats, nil
+}
+
+// lastMessages returns the newest indexed message of each chat
+func lastMessages(phone string, jids []string) (map[string]MessageIndex, error) {
+	var rows []MessageIndex
+	ranked := DB.Table("message_index").
+		Select("*, ROW_NUMBER() OVER (PARTITION BY chat ORDER BY sent_at DESC, id DESC) AS rn").
+		Where("session_phone = ? AND chat IN ?", phone, jids)
+	err := DB.Table("(?) ranked", ranked).Where("rn = 1").Scan(&rows).Error
+
+	out := make(map[string]MessageIndex, len(rows))
+	for _, r := range rows {
+		out[r.Chat] = r
+	}
+	return out, err
+}
+
+// ChatNames resolves group subjects from group_metadata and, for the other chats,
+// the latest push name the contact sent
+func ChatNames(phone string, jids []string) (map[string]string, error) {
+	names := make(map[string]string, len(jids))
+
+	var groups []GroupMetadata
+	err := DB.Where("session_phone = ? AND id IN ?", phone, jids).Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		var meta struct {
+			Subject string `json:"subject"`
+		}
+		if json.Unmarshal([]byte(g.MetaData), &meta) == nil && meta.Subject != "" {
+			names[g.ID] = meta.Subject
+		}
+	}
+
+	var pushed []struct {
+		Chat     string
+		PushName string
+		SentAt   int64
+	}
+	err = DB.Model(&MessageIndex{}).
+		Select("chat, push_name, MAX(sent_at) AS sent_at").
+		Where("session_phone = ? AND chat IN ? AND from_me = ? AND push_name <> ''", phone, jids, false).
+		Where("chat NOT LIKE ?", "%@g.us").
+		Group("chat, push_name").
+		Scan(&pushed).Error
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]int64, len(pushed))
+	for _, p := range pushed {
+		if _, named := names[p.Chat]; !named || p.SentAt > latest[p.Chat] {
+			names[p.Chat] = p.PushName
+			latest[p.Chat] = p.SentAt
+		}
+	}
+	return names, nil
+}
+
+// MarkChatRead records the chat as read up to readAt, or up to its newest message
+// when readAt is zero. The read position never moves backwards.
+func MarkChatRead(phone, chat string, readAt int64) (int64, error) {
+	if readAt == 0 {
+		var newest *int64
+		err := DB.Model(&MessageIndex{}).Select("MAX(sent_at)").
+			Where("session_phone = ? AND chat = ?", phone, chat).Scan(&newest).Error
+		if err != nil {
+			return 0, err
+		}
+		if newest != nil {
+			readAt = *newest
+		}
+	}
+
+	read := ChatRead{SessionPhone: phone, Chat: chat, ReadAt: readAt, UpdatedAt: time.Now()}
+	err := DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "session_phone"}, {Name: "chat"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "read_at"}, Value: clause.Expr{SQL: "CASE WHEN excluded.read_at > chat_reads.read_at THEN excluded.read_at ELSE chat_reads.read_at END"}},
+			{Column: clause.Column{Name: "updated_at"}, Value: read.UpdatedAt},
+		},
+	}).Create(&read).Error
+	if err != nil {
+		return 0, err
+	}
+
+	err = DB.Where(&ChatRead{SessionPhone: phone, Chat: chat}).First(&read).Error
+	return read.ReadAt, err
+}
+
+// ResolveLIDs maps @lid JIDs to phone number JIDs using user_contacts, which
+// stores the pair in either column order
+func ResolveLIDs(phone string, jids []string) (map[string]string, error) {
+	var lids []string
+	for _, j := range jids {
+		if strings.HasSuffix(j, "@lid") {
+			lids = append(lids, j)
+		}
+	}
+	out := make(map[string]string, len(lids))
+	if len(lids) == 0 {
+		return out, nil
+	}
+
+	var contacts []UserContact
+	err := DB.Where("session_phone = ? AND (lid IN ? OR pn IN ?)", phone, lids, lids).Find(&contacts).Error
+	for _, c := range contacts {
+		switch {
+		case strings.HasSuffix(c.LID, "@lid") && strings.HasSuffix(c.PN, "@s.whatsapp.net"):
+			out[c.LID] = c.PN
+		case strings.HasSuffix(c.PN, "@lid") && strings.HasSuffix(c.LID, "@s.whatsapp.net"):
+			out[c.PN] = c.LID
+		}
+	}
+	return out, err
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+const (
+	carol   = "99999999999999@lid"
+	carolPN = "2348033333333@s.whatsapp.net"
+	dave    = "88888888888888@lid"
+	davePN  = "2348044444444@s.whatsapp.net"
+)
+
+// storeChats stores and indexes a direct chat with alice, whose push name changed,
+// a group, a chat known by carol's LID only and a status broadcast
+func storeChats(t *testing.T) {
+	t.Helper()
+	storeMessages(t, testPhone, []testMessage{
+		{id: "a1", chat: alice, content: text("hi"), at: 0, pushName: "Alice"},
+		{id: "a2", chat: alice, fromMe: true, content: text("hello"), at: 1},
+		{id: "a3", chat: alice, content: text("how are you"), at: 2, pushName: "Alice"},
+		{id: "g1", chat: group, participant: bob, content: text("morning"), at: 3, pushName: "Bob"},
+		{id: "g2", chat: group, fromMe: true, content: text("morning all"), at: 4},
+		{id: "c1", chat: carol, content: text("it's carol"), at: 5, pushName: "Carol"},
+		{id: "a4", chat: alice, content: text("new phone"), at: 6, pushName: "Ali B"},
+		{id: "s1", chat: "status@broadcast", participant: bob, content: text("status"), at: 7},
+	})
+	storeMessages(t, otherPhone, []testMessage{{id: "x1", chat: alice, content: text("elsewhere"), at: 8, pushName: "Other"}})
+
+	rows := []any{
+		&GroupMetadata{ID: group, SessionID: testPhone, MetaData: `{"subject":"Family"}`},
+		&UserContact{SessionPhone: testPhone, PN: carolPN, LID: carol},
+		&UserContact{SessionPhone: testPhone, PN: dave, LID: davePN}, // Stored the other way around
+		&UserContact{SessionPhone: otherPhone, PN: "2348055555555@s.whatsapp.net", LID: carol},
+	}
+	for _, row := range rows {
+		if err := DB.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ReindexMessages(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func minutes(n int) int64 {
+	return testEpoch.Add(time.Duration(n) * time.Minute).Unix()
+}
+
+func TestListChats(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeChats(t)
+		chats, err := ListChats(testPhone, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type summary struct {
+			jid, name, last      string
+			messages, unread     int64
+			lastActivity, lastAt int64
+		}
+		var got []summary
+		for _, c := range chats {
+			got = append(got, summary{c.JID, c.Name, c.LastMessage.MessageID, c.MessageCount, c.UnreadCount, c.LastActivity, c.LastMessage.SentAt})
+		}
+		want := []summary{
+			{alice, "Ali B", "a4", 4, 3, minutes(6), minutes(6)},
+			{carol, "Carol", "c1", 1, 1, minutes(5), minutes(5)},
+			{group, "Family", "g2", 2, 1, minutes(4), minutes(4)},
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("got %+v\nwant %+v", got, want)
+		}
+	})
+}
+
+func TestListChatsPages(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeChats(t)
+		// Chats active in the same minute are ordered by JID
+		storeMessages(t, testPhone, []testMessage{{id: "b1", chat: bob, content: text("same time"), at: 5}})
+		if _, err := ReindexMessages(testPhone); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for offset := 0; ; offset += 2 {
+			page, err := ListChats(testPhone, 2, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range page {
+				got = append(got, c.JID)
+			}
+			if len(page) < 2 {
+				break
+			}
+		}
+		if want := []string{alice, bob, carol, group}; !slices.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestMarkChatRead(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeChats(t)
+		unread := func() map[string]int64 {
+			t.Helper()
+			chats, err := ListChats(testPhone, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := make(map[string]int64)
+			for _, c := range chats {
+				out[c.JID] = c.UnreadCount
+			}
+			return out
+		}
+
+		steps := []struct {
+			name   string
+			readAt int64
+			want   int64 // Stored read position
+			unread int64 // Unread messages of alice's chat
+		}{
+			{"up to a message", minutes(1), minutes(1), 2},
+			{"never backwards", minutes(0), minutes(1), 2},
+			{"newest message", 0, minutes(6), 0},
+			{"past the newest message", minutes(30), minutes(30), 0},
+		}
+		for _, s := range steps {
+			got, err := MarkChatRead(testPhone, alice, s.readAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != s.want {
+				t.Fatalf("%s: read at %d, want %d", s.name, got, s.want)
+			}
+			if u := unread(); u[alice] != s.unread || u[group] != 1 || u[carol] != 1 {
+				t.Fatalf("%s: unread %v, want %d for alice and the others unchanged", s.name, u, s.unread)
+			}
+		}
+
+		// Chats without messages are read up to nothing
+		if got, err := MarkChatRead(testPhone, bob, 0); err != nil || got != 0 {
+			t.Fatalf("empty chat read at %d, %v", got, err)
+		}
+		// Reads of an instance don't apply to another
+		if got, err := MarkChatRead(otherPhone, alice, 0); err != nil || got != minutes(8) {
+			t.Fatalf("other instance read at %d, %v", got, err)
+		}
+		if u := unread(); u[alice] != 0 {
+			t.Fatalf("unread %v after reading another instance", u)
+		}
+	})
+}
+
+func TestChatNames(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeChats(t)
+		// A group without metadata isn't named after its members
+		storeMessages(t, testPhone, []testMessage{{id: "g3", chat: "120363000000000002@g.us", participant: bob, content: text("hi"), at: 9, pushName: "Bob"}})
+		if _, err := ReindexMessages(testPhone); err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := ChatNames(testPhone, []string{alice, group, carol, bob, "120363000000000002@g.us"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{alice: "Ali B", group: "Family", carol: "Carol"}
+		if !maps.Equal(names, want) {
+			t.Fatalf("got %v, want %v", names, want)
+		}
+	})
+}
+
+func TestResolveLIDs(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeChats(t)
+		got, err := ResolveLIDs(testPhone, []string{alice, carol, dave, "77777777777777@lid", group})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]string{carol: carolPN, dave: davePN}; !maps.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+
+		if got, err := ResolveLIDs(testPhone, []string{alice}); err != nil || len(got) != 0 {
+			t.Fatalf("without LIDs got %v, %v", got, err)
+		}
+	})
+}
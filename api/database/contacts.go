@@ -1,9 +1,9 @@
 package database
 
 type UserContact struct {
-	SessionPhone string `gorm:"column:session_phone;index"` // The owner of the contacts
-	PN           string `gorm:"column:pn"`                  // Phone Number
-	LID          string `gorm:"column:lid"`                 // List ID or Label ID
+	SessionPhone string `gorm:"column:session_phone"` // The owner of the contacts
+	PN           string `gorm:"column:pn"`            // Phone Number
+	LID          string `gorm:"column:lid"`           // List ID or Label ID
 }
 
 type ContactResult struct {
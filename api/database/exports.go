@@ -0,0 +1,100 @@
+package database
+
+import (
+	"time"
+)
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// ExportJob is a background export of an instance's or a chat's messages to a file
+type ExportJob struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"index;not null"`
+	Phone     string `gorm:"index;not null"`
+	Chat      string // Empty for every chat
+	Format    string `gorm:"not null"`
+	From      *time.Time
+	To        *time.Time
+	Status    string `gorm:"index;not null"`
+	Error     string
+	File      string // Name inside the export directory
+	Size      int64
+	Messages  int
+	CreatedBy string
+	CreatedAt time.Time
+	StartedAt *time.Time
+	DoneAt    *time.Time
+}
+
+func (ExportJob) TableName() string {
+	return "export_jobs"
+}
+
+func CreateExportJob(job *ExportJob) error {
+	return DB.Create(job).Error
+}
+
+func GetExportJob(id uint, phone string) (*ExportJob, error) {
+	var job ExportJob
+	err := DB.Where(&ExportJob{ID: id, Phone: phone}).First(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func ListExportJobs(phone string) ([]ExportJob, error) {
+	var jobs []ExportJob
+	err := DB.Where(&ExportJob{Phone: phone}).Order("id DESC").Limit(100).Find(&jobs).Error
+	return jobs, err
+}
+
+// ClaimExportJob marks the oldest pending job as running and returns it, nil when
+// there is none
+func ClaimExportJob() (*ExportJob, error) {
+	var job ExportJob
+	err := DB.Where(&ExportJob{Status: ExportPending}).Order("id").Limit(1).Find(&job).Error
+	if err != nil || job.ID == 0 {
+		return nil, err
+	}
+	now := time.Now()
+	res := DB.Model(&ExportJob{}).
+		Where(&ExportJob{ID: job.ID, Status: ExportPending}).
+		Updates(ExportJob{Status: ExportRunning, StartedAt: &now})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	job.Status = ExportRunning
+	job.StartedAt = &now
+	return &job, nil
+}
+
+// FinishExportJob stores the outcome of a running job
+func FinishExportJob(job *ExportJob) error {
+	now := time.Now()
+	job.DoneAt = &now
+	return DB.Model(job).Select("status", "error", "file", "size", "messages", "done_at").Updates(job).Error
+}
+
+// FailInterruptedExports fails jobs left running by a previous process
+func FailInterruptedExports() error {
+	return DB.Model(&ExportJob{}).
+		Where(&ExportJob{Status: ExportRunning}).
+		Updates(ExportJob{Status: ExportFailed, Error: "interrupted by a restart"}).Error
+}
+
+// ExpiredExportJobs returns finished jobs older than before
+func ExpiredExportJobs(before time.Time) ([]ExportJob, error) {
+	var jobs []ExportJob
+	err := DB.Where("status IN ? AND created_at < ?", []string{ExportDone, ExportFailed}, before).Find(&jobs).Error
+	return jobs, err
+}
+
+func DeleteExportJob(id uint) error {
+	return DB.Delete(&ExportJob{}, id).Error
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"api/kvstore"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// KVEntry persists keys of the embedded Redis compatible server
+type KVEntry struct {
+	Key       string `gorm:"column:key;primaryKey"`
+	Type      string `gorm:"column:type;not null"`
+	Value     string `gorm:"column:value;type:text"`
+	ExpiresAt int64  `gorm:"column:expires_at;default:0"`
+}
+
+func (KVEntry) TableName() string {
+	return "kv_entries"
+}
+
+// KVBackend stores kvstore entries in the kv_entries table
+type KVBackend struct{}
+
+func (KVBackend) LoadEntries() ([]kvstore.Entry, error) {
+	var rows []KVEntry
+	if err := DB.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	entries := make([]kvstore.Entry, len(rows))
+	for i, r := range rows {
+		entries[i] = kvstore.Entry{Key: r.Key, Type: r.Type, Value: r.Value, ExpiresAt: r.ExpiresAt}
+	}
+	return entries, nil
+}
+
+func (KVBackend) SaveEntries(put []kvstore.Entry, del []string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		rows := make([]KVEntry, len(put))
+		for i, e := range put {
+			rows[i] = KVEntry{Key: e.Key, Type: e.Type, Value: e.Value, ExpiresAt: e.ExpiresAt}
+		}
+		if len(rows) > 0 {
+			err := tx.Clauses(clause.OnConflict{UpdateAll: true}).
+				CreateInBatches(rows, 200).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for len(del) > 0 {
+			n := min(len(del), 500)
+			if err := tx.Where("key IN ?", del[:n]).Delete(&KVEntry{}).Error; err != nil {
+				return err
+			}
+			del = del[n:]
+		}
+		return nil
+	})
+}
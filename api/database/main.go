@@ -1,32 +1,74 @@
 package database
 
 import (
+	"fmt"
+	"log"
+
 	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"log"
 )
 
 var DB *gorm.DB
 
-func InitDB() {
-	var err error
-	path := "../whatsaly_dev.sqlite"
+// Options selects the database. Path is used by SQLite, DSN by Postgres.
+type Options struct {
+	Driver string // sqlite or postgres
+	Path   string
+	DSN    string
+}
+
+func dialector(opts Options) (gorm.Dialector, error) {
+	switch opts.Driver {
+	case "", "sqlite":
+		return sqlite.Open(opts.Path), nil
+	case "postgres", "postgresql":
+		if opts.DSN == "" {
+			return nil, fmt.Errorf("the postgres driver needs a DSN, set WHATSALY_DATABASE_URL or db.dsn")
+		}
+		return postgres.Open(opts.DSN), nil
+	}
+	return nil, fmt.Errorf("unknown database driver %q", opts.Driver)
+}
+
+// Open connects to the database without touching its schema
+func Open(opts Options) {
+	d, err := dialector(opts)
+	if err != nil {
+		log.Fatal("Invalid database config: ", err)
+	}
 
-	DB, err = gorm.Open(sqlite.Open(path), &gorm.Config{})
+	DB, err = gorm.Open(d, &gorm.Config{})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
-	DB.Exec("PRAGMA journal_mode=WAL;")
+	if IsSQLite() {
+		DB.Exec("PRAGMA journal_mode=WAL;")
+	}
+}
 
-	err = DB.AutoMigrate(&Session{}, &UserSettings{})
-	if err != nil {
-		log.Fatal("Migration failed:", err)
+// IsSQLite reports whether DB is a SQLite database, for the few statements that
+// differ between dialects
+func IsSQLite() bool {
+	return DB.Dialector.Name() == "sqlite"
+}
+
+// InitDB opens the database and applies pending migrations
+func InitDB(opts Options) {
+	Open(opts)
+
+	if err := Migrate(); err != nil {
+		log.Fatal("Migration failed: ", err)
+	}
+
+	if err := ensureDefaultTenant(); err != nil {
+		log.Fatal("Failed to create default tenant:", err)
 	}
 
 	var count int64
 	DB.Model(&Session{}).Count(&count)
-	if count == 0 {
+	if count == 0 && IsSQLite() {
 		DB.Exec("DELETE FROM sqlite_sequence WHERE name = 'sessions'")
 	}
 }
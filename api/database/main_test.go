@@ -0,0 +1,88 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPostgresEnv names the Postgres server the tests also run against when set,
+// each test gets a schema of its own that is dropped afterwards
+const testPostgresEnv = "WHATSALY_TEST_DATABASE_URL"
+
+// openTestDB points DB at a fresh, fully migrated SQLite database for the test
+func openTestDB(t *testing.T) {
+	t.Helper()
+	Open(Options{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "test.sqlite")})
+	t.Cleanup(closeTestDB)
+	migrateTestDB(t)
+}
+
+// openTestPostgres is openTestDB for the server in WHATSALY_TEST_DATABASE_URL,
+// skipping the test when it is not set
+func openTestPostgres(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv(testPostgresEnv)
+	if dsn == "" {
+		t.Skip(testPostgresEnv + " is not set")
+	}
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	Open(Options{Driver: "postgres", DSN: dsn})
+	if err := DB.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	closeTestDB()
+
+	Open(Options{Driver: "postgres", DSN: withSearchPath(dsn, schema)})
+	t.Cleanup(func() {
+		DB.Exec("DROP SCHEMA " + schema + " CASCADE")
+		closeTestDB()
+	})
+	migrateTestDB(t)
+}
+
+// forEachDialect runs fn against SQLite and, when configured, Postgres
+func forEachDialect(t *testing.T, fn func(t *testing.T)) {
+	t.Run("sqlite", func(t *testing.T) {
+		openTestDB(t)
+		fn(t)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		openTestPostgres(t)
+		fn(t)
+	})
+}
+
+func migrateTestDB(t *testing.T) {
+	t.Helper()
+	if err := Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := ensureDefaultTenant(); err != nil {
+		t.Fatalf("default tenant: %v", err)
+	}
+}
+
+func closeTestDB() {
+	if db, err := DB.DB(); err == nil {
+		db.Close()
+	}
+}
+
+// withSearchPath adds search_path to a URL or keyword/value DSN
+func withSearchPath(dsn, schema string) string {
+	if strings.Contains(dsn, "://") {
+		if u, err := url.Parse(dsn); err == nil {
+			q := u.Query()
+			q.Set("search_path", schema)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " search_path=" + schema
+}
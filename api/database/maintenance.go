@@ -0,0 +1,51 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Backup writes a consistent copy of the database to path, which must not exist
+func Backup(path string) error {
+	if !IsSQLite() {
+		return errors.New("backups of Postgres databases are taken with pg_dump")
+	}
+	return DB.Exec("VACUUM INTO ?", path).Error
+}
+
+// Vacuum rebuilds the database file to reclaim free pages. On Postgres it reclaims
+// dead rows and refreshes planner statistics.
+//
+// SQLite databases are switched to incremental auto vacuum on the way, so pages
+// freed by later purges can be returned with IncrementalVacuum.
+func Vacuum() error {
+	if !IsSQLite() {
+		return DB.Exec("VACUUM ANALYZE").Error
+	}
+	// The pragma only sticks when VACUUM runs on the same connection
+	return DB.Connection(func(tx *gorm.DB) error {
+		if err := tx.Exec("PRAGMA auto_vacuum = INCREMENTAL").Error; err != nil {
+			return err
+		}
+		return tx.Exec("VACUUM").Error
+	})
+}
+
+// incrementalPages bounds how long IncrementalVacuum holds the write lock
+const incrementalPages = 4096
+
+// IncrementalVacuum returns free pages of a SQLite database in incremental auto vacuum
+// mode to the file system. It does nothing on other databases, Postgres reuses dead
+// rows once autovacuum reclaimed them.
+func IncrementalVacuum() error {
+	if !IsSQLite() {
+		return nil
+	}
+	var mode int
+	if err := DB.Raw("PRAGMA auto_vacuum").Scan(&mode).Error; err != nil || mode != 2 {
+		return err
+	}
+	return DB.Exec(fmt.Sprintf("PRAGMA incremental_vacuum(%d)", incrementalPages)).Error
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserMessage is a raw Baileys WAMessage as stored by the core. Timestamp is the
+// ISO 8601 time the core saved it, not the time the message was sent.
+type UserMessage struct {
+	ID           string `gorm:"column:id;primaryKey"`
+	SessionPhone string `gorm:"column:session_phone;primaryKey"`
+	Data         string `gorm:"column:data;type:text"`
+	Timestamp    string `gorm:"column:timestamp"`
+	SentAt       int64  `gorm:"column:sent_at;->;-:migration" json:"-"` // Set by QueryMessages only
+}
+
+func (UserMessage) TableName() string {
+	return "user_messages"
+}
+
+// MessageCursor is the position of the last message of a page
+type MessageCursor struct {
+	SentAt int64 // Unix seconds
+	ID     string
+}
+
+type MessageFilter struct {
+	Phone       string
+	Chat        string // Remote JID
+	Sender      string // Participant JID in groups, the remote JID in direct chats
+	FromMe      *bool
+	ContentType string    // Key of the message content without wrappers, e.g. imageMessage
+	From        time.Time // Sent times, as indexed
+	To          time.Time
+	Before      *MessageCursor
+	After       *MessageCursor
+	Oldest      bool // Oldest first instead of newest first
+	Limit       int  // 0 for no limit
+}
+
+// FormatMessageTime formats t the way the core stores message timestamps
+func FormatMessageTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// QueryMessages returns matching messages with their sent time, newest first
+// unless f.Oldest is set
+func QueryMessages(f MessageFilter) ([]UserMessage, error) {
+	var msgs []UserMessage
+	err := messageQuery(f).Find(&msgs).Error
+	return msgs, err
+}
+
+// EachMessage calls fn for every matching message, loading them in batches
+func EachMessage(f MessageFilter, fn func(UserMessage) error) error {
+	const batch = 500
+	for {
+		page := f
+		page.Limit = batch
+		msgs, err := QueryMessages(page)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if len(msgs) < batch {
+			return nil
+		}
+		last := &MessageCursor{SentAt: msgs[len(msgs)-1].SentAt, ID: msgs[len(msgs)-1].ID}
+		if f.Oldest {
+			f.After = last
+		} else {
+			f.Before = last
+		}
+	}
+}
+
+func GetMessage(phone, id string) (*UserMessage, error) {
+	var msg UserMessage
+	err := DB.Where(&UserMessage{SessionPhone: phone, ID: id}).First(&msg).Error
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// GetMessages loads the messages of phone with the given ids, keyed by id
+func GetMessages(phone string, ids []string) (map[string]UserMessage, error) {
+	out := make(map[string]UserMessage, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	var msgs []UserMessage
+	err := DB.Where(&UserMessage{SessionPhone: phone}).Where("id IN ?", ids).Find(&msgs).Error
+	for _, m := range msgs {
+		out[m.ID] = m
+	}
+	return out, err
+}
+
+// messageQuery pages through message_index, which the indexes on (session_phone,
+// sent_at, message_id) and (session_phone, chat, sent_at, message_id) serve, and
+// joins user_messages for the rows of the page only. Messages are listed once the
+// indexer has picked them up.
+func messageQuery(f MessageFilter) *gorm.DB {
+	page := DB.Model(&MessageIndex{}).
+		Select("session_phone, message_id, sent_at").
+		Where("session_phone = ?", f.Phone)
+	dir := " DESC"
+	if f.Oldest {
+		dir = ""
+	}
+	page = page.Order("sent_at" + dir + ", message_id" + dir)
+
+	if f.Chat != "" {
+		page = page.Where("chat = ?", f.Chat)
+	}
+	if f.Sender != "" {
+		page = page.Where("sender = ?", f.Sender)
+	}
+	if f.FromMe != nil {
+		page = page.Where("from_me = ?", *f.FromMe)
+	}
+	if f.ContentType != "" {
+		page = page.Where("content_type = ?", f.ContentType)
+	}
+	if !f.From.IsZero() {
+		page = page.Where("sent_at >= ?", f.From.Unix())
+	}
+	if !f.To.IsZero() {
+		page = page.Where("sent_at < ?", f.To.Unix())
+	}
+	if c := f.Before; c != nil {
+		page = page.Where("(sent_at, message_id) < (?, ?)", c.SentAt, c.ID)
+	}
+	if c := f.After; c != nil {
+		page = page.Where("(sent_at, message_id) > (?, ?)", c.SentAt, c.ID)
+	}
+	if f.Limit > 0 {
+		page = page.Limit(f.Limit)
+	}
+
+	return DB.Table("(?) AS page", page).
+		Select("user_messages.*, page.sent_at").
+		Joins("JOIN user_messages ON user_messages.session_phone = page.session_phone AND user_messages.id = page.message_id").
+		Order("page.sent_at" + dir + ", page.message_id" + dir)
+}
+
+// jsonText returns an expression for the text at path inside a JSON column, NULL when
+// missing. Path segments are inlined and must not come from user input unchecked.
+func jsonText(column string, path ...string) string {
+	if IsSQLite() {
+		return fmt.Sprintf("json_extract(%s, '$.%s')", column, strings.Join(path, "."))
+	}
+	return fmt.Sprintf("(%s::jsonb #>> '{%s}')", column, strings.Join(path, ","))
+}
+
+// jsonBool returns a condition that holds when the value at path is JSON true
+func jsonBool(column string, path ...string) string {
+	if IsSQLite() {
+		return fmt.Sprintf("COALESCE(%s, 0) = 1", jsonText(column, path...))
+	}
+	return fmt.Sprintf("COALESCE(%s, 'false') = 'true'", jsonText(column, path...))
+}
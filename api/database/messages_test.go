@@ -0,0 +1,402 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	testPhone  = "2348012345678"
+	otherPhone = "2348087654321"
+	alice      = "2348011111111@s.whatsapp.net"
+	bob        = "2348022222222@s.whatsapp.net"
+	group      = "120363000000000001@g.us"
+)
+
+var testEpoch = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testMessage is a stored Baileys WAMessage reduced to what the queries read
+type testMessage struct {
+	id          string
+	chat        string
+	participant string
+	fromMe      bool
+	content     string // JSON of the message field
+	at          int    // Minutes after testEpoch the message was sent
+	delay       int    // Minutes after sending the core stored it
+	starred     bool
+	pushName    string // Test when empty
+}
+
+func text(s string) string {
+	return fmt.Sprintf(`{"conversation":%q}`, s)
+}
+
+func storeMessages(t *testing.T, phone string, msgs []testMessage) {
+	t.Helper()
+	for _, m := range msgs {
+		at := testEpoch.Add(time.Duration(m.at) * time.Minute)
+		stored := at.Add(time.Duration(m.delay) * time.Minute)
+		participant := ""
+		if m.participant != "" {
+			participant = fmt.Sprintf(`,"participant":%q`, m.participant)
+		}
+		pushName := m.pushName
+		if pushName == "" {
+			pushName = "Test"
+		}
+		data := fmt.Sprintf(`{"key":{"remoteJid":%q,"fromMe":%t,"id":%q%s},"message":%s,"messageTimestamp":%d,"pushName":%q,"starred":%t}`,
+			m.chat, m.fromMe, m.id, participant, m.content, at.Unix(), pushName, m.starred)
+		row := UserMessage{ID: m.id, SessionPhone: phone, Data: data, Timestamp: FormatMessageTime(stored)}
+		if err := DB.Create(&row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var conversation = []testMessage{
+	{id: "m1", chat: alice, content: text("hello there"), at: 0},
+	{id: "m2", chat: alice, fromMe: true, content: text("hi alice, how are you"), at: 1},
+	{id: "m3", chat: group, participant: bob, content: `{"imageMessage":{"caption":"holiday photo"}}`, at: 2},
+	{id: "m4", chat: group, participant: alice, content: `{"ephemeralMessage":{"message":{"imageMessage":{"caption":"vanishing"}}}}`, at: 3},
+	{id: "m5", chat: group, fromMe: true, content: text("nice pictures"), at: 4},
+	{id: "m6", chat: bob, content: text("hello bob here"), at: 5},
+}
+
+func ids(msgs []UserMessage) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.ID
+	}
+	return out
+}
+
+func TestQueryMessages(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeMessages(t, testPhone, conversation)
+		storeMessages(t, otherPhone, []testMessage{{id: "x1", chat: alice, content: text("other instance"), at: 0}})
+		if _, err := ReindexMessages(""); err != nil {
+			t.Fatal(err)
+		}
+
+		yes, no := true, false
+		tests := []struct {
+			name   string
+			filter MessageFilter
+			want   []string
+		}{
+			{"newest first", MessageFilter{}, []string{"m6", "m5", "m4", "m3", "m2", "m1"}},
+			{"oldest first", MessageFilter{Oldest: true, Limit: 2}, []string{"m1", "m2"}},
+			{"chat", MessageFilter{Chat: alice}, []string{"m2", "m1"}},
+			{"group sender", MessageFilter{Sender: bob}, []string{"m6", "m3"}},
+			{"direct sender", MessageFilter{Sender: alice}, []string{"m4", "m1"}},
+			{"from me", MessageFilter{FromMe: &yes}, []string{"m5", "m2"}},
+			{"not from me", MessageFilter{FromMe: &no, Chat: group}, []string{"m4", "m3"}},
+			{"content type with ephemeral", MessageFilter{ContentType: "imageMessage"}, []string{"m4", "m3"}},
+			{"time range", MessageFilter{From: testEpoch.Add(time.Minute), To: testEpoch.Add(3 * time.Minute)}, []string{"m3", "m2"}},
+			{"before cursor", MessageFilter{Before: &MessageCursor{SentAt: testEpoch.Add(2 * time.Minute).Unix(), ID: "m3"}}, []string{"m2", "m1"}},
+			{"after cursor", MessageFilter{Oldest: true, After: &MessageCursor{SentAt: testEpoch.Add(4 * time.Minute).Unix(), ID: "m5"}}, []string{"m6"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.filter.Phone = testPhone
+				msgs, err := QueryMessages(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := ids(msgs); !slices.Equal(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestQueryMessagesSentTime(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		// m2 was sent before m1 but reached the core an hour later, after a reconnect
+		storeMessages(t, testPhone, []testMessage{
+			{id: "m1", chat: alice, content: text("first stored"), at: 10},
+			{id: "m2", chat: alice, content: text("sent offline"), at: 5, delay: 60},
+			{id: "m3", chat: alice, content: text("latest"), at: 20},
+		})
+		query := func(f MessageFilter) []string {
+			t.Helper()
+			f.Phone = testPhone
+			msgs, err := QueryMessages(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ids(msgs)
+		}
+
+		// Messages are listed once indexed, in the order they were sent
+		if got := query(MessageFilter{Oldest: true}); len(got) != 0 {
+			t.Fatalf("before indexing got %v, want none", got)
+		}
+		if _, err := ReindexMessages(testPhone); err != nil {
+			t.Fatal(err)
+		}
+
+		window := MessageFilter{From: testEpoch, To: testEpoch.Add(15 * time.Minute)}
+		tests := []struct {
+			name   string
+			filter MessageFilter
+			want   []string
+		}{
+			{"oldest first", MessageFilter{Oldest: true}, []string{"m2", "m1", "m3"}},
+			{"newest first", MessageFilter{}, []string{"m3", "m1", "m2"}},
+			{"time range", window, []string{"m1", "m2"}},
+			{"before cursor", MessageFilter{Before: &MessageCursor{SentAt: testEpoch.Add(10 * time.Minute).Unix(), ID: "m1"}}, []string{"m2"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if got := query(tt.filter); !slices.Equal(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+
+		msgs, err := QueryMessages(MessageFilter{Phone: testPhone, Oldest: true, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := testEpoch.Add(5 * time.Minute).Unix(); msgs[0].SentAt != want {
+			t.Fatalf("sent at %d, want %d", msgs[0].SentAt, want)
+		}
+	})
+}
+
+// TestQueryMessagesPlan checks that pages are read from the message_index indexes
+// from the cursor on, instead of scanning and sorting every message
+func TestQueryMessagesPlan(t *testing.T) {
+	openTestDB(t)
+	cursor := &MessageCursor{SentAt: testEpoch.Unix(), ID: "m1"}
+	tests := []struct {
+		name   string
+		filter MessageFilter
+		index  string
+	}{
+		{"instance", MessageFilter{Before: cursor}, "idx_message_index_page (session_phone=? AND (sent_at,message_id)<(?,?))"},
+		{"chat", MessageFilter{Chat: alice, Oldest: true, After: cursor}, "idx_message_index_chat_page (session_phone=? AND chat=? AND (sent_at,message_id)>(?,?))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filter.Phone, tt.filter.Limit = testPhone, 50
+			stmt := messageQuery(tt.filter).Session(&gorm.Session{DryRun: true}).Find(&[]UserMessage{}).Statement
+			var plan []struct{ Detail string }
+			if err := DB.Raw("EXPLAIN QUERY PLAN "+stmt.SQL.String(), stmt.Vars...).Scan(&plan).Error; err != nil {
+				t.Fatal(err)
+			}
+			var details []string
+			for _, p := range plan {
+				details = append(details, p.Detail)
+			}
+			if !slices.ContainsFunc(details, func(d string) bool { return strings.HasSuffix(d, tt.index) }) {
+				t.Errorf("plan %q doesn't search %s", details, tt.index)
+			}
+			if slices.ContainsFunc(details, func(d string) bool { return strings.HasPrefix(d, "SCAN user_messages") }) {
+				t.Errorf("plan %q scans user_messages", details)
+			}
+		})
+	}
+}
+
+func TestEachMessagePages(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		// More than a batch, with equal timestamps across the page boundary
+		var msgs []testMessage
+		for i := range 1100 {
+			msgs = append(msgs, testMessage{id: fmt.Sprintf("m%04d", i), chat: alice, content: text("x"), at: i / 3})
+		}
+		storeMessages(t, testPhone, msgs)
+		if _, err := ReindexMessages(testPhone); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		err := EachMessage(MessageFilter{Phone: testPhone, Oldest: true}, func(m UserMessage) error {
+			got = append(got, m.ID)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(msgs) || !slices.IsSorted(got) {
+			t.Fatalf("got %d messages, sorted %t, want %d in order", len(got), slices.IsSorted(got), len(msgs))
+		}
+	})
+}
+
+func TestSearchMessages(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		storeMessages(t, testPhone, conversation)
+		storeMessages(t, otherPhone, []testMessage{{id: "x1", chat: alice, content: text("hello from elsewhere"), at: 0}})
+		n, err := ReindexMessages("")
+		if err != nil || n != len(conversation)+1 {
+			t.Fatalf("ReindexMessages = %d, %v", n, err)
+		}
+
+		tests := []struct {
+			name   string
+			filter SearchFilter
+			want   []string
+		}{
+			{"word", SearchFilter{Query: "hello"}, []string{"m1", "m6"}},
+			{"caption", SearchFilter{Query: "holiday"}, []string{"m3"}},
+			{"wrapped caption", SearchFilter{Query: "vanishing"}, []string{"m4"}},
+			{"excluded term", SearchFilter{Query: "hello -bob"}, []string{"m1"}},
+			{"phrase", SearchFilter{Query: `"how are you"`}, []string{"m2"}},
+			{"chat", SearchFilter{Query: "hello", Chat: bob}, []string{"m6"}},
+			{"no match", SearchFilter{Query: "nothing"}, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.filter.Phone = testPhone
+				tt.filter.Limit = 10
+				hits, err := SearchMessages(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, h := range hits {
+					got = append(got, h.MessageID)
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestReindexMessages(t *testing.T) {
+	openTestDB(t)
+	storeMessages(t, testPhone, conversation)
+	storeMessages(t, otherPhone, []testMessage{{id: "x1", chat: alice, content: text("other instance"), at: 0}})
+	if n, err := ReindexMessages(""); err != nil || n != len(conversation)+1 {
+		t.Fatalf("ReindexMessages = %d, %v", n, err)
+	}
+	indexed := func(phone string) (rows, rolledUp int64) {
+		t.Helper()
+		if err := DB.Model(&MessageIndex{}).Where("session_phone = ?", phone).Count(&rows).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := DB.Model(&MessageRollup{}).Where("session_phone = ?", phone).Select("COALESCE(SUM(messages), 0)").Scan(&rolledUp).Error; err != nil {
+			t.Fatal(err)
+		}
+		return rows, rolledUp
+	}
+
+	// A rebuild failing halfway keeps the previous index
+	err := DB.Exec(`CREATE TRIGGER fail_index BEFORE INSERT ON message_index WHEN new.message_id = 'm5'
+		BEGIN SELECT RAISE(ABORT, 'index failed'); END`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReindexMessages(testPhone); err == nil {
+		t.Fatal("reindex succeeded despite the failing insert")
+	}
+	if rows, rolledUp := indexed(testPhone); rows != 6 || rolledUp != 6 {
+		t.Fatalf("after a failed rebuild %d rows and %d rolled up, want 6", rows, rolledUp)
+	}
+
+	// Rows of deleted messages and instances are dropped
+	if err := DB.Exec("DROP TRIGGER fail_index").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Where("id IN ?", []string{"m1", "x1"}).Delete(&UserMessage{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ReindexMessages(""); err != nil || n != 5 {
+		t.Fatalf("ReindexMessages = %d, %v, want 5", n, err)
+	}
+	if rows, rolledUp := indexed(testPhone); rows != 5 || rolledUp != 5 {
+		t.Fatalf("%d rows and %d rolled up, want 5", rows, rolledUp)
+	}
+	if rows, rolledUp := indexed(otherPhone); rows != 0 || rolledUp != 0 {
+		t.Fatalf("instance without messages kept %d rows and %d rolled up", rows, rolledUp)
+	}
+}
+
+func TestPurgeSessionData(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		for _, phone := range []string{testPhone, otherPhone} {
+			s := Session{Phone: phone, TenantID: DefaultTenant}
+			if err := DB.Create(&s).Error; err != nil {
+				t.Fatal(err)
+			}
+			storeMessages(t, phone, conversation[:2])
+			rows := []any{
+				&UserSettings{User: phone},
+				&UserContact{SessionPhone: phone, PN: alice, LID: "1@lid"},
+				&GroupMetadata{ID: group, SessionID: phone, MetaData: "{}"},
+				&ChatRead{SessionPhone: phone, Chat: alice, ReadAt: testEpoch.Unix()},
+				&RetentionPolicy{SessionPhone: phone, MaxAgeDays: 30},
+				&PurgeRun{SessionPhone: phone, Trigger: "manual", StartedAt: testEpoch},
+			}
+			for _, row := range rows {
+				if err := DB.Create(row).Error; err != nil {
+					t.Fatalf("%T: %v", row, err)
+				}
+			}
+			for _, key := range []string{"creds", "app-state-sync-key-1"} {
+				if err := DB.Exec("INSERT INTO auth_data (id, data) VALUES (?, '{}')", "session:"+phone+":"+key).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if _, err := ReindexMessages(""); err != nil {
+			t.Fatal(err)
+		}
+		// Soft deleted sessions are purged too
+		if err := DB.Where("phone = ?", testPhone).Delete(&Session{}).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if err := PurgeSessionData(testPhone); err != nil {
+			t.Fatal(err)
+		}
+
+		count := func(table, column, phone string) int64 {
+			var n int64
+			q := DB.Table(table)
+			if table == "auth_data" {
+				q = q.Where("id LIKE ?", "session:"+phone+":%")
+			} else {
+				q = q.Where(fmt.Sprintf("%q = ?", column), phone)
+			}
+			if err := q.Count(&n).Error; err != nil {
+				t.Fatalf("%s: %v", table, err)
+			}
+			return n
+		}
+		tables := map[string]string{
+			"sessions":           "phone",
+			"user_settings":      "user",
+			"user_messages":      "session_phone",
+			"message_index":      "session_phone",
+			"message_rollups":    "session_phone",
+			"user_contacts":      "session_phone",
+			"group_metadata":     "session_phone",
+			"chat_reads":         "session_phone",
+			"retention_policies": "session_phone",
+			"purge_runs":         "session_phone",
+			"auth_data":          "id",
+		}
+		for table, column := range tables {
+			if n := count(table, column, testPhone); n != 0 {
+				t.Errorf("%s: %d rows of the purged instance left", table, n)
+			}
+			if n := count(table, column, otherPhone); n == 0 {
+				t.Errorf("%s: rows of the other instance were deleted", table)
+			}
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is one numbered schema change. The Go side owns the schema of every
+// table, including the ones the core reads and writes.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"not null"`
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+// LatestVersion is the schema version this build migrates to
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the highest applied migration, 0 for a fresh database
+func SchemaVersion() (int, error) {
+	if err := DB.AutoMigrate(&SchemaMigration{}); err != nil {
+		return 0, err
+	}
+	var version int
+	err := DB.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// CheckSchema refuses databases migrated by a newer build, whose schema this one
+// doesn't know
+func CheckSchema() error {
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > LatestVersion() {
+		return fmt.Errorf("%w: database is at version %d, this build knows up to %d", ErrSchemaTooNew, version, LatestVersion())
+	}
+	return nil
+}
+
+// Migrate applies all pending migrations in order, each in its own transaction
+func Migrate() error {
+	if err := CheckSchema(); err != nil {
+		return err
+	}
+
+	var applied []SchemaMigration
+	if err := DB.Find(&applied).Error; err != nil {
+		return err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		fmt.Printf("Applied migration %d %s\n", m.Version, m.Name)
+	}
+	return nil
+}
+
+// MigrateDown rolls back the last steps applied migrations
+func MigrateDown(steps int) error {
+	if err := CheckSchema(); err != nil {
+		return err
+	}
+
+	for ; steps > 0; steps-- {
+		var last SchemaMigration
+		err := DB.Order("version DESC").First(&last).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		m := findMigration(last.Version)
+		if m == nil {
+			return fmt.Errorf("unknown migration %d", last.Version)
+		}
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("rolling back %d %s: %w", m.Version, m.Name, err)
+		}
+		fmt.Printf("Rolled back migration %d %s\n", m.Version, m.Name)
+	}
+	return nil
+}
+
+// MigrationStatus lists every known migration with whether it is applied
+func MigrationStatus() ([]Migration, map[int]time.Time, error) {
+	if _, err := SchemaVersion(); err != nil {
+		return nil, nil, err
+	}
+	var applied []SchemaMigration
+	if err := DB.Find(&applied).Error; err != nil {
+		return nil, nil, err
+	}
+	at := make(map[int]time.Time, len(applied))
+	for _, m := range applied {
+		at[m.Version] = m.AppliedAt
+	}
+	return migrations, at, nil
+}
+
+func findMigration(version int) *Migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm/schema"
+)
+
+// models lists every table the migrations own with the model the code reads it with
+var models = []any{
+	&UserMessage{}, &UserContact{}, &GroupMetadata{},
+	&Session{}, &UserSettings{}, &KVEntry{}, &Tenant{}, &APIKey{},
+	&User{}, &UserSession{}, &QuotaUsage{}, &AuditEntry{},
+	&MessageIndex{}, &ChatRead{}, &ExportJob{}, &MessageRollup{},
+	&RetentionPolicy{}, &PurgeRun{},
+}
+
+// checkSchema fails unless the tables match the models column for column
+// and every model index exists
+func checkSchema(t *testing.T) {
+	t.Helper()
+	m := DB.Migrator()
+	for _, model := range models {
+		stmt := DB.Model(model).Statement
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		table := stmt.Schema.Table
+		if !m.HasTable(model) {
+			t.Errorf("%s: table missing", table)
+			continue
+		}
+
+		cols, err := m.ColumnTypes(model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		for _, c := range cols {
+			have = append(have, c.Name())
+		}
+		var want []string
+		for _, f := range stmt.Schema.Fields {
+			if f.DBName != "" && !f.IgnoreMigration {
+				want = append(want, f.DBName)
+			}
+		}
+		slices.Sort(have)
+		slices.Sort(want)
+		if !slices.Equal(have, want) {
+			t.Errorf("%s: columns %v, model has %v", table, have, want)
+		}
+
+		modelIndexes := stmt.Schema.ParseIndexes()
+		for _, idx := range modelIndexes {
+			if !m.HasIndex(model, idx.Name) {
+				t.Errorf("%s: index %s missing", table, idx.Name)
+			}
+		}
+		// A stale unique index rejects rows the model allows
+		indexes, err := m.GetIndexes(model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range indexes {
+			unique, _ := idx.Unique()
+			primary, _ := idx.PrimaryKey()
+			inModel := slices.ContainsFunc(modelIndexes, func(i *schema.Index) bool { return i.Name == idx.Name() })
+			if unique && !primary && !inModel && !strings.HasPrefix(idx.Name(), "sqlite_autoindex") {
+				t.Errorf("%s: unique index %s is not in the model", table, idx.Name())
+			}
+		}
+	}
+}
+
+func TestMigrationsMatchModels(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		checkSchema(t)
+	})
+}
+
+func TestMigrateDownUp(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		// Every migration rolls back on its own
+		for v := LatestVersion(); v > 0; v-- {
+			if err := MigrateDown(1); err != nil {
+				t.Fatalf("down from %d: %v", v, err)
+			}
+			if got, _ := SchemaVersion(); got != v-1 {
+				t.Fatalf("version after rolling back %d is %d", v, got)
+			}
+		}
+		if err := Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		checkSchema(t)
+
+		// And all of them in one go
+		if err := MigrateDown(LatestVersion()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing but the bookkeeping table is left
+		for _, model := range models {
+			if DB.Migrator().HasTable(model) {
+				t.Errorf("%T still exists after rolling back every migration", model)
+			}
+		}
+
+		if err := Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := SchemaVersion(); got != LatestVersion() {
+			t.Fatalf("version %d after migrating, want %d", got, LatestVersion())
+		}
+		checkSchema(t)
+	})
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		DB.Create(&SchemaMigration{Version: LatestVersion() + 1, Name: "future"})
+		if err := Migrate(); err == nil {
+			t.Fatal("Migrate accepted a schema newer than this build")
+		}
+	})
+}
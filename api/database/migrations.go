@@ -0,0 +1,544 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// migrations must only ever be appended to. Migrations 1 to 3 are idempotent so
+// databases created before versioning adopt them without changes.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "core_tables",
+		Up: func(tx *gorm.DB) error {
+			// Snapshots of the tables written by the core, kept here so later model
+			// changes don't alter this migration
+			type authData struct {
+				ID        string `gorm:"column:id;primaryKey"`
+				Data      string `gorm:"column:data;type:text"`
+				UpdatedAt string `gorm:"column:updated_at"`
+			}
+			type userMessage struct {
+				ID           string `gorm:"column:id;primaryKey"`
+				SessionPhone string `gorm:"column:session_phone;primaryKey"`
+				Data         string `gorm:"column:data;type:text"`
+				Timestamp    string `gorm:"column:timestamp;index:idx_user_messages_timestamp"`
+			}
+			type userContact struct {
+				PN           string `gorm:"column:pn;primaryKey"`
+				SessionPhone string `gorm:"column:session_phone;primaryKey"`
+				LID          string `gorm:"column:lid;index:idx_user_contacts_lid"`
+			}
+			type groupMetadata struct {
+				ID           string `gorm:"column:id;primaryKey"`
+				SessionPhone string `gorm:"column:session_phone;primaryKey"`
+				Metadata     string `gorm:"column:metadata;type:text"`
+				UpdatedAt    string `gorm:"column:updated_at"`
+			}
+
+			tables := map[string]any{
+				"auth_data":      &authData{},
+				"user_messages":  &userMessage{},
+				"user_contacts":  &userContact{},
+				"group_metadata": &groupMetadata{},
+			}
+			for name, model := range tables {
+				if err := tx.Table(name).AutoMigrate(model); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("auth_data", "user_messages", "user_contacts", "group_metadata")
+		},
+	},
+	{
+		Version: 2,
+		Name:    "api_tables",
+		Up: func(tx *gorm.DB) error {
+			// Snapshots of the Go models when the schema was first versioned, later
+			// column changes get their own migration
+			type session struct {
+				ID              int64  `gorm:"primaryKey"`
+				Phone           string `gorm:"uniqueIndex;not null"`
+				TenantID        string `gorm:"index;not null;default:'default'"`
+				Status          string `gorm:"default:'starting'"`
+				PairingCode     string
+				DisplayName     string
+				Notes           string `gorm:"type:text"`
+				Labels          string `gorm:"type:text"`
+				StartupPriority int    `gorm:"default:0"`
+				CreatedAt       time.Time
+				UpdatedAt       time.Time
+				DeletedAt       gorm.DeletedAt `gorm:"index"`
+			}
+			type userSettings struct {
+				User             string `gorm:"primaryKey;column:user"`
+				Language         string `gorm:"default:'en'"`
+				Prefix           string `gorm:"default:null"`
+				Mode             string `gorm:"default:'private'"`
+				Afk              string `gorm:"type:text"`
+				BGM              string `gorm:"type:text"`
+				AliveMsg         string `gorm:"type:text"`
+				Filters          string `gorm:"type:text"`
+				AntiMsg          string `gorm:"type:text"`
+				AntiWord         string `gorm:"type:text"`
+				Antilink         int32  `gorm:"default:0"`
+				AntiCall         int32  `gorm:"default:0"`
+				AntiDelete       int32  `gorm:"default:0"`
+				AntilinkSpam     int32  `gorm:"default:0"`
+				WelcomeMsg       string `gorm:"type:text"`
+				GoodbyeMsg       string `gorm:"type:text"`
+				GroupEvents      int32  `gorm:"default:0"`
+				AutoKick         string `gorm:"type:text"`
+				Sudo             string `gorm:"type:text"`
+				Banned           string `gorm:"type:text"`
+				DisabledGroups   int32  `gorm:"default:0"`
+				DisabledCommands string `gorm:"type:text"`
+			}
+			type kvEntry struct {
+				Key       string `gorm:"column:key;primaryKey"`
+				Type      string `gorm:"column:type;not null"`
+				Value     string `gorm:"column:value;type:text"`
+				ExpiresAt int64  `gorm:"column:expires_at;default:0"`
+			}
+			type tenant struct {
+				ID        string `gorm:"primaryKey"`
+				Name      string `gorm:"not null"`
+				CreatedAt time.Time
+			}
+			type apiKey struct {
+				ID         uint   `gorm:"primaryKey"`
+				Name       string `gorm:"not null"`
+				TenantID   string `gorm:"index;not null;default:'default'"`
+				Prefix     string `gorm:"not null"`
+				Hash       string `gorm:"uniqueIndex;not null"`
+				Scopes     string `gorm:"type:text"`
+				RateLimits string `gorm:"type:text"`
+				DailyQuota int64  `gorm:"default:0"`
+				CreatedAt  time.Time
+				LastUsedAt *time.Time
+				RevokedAt  *time.Time
+			}
+			type user struct {
+				ID           uint   `gorm:"primaryKey"`
+				Username     string `gorm:"uniqueIndex;not null"`
+				PasswordHash string `gorm:"not null"`
+				Role         string `gorm:"not null;default:'viewer'"`
+				TenantID     string `gorm:"index;not null;default:'default'"`
+				TOTPSecret   string
+				TOTPEnabled  bool    `gorm:"default:false"`
+				Disabled     bool    `gorm:"default:false"`
+				OIDCSubject  *string `gorm:"column:oidc_subject;uniqueIndex"`
+				CreatedAt    time.Time
+				UpdatedAt    time.Time
+				LastLoginAt  *time.Time
+			}
+			type userSession struct {
+				ID        string `gorm:"primaryKey"`
+				UserID    uint   `gorm:"index;not null"`
+				IP        string
+				UserAgent string
+				CreatedAt time.Time
+				ExpiresAt time.Time `gorm:"index"`
+			}
+			type quotaUsage struct {
+				KeyID uint   `gorm:"primaryKey;autoIncrement:false"`
+				Day   string `gorm:"primaryKey"`
+				Count int64  `gorm:"not null;default:0"`
+			}
+			type auditEntry struct {
+				ID        uint      `gorm:"primaryKey"`
+				CreatedAt time.Time `gorm:"index"`
+				ActorType string    `gorm:"not null"`
+				ActorID   uint
+				Actor     string `gorm:"index"`
+				TenantID  string `gorm:"index"`
+				Method    string `gorm:"not null"`
+				Route     string `gorm:"not null"`
+				Path      string `gorm:"not null"`
+				Phone     string `gorm:"index"`
+				Status    int
+				Outcome   string
+				IP        string
+				Before    string `gorm:"type:text"`
+				After     string `gorm:"type:text"`
+			}
+
+			// Created in order, a slice keeps it stable unlike migration 1's map
+			tables := []struct {
+				name  string
+				model any
+			}{
+				{"sessions", &session{}},
+				{"user_settings", &userSettings{}},
+				{"kv_entries", &kvEntry{}},
+				{"tenants", &tenant{}},
+				{"api_keys", &apiKey{}},
+				{"users", &user{}},
+				{"user_sessions", &userSession{}},
+				{"quota_usage", &quotaUsage{}},
+				{"audit_log", &auditEntry{}},
+			}
+			for _, t := range tables {
+				if err := tx.Table(t.name).AutoMigrate(t.model); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("sessions", "user_settings", "kv_entries", "tenants", "api_keys",
+				"users", "user_sessions", "quota_usage", "audit_log")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "audit_log_append_only",
+		Up: func(tx *gorm.DB) error {
+			for _, stmt := range auditTriggers[tx.Dialector.Name()] {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			stmts := []string{
+				"DROP TRIGGER IF EXISTS audit_log_no_update",
+				"DROP TRIGGER IF EXISTS audit_log_no_delete",
+			}
+			if tx.Dialector.Name() == "postgres" {
+				stmts = []string{
+					"DROP TRIGGER IF EXISTS audit_log_no_change ON audit_log",
+					"DROP FUNCTION IF EXISTS audit_log_append_only()",
+				}
+			}
+			for _, stmt := range stmts {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 4,
+		Name:    "message_index",
+		Up: func(tx *gorm.DB) error {
+			type messageIndex struct {
+				ID           uint   `gorm:"primaryKey"`
+				SessionPhone string `gorm:"column:session_phone;not null;uniqueIndex:idx_message_index_message,priority:1;index:idx_message_index_chat,priority:1"`
+				MessageID    string `gorm:"column:message_id;not null;uniqueIndex:idx_message_index_message,priority:2"`
+				Chat         string `gorm:"column:chat;index:idx_message_index_chat,priority:2"`
+				Sender       string `gorm:"column:sender"`
+				FromMe       bool   `gorm:"column:from_me"`
+				ContentType  string `gorm:"column:content_type"`
+				Text         string `gorm:"column:text;type:text"`
+				SentAt       int64  `gorm:"column:sent_at;index:idx_message_index_chat,priority:3"`
+				StoredAt     string `gorm:"column:stored_at;index"`
+			}
+			if err := tx.Table("message_index").AutoMigrate(&messageIndex{}); err != nil {
+				return err
+			}
+			for _, stmt := range messageSearchSchema[tx.Dialector.Name()] {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == "sqlite" {
+				for _, stmt := range []string{
+					"DROP TRIGGER IF EXISTS message_index_ai",
+					"DROP TRIGGER IF EXISTS message_index_ad",
+					"DROP TRIGGER IF EXISTS message_index_au",
+					"DROP TABLE IF EXISTS message_fts",
+				} {
+					if err := tx.Exec(stmt).Error; err != nil {
+						return err
+					}
+				}
+			}
+			return tx.Migrator().DropTable("message_index")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "chat_reads",
+		Up: func(tx *gorm.DB) error {
+			type chatRead struct {
+				SessionPhone string `gorm:"column:session_phone;primaryKey"`
+				Chat         string `gorm:"column:chat;primaryKey"`
+				ReadAt       int64  `gorm:"column:read_at"`
+				UpdatedAt    time.Time
+			}
+			if err := tx.Table("chat_reads").AutoMigrate(&chatRead{}); err != nil {
+				return err
+			}
+
+			// Chats without a group subject are named after the contact's push name
+			type messageIndex struct {
+				PushName string `gorm:"column:push_name"`
+			}
+			if err := tx.Table("message_index").AutoMigrate(&messageIndex{}); err != nil {
+				return err
+			}
+			return tx.Exec(fmt.Sprintf(`UPDATE message_index SET push_name = COALESCE((
+				SELECT %s FROM user_messages u
+				WHERE u.id = message_index.message_id AND u.session_phone = message_index.session_phone), '')`,
+				jsonText("u.data", "pushName"))).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Exec("ALTER TABLE message_index DROP COLUMN push_name").Error; err != nil {
+				return err
+			}
+			return tx.Migrator().DropTable("chat_reads")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "export_jobs",
+		Up: func(tx *gorm.DB) error {
+			type exportJob struct {
+				ID        uint   `gorm:"primaryKey"`
+				TenantID  string `gorm:"index;not null"`
+				Phone     string `gorm:"index;not null"`
+				Chat      string
+				Format    string `gorm:"not null"`
+				From      *time.Time
+				To        *time.Time
+				Status    string `gorm:"index;not null"`
+				Error     string
+				File      string
+				Size      int64
+				Messages  int
+				CreatedBy string
+				CreatedAt time.Time
+				StartedAt *time.Time
+				DoneAt    *time.Time
+			}
+			return tx.Table("export_jobs").AutoMigrate(&exportJob{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("export_jobs")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "message_rollups",
+		Up: func(tx *gorm.DB) error {
+			type messageRollup struct {
+				SessionPhone string `gorm:"column:session_phone;primaryKey"`
+				Hour         int64  `gorm:"column:hour;primaryKey;autoIncrement:false"`
+				Chat         string `gorm:"column:chat;primaryKey"`
+				Sender       string `gorm:"column:sender;primaryKey"`
+				FromMe       bool   `gorm:"column:from_me;primaryKey"`
+				ContentType  string `gorm:"column:content_type;primaryKey"`
+				Messages     int64  `gorm:"column:messages"`
+			}
+			if err := tx.Table("message_rollups").AutoMigrate(&messageRollup{}); err != nil {
+				return err
+			}
+			return tx.Exec(rollupInsert("")).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("message_rollups")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "retention",
+		Up: func(tx *gorm.DB) error {
+			type retentionPolicy struct {
+				SessionPhone string `gorm:"column:session_phone;primaryKey"`
+				MaxAgeDays   int    `gorm:"column:max_age_days"`
+				MaxPerChat   int    `gorm:"column:max_per_chat"`
+				KeepStarred  bool   `gorm:"column:keep_starred"`
+				UpdatedAt    time.Time
+			}
+			type purgeRun struct {
+				ID           uint   `gorm:"primaryKey"`
+				SessionPhone string `gorm:"column:session_phone;index;not null"`
+				Trigger      string `gorm:"not null"`
+				MaxAgeDays   int
+				MaxPerChat   int
+				KeepStarred  bool
+				ByAge        int64
+				ByCount      int64
+				Chats        int
+				Error        string
+				StartedAt    time.Time
+				FinishedAt   *time.Time
+			}
+			if err := tx.Table("retention_policies").AutoMigrate(&retentionPolicy{}); err != nil {
+				return err
+			}
+			return tx.Table("purge_runs").AutoMigrate(&purgeRun{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("purge_runs", "retention_policies")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "instance_keys",
+		Up: func(tx *gorm.DB) error {
+			type apiKey struct {
+				Phone string `gorm:"index"`
+			}
+			if err := tx.Table("api_keys").AutoMigrate(&apiKey{}); err != nil {
+				return err
+			}
+			// Core processes held a shared super admin key, they now get one per instance
+			return tx.Exec("DELETE FROM api_keys WHERE name = 'core-internal'").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Exec("DROP INDEX IF EXISTS idx_api_keys_phone").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("DELETE FROM api_keys WHERE phone IS NOT NULL AND phone <> ''").Error; err != nil {
+				return err
+			}
+			return tx.Exec("ALTER TABLE api_keys DROP COLUMN phone").Error
+		},
+	},
+	{
+		Version: 10,
+		Name:    "session_ids",
+		// Sessions created before tenants had ids that weren't generated, so
+		// every insert after the first failed on id 0
+		Up: func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == "postgres" {
+				return tx.Exec(`DO $$ BEGIN
+					IF (SELECT column_default FROM information_schema.columns
+						WHERE table_schema = current_schema() AND table_name = 'sessions' AND column_name = 'id') IS NULL THEN
+						CREATE SEQUENCE IF NOT EXISTS sessions_id_seq OWNED BY sessions.id;
+						ALTER TABLE sessions ALTER COLUMN id SET DEFAULT nextval('sessions_id_seq');
+						PERFORM setval('sessions_id_seq', COALESCE((SELECT MAX(id) FROM sessions), 0) + 1, false);
+					END IF;
+				END $$`).Error
+			}
+
+			var ddl string
+			if err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'sessions'").Scan(&ddl).Error; err != nil {
+				return err
+			}
+			if strings.Contains(strings.ToUpper(ddl), "AUTOINCREMENT") {
+				return nil
+			}
+
+			// SQLite can't change a primary key in place, the table is rebuilt
+			type session struct {
+				ID              int64  `gorm:"primaryKey"`
+				Phone           string `gorm:"uniqueIndex;not null"`
+				TenantID        string `gorm:"index;not null;default:'default'"`
+				Status          string `gorm:"default:'starting'"`
+				PairingCode     string
+				DisplayName     string
+				Notes           string `gorm:"type:text"`
+				Labels          string `gorm:"type:text"`
+				StartupPriority int    `gorm:"default:0"`
+				CreatedAt       time.Time
+				UpdatedAt       time.Time
+				DeletedAt       gorm.DeletedAt `gorm:"index"`
+			}
+			columns := "id, phone, tenant_id, status, pairing_code, display_name, notes, labels, startup_priority, created_at, updated_at, deleted_at"
+			stmts := []string{
+				"ALTER TABLE sessions RENAME TO sessions_old",
+				"DROP INDEX IF EXISTS idx_sessions_phone",
+				"DROP INDEX IF EXISTS idx_sessions_tenant_id",
+				"DROP INDEX IF EXISTS idx_sessions_deleted_at",
+			}
+			for _, stmt := range stmts {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Table("sessions").AutoMigrate(&session{}); err != nil {
+				return err
+			}
+			if err := tx.Exec(fmt.Sprintf("INSERT INTO sessions (%s) SELECT %s FROM sessions_old", columns, columns)).Error; err != nil {
+				return err
+			}
+			return tx.Exec("DROP TABLE sessions_old").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			// The old definition can't hold more than one session, there is nothing to restore
+			return nil
+		},
+	},
+	{
+		Version: 11,
+		Name:    "totp_last_step",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				TOTPLastStep int64 `gorm:"column:totp_last_step;not null;default:0"`
+			}
+			return tx.Table("users").AutoMigrate(&user{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("ALTER TABLE users DROP COLUMN totp_last_step").Error
+		},
+	},
+	{
+		Version: 12,
+		Name:    "oidc_issuer",
+		// Subjects are only unique per issuer. Existing single sign-on users keep a
+		// NULL issuer until AdoptOIDCUsers assigns them the configured one.
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("DROP INDEX IF EXISTS idx_users_o_id_c_subject").Error; err != nil {
+				return err
+			}
+			type user struct {
+				OIDCIssuer  *string `gorm:"column:oidc_issuer;uniqueIndex:idx_users_oidc"`
+				OIDCSubject *string `gorm:"column:oidc_subject;uniqueIndex:idx_users_oidc"`
+			}
+			return tx.Table("users").AutoMigrate(&user{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Exec("DROP INDEX IF EXISTS idx_users_oidc").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("ALTER TABLE users DROP COLUMN oidc_issuer").Error; err != nil {
+				return err
+			}
+			return tx.Exec("CREATE UNIQUE INDEX idx_users_o_id_c_subject ON users (oidc_subject)").Error
+		},
+	},
+	{
+		Version: 13,
+		Name:    "message_index_paging",
+		// Message lists page through message_index by sent time and message id
+		Up: func(tx *gorm.DB) error {
+			for _, stmt := range []string{
+				"DROP INDEX IF EXISTS idx_message_index_chat",
+				"CREATE INDEX IF NOT EXISTS idx_message_index_chat_page ON message_index (session_phone, chat, sent_at, message_id)",
+				"CREATE INDEX IF NOT EXISTS idx_message_index_page ON message_index (session_phone, sent_at, message_id)",
+			} {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, stmt := range []string{
+				"DROP INDEX IF EXISTS idx_message_index_chat_page",
+				"DROP INDEX IF EXISTS idx_message_index_page",
+				"CREATE INDEX IF NOT EXISTS idx_message_index_chat ON message_index (session_phone, chat, sent_at)",
+			} {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// QuotaUsage counts the requests an API key made on one UTC day
+type QuotaUsage struct {
+	KeyID uint   `gorm:"primaryKey;autoIncrement:false"`
+	Day   string `gorm:"primaryKey"` // YYYY-MM-DD
+	Count int64  `gorm:"not null;default:0"`
+}
+
+func (QuotaUsage) TableName() string {
+	return "quota_usage"
+}
+
+// QuotaBackend stores ratelimit quota counters in the quota_usage table
+type QuotaBackend struct{}
+
+func (QuotaBackend) LoadUsage(day string) (map[uint]int64, error) {
+	var rows []QuotaUsage
+	if err := DB.Where("day = ?", day).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	used := make(map[uint]int64, len(rows))
+	for _, r := range rows {
+		used[r.KeyID] = r.Count
+	}
+	return used, nil
+}
+
+func (QuotaBackend) AddUsage(day string, delta map[uint]int64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		for key, n := range delta {
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "key_id"}, {Name: "day"}},
+				DoUpdates: clause.Assignments(map[string]any{"count": gorm.Expr("quota_usage.count + ?", n)}),
+			}).Create(&QuotaUsage{KeyID: key, Day: day, Count: n}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
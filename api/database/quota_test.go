@@ -0,0 +1,25 @@
+package database
+
+import "testing"
+
+func TestQuotaBackend(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		var b QuotaBackend
+		for range 2 {
+			if err := b.AddUsage("2024-03-01", map[uint]int64{1: 3, 2: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.AddUsage("2024-03-02", map[uint]int64{1: 5}); err != nil {
+			t.Fatal(err)
+		}
+
+		used, err := b.LoadUsage("2024-03-01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(used) != 2 || used[1] != 6 || used[2] != 2 {
+			t.Fatalf("usage %v, want 1:6 2:2", used)
+		}
+	})
+}
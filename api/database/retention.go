@@ -0,0 +1,354 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RetentionPolicy limits how many stored messages an instance keeps. Zero limits
+// keep messages forever.
+type RetentionPolicy struct {
+	SessionPhone string `gorm:"column:session_phone;primaryKey"`
+	MaxAgeDays   int    `gorm:"column:max_age_days"`
+	MaxPerChat   int    `gorm:"column:max_per_chat"` // Newest messages kept per chat, besides starred ones
+	KeepStarred  bool   `gorm:"column:keep_starred"`
+	UpdatedAt    time.Time
+}
+
+func (RetentionPolicy) TableName() string {
+	return "retention_policies"
+}
+
+// Enabled reports whether the policy purges anything
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAgeDays > 0 || p.MaxPerChat > 0
+}
+
+// PurgeRun reports one pass of a retention policy over an instance
+type PurgeRun struct {
+	ID           uint   `gorm:"primaryKey"`
+	SessionPhone string `gorm:"column:session_phone;index;not null"`
+	Trigger      string `gorm:"not null"` // scheduled, manual or cli
+	MaxAgeDays   int
+	MaxPerChat   int
+	KeepStarred  bool
+	ByAge        int64 // Messages older than the maximum age
+	ByCount      int64 // Messages over the per chat limit
+	Chats        int   // Chats that lost messages
+	Error        string
+	StartedAt    time.Time
+	FinishedAt   *time.Time
+}
+
+func (PurgeRun) TableName() string {
+	return "purge_runs"
+}
+
+// GetRetentionPolicy returns the policy of phone, one keeping everything when none
+// was set
+func GetRetentionPolicy(phone string) (*RetentionPolicy, error) {
+	var p RetentionPolicy
+	err := DB.Where(&RetentionPolicy{SessionPhone: phone}).First(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &RetentionPolicy{SessionPhone: phone, KeepStarred: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func SaveRetentionPolicy(p *RetentionPolicy) error {
+	return DB.Save(p).Error
+}
+
+func DeleteRetentionPolicy(phone string) error {
+	return DB.Where(&RetentionPolicy{SessionPhone: phone}).Delete(&RetentionPolicy{}).Error
+}
+
+// ListRetentionPolicies returns the policies that purge anything
+func ListRetentionPolicies() ([]RetentionPolicy, error) {
+	var list []RetentionPolicy
+	err := DB.Where("max_age_days > 0 OR max_per_chat > 0").Order("session_phone").Find(&list).Error
+	return list, err
+}
+
+func ListPurgeRuns(phone string) ([]PurgeRun, error) {
+	var runs []PurgeRun
+	err := DB.Where(&PurgeRun{SessionPhone: phone}).Order("id DESC").Limit(100).Find(&runs).Error
+	return runs, err
+}
+
+// purger deletes the messages of one instance in short transactions, so the core
+// can keep writing between batches
+type purger struct {
+	policy RetentionPolicy
+	batch  int
+	pause  time.Duration
+	chats  map[string]bool
+}
+
+// candidates selects indexed messages of the instance that the policy may delete.
+// Messages not indexed yet are left for a later run.
+func (p *purger) candidates() *gorm.DB {
+	q := DB.Table("message_index mi").
+		Select("mi.id, mi.session_phone, mi.message_id, mi.chat, mi.sent_at").
+		Where("mi.session_phone = ?", p.policy.SessionPhone)
+	if p.policy.KeepStarred {
+		q = q.Where(`NOT EXISTS (SELECT 1 FROM user_messages u
+			WHERE u.id = mi.message_id AND u.session_phone = mi.session_phone AND ` + jsonBool("u.data", "starred") + ")")
+	}
+	return q
+}
+
+// drain deletes the rows returned by next until it returns none, and the number deleted
+func (p *purger) drain(next func() ([]MessageIndex, error)) (int64, error) {
+	var total int64
+	for {
+		rows, err := next()
+		if err != nil || len(rows) == 0 {
+			return total, err
+		}
+		if err := p.delete(rows); err != nil {
+			return total, err
+		}
+		total += int64(len(rows))
+		if len(rows) < p.batch {
+			return total, nil
+		}
+		time.Sleep(p.pause)
+	}
+}
+
+func (p *purger) delete(rows []MessageIndex) error {
+	phone := p.policy.SessionPhone
+	ids := make([]uint, len(rows))
+	messageIDs := make([]string, len(rows))
+	var hours []int64
+	for i, r := range rows {
+		ids[i] = r.ID
+		messageIDs[i] = r.MessageID
+		if hour := r.SentAt - r.SentAt%3600; !slices.Contains(hours, hour) {
+			hours = append(hours, hour)
+		}
+		p.chats[r.Chat] = true
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_phone = ? AND id IN ?", phone, messageIDs).Delete(&UserMessage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id IN ?", ids).Delete(&MessageIndex{}).Error; err != nil {
+			return err
+		}
+		return refreshRollups(tx, phone, hours)
+	})
+}
+
+func (p *purger) byAge() (int64, error) {
+	cutoff := time.Now().AddDate(0, 0, -p.policy.MaxAgeDays).Unix()
+	return p.drain(func() ([]MessageIndex, error) {
+		var rows []MessageIndex
+		err := p.candidates().Where("mi.sent_at < ?", cutoff).
+			Order("mi.sent_at, mi.id").Limit(p.batch).Scan(&rows).Error
+		return rows, err
+	})
+}
+
+func (p *purger) byCount() (int64, error) {
+	var chats []string
+	err := DB.Model(&MessageIndex{}).
+		Where("session_phone = ?", p.policy.SessionPhone).
+		Group("chat").Having("COUNT(*) > ?", p.policy.MaxPerChat).
+		Pluck("chat", &chats).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, chat := range chats {
+		n, err := p.drain(func() ([]MessageIndex, error) {
+			var rows []MessageIndex
+			err := p.candidates().Where("mi.chat = ?", chat).
+				Order("mi.sent_at DESC, mi.id DESC").Offset(p.policy.MaxPerChat).Limit(p.batch).
+				Scan(&rows).Error
+			return rows, err
+		})
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// PurgeMessages applies policy to its instance, deleting batch messages per
+// transaction and sleeping pause in between, and records the run
+func PurgeMessages(policy RetentionPolicy, trigger string, batch int, pause time.Duration) (*PurgeRun, error) {
+	run := PurgeRun{
+		SessionPhone: policy.SessionPhone,
+		Trigger:      trigger,
+		MaxAgeDays:   policy.MaxAgeDays,
+		MaxPerChat:   policy.MaxPerChat,
+		KeepStarred:  policy.KeepStarred,
+		StartedAt:    time.Now(),
+	}
+	if err := DB.Create(&run).Error; err != nil {
+		return nil, err
+	}
+
+	p := &purger{policy: policy, batch: max(batch, 1), pause: pause, chats: make(map[string]bool)}
+	var err error
+	if policy.MaxAgeDays > 0 {
+		run.ByAge, err = p.byAge()
+	}
+	if err == nil && policy.MaxPerChat > 0 {
+		run.ByCount, err = p.byCount()
+	}
+	if err == nil && len(p.chats) > 0 {
+		// Read positions of chats that no longer have messages
+		chats := make([]string, 0, len(p.chats))
+		for chat := range p.chats {
+			chats = append(chats, chat)
+		}
+		err = DB.Where("session_phone = ? AND chat IN ?", policy.SessionPhone, chats).
+			Where(`NOT EXISTS (SELECT 1 FROM message_index mi
+				WHERE mi.session_phone = chat_reads.session_phone AND mi.chat = chat_reads.chat)`).
+			Delete(&ChatRead{}).Error
+	}
+
+	now := time.Now()
+	run.Chats = len(p.chats)
+	run.FinishedAt = &now
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if dbErr := DB.Model(&run).Select("by_age", "by_count", "chats", "error", "finished_at").Updates(&run).Error; dbErr != nil && err == nil {
+		err = dbErr
+	}
+	return &run, err
+}
+
+type JanitorOptions struct {
+	Interval       time.Duration // Between scheduled runs over every policy
+	Batch          int           // Messages deleted per transaction
+	Pause          time.Duration // Between batches
+	VacuumInterval time.Duration // Between full vacuums, 0 disables them
+	AuditMaxAge    time.Duration // Audit log entries older than this are deleted, 0 keeps them
+}
+
+// RetentionJanitor applies the retention policies on a schedule or on request,
+// expires old audit entries, reclaims the freed pages after purges and vacuums
+// the database periodically
+type RetentionJanitor struct {
+	opts       JanitorOptions
+	lastVacuum time.Time
+
+	queue chan string
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewRetentionJanitor(opts JanitorOptions) *RetentionJanitor {
+	j := &RetentionJanitor{
+		opts:       opts,
+		lastVacuum: time.Now(),
+		queue:      make(chan string, 16),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go j.loop()
+	return j
+}
+
+// Run queues a manual run for phone and reports false when the queue is full
+func (j *RetentionJanitor) Run(phone string) bool {
+	select {
+	case j.queue <- phone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the janitor after the current run
+func (j *RetentionJanitor) Close() {
+	j.once.Do(func() { close(j.stop) })
+	<-j.done
+}
+
+func (j *RetentionJanitor) loop() {
+	defer close(j.done)
+	t := time.NewTicker(j.opts.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			j.scheduled()
+		case phone := <-j.queue:
+			policy, err := GetRetentionPolicy(phone)
+			if err != nil {
+				fmt.Printf("Error loading retention policy of %s: %v\n", phone, err)
+				continue
+			}
+			j.purge([]RetentionPolicy{*policy}, "manual")
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+func (j *RetentionJanitor) scheduled() {
+	policies, err := ListRetentionPolicies()
+	if err != nil {
+		fmt.Printf("Error listing retention policies: %v\n", err)
+		return
+	}
+	j.purge(policies, "scheduled")
+
+	if j.opts.AuditMaxAge > 0 {
+		if _, err := PurgeAudit(time.Now().Add(-j.opts.AuditMaxAge)); err != nil {
+			fmt.Printf("Error purging audit log: %v\n", err)
+		}
+	}
+
+	if j.opts.VacuumInterval > 0 && time.Since(j.lastVacuum) >= j.opts.VacuumInterval {
+		j.lastVacuum = time.Now()
+		if err := Vacuum(); err != nil {
+			fmt.Printf("Error vacuuming database: %v\n", err)
+		}
+	}
+}
+
+func (j *RetentionJanitor) purge(policies []RetentionPolicy, trigger string) {
+	var purged int64
+	for _, policy := range policies {
+		if !policy.Enabled() {
+			continue
+		}
+		run, err := PurgeMessages(policy, trigger, j.opts.Batch, j.opts.Pause)
+		if err != nil {
+			fmt.Printf("Error purging messages of %s: %v\n", policy.SessionPhone, err)
+		}
+		if run != nil {
+			purged += run.ByAge + run.ByCount
+		}
+
+		select {
+		case <-j.stop:
+			return
+		default:
+		}
+	}
+	if purged > 0 {
+		if err := IncrementalVacuum(); err != nil {
+			fmt.Printf("Error reclaiming free pages: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPurgeMessages(t *testing.T) {
+	// Minutes after testEpoch an hour ago, well within any maximum age
+	recent := int(time.Since(testEpoch).Minutes()) - 60
+	msgs := []testMessage{
+		{id: "a1", chat: alice, content: text("old 1"), at: 0},
+		{id: "a2", chat: alice, content: text("old 2"), at: 1},
+		{id: "a3", chat: alice, fromMe: true, content: text("old 3"), at: 2},
+		{id: "a4", chat: alice, content: text("old starred"), at: 3, starred: true},
+		{id: "g1", chat: group, participant: bob, content: text("old group"), at: 4},
+		{id: "b1", chat: bob, content: text("recent 1"), at: recent},
+		{id: "b2", chat: bob, content: text("recent 2"), at: recent + 1},
+		{id: "b3", chat: bob, content: text("recent 3"), at: recent + 2},
+	}
+
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		byAge   int64
+		byCount int64
+		chats   int
+		kept    []string
+		reads   []string // Chats keeping their read position
+	}{
+		{"age and count", RetentionPolicy{MaxAgeDays: 30, MaxPerChat: 2, KeepStarred: true}, 4, 1, 3,
+			[]string{"a4", "b2", "b3"}, []string{alice, bob}},
+		{"starred too", RetentionPolicy{MaxAgeDays: 30, MaxPerChat: 2}, 5, 1, 3,
+			[]string{"b2", "b3"}, []string{bob}},
+		{"age only", RetentionPolicy{MaxAgeDays: 30, KeepStarred: true}, 4, 0, 2,
+			[]string{"a4", "b1", "b2", "b3"}, []string{alice, bob}},
+		{"count only", RetentionPolicy{MaxPerChat: 1}, 0, 5, 2,
+			[]string{"a4", "b3", "g1"}, []string{alice, bob, group}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachDialect(t, func(t *testing.T) {
+				storeMessages(t, testPhone, msgs)
+				storeMessages(t, otherPhone, []testMessage{{id: "x1", chat: alice, content: text("other instance"), at: 0}})
+				if _, err := ReindexMessages(""); err != nil {
+					t.Fatal(err)
+				}
+				for _, chat := range []string{alice, bob, group} {
+					if err := DB.Create(&ChatRead{SessionPhone: testPhone, Chat: chat, ReadAt: testEpoch.Unix()}).Error; err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// Batches of 2 spread each purge over several transactions
+				tt.policy.SessionPhone = testPhone
+				run, err := PurgeMessages(tt.policy, "manual", 2, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if run.ByAge != tt.byAge || run.ByCount != tt.byCount || run.Chats != tt.chats {
+					t.Errorf("purged %d by age and %d by count in %d chats, want %d, %d and %d",
+						run.ByAge, run.ByCount, run.Chats, tt.byAge, tt.byCount, tt.chats)
+				}
+
+				var stored, indexed, reads []string
+				DB.Model(&UserMessage{}).Where("session_phone = ?", testPhone).Order("id").Pluck("id", &stored)
+				DB.Model(&MessageIndex{}).Where("session_phone = ?", testPhone).Order("message_id").Pluck("message_id", &indexed)
+				DB.Model(&ChatRead{}).Where("session_phone = ?", testPhone).Order("chat").Pluck("chat", &reads)
+				if !slices.Equal(stored, tt.kept) || !slices.Equal(indexed, tt.kept) {
+					t.Errorf("kept %v, indexed %v, want %v", stored, indexed, tt.kept)
+				}
+				slices.Sort(tt.reads)
+				if !slices.Equal(reads, tt.reads) {
+					t.Errorf("read positions of %v, want %v", reads, tt.reads)
+				}
+
+				var rolledUp int64
+				DB.Model(&MessageRollup{}).Where("session_phone = ?", testPhone).Select("COALESCE(SUM(messages), 0)").Scan(&rolledUp)
+				if rolledUp != int64(len(tt.kept)) {
+					t.Errorf("rollups count %d messages, want %d", rolledUp, len(tt.kept))
+				}
+				var other int64
+				DB.Model(&UserMessage{}).Where("session_phone = ?", otherPhone).Count(&other)
+				if other != 1 {
+					t.Errorf("other instance has %d messages left, want 1", other)
+				}
+
+				runs, err := ListPurgeRuns(testPhone)
+				if err != nil || len(runs) != 1 {
+					t.Fatalf("ListPurgeRuns = %v, %v", runs, err)
+				}
+				if r := runs[0]; r.FinishedAt == nil || r.Error != "" || r.ByAge != tt.byAge || r.ByCount != tt.byCount || r.Trigger != "manual" {
+					t.Errorf("recorded run %+v", r)
+				}
+			})
+		})
+	}
+}
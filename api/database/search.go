@@ -0,0 +1,345 @@
+package database
+
+import (
+	"api/message"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MessageIndex is the decoded projection of a user_messages row, searched with
+// FTS5 on SQLite and a tsvector column on Postgres
+type MessageIndex struct {
+	ID           uint   `gorm:"primaryKey"`
+	SessionPhone string `gorm:"column:session_phone;uniqueIndex:idx_message_index_message,priority:1;index:idx_message_index_chat_page,priority:1;index:idx_message_index_page,priority:1"`
+	MessageID    string `gorm:"column:message_id;uniqueIndex:idx_message_index_message,priority:2;index:idx_message_index_chat_page,priority:4;index:idx_message_index_page,priority:3"`
+	Chat         string `gorm:"column:chat;index:idx_message_index_chat_page,priority:2"`
+	Sender       string `gorm:"column:sender"`
+	PushName     string `gorm:"column:push_name"`
+	FromMe       bool   `gorm:"column:from_me"`
+	ContentType  string `gorm:"column:content_type"`
+	Text         string `gorm:"column:text"`
+	SentAt       int64  `gorm:"column:sent_at;index:idx_message_index_chat_page,priority:3;index:idx_message_index_page,priority:2"` // Unix seconds, the stored time when the message has none
+	StoredAt     string `gorm:"column:stored_at;index"`                                                                              // user_messages.timestamp
+}
+
+func (MessageIndex) TableName() string {
+	return "message_index"
+}
+
+// messageSearchSchema is the full text part of the message_index migration
+var messageSearchSchema = map[string][]string{
+	"sqlite": {
+		`CREATE VIRTUAL TABLE IF NOT EXISTS message_fts USING fts5(text,
+		content='message_index', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`,
+		`CREATE TRIGGER IF NOT EXISTS message_index_ai AFTER INSERT ON message_index BEGIN
+			INSERT INTO message_fts(rowid, text) VALUES (new.id, new.text);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS message_index_ad AFTER DELETE ON message_index BEGIN
+			INSERT INTO message_fts(message_fts, rowid, text) VALUES ('delete', old.id, old.text);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS message_index_au AFTER UPDATE ON message_index BEGIN
+			INSERT INTO message_fts(message_fts, rowid, text) VALUES ('delete', old.id, old.text);
+			INSERT INTO message_fts(rowid, text) VALUES (new.id, new.text);
+		END`,
+	},
+	"postgres": {
+		`ALTER TABLE message_index ADD COLUMN IF NOT EXISTS tsv tsvector
+		GENERATED ALWAYS AS (to_tsvector('simple', coalesce(text, ''))) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_message_index_tsv ON message_index USING GIN (tsv)`,
+	},
+}
+
+const indexBatch = 500
+
+// indexMessages decodes rows into message_index, skipping rows already indexed,
+// and refreshes the rollups of the hours they fall in
+func indexMessages(tx *gorm.DB, rows []UserMessage) error {
+	entries := make([]MessageIndex, 0, len(rows))
+	for _, row := range rows {
+		e := MessageIndex{SessionPhone: row.SessionPhone, MessageID: row.ID, StoredAt: row.Timestamp}
+		if m, err := message.Decode([]byte(row.Data), message.UserJID(row.SessionPhone)); err == nil {
+			e.Chat = m.Chat
+			e.Sender = m.Sender
+			e.PushName = m.PushName
+			e.FromMe = m.FromMe
+			e.ContentType = m.ContentType
+			e.Text = m.Text
+			if !m.Timestamp.IsZero() {
+				e.SentAt = m.Timestamp.Unix()
+			}
+		}
+		if e.SentAt == 0 {
+			if t, err := time.Parse(time.RFC3339, row.Timestamp); err == nil {
+				e.SentAt = t.Unix()
+			}
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&entries, 100).Error; err != nil {
+		return err
+	}
+	return refreshRollupsFor(tx, entries)
+}
+
+// storedPosition orders messages by the time the core stored them, unlike
+// MessageCursor, so the indexer picks up every message the core inserts
+type storedPosition struct {
+	Timestamp string
+	ID        string
+}
+
+// eachMessageBatch calls fn with the messages stored after the position, oldest
+// first, and returns the position of the last one
+func eachMessageBatch(tx *gorm.DB, phone string, after storedPosition, fn func([]UserMessage) error) (storedPosition, error) {
+	for {
+		q := tx.Model(&UserMessage{}).
+			Where("(timestamp > ? OR (timestamp = ? AND id > ?))", after.Timestamp, after.Timestamp, after.ID).
+			Order("timestamp, id").
+			Limit(indexBatch)
+		if phone != "" {
+			q = q.Where(&UserMessage{SessionPhone: phone})
+		}
+		var rows []UserMessage
+		if err := q.Find(&rows).Error; err != nil {
+			return after, err
+		}
+		if len(rows) == 0 {
+			return after, nil
+		}
+		if err := fn(rows); err != nil {
+			return after, err
+		}
+		last := rows[len(rows)-1]
+		after = storedPosition{Timestamp: last.Timestamp, ID: last.ID}
+		if len(rows) < indexBatch {
+			return after, nil
+		}
+	}
+}
+
+// ReindexMessages rebuilds the search index of phone, or of every instance when
+// phone is empty, and returns the number of messages indexed. Each instance is
+// rebuilt in a transaction, so searches see the old index until it is replaced.
+func ReindexMessages(phone string) (int, error) {
+	phones := []string{phone}
+	if phone == "" {
+		// Instances left in the index without messages are cleared too
+		var indexed []string
+		if err := DB.Model(&UserMessage{}).Distinct().Pluck("session_phone", &phones).Error; err != nil {
+			return 0, err
+		}
+		if err := DB.Model(&MessageIndex{}).Distinct().Pluck("session_phone", &indexed).Error; err != nil {
+			return 0, err
+		}
+		for _, p := range indexed {
+			if !slices.Contains(phones, p) {
+				phones = append(phones, p)
+			}
+		}
+	}
+
+	count := 0
+	for _, p := range phones {
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			for _, model := range []any{&MessageIndex{}, &MessageRollup{}} {
+				if err := tx.Where("session_phone = ?", p).Delete(model).Error; err != nil {
+					return err
+				}
+			}
+			_, err := eachMessageBatch(tx, p, storedPosition{}, func(rows []UserMessage) error {
+				count += len(rows)
+				return indexMessages(tx, rows)
+			})
+			return err
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// indexOverlap is how far back each pass looks again, for messages that were
+// committed late with an earlier timestamp by another core process
+const indexOverlap = 10 * time.Second
+
+// MessageIndexer keeps message_index in sync with the rows the core inserts by
+// polling user_messages. The first pass after start catches up on missed messages.
+type MessageIndexer struct {
+	interval time.Duration
+	last     string // Newest stored timestamp indexed
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewMessageIndexer(interval time.Duration) (*MessageIndexer, error) {
+	var last *string
+	if err := DB.Model(&MessageIndex{}).Select("MAX(stored_at)").Scan(&last).Error; err != nil {
+		return nil, err
+	}
+	ix := &MessageIndexer{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if last != nil {
+		ix.last = *last
+	}
+	go ix.loop()
+	return ix, nil
+}
+
+func (ix *MessageIndexer) loop() {
+	defer close(ix.done)
+	t := time.NewTicker(ix.interval)
+	defer t.Stop()
+	for {
+		if err := ix.pass(); err != nil {
+			fmt.Printf("Error indexing messages: %v\n", err)
+		}
+		select {
+		case <-t.C:
+		case <-ix.stop:
+			return
+		}
+	}
+}
+
+func (ix *MessageIndexer) pass() error {
+	from := ix.last
+	if t, err := time.Parse(time.RFC3339, ix.last); err == nil {
+		from = FormatMessageTime(t.Add(-indexOverlap))
+	}
+
+	// An empty id sorts before every id with the same timestamp
+	end, err := eachMessageBatch(DB, "", storedPosition{Timestamp: from}, func(rows []UserMessage) error {
+		return indexMessages(DB, rows)
+	})
+	if end.Timestamp > ix.last {
+		ix.last = end.Timestamp
+	}
+	return err
+}
+
+// Close stops polling after the current pass
+func (ix *MessageIndexer) Close() {
+	ix.once.Do(func() { close(ix.stop) })
+	<-ix.done
+}
+
+// Snippet markers, replaced by the caller after escaping the text
+const (
+	MarkStart = "\x02"
+	MarkEnd   = "\x03"
+)
+
+type SearchFilter struct {
+	Phone  string
+	Query  string
+	Chat   string
+	Limit  int
+	Offset int
+}
+
+type SearchHit struct {
+	MessageID string  `gorm:"column:message_id"`
+	Snippet   string  `gorm:"column:snippet"` // Matches between MarkStart and MarkEnd
+	Rank      float64 `gorm:"column:rank"`    // Higher is more relevant
+}
+
+var ErrEmptyQuery = errors.New("search query has no terms")
+
+// SearchMessages runs a full text query, best matches first. Queries use web search
+// syntax: "quoted phrases", -excluded terms and prefix* terms on SQLite.
+func SearchMessages(f SearchFilter) ([]SearchHit, error) {
+	var hits []SearchHit
+
+	if IsSQLite() {
+		match, err := ftsQuery(f.Query)
+		if err != nil {
+			return nil, err
+		}
+		q := DB.Table("message_fts").
+			Select("mi.message_id, snippet(message_fts, 0, ?, ?, '…', 16) AS snippet, -bm25(message_fts) AS rank", MarkStart, MarkEnd).
+			Joins("JOIN message_index mi ON mi.id = message_fts.rowid").
+			Where("message_fts MATCH ? AND mi.session_phone = ?", match, f.Phone)
+		if f.Chat != "" {
+			q = q.Where("mi.chat = ?", f.Chat)
+		}
+		err = q.Order("rank DESC").Limit(f.Limit).Offset(f.Offset).Scan(&hits).Error
+		return hits, err
+	}
+
+	if strings.TrimSpace(f.Query) == "" {
+		return nil, ErrEmptyQuery
+	}
+	opts := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxFragments=2, MaxWords=16, MinWords=4", MarkStart, MarkEnd)
+	q := DB.Table("message_index, websearch_to_tsquery('simple', ?) query", f.Query).
+		Select("message_id, ts_headline('simple', text, query, ?) AS snippet, ts_rank(tsv, query) AS rank", opts).
+		Where("tsv @@ query AND session_phone = ?", f.Phone)
+	if f.Chat != "" {
+		q = q.Where("chat = ?", f.Chat)
+	}
+	err := q.Order("rank DESC, sent_at DESC").Limit(f.Limit).Offset(f.Offset).Scan(&hits).Error
+	return hits, err
+}
+
+// ftsQuery turns web search syntax into an FTS5 expression with every term quoted,
+// so user input can't produce FTS5 syntax errors
+func ftsQuery(s string) (string, error) {
+	var include, exclude []string
+	add := func(term string, negate, prefix bool) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return
+		}
+		quoted := `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			quoted += "*"
+		}
+		if negate {
+			exclude = append(exclude, quoted)
+		} else {
+			include = append(include, quoted)
+		}
+	}
+
+	s = strings.Join(strings.Fields(s), " ")
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		negate := false
+		if len(s) > 1 && s[0] == '-' {
+			negate = true
+			s = s[1:]
+		}
+		if s[0] == '"' {
+			phrase, rest, _ := strings.Cut(s[1:], `"`)
+			add(phrase, negate, false)
+			s = rest
+			continue
+		}
+		word, rest, _ := strings.Cut(s, " ")
+		word, prefix := strings.CutSuffix(word, "*")
+		add(word, negate, prefix)
+		s = rest
+	}
+
+	if len(include) == 0 {
+		return "", ErrEmptyQuery
+	}
+	q := strings.Join(include, " ")
+	for _, term := range exclude {
+		q += " NOT " + term
+	}
+	return q, nil
+}
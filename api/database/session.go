@@ -1,20 +1,227 @@
 package database
 
 import (
-	"gorm.io/gorm"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Session struct {
-	ID          int64  `gorm:"primaryKey;autoIncrement:false"`
-	Phone       string `gorm:"uniqueIndex;not null"`
-	Status      string `gorm:"default:'starting'"` // active, paused, logged_out
-	PairingCode string
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
-	DeletedAt   gorm.DeletedAt `gorm:"index"`
+	ID              int64  `gorm:"primaryKey"`
+	Phone           string `gorm:"uniqueIndex;not null"`
+	TenantID        string `gorm:"index;not null;default:'default'"`
+	Status          string `gorm:"default:'starting'"` // active, paused, logged_out
+	PairingCode     string
+	DisplayName     string
+	Notes           string `gorm:"type:text"`
+	Labels          Labels `gorm:"type:text"`
+	StartupPriority int    `gorm:"default:0"` // Higher values start first on boot
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	DeletedAt       gorm.DeletedAt `gorm:"index"`
+}
+
+// Labels are free-form key=value pairs attached to a session, stored as JSON
+type Labels map[string]string
+
+func (l Labels) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (l *Labels) Scan(value any) error {
+	var raw []byte
+	switch v := value.(type) {
+	case nil:
+		*l = Labels{}
+		return nil
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	default:
+		return fmt.Errorf("unsupported labels type %T", value)
+	}
+
+	if len(raw) == 0 {
+		*l = Labels{}
+		return nil
+	}
+	return json.Unmarshal(raw, l)
+}
+
+// ParseLabelSelector parses "env=prod,team=ops" into a label set
+func ParseLabelSelector(s string) (Labels, error) {
+	labels := Labels{}
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label selector %q", part)
+		}
+		labels[key] = strings.TrimSpace(val)
+	}
+	return labels, nil
+}
+
+// ValidateLabels rejects empty or oversized keys and values
+func ValidateLabels(labels Labels) error {
+	for k, v := range labels {
+		if k == "" || len(k) > 63 || strings.ContainsAny(k, "=, ") {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if len(v) > 255 || strings.Contains(v, ",") {
+			return fmt.Errorf("invalid label value for %q", k)
+		}
+	}
+	return nil
+}
+
+type SessionFilter struct {
+	TenantID string   // Empty matches every tenant
+	Phones   []string // Empty matches every phone
+	Status   string
+	Labels   Labels
+}
+
+// ListSessions returns sessions matching the phone, status and label filter
+func ListSessions(filter SessionFilter) ([]Session, error) {
+	var sessions []Session
+
+	query := DB.Order("phone")
+	if filter.TenantID != "" {
+		query = query.Where("tenant_id = ?", filter.TenantID)
+	}
+	if len(filter.Phones) > 0 {
+		query = query.Where("phone IN ?", filter.Phones)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	for k, v := range filter.Labels {
+		query = query.Where(labelCondition(), k, v)
+	}
+	if err := query.Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// labelCondition matches sessions whose labels JSON has a key with a value, both
+// passed as arguments. Rows written before labels existed may hold an empty string.
+func labelCondition() string {
+	if IsSQLite() {
+		return `EXISTS (SELECT 1 FROM json_each(CASE WHEN json_valid(sessions.labels) THEN sessions.labels ELSE '{}' END)
+			WHERE json_each.key = ? AND json_each.value = ?)`
+	}
+	return "(NULLIF(sessions.labels, '')::jsonb ->> ?) = ?"
+}
+
+func GetSession(phone string) (*Session, error) {
+	var session Session
+	if err := DB.Where("phone = ?", phone).First(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// SessionTenants returns the tenant of each of phones that has a session
+func SessionTenants(phones []string) (map[string]string, error) {
+	var rows []Session
+	if err := DB.Select("phone", "tenant_id").Where("phone IN ?", phones).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	tenants := make(map[string]string, len(rows))
+	for _, s := range rows {
+		tenants[s.Phone] = s.TenantID
+	}
+	return tenants, nil
 }
 
-func ClearSession(db *gorm.DB, phone string) error {
-	return db.Where("phone = ?", phone).Delete(&Session{}).Error
+// ClaimSession creates the session for phone owned by tenant if it does not exist yet.
+// Sessions soft deleted by older builds still hold the phone's unique index, they are
+// purged with their data first.
+func ClaimSession(phone, tenant string) (*Session, error) {
+	var deleted int64
+	err := DB.Unscoped().Model(&Session{}).Where("phone = ? AND deleted_at IS NOT NULL", phone).Count(&deleted).Error
+	if err != nil {
+		return nil, err
+	}
+	if deleted > 0 {
+		if err := PurgeSessionData(phone); err != nil {
+			return nil, err
+		}
+	}
+
+	var session Session
+	err = DB.Where(Session{Phone: phone}).
+		Attrs(Session{TenantID: tenant, Status: "starting"}).
+		FirstOrCreate(&session).Error
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// UpdateSessionMeta updates display name, notes, labels and startup priority of a session
+func UpdateSessionMeta(phone string, updates map[string]any) error {
+	res := DB.Model(&Session{}).Where("phone = ?", phone).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// likeEscaper escapes the LIKE wildcards of a value, with \ as the escape character
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// PurgeSessionData deletes everything stored for phone: the session itself, unscoped
+// so the phone can be paired again, possibly by another tenant, its settings and the
+// tables written by the core. Identifiers are quoted by the dialect.
+func PurgeSessionData(phone string) error {
+	byPhone := func(column string) clause.Expression {
+		return clause.Eq{Column: clause.Column{Name: column}, Value: phone}
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where(byPhone("phone")).Delete(&Session{}).Error; err != nil {
+			return fmt.Errorf("sessions: %w", err)
+		}
+		if err := tx.Where(byPhone("user")).Delete(&UserSettings{}).Error; err != nil {
+			return fmt.Errorf("user_settings: %w", err)
+		}
+		if err := tx.Where(byPhone("phone")).Delete(&APIKey{}).Error; err != nil {
+			return fmt.Errorf("api_keys: %w", err)
+		}
+		for _, table := range []string{"user_contacts", "user_messages", "message_index", "message_rollups", "chat_reads", "group_metadata", "retention_policies", "purge_runs"} {
+			if err := tx.Table(table).Where(byPhone("session_phone")).Delete(map[string]any{}).Error; err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+		}
+
+		// Auth keys are stored as session:{phone}:*, legacy phones may hold LIKE wildcards
+		prefix := fmt.Sprintf("session:%s:%%", likeEscaper.Replace(phone))
+		if err := tx.Table("auth_data").Where(`id LIKE ? ESCAPE '\'`, prefix).Delete(map[string]any{}).Error; err != nil {
+			return fmt.Errorf("auth_data: %w", err)
+		}
+		return nil
+	})
 }
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListSessionsFiltersLabels(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		for _, s := range []Session{
+			{Phone: "2348000000001", TenantID: DefaultTenant, Status: "active", Labels: Labels{"env": "prod", "team": "ops"}},
+			{Phone: "2348000000002", TenantID: DefaultTenant, Status: "active", Labels: Labels{"env": "dev"}},
+			{Phone: "2348000000003", TenantID: DefaultTenant, Status: "paused", Labels: Labels{"env": "prod"}},
+			{Phone: "2348000000004", TenantID: DefaultTenant, Status: "active"},
+		} {
+			if err := DB.Create(&s).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Rows from before labels existed
+		if err := DB.Exec("UPDATE sessions SET labels = '' WHERE phone = ?", "2348000000004").Error; err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name   string
+			filter SessionFilter
+			want   []string
+		}{
+			{"all", SessionFilter{}, []string{"2348000000001", "2348000000002", "2348000000003", "2348000000004"}},
+			{"one label", SessionFilter{Labels: Labels{"env": "prod"}}, []string{"2348000000001", "2348000000003"}},
+			{"two labels", SessionFilter{Labels: Labels{"env": "prod", "team": "ops"}}, []string{"2348000000001"}},
+			{"label and status", SessionFilter{Status: "paused", Labels: Labels{"env": "prod"}}, []string{"2348000000003"}},
+			{"missing key", SessionFilter{Labels: Labels{"region": "eu"}}, nil},
+			{"quoted key", SessionFilter{Labels: Labels{`env"`: "prod"}}, nil},
+			{"other tenant", SessionFilter{TenantID: "acme"}, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				sessions, err := ListSessions(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, s := range sessions {
+					got = append(got, s.Phone)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestClaimSessionSoftDeleted(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		if _, err := ClaimSession(testPhone, DefaultTenant); err != nil {
+			t.Fatal(err)
+		}
+		storeMessages(t, testPhone, conversation[:1])
+		// Older builds soft deleted sessions and kept their data
+		if err := DB.Where("phone = ?", testPhone).Delete(&Session{}).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := ClaimSession(testPhone, "acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.TenantID != "acme" || s.Status != "starting" {
+			t.Fatalf("claimed session in %q with status %q", s.TenantID, s.Status)
+		}
+		var left int64
+		DB.Model(&UserMessage{}).Where("session_phone = ?", testPhone).Count(&left)
+		if left != 0 {
+			t.Fatalf("%d messages of the deleted session were handed to the new tenant", left)
+		}
+
+		// Claiming a live session keeps its owner
+		if s, err := ClaimSession(testPhone, DefaultTenant); err != nil || s.TenantID != "acme" {
+			t.Fatalf("second claim = %+v, %v", s, err)
+		}
+	})
+}
+
+func TestSessionIDMigration(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		// The sessions table as created before ids were generated, holding the
+		// one session the old definition allowed
+		old := "CREATE TABLE sessions (id integer, phone text NOT NULL, tenant_id text NOT NULL DEFAULT 'default', status text DEFAULT 'starting', pairing_code text, display_name text, notes text, labels text, startup_priority integer DEFAULT 0, created_at datetime, updated_at datetime, deleted_at datetime, PRIMARY KEY (id))"
+		if !IsSQLite() {
+			old = strings.ReplaceAll(old, "datetime", "timestamptz")
+			old = strings.Replace(old, "id integer", "id bigint", 1)
+		}
+		stmts := []string{
+			"DROP TABLE sessions",
+			old,
+			"CREATE UNIQUE INDEX idx_sessions_phone ON sessions(phone)",
+			"CREATE INDEX idx_sessions_tenant_id ON sessions(tenant_id)",
+			"CREATE INDEX idx_sessions_deleted_at ON sessions(deleted_at)",
+			"INSERT INTO sessions (id, phone, status) VALUES (0, '2348000000001', 'connected')",
+		}
+		for _, stmt := range stmts {
+			if err := DB.Exec(stmt).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := findMigration(10).Up(DB); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{"2348000000002", "2348000000003"} {
+			if _, err := ClaimSession(p, DefaultTenant); err != nil {
+				t.Fatalf("claim %s: %v", p, err)
+			}
+		}
+		s, err := GetSession("2348000000001")
+		if err != nil || s.Status != "connected" {
+			t.Fatalf("existing session = %+v, %v", s, err)
+		}
+		checkSchema(t)
+	})
+}
@@ -25,6 +25,15 @@ type UserSettings struct {
 	DisabledCommands string `gorm:"type:text"`
 }
 
+// SettingKeys are the settings that may be changed through the API
+var SettingKeys = map[string]bool{
+	"language": true, "prefix": true, "mode": true, "afk": true,
+	"bgm": true, "alive_msg": true, "filters": true, "antimsg": true,
+	"antiword": true, "antilink": true, "anticall": true, "antidelete": true,
+	"antilink_spam": true, "welcome_msg": true, "goodbye_msg": true,
+	"group_events": true, "autokick": true,
+}
+
 func GetUserSettings(phone string) (*UserSettings, error) {
 	var settings UserSettings
 
@@ -37,12 +46,25 @@ func GetUserSettings(phone string) (*UserSettings, error) {
 	return &settings, nil
 }
 
-// UpdateUserSetting updates a specific field for a user
+// GetUserSetting returns the current value of a single setting column
+func GetUserSetting(phone string, column string) (any, error) {
+	row := map[string]any{}
+	err := DB.Model(&UserSettings{}).Select(column).Where(&UserSettings{User: phone}).Take(&row).Error
+	if err != nil {
+		return nil, err
+	}
+	return row[column], nil
+}
+
+// UpdateUserSetting updates a specific field for a user, creating their settings if needed
 func UpdateUserSetting(phone string, column string, value any) error {
-	return DB.Model(&UserSettings{}).Where("user = ?", phone).Update(column, value).Error
+	if _, err := GetUserSettings(phone); err != nil {
+		return err
+	}
+	return DB.Model(&UserSettings{}).Where(&UserSettings{User: phone}).Update(column, value).Error
 }
 
 // UpdateFullSettings updates multiple fields at once
 func UpdateFullSettings(phone string, updates map[string]any) error {
-	return DB.Model(&UserSettings{}).Where("user = ?", phone).Updates(updates).Error
+	return DB.Model(&UserSettings{}).Where(&UserSettings{User: phone}).Updates(updates).Error
 }
@@ -0,0 +1,47 @@
+package database
+
+import "time"
+
+// DefaultTenant owns sessions and keys created before tenants existed
+const DefaultTenant = "default"
+
+type Tenant struct {
+	ID        string    `gorm:"primaryKey" json:"id"` // Short slug used in keys and sessions
+	Name      string    `gorm:"not null" json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func ListTenants() ([]Tenant, error) {
+	var tenants []Tenant
+	err := DB.Order("id").Find(&tenants).Error
+	return tenants, err
+}
+
+func GetTenant(id string) (*Tenant, error) {
+	var t Tenant
+	if err := DB.Where("id = ?", id).First(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func CreateTenant(t *Tenant) error {
+	return DB.Create(t).Error
+}
+
+// ensureDefaultTenant creates the default tenant and assigns it to rows without one
+func ensureDefaultTenant() error {
+	err := DB.Where(Tenant{ID: DefaultTenant}).
+		Attrs(Tenant{Name: "Default"}).
+		FirstOrCreate(&Tenant{}).Error
+	if err != nil {
+		return err
+	}
+
+	if err := DB.Model(&Session{}).Where("tenant_id IS NULL OR tenant_id = ''").
+		Update("tenant_id", DefaultTenant).Error; err != nil {
+		return err
+	}
+	return DB.Model(&APIKey{}).Where("tenant_id IS NULL OR tenant_id = ''").
+		Update("tenant_id", DefaultTenant).Error
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// User is a dashboard account logging in with a password and optional TOTP
+type User struct {
+	ID           uint    `gorm:"primaryKey"`
+	Username     string  `gorm:"uniqueIndex;not null"`
+	PasswordHash string  `gorm:"not null"`
+	Role         string  `gorm:"not null;default:'viewer'"` // viewer, operator, admin
+	TenantID     string  `gorm:"index;not null;default:'default'"`
+	TOTPSecret   string  // Set during setup, only enforced once TOTPEnabled
+	TOTPEnabled  bool    `gorm:"default:false"`
+	TOTPLastStep int64   `gorm:"column:totp_last_step;not null;default:0"` // Time step of the last accepted code
+	Disabled     bool    `gorm:"default:false"`
+	OIDCIssuer   *string `gorm:"column:oidc_issuer;uniqueIndex:idx_users_oidc"`  // Set with OIDCSubject
+	OIDCSubject  *string `gorm:"column:oidc_subject;uniqueIndex:idx_users_oidc"` // Set for single sign-on users
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	LastLoginAt  *time.Time
+}
+
+// UserSession is a cookie login, the cookie holds a token whose hash is the ID
+type UserSession struct {
+	ID        string `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	IP        string
+	UserAgent string
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func CreateUser(u *User) error {
+	return DB.Create(u).Error
+}
+
+func GetUser(id uint) (*User, error) {
+	var u User
+	if err := DB.First(&u, id).Error; err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func GetUserByOIDCSubject(issuer, sub string) (*User, error) {
+	var u User
+	if err := DB.Where("oidc_issuer = ? AND oidc_subject = ?", issuer, sub).First(&u).Error; err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// AdoptOIDCUsers assigns issuer to single sign-on users created before issuers were
+// recorded, they all came from the provider configured at the time
+func AdoptOIDCUsers(issuer string) (int64, error) {
+	res := DB.Model(&User{}).Where("oidc_subject IS NOT NULL AND oidc_issuer IS NULL").Update("oidc_issuer", issuer)
+	return res.RowsAffected, res.Error
+}
+
+func GetUserByUsername(username string) (*User, error) {
+	var u User
+	if err := DB.Where("username = ?", username).First(&u).Error; err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListUsers returns the users of tenant, or of every tenant when tenant is empty
+func ListUsers(tenant string) ([]User, error) {
+	var users []User
+	query := DB.Order("username")
+	if tenant != "" {
+		query = query.Where("tenant_id = ?", tenant)
+	}
+	err := query.Find(&users).Error
+	return users, err
+}
+
+func UpdateUser(id uint, updates map[string]any) error {
+	res := DB.Model(&User{}).Where("id = ?", id).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// UseTOTPStep records step as the last accepted TOTP code of the user and reports
+// false when that or a later step was accepted before, so each code works once
+func UseTOTPStep(id uint, step int64) (bool, error) {
+	res := DB.Model(&User{}).Where("id = ? AND totp_last_step < ?", id, step).Update("totp_last_step", step)
+	return res.RowsAffected == 1, res.Error
+}
+
+// DeleteUser removes the user and all of their sessions
+func DeleteUser(id uint) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", id).Delete(&UserSession{}).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&User{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+func CreateUserSession(s *UserSession) error {
+	return DB.Create(s).Error
+}
+
+// FindUserSession returns the unexpired session with the given token hash
+func FindUserSession(id string) (*UserSession, error) {
+	var s UserSession
+	err := DB.Where("id = ? AND expires_at > ?", id, time.Now()).First(&s).Error
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func DeleteUserSession(id string) error {
+	return DB.Where("id = ?", id).Delete(&UserSession{}).Error
+}
+
+// DeleteUserSessions logs the user out everywhere, used after password changes
+func DeleteUserSessions(userID uint) error {
+	return DB.Where("user_id = ?", userID).Delete(&UserSession{}).Error
+}
+
+func PurgeExpiredUserSessions() error {
+	return DB.Where("expires_at <= ?", time.Now()).Delete(&UserSession{}).Error
+}
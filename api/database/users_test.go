@@ -0,0 +1,30 @@
+package database
+
+import "testing"
+
+func TestAdoptOIDCUsers(t *testing.T) {
+	forEachDialect(t, func(t *testing.T) {
+		sub := "00u1alice"
+		legacy := User{Username: "alice", PasswordHash: "!", OIDCSubject: &sub}
+		local := User{Username: "bob", PasswordHash: "!"}
+		for _, u := range []*User{&legacy, &local} {
+			if err := CreateUser(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n, err := AdoptOIDCUsers("https://idp.example")
+		if err != nil || n != 1 {
+			t.Fatalf("AdoptOIDCUsers = %d, %v, want 1", n, err)
+		}
+		if u, err := GetUserByOIDCSubject("https://idp.example", sub); err != nil || u.ID != legacy.ID {
+			t.Fatalf("legacy user not found under the issuer: %v", err)
+		}
+		if _, err := GetUserByOIDCSubject("https://other.example", sub); err == nil {
+			t.Fatal("subject found under another issuer")
+		}
+		if u, _ := GetUser(local.ID); u.OIDCIssuer != nil {
+			t.Fatalf("local user got issuer %q", *u.OIDCIssuer)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+// Package export writes stored messages as JSON Lines, CSV or a self-contained
+// HTML transcript, either streamed to a request or as a background job.
+package export
+
+import (
+	"api/database"
+	"api/message"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var formats = map[string]struct {
+	contentType string
+	ext         string
+}{
+	"jsonl": {"application/x-ndjson", "jsonl"},
+	"csv":   {"text/csv; charset=utf-8", "csv"},
+	"html":  {"text/html; charset=utf-8", "html"},
+}
+
+func ValidFormat(format string) bool {
+	_, ok := formats[format]
+	return ok
+}
+
+func ContentType(format string) string {
+	return formats[format].contentType
+}
+
+// FileName suggests a download name for an export of phone, optionally of one chat
+func FileName(phone, chat, format string) string {
+	name := "messages-" + phone
+	if chat != "" {
+		user, _, _ := strings.Cut(chat, "@")
+		name += "-" + user
+	}
+	return name + "." + formats[format].ext
+}
+
+type Options struct {
+	Phone  string
+	Chat   string // Empty for every chat
+	Format string
+	From   time.Time
+	To     time.Time
+}
+
+// Record is one exported message
+type Record struct {
+	ID          string          `json:"id"`
+	Chat        string          `json:"chat"`
+	ChatName    string          `json:"chat_name,omitempty"`
+	Sender      string          `json:"sender"`
+	SenderName  string          `json:"sender_name,omitempty"`
+	SenderPhone string          `json:"sender_phone,omitempty"`
+	FromMe      bool            `json:"from_me"`
+	Timestamp   time.Time       `json:"timestamp"`
+	Type        string          `json:"type"`
+	Text        string          `json:"text"`
+	Media       *message.Media  `json:"media,omitempty"`
+	Quoted      *message.Quoted `json:"quoted,omitempty"`
+}
+
+type writer interface {
+	begin(opts Options, title string) error
+	write(r Record) error
+	end() error
+}
+
+// Write exports the messages selected by opts to w, oldest first, and returns how
+// many were written
+func Write(w io.Writer, opts Options) (int, error) {
+	var out writer
+	switch opts.Format {
+	case "jsonl":
+		out = &jsonlWriter{enc: json.NewEncoder(w)}
+	case "csv":
+		out = &csvWriter{w: csv.NewWriter(w)}
+	case "html":
+		out = &htmlWriter{w: w}
+	default:
+		return 0, fmt.Errorf("unknown export format %q", opts.Format)
+	}
+
+	names := newNames(opts.Phone)
+	title := "+" + opts.Phone
+	if opts.Chat != "" {
+		if title = names.chat(opts.Chat); title == "" {
+			title = opts.Chat
+		}
+	}
+	if err := out.begin(opts, title); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	f := database.MessageFilter{
+		Phone:  opts.Phone,
+		Chat:   opts.Chat,
+		From:   opts.From,
+		To:     opts.To,
+		Oldest: true,
+	}
+	err := database.EachMessage(f, func(row database.UserMessage) error {
+		m, err := message.Decode([]byte(row.Data), message.UserJID(opts.Phone))
+		if err != nil {
+			return nil // Skip documents the core wrote in a shape we can't read
+		}
+		if m.ContentType == "protocolMessage" || m.ContentType == "" {
+			return nil
+		}
+
+		r := Record{
+			ID:       row.ID,
+			Chat:     m.Chat,
+			ChatName: names.chat(m.Chat),
+			Sender:   m.Sender,
+			FromMe:   m.FromMe,
+			Type:     m.ContentType,
+			Text:     m.Text,
+			Media:    m.Media,
+			Quoted:   m.Quoted,
+		}
+		r.Timestamp = m.Timestamp
+		if r.Timestamp.IsZero() {
+			r.Timestamp, _ = time.Parse(time.RFC3339, row.Timestamp)
+		}
+		names.observe(m)
+		r.SenderName, r.SenderPhone = names.sender(m.Sender, m.FromMe)
+
+		count++
+		return out.write(r)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, out.end()
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonlWriter) begin(Options, string) error { return nil }
+func (j *jsonlWriter) write(r Record) error        { return j.enc.Encode(r) }
+func (j *jsonlWriter) end() error                  { return nil }
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) begin(Options, string) error {
+	return c.w.Write([]string{
+		"timestamp", "chat", "chat_name", "sender", "sender_name", "sender_phone",
+		"from_me", "type", "text", "id",
+	})
+}
+
+func (c *csvWriter) write(r Record) error {
+	return c.w.Write([]string{
+		r.Timestamp.UTC().Format(time.RFC3339), r.Chat, r.ChatName, r.Sender, r.SenderName,
+		r.SenderPhone, strconv.FormatBool(r.FromMe), r.Type, r.Text, r.ID,
+	})
+}
+
+func (c *csvWriter) end() error {
+	c.w.Flush()
+	return c.w.Error()
+}
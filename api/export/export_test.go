@@ -0,0 +1,259 @@
+package export
+
+import (
+	"api/database"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testPhone = "2348012345678"
+	alice     = "2348011111111@s.whatsapp.net"
+	bob       = "2348022222222@s.whatsapp.net"
+	carol     = "99999999999999@lid"
+	carolPN   = "2348033333333@s.whatsapp.net"
+	family    = "120363000000000001@g.us"
+)
+
+var testEpoch = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// openTestDB points database.DB at a fresh SQLite database holding a direct
+// chat with alice, a group with carol, known by her LID only, and a later
+// message from bob
+func openTestDB(t *testing.T) {
+	t.Helper()
+	database.InitDB(database.Options{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "test.sqlite")})
+	t.Cleanup(func() {
+		if db, err := database.DB.DB(); err == nil {
+			db.Close()
+		}
+	})
+
+	store := func(phone, id string, minutes int, doc string) {
+		t.Helper()
+		at := testEpoch.Add(time.Duration(minutes) * time.Minute)
+		data := strings.ReplaceAll(doc, "$TS", fmt.Sprint(at.Unix()))
+		row := database.UserMessage{ID: id, SessionPhone: phone, Data: data, Timestamp: database.FormatMessageTime(at)}
+		if err := database.DB.Create(&row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	store(testPhone, "e1", 0, `{"key":{"remoteJid":"`+alice+`","fromMe":false,"id":"e1"},"messageTimestamp":$TS,"pushName":"Alice","message":{"conversation":"Hello"}}`)
+	store(testPhone, "e2", 1, `{"key":{"remoteJid":"`+alice+`","fromMe":true,"id":"e2"},"messageTimestamp":"$TS","message":{"extendedTextMessage":{"text":"Hi <b>Alice</b>"}}}`)
+	store(testPhone, "e3", 2, `{"key":{"remoteJid":"`+alice+`","fromMe":true,"id":"e3"},"messageTimestamp":$TS,"message":{"protocolMessage":{"type":"REVOKE","key":{"id":"e2"}}}}`)
+	store(testPhone, "e4", 3, `{"key":{"remoteJid":"`+family+`","fromMe":false,"id":"e4","participant":"`+carol+`"},"messageTimestamp":{"low":$TS,"high":0,"unsigned":true},"pushName":"Carol","message":{"imageMessage":{"caption":"Group photo","mimetype":"image/jpeg","fileLength":"2048","contextInfo":{"stanzaId":"e1","participant":"`+alice+`","quotedMessage":{"conversation":"Hello"}}}}}`)
+	store(testPhone, "e5", 24*60, `{"key":{"remoteJid":"`+bob+`","fromMe":false,"id":"e5"},"messageTimestamp":$TS,"pushName":"Bob","message":{"conversation":"Next day"}}`)
+	store("2348087654321", "x1", 0, `{"key":{"remoteJid":"`+alice+`","fromMe":false,"id":"x1"},"messageTimestamp":$TS,"message":{"conversation":"Other instance"}}`)
+
+	rows := []any{
+		&database.UserContact{SessionPhone: testPhone, PN: carolPN, LID: carol},
+		&database.GroupMetadata{ID: family, SessionID: testPhone, MetaData: `{"subject":"Family"}`},
+	}
+	for _, row := range rows {
+		if err := database.DB.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.ReindexMessages(testPhone); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readJSONL(t *testing.T, data []byte) []Record {
+	t.Helper()
+	var out []Record
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func TestWriteJSONL(t *testing.T) {
+	openTestDB(t)
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"instance", Options{}, []string{"e1", "e2", "e4", "e5"}},
+		{"chat", Options{Chat: alice}, []string{"e1", "e2"}},
+		{"time range", Options{From: testEpoch.Add(time.Minute), To: testEpoch.Add(time.Hour)}, []string{"e2", "e4"}},
+		{"empty range", Options{From: testEpoch.Add(-time.Hour), To: testEpoch}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.opts.Phone, tt.opts.Format = testPhone, "jsonl"
+			n, err := Write(&buf, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range readJSONL(t, buf.Bytes()) {
+				got = append(got, r.ID)
+			}
+			if n != len(tt.want) || !slices.Equal(got, tt.want) {
+				t.Fatalf("wrote %d: %v, want %v", n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteRecords(t *testing.T) {
+	openTestDB(t)
+	var buf bytes.Buffer
+	if _, err := Write(&buf, Options{Phone: testPhone, Format: "jsonl"}); err != nil {
+		t.Fatal(err)
+	}
+	records := make(map[string]Record)
+	for _, r := range readJSONL(t, buf.Bytes()) {
+		records[r.ID] = r
+	}
+
+	if r := records["e1"]; r.ChatName != "Alice" || r.SenderName != "Alice" || r.SenderPhone != "2348011111111" ||
+		r.FromMe || r.Type != "conversation" || r.Text != "Hello" || !r.Timestamp.Equal(testEpoch) {
+		t.Errorf("incoming message %+v", r)
+	}
+	if r := records["e2"]; r.SenderName != "Me" || r.SenderPhone != testPhone || !r.FromMe || r.Text != "Hi <b>Alice</b>" {
+		t.Errorf("own message %+v", r)
+	}
+	r := records["e4"]
+	if r.ChatName != "Family" || r.Sender != carol || r.SenderName != "Carol" || r.SenderPhone != "2348033333333" {
+		t.Errorf("group message from %q %q +%q in %q", r.Sender, r.SenderName, r.SenderPhone, r.ChatName)
+	}
+	if r.Media == nil || r.Media.Kind != "image" || r.Media.FileLength != 2048 {
+		t.Errorf("media %+v", r.Media)
+	}
+	if r.Quoted == nil || r.Quoted.ID != "e1" || r.Quoted.Text != "Hello" {
+		t.Errorf("quoted %+v", r.Quoted)
+	}
+	if _, ok := records["e3"]; ok {
+		t.Error("protocol message exported")
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	openTestDB(t)
+	var buf bytes.Buffer
+	if _, err := Write(&buf, Options{Phone: testPhone, Chat: family, Format: "csv"}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"timestamp", "chat", "chat_name", "sender", "sender_name", "sender_phone", "from_me", "type", "text", "id"},
+		{"2024-03-01T12:03:00Z", family, "Family", carol, "Carol", "2348033333333", "false", "imageMessage", "Group photo", "e4"},
+	}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Fatalf("got %q, want %q", rows, want)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	openTestDB(t)
+	var buf bytes.Buffer
+	if _, err := Write(&buf, Options{Phone: testPhone, Chat: alice, Format: "html"}); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	for _, want := range []string{
+		"<title>Alice</title>",
+		"Friday, 1 March 2024",
+		`<div class="text">Hello</div>`,
+		`<div class="msg me">`,
+		"Hi &lt;b&gt;Alice&lt;/b&gt;",
+		"</html>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("transcript lacks %q", want)
+		}
+	}
+
+	buf.Reset()
+	if _, err := Write(&buf, Options{Phone: testPhone, Format: "html", To: testEpoch}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "No messages") {
+		t.Error("empty transcript doesn't say so")
+	}
+}
+
+func TestRunner(t *testing.T) {
+	openTestDB(t)
+	r, err := NewRunner(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	job := database.ExportJob{TenantID: database.DefaultTenant, Phone: testPhone, Chat: alice, Format: "jsonl", Status: database.ExportPending}
+	if err := database.CreateExportJob(&job); err != nil {
+		t.Fatal(err)
+	}
+	r.Notify()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		done, err := database.GetExportJob(job.ID, testPhone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done.Status == database.ExportDone || done.Status == database.ExportFailed {
+			job = *done
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", done.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if job.Status != database.ExportDone || job.Messages != 2 || job.Error != "" {
+		t.Fatalf("job finished %+v", job)
+	}
+	data, err := os.ReadFile(r.Path(&job))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != job.Size || len(readJSONL(t, data)) != 2 {
+		t.Fatalf("file of %d bytes, job says %d", len(data), job.Size)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(r.dir, ".export-*")); len(tmp) != 0 {
+		t.Fatalf("temporary files left: %v", tmp)
+	}
+
+	// Past the retention the file and the job go away
+	err = database.DB.Model(&job).Update("created_at", time.Now().Add(-2*time.Hour)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Notify()
+	for {
+		_, statErr := os.Stat(r.Path(&job))
+		_, err := database.GetExportJob(job.ID, testPhone)
+		if os.IsNotExist(statErr) && err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired export was kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,95 @@
+package export
+
+import (
+	"html/template"
+	"io"
+	"time"
+)
+
+var transcript = template.Must(template.New("begin").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #efeae2; margin: 0; color: #111; }
+header { background: #075e54; color: #fff; padding: 16px 24px; }
+header h1 { margin: 0; font-size: 20px; }
+header p { margin: 4px 0 0; font-size: 13px; opacity: .8; }
+main { max-width: 820px; margin: 0 auto; padding: 16px; }
+.day { text-align: center; margin: 16px 0 8px; }
+.day span { background: #e1f2fb; border-radius: 8px; padding: 4px 12px; font-size: 12px; }
+.msg { background: #fff; border-radius: 8px; padding: 6px 10px; margin: 4px 0; max-width: 75%; width: fit-content; box-shadow: 0 1px 1px rgba(0,0,0,.1); }
+.msg.me { background: #d9fdd3; margin-left: auto; }
+.who { font-size: 12px; font-weight: 600; color: #075e54; }
+.text { white-space: pre-wrap; word-wrap: break-word; }
+.meta { font-size: 11px; color: #667781; text-align: right; }
+.quote { border-left: 3px solid #25d366; background: rgba(0,0,0,.04); padding: 2px 8px; margin-bottom: 4px; font-size: 13px; }
+.media { font-style: italic; color: #555; }
+</style>
+</head>
+<body>
+<header><h1>{{.Title}}</h1><p>Exported {{.Exported}}{{if .Range}} · {{.Range}}{{end}}</p></header>
+<main>
+`))
+
+func init() {
+	template.Must(transcript.New("day").Parse(`<div class="day"><span>{{.}}</span></div>
+`))
+	template.Must(transcript.New("msg").Parse(`<div class="msg{{if .FromMe}} me{{end}}">
+{{- if not .FromMe}}<div class="who">{{with .SenderName}}{{.}}{{else}}{{.Sender}}{{end}}{{with .SenderPhone}} · +{{.}}{{end}}{{if $.ShowChat}} in {{with .ChatName}}{{.}}{{else}}{{.Chat}}{{end}}{{end}}</div>{{end}}
+{{- with .Quoted}}<div class="quote">{{.Text}}</div>{{end}}
+{{- with .Media}}<div class="media">[{{.Kind}}{{with .FileName}}: {{.}}{{end}}]</div>{{end}}
+{{- with .Text}}<div class="text">{{.}}</div>{{end}}
+<div class="meta">{{.Timestamp.UTC.Format "15:04"}}</div></div>
+`))
+	template.Must(transcript.New("end").Parse(`{{if not .}}<p class="day"><span>No messages</span></p>
+{{end}}</main>
+</body>
+</html>
+`))
+}
+
+type htmlWriter struct {
+	w        io.Writer
+	showChat bool
+	day      string
+	count    int
+}
+
+func (h *htmlWriter) begin(opts Options, title string) error {
+	h.showChat = opts.Chat == ""
+	var rng string
+	switch {
+	case !opts.From.IsZero() && !opts.To.IsZero():
+		rng = opts.From.UTC().Format(time.DateOnly) + " to " + opts.To.UTC().Format(time.DateOnly)
+	case !opts.From.IsZero():
+		rng = "from " + opts.From.UTC().Format(time.DateOnly)
+	case !opts.To.IsZero():
+		rng = "until " + opts.To.UTC().Format(time.DateOnly)
+	}
+	return transcript.ExecuteTemplate(h.w, "begin", map[string]string{
+		"Title":    title,
+		"Exported": time.Now().UTC().Format("2006-01-02 15:04 MST"),
+		"Range":    rng,
+	})
+}
+
+func (h *htmlWriter) write(r Record) error {
+	if day := r.Timestamp.UTC().Format("Monday, 2 January 2006"); day != h.day {
+		h.day = day
+		if err := transcript.ExecuteTemplate(h.w, "day", day); err != nil {
+			return err
+		}
+	}
+	h.count++
+	return transcript.ExecuteTemplate(h.w, "msg", struct {
+		Record
+		ShowChat bool
+	}{r, h.showChat})
+}
+
+func (h *htmlWriter) end() error {
+	return transcript.ExecuteTemplate(h.w, "end", h.count > 0)
+}
@@ -0,0 +1,168 @@
+package export
+
+import (
+	"api/database"
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Runner executes export jobs one at a time and deletes their files once they
+// are older than the retention
+type Runner struct {
+	dir       string
+	retention time.Duration
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func NewRunner(dir string, retention time.Duration) (*Runner, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	if err := database.FailInterruptedExports(); err != nil {
+		return nil, err
+	}
+
+	r := &Runner{
+		dir:       dir,
+		retention: retention,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go r.loop()
+	return r, nil
+}
+
+// Notify wakes the runner after a job was queued
+func (r *Runner) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Path is where the file of a finished job is stored
+func (r *Runner) Path(job *database.ExportJob) string {
+	return filepath.Join(r.dir, job.File)
+}
+
+// Close stops the runner after the current job
+func (r *Runner) Close() {
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+func (r *Runner) loop() {
+	defer close(r.done)
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		r.expire()
+		for {
+			job, err := database.ClaimExportJob()
+			if err != nil {
+				fmt.Printf("Error claiming export job: %v\n", err)
+			}
+			if job == nil {
+				break
+			}
+			r.run(job)
+
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-r.wake:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *Runner) run(job *database.ExportJob) {
+	opts := Options{Phone: job.Phone, Chat: job.Chat, Format: job.Format}
+	if job.From != nil {
+		opts.From = *job.From
+	}
+	if job.To != nil {
+		opts.To = *job.To
+	}
+
+	name := fmt.Sprintf("export-%d-%s", job.ID, FileName(job.Phone, job.Chat, job.Format))
+	n, size, err := r.writeFile(name, opts)
+	job.Messages = n
+	if err != nil {
+		job.Status = database.ExportFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = database.ExportDone
+		job.File = name
+		job.Size = size
+	}
+	if err := database.FinishExportJob(job); err != nil {
+		fmt.Printf("Error saving export job %d: %v\n", job.ID, err)
+	}
+}
+
+// writeFile writes to a temporary file renamed into place once complete
+func (r *Runner) writeFile(name string, opts Options) (int, int64, error) {
+	tmp, err := os.CreateTemp(r.dir, ".export-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	n, err := Write(w, opts)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return n, 0, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return n, 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return n, 0, err
+	}
+	return n, info.Size(), os.Rename(tmp.Name(), filepath.Join(r.dir, name))
+}
+
+// expire deletes jobs and files past the retention
+func (r *Runner) expire() {
+	jobs, err := database.ExpiredExportJobs(time.Now().Add(-r.retention))
+	if err != nil {
+		fmt.Printf("Error listing expired exports: %v\n", err)
+		return
+	}
+	for _, job := range jobs {
+		if job.File != "" {
+			if err := os.Remove(r.Path(&job)); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("Error deleting export %s: %v\n", job.File, err)
+				continue
+			}
+		}
+		if err := database.DeleteExportJob(job.ID); err != nil {
+			fmt.Printf("Error deleting export job %d: %v\n", job.ID, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package export
+
+import (
+	"api/database"
+	"api/message"
+	"strings"
+)
+
+// names resolves chat names and sender names and numbers, caching every lookup
+type names struct {
+	phone string
+	chats map[string]string
+	push  map[string]string // Latest push name by sender JID
+	pns   map[string]string // Phone number JID by LID, empty when unknown
+}
+
+func newNames(phone string) *names {
+	return &names{
+		phone: phone,
+		chats: make(map[string]string),
+		push:  make(map[string]string),
+		pns:   make(map[string]string),
+	}
+}
+
+func (n *names) chat(jid string) string {
+	if name, ok := n.chats[jid]; ok {
+		return name
+	}
+	found, err := database.ChatNames(n.phone, []string{jid})
+	if err != nil {
+		return ""
+	}
+	n.chats[jid] = found[jid]
+	return found[jid]
+}
+
+func (n *names) observe(m *message.Message) {
+	if !m.FromMe && m.PushName != "" {
+		n.push[m.Sender] = m.PushName
+	}
+}
+
+// sender returns the display name and phone number of a sender JID, resolving
+// LIDs through user_contacts
+func (n *names) sender(jid string, fromMe bool) (name, phone string) {
+	if fromMe {
+		return "Me", n.phone
+	}
+
+	pn := jid
+	if strings.HasSuffix(jid, "@lid") {
+		resolved, ok := n.pns[jid]
+		if !ok {
+			found, err := database.ResolveLIDs(n.phone, []string{jid})
+			if err == nil {
+				resolved = found[jid]
+			}
+			n.pns[jid] = resolved
+		}
+		pn = resolved
+	}
+	phone, _ = strings.CutSuffix(pn, "@s.whatsapp.net")
+	if strings.Contains(phone, "@") {
+		phone = ""
+	}
+	return n.push[jid], phone
+}
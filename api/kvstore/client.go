@@ -0,0 +1,214 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxIdleConns = 4
+
+// Client is a minimal Redis client speaking RESP over TCP with a small connection pool
+type Client struct {
+	opts Options
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func NewClient(opts Options) *Client {
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.IOTimeout == 0 {
+		opts.IOTimeout = 10 * time.Second
+	}
+	return &Client{opts: opts}
+}
+
+// Do sends a command and returns the decoded reply
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(c.opts.IOTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	cn.nc.SetDeadline(deadline)
+
+	if err := writeCommand(cn.w, args...); err != nil {
+		cn.nc.Close()
+		return nil, err
+	}
+	reply, err := readReply(cn.r, replyLimits)
+
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// Connection state is unknown after an I/O error
+		cn.nc.Close()
+		return nil, err
+	}
+
+	c.put(cn)
+	return reply, err
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errors.New("client is closed")
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	return c.dial(ctx)
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= maxIdleConns {
+		cn.nc.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	nc.SetDeadline(time.Now().Add(c.opts.IOTimeout))
+
+	if c.opts.Password != "" {
+		if err := cn.handshake("AUTH", c.opts.Password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.opts.DB != 0 {
+		if err := cn.handshake("SELECT", strconv.Itoa(c.opts.DB)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+func (cn *conn) handshake(args ...string) error {
+	if err := writeCommand(cn.w, args...); err != nil {
+		return err
+	}
+	_, err := readReply(cn.r, replyLimits)
+	return err
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	reply, err := c.Do(ctx, "GET", key)
+	if err != nil {
+		return "", err
+	}
+	if reply == nil {
+		return "", ErrNotFound
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected GET reply %T", reply)
+	}
+	return s, nil
+}
+
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	_, err := c.Do(ctx, "SET", key, value)
+	return err
+}
+
+func (c *Client) Del(ctx context.Context, keys ...string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	reply, err := c.Do(ctx, append([]string{"DEL"}, keys...)...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected DEL reply %T", reply)
+	}
+	return int(n), nil
+}
+
+func (c *Client) Scan(ctx context.Context, cursor uint64, pattern string, count int) ([]string, uint64, error) {
+	args := []string{"SCAN", strconv.FormatUint(cursor, 10)}
+	if pattern != "" {
+		args = append(args, "MATCH", pattern)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+
+	reply, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	parts, ok := reply.([]any)
+	if !ok || len(parts) != 2 {
+		return nil, 0, fmt.Errorf("unexpected SCAN reply %T", reply)
+	}
+	cs, _ := parts[0].(string)
+	next, err := strconv.ParseUint(cs, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid SCAN cursor %q", cs)
+	}
+	items, _ := parts[1].([]any)
+	keys := make([]string, 0, len(items))
+	for _, it := range items {
+		if k, ok := it.(string); ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys, next, nil
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Do(ctx, "PING")
+	return err
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.nc.Close()
+	}
+	c.idle = nil
+	return nil
+}
@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"hash/fnv"
+	"slices"
+	"strings"
+)
+
+// hashedKey orders keys for SCAN: by hash, then by key for colliding hashes
+type hashedKey struct {
+	h   uint64
+	key string
+}
+
+func compareHashed(a, b hashedKey) int {
+	if a.h != b.h {
+		if a.h < b.h {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.key, b.key)
+}
+
+// keyIndex keeps keys in SCAN order, so a page is a binary search away instead
+// of a sort of the whole keyspace
+type keyIndex struct {
+	items []hashedKey
+}
+
+func newKeyIndex(keys []string) *keyIndex {
+	items := make([]hashedKey, len(keys))
+	for i, k := range keys {
+		items[i] = hashedKey{keyHash(k), k}
+	}
+	slices.SortFunc(items, compareHashed)
+	return &keyIndex{items: items}
+}
+
+func (ix *keyIndex) add(key string) {
+	hk := hashedKey{keyHash(key), key}
+	if i, found := slices.BinarySearchFunc(ix.items, hk, compareHashed); !found {
+		ix.items = slices.Insert(ix.items, i, hk)
+	}
+}
+
+func (ix *keyIndex) remove(key string) {
+	if i, found := slices.BinarySearchFunc(ix.items, hashedKey{keyHash(key), key}, compareHashed); found {
+		ix.items = slices.Delete(ix.items, i, i+1)
+	}
+}
+
+// page returns about count keys starting at the cursor hash and the cursor of
+// the next page, 0 after the last one. Keys sharing a hash are never split
+// across pages, so deleting keys during an iteration never makes it skip the
+// remaining ones.
+func (ix *keyIndex) page(cursor uint64, count int) ([]string, uint64) {
+	if count <= 0 {
+		count = 10
+	}
+	start, _ := slices.BinarySearchFunc(ix.items, cursor, func(it hashedKey, h uint64) int {
+		if it.h < h {
+			return -1
+		}
+		if it.h > h {
+			return 1
+		}
+		return 0
+	})
+	end := min(start+count, len(ix.items))
+	for end < len(ix.items) && end > start && ix.items[end].h == ix.items[end-1].h {
+		end++
+	}
+
+	keys := make([]string, 0, end-start)
+	for _, it := range ix.items[start:end] {
+		keys = append(keys, it.key)
+	}
+	var next uint64
+	if end < len(ix.items) {
+		next = ix.items[end].h
+	}
+	return keys, next
+}
+
+// keyHash is never 0, which is reserved for the start and end of a scan
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	if v := h.Sum64(); v != 0 {
+		return v
+	}
+	return 1
+}
@@ -0,0 +1,124 @@
+// Package kvstore provides the key-value store used for the core's auth cache,
+// with a native Redis client and an in-memory implementation.
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// Store is the subset of Redis the API needs to manage session keys
+type Store interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key, value string) error
+	// Del removes keys and returns how many existed
+	Del(ctx context.Context, keys ...string) (int, error)
+	// Scan returns one page of keys matching pattern and the cursor for the next page,
+	// a returned cursor of 0 means the iteration is complete
+	Scan(ctx context.Context, cursor uint64, pattern string, count int) ([]string, uint64, error)
+	Close() error
+}
+
+// DeleteResult reports the outcome of deleting every key matching a pattern
+type DeleteResult struct {
+	Pattern string   `json:"pattern"`
+	Matched int      `json:"matched"`
+	Deleted int      `json:"deleted"`
+	Failed  []string `json:"failed,omitempty"`
+}
+
+// DeletePattern removes all keys matching pattern using SCAN, deleting each page
+// as it is read so large key sets never have to be held in memory.
+func DeletePattern(ctx context.Context, s Store, pattern string) (DeleteResult, error) {
+	res := DeleteResult{Pattern: pattern}
+	var cursor uint64
+
+	for {
+		keys, next, err := s.Scan(ctx, cursor, pattern, 500)
+		if err != nil {
+			return res, err
+		}
+		res.Matched += len(keys)
+
+		if len(keys) > 0 {
+			n, err := s.Del(ctx, keys...)
+			if err != nil {
+				res.Failed = append(res.Failed, keys...)
+			} else {
+				res.Deleted += n
+			}
+		}
+
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	if len(res.Failed) > 0 {
+		return res, fmt.Errorf("failed to delete %d keys matching %s", len(res.Failed), pattern)
+	}
+	return res, nil
+}
+
+type Options struct {
+	Addr        string
+	Password    string
+	DB          int
+	DialTimeout time.Duration
+	IOTimeout   time.Duration
+}
+
+// ParseURL reads redis://[:password@]host:port[/db] into Options
+func ParseURL(raw string) (Options, error) {
+	opts := Options{
+		DialTimeout: 5 * time.Second,
+		IOTimeout:   10 * time.Second,
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return opts, err
+	}
+	if u.Scheme != "redis" {
+		return opts, fmt.Errorf("unsupported redis scheme %q", u.Scheme)
+	}
+
+	opts.Addr = u.Host
+	if u.Port() == "" {
+		opts.Addr = u.Hostname() + ":6379"
+	}
+	if u.User != nil {
+		opts.Password, _ = u.User.Password()
+		if opts.Password == "" {
+			opts.Password = u.User.Username()
+		}
+	}
+	if db := u.Path; len(db) > 1 {
+		n, err := strconv.Atoi(db[1:])
+		if err != nil {
+			return opts, fmt.Errorf("invalid redis db %q", db[1:])
+		}
+		opts.DB = n
+	}
+
+	return opts, nil
+}
+
+// Open connects to the store described by raw. "memory://" returns an in-memory store.
+func Open(raw string) (Store, error) {
+	if raw == "memory://" {
+		return NewMemory(), nil
+	}
+	opts, err := ParseURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(opts), nil
+}
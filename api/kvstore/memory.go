@@ -0,0 +1,73 @@
+package kvstore
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is an in-process Store, used in place of Redis for tests and single-node setups
+type Memory struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+func NewMemory() *Memory {
+	return &Memory{data: make(map[string]string)}
+}
+
+func (m *Memory) Get(_ context.Context, key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
+
+func (m *Memory) Set(_ context.Context, key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = value
+	return nil
+}
+
+func (m *Memory) Del(_ context.Context, keys ...string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, k := range keys {
+		if _, ok := m.data[k]; ok {
+			delete(m.data, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) Scan(_ context.Context, cursor uint64, pattern string, count int) ([]string, uint64, error) {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+	m.mu.RUnlock()
+
+	return scanPage(keys, cursor, pattern, count)
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// scanPage returns the keys matching pattern from one page of count keys
+func scanPage(keys []string, cursor uint64, pattern string, count int) ([]string, uint64, error) {
+	page, next := newKeyIndex(keys).page(cursor, count)
+	var out []string
+	for _, k := range page {
+		if pattern == "" || MatchGlob(pattern, k) {
+			out = append(out, k)
+		}
+	}
+	return out, next, nil
+}
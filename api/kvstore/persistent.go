@@ -0,0 +1,488 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+const (
+	TypeString = "string"
+	TypeHash   = "hash"
+)
+
+// Entry is the persisted form of a key. Hash values are stored as a JSON object.
+type Entry struct {
+	Key       string
+	Type      string
+	Value     string
+	ExpiresAt int64 // Unix milliseconds, 0 when the key never expires
+}
+
+// Backend loads and saves entries for a Persistent store
+type Backend interface {
+	LoadEntries() ([]Entry, error)
+	SaveEntries(put []Entry, del []string) error
+}
+
+type entry struct {
+	kind    string
+	str     string
+	hash    map[string]string
+	expires int64
+}
+
+// Persistent is an in-memory store with string and hash values and key expiry.
+// Changes are written to its Backend in batches by a background flusher.
+type Persistent struct {
+	mu      sync.Mutex
+	data    map[string]*entry
+	index   *keyIndex // Keys of data in SCAN order
+	dirty   map[string]bool
+	backend Backend
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPersistent loads all entries from backend and starts flushing changes every interval
+func NewPersistent(backend Backend, interval time.Duration) (*Persistent, error) {
+	p := &Persistent{
+		data:    make(map[string]*entry),
+		dirty:   make(map[string]bool),
+		backend: backend,
+		stop:    make(chan struct{}),
+	}
+
+	entries, err := backend.LoadEntries()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	for _, e := range entries {
+		if e.ExpiresAt != 0 && e.ExpiresAt <= now {
+			p.dirty[e.Key] = true
+			continue
+		}
+		en := &entry{kind: e.Type, expires: e.ExpiresAt}
+		switch e.Type {
+		case TypeHash:
+			if err := json.Unmarshal([]byte(e.Value), &en.hash); err != nil {
+				return nil, fmt.Errorf("invalid hash value for %s: %w", e.Key, err)
+			}
+		default:
+			en.kind = TypeString
+			en.str = e.Value
+		}
+		p.data[e.Key] = en
+	}
+	keys := make([]string, 0, len(p.data))
+	for k := range p.data {
+		keys = append(keys, k)
+	}
+	p.index = newKeyIndex(keys)
+
+	p.wg.Add(1)
+	go p.run(interval)
+
+	return p, nil
+}
+
+func (p *Persistent) run(interval time.Duration) {
+	defer p.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	sweeps := 0
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			// Expired keys are removed lazily on access and swept here every tenth flush
+			if sweeps++; sweeps%10 == 0 {
+				p.sweep()
+			}
+			if err := p.Flush(); err != nil {
+				fmt.Printf("Error persisting kv store: %v\n", err)
+			}
+		}
+	}
+}
+
+// Flush writes all pending changes to the backend
+func (p *Persistent) Flush() error {
+	p.mu.Lock()
+	if len(p.dirty) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+
+	var put []Entry
+	var del []string
+	for k := range p.dirty {
+		e, ok := p.data[k]
+		if !ok {
+			del = append(del, k)
+			continue
+		}
+		pe := Entry{Key: k, Type: e.kind, Value: e.str, ExpiresAt: e.expires}
+		if e.kind == TypeHash {
+			b, _ := json.Marshal(e.hash)
+			pe.Value = string(b)
+		}
+		put = append(put, pe)
+	}
+	pending := p.dirty
+	p.dirty = make(map[string]bool)
+	p.mu.Unlock()
+
+	if err := p.backend.SaveEntries(put, del); err != nil {
+		// Requeue so the next flush retries
+		p.mu.Lock()
+		for k := range pending {
+			p.dirty[k] = true
+		}
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (p *Persistent) sweep() {
+	now := time.Now().UnixMilli()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, e := range p.data {
+		if e.expires != 0 && e.expires <= now {
+			p.remove(k)
+		}
+	}
+}
+
+// lookup returns the live entry for key, expiring it if needed. Callers hold p.mu.
+func (p *Persistent) lookup(key string) *entry {
+	e, ok := p.data[key]
+	if !ok {
+		return nil
+	}
+	if e.expires != 0 && e.expires <= time.Now().UnixMilli() {
+		p.remove(key)
+		return nil
+	}
+	return e
+}
+
+// put stores e under key and marks it dirty. Callers hold p.mu.
+func (p *Persistent) put(key string, e *entry) {
+	if _, ok := p.data[key]; !ok {
+		p.index.add(key)
+	}
+	p.data[key] = e
+	p.dirty[key] = true
+}
+
+// remove deletes key and marks it dirty. Callers hold p.mu.
+func (p *Persistent) remove(key string) {
+	if _, ok := p.data[key]; ok {
+		p.index.remove(key)
+		delete(p.data, key)
+	}
+	p.dirty[key] = true
+}
+
+func (p *Persistent) Get(_ context.Context, key string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.lookup(key)
+	if e == nil {
+		return "", ErrNotFound
+	}
+	if e.kind != TypeString {
+		return "", ErrWrongType
+	}
+	return e.str, nil
+}
+
+func (p *Persistent) Set(_ context.Context, key, value string) error {
+	_, err := p.SetWith(key, value, SetOptions{})
+	return err
+}
+
+type SetOptions struct {
+	TTL     time.Duration
+	NX      bool // Only set if the key does not exist
+	XX      bool // Only set if the key exists
+	KeepTTL bool
+	Get     bool // Return the previous value
+}
+
+type SetResult struct {
+	Written bool
+	Old     string
+	HadOld  bool
+}
+
+// SetWith implements SET with its options. It reports whether the value was written
+// and, with opts.Get, the previous value.
+func (p *Persistent) SetWith(key, value string, opts SetOptions) (SetResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var res SetResult
+	old := p.lookup(key)
+	if old != nil && opts.Get {
+		if old.kind != TypeString {
+			return res, ErrWrongType
+		}
+		res.Old, res.HadOld = old.str, true
+	}
+	if (opts.NX && old != nil) || (opts.XX && old == nil) {
+		return res, nil
+	}
+
+	e := &entry{kind: TypeString, str: value}
+	if opts.TTL > 0 {
+		e.expires = time.Now().Add(opts.TTL).UnixMilli()
+	} else if opts.KeepTTL && old != nil {
+		e.expires = old.expires
+	}
+	p.put(key, e)
+	res.Written = true
+	return res, nil
+}
+
+// MGet returns the values of keys, with ok false for missing or non string keys
+func (p *Persistent) MGet(keys ...string) ([]string, []bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vals := make([]string, len(keys))
+	oks := make([]bool, len(keys))
+	for i, k := range keys {
+		if e := p.lookup(k); e != nil && e.kind == TypeString {
+			vals[i], oks[i] = e.str, true
+		}
+	}
+	return vals, oks
+}
+
+func (p *Persistent) Del(_ context.Context, keys ...string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, k := range keys {
+		if p.lookup(k) != nil {
+			p.remove(k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (p *Persistent) Exists(keys ...string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, k := range keys {
+		if p.lookup(k) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Type returns the type name of key or "none"
+func (p *Persistent) Type(key string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e := p.lookup(key); e != nil {
+		return e.kind
+	}
+	return "none"
+}
+
+// Expire sets a TTL on key, a non positive ttl deletes it. It reports whether the key exists.
+func (p *Persistent) Expire(key string, ttl time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.lookup(key)
+	if e == nil {
+		return false
+	}
+	if ttl <= 0 {
+		p.remove(key)
+	} else {
+		e.expires = time.Now().Add(ttl).UnixMilli()
+	}
+	p.dirty[key] = true
+	return true
+}
+
+// Persist removes the TTL of key and reports whether one was removed
+func (p *Persistent) Persist(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.lookup(key)
+	if e == nil || e.expires == 0 {
+		return false
+	}
+	e.expires = 0
+	p.dirty[key] = true
+	return true
+}
+
+// TTL returns the remaining time to live of key. Following Redis, it returns -2
+// for missing keys and -1 for keys without expiry.
+func (p *Persistent) TTL(key string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.lookup(key)
+	if e == nil {
+		return -2
+	}
+	if e.expires == 0 {
+		return -1
+	}
+	return time.Until(time.UnixMilli(e.expires))
+}
+
+func (p *Persistent) HSet(key string, pairs map[string]string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.lookup(key)
+	if e == nil {
+		e = &entry{kind: TypeHash, hash: make(map[string]string)}
+		p.put(key, e)
+	} else if e.kind != TypeHash {
+		return 0, ErrWrongType
+	}
+
+	added := 0
+	for f, v := range pairs {
+		if _, ok := e.hash[f]; !ok {
+			added++
+		}
+		e.hash[f] = v
+	}
+	p.dirty[key] = true
+	return added, nil
+}
+
+func (p *Persistent) HGet(key, field string) (string, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.lookup(key)
+	if e == nil {
+		return "", false, nil
+	}
+	if e.kind != TypeHash {
+		return "", false, ErrWrongType
+	}
+	v, ok := e.hash[field]
+	return v, ok, nil
+}
+
+func (p *Persistent) HGetAll(key string) (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.lookup(key)
+	if e == nil {
+		return map[string]string{}, nil
+	}
+	if e.kind != TypeHash {
+		return nil, ErrWrongType
+	}
+	out := make(map[string]string, len(e.hash))
+	for f, v := range e.hash {
+		out[f] = v
+	}
+	return out, nil
+}
+
+func (p *Persistent) HDel(key string, fields ...string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.lookup(key)
+	if e == nil {
+		return 0, nil
+	}
+	if e.kind != TypeHash {
+		return 0, ErrWrongType
+	}
+	n := 0
+	for _, f := range fields {
+		if _, ok := e.hash[f]; ok {
+			delete(e.hash, f)
+			n++
+		}
+	}
+	if len(e.hash) == 0 {
+		p.remove(key)
+	}
+	p.dirty[key] = true
+	return n, nil
+}
+
+// Keys returns all live keys matching pattern in sorted order
+func (p *Persistent) Keys(pattern string) []string {
+	p.mu.Lock()
+	keys := make([]string, 0, len(p.data))
+	now := time.Now().UnixMilli()
+	for k, e := range p.data {
+		if e.expires != 0 && e.expires <= now {
+			continue
+		}
+		if pattern == "" || pattern == "*" || MatchGlob(pattern, k) {
+			keys = append(keys, k)
+		}
+	}
+	p.mu.Unlock()
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (p *Persistent) Scan(_ context.Context, cursor uint64, pattern string, count int) ([]string, uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	page, next := p.index.page(cursor, count)
+	var keys []string
+	for _, k := range page {
+		if p.lookup(k) != nil && (pattern == "" || MatchGlob(pattern, k)) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, next, nil
+}
+
+func (p *Persistent) DBSize() int {
+	return len(p.Keys(""))
+}
+
+func (p *Persistent) FlushAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k := range p.data {
+		p.dirty[k] = true
+	}
+	p.data = make(map[string]*entry)
+	p.index = newKeyIndex(nil)
+}
+
+// Close stops the flusher and writes pending changes
+func (p *Persistent) Close() error {
+	select {
+	case <-p.stop:
+		return nil
+	default:
+		close(p.stop)
+	}
+	p.wg.Wait()
+	return p.Flush()
+}
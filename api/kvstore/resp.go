@@ -0,0 +1,146 @@
+package kvstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// limits bound what decoding one value may allocate
+type limits struct {
+	bulk  int // Longest bulk string or line
+	array int // Most elements in an array
+}
+
+var (
+	// replyLimits match the Redis limits on a single bulk string and array
+	replyLimits = limits{bulk: 512 << 20, array: 1 << 20}
+	// preAuthLimits apply to connections that have not authenticated yet, which
+	// only need room for AUTH, PING and QUIT
+	preAuthLimits = limits{bulk: 4 << 10, array: 4}
+)
+
+// maxHeaderLen bounds the length and count lines of bulk strings and arrays
+const maxHeaderLen = 32
+
+// RedisError is an error reply sent by the server
+type RedisError string
+
+func (e RedisError) Error() string { return string(e) }
+
+// writeCommand encodes args as a RESP array of bulk strings
+func writeCommand(w *bufio.Writer, args ...string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return w.Flush()
+}
+
+// readReply decodes one RESP value. Bulk strings are returned as string, nil bulk
+// strings and arrays as nil, integers as int64 and arrays as []any.
+func readReply(r *bufio.Reader, lim limits) (any, error) {
+	line, err := readLine(r, lim.bulk)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := parseLen(line, lim.bulk)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		return readBulk(r, n)
+	case '*':
+		n, err := parseLen(line, lim.array)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r, lim); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply type %q", line[0])
+	}
+}
+
+// readHeader reads a bulk string or array header of the given type
+func readHeader(r *bufio.Reader, typ byte, max int) (int, error) {
+	line, err := readLine(r, maxHeaderLen)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 || line[0] != typ {
+		return 0, fmt.Errorf("expected '%c', got %q", typ, line)
+	}
+	return parseLen(line, max)
+}
+
+// parseLen reads the length of a header line, -1 for nil values
+func parseLen(line string, max int) (int, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return 0, err
+	}
+	if n < -1 {
+		return 0, errors.New("invalid length")
+	}
+	if n > max {
+		if line[0] == '*' {
+			return 0, errors.New("array too long")
+		}
+		return 0, errors.New("bulk string too long")
+	}
+	return n, nil
+}
+
+func readBulk(r *bufio.Reader, n int) (string, error) {
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", errors.New("malformed bulk string")
+	}
+	return string(buf[:n]), nil
+}
+
+// readLine reads a CRLF terminated line of at most max bytes without buffering
+// more than that
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max+2 {
+			return "", errors.New("line too long")
+		}
+		line = append(line, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("malformed line")
+	}
+	return string(line[:len(line)-2]), nil
+}
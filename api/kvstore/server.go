@@ -0,0 +1,619 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server speaks the subset of the Redis protocol the core's auth cache uses,
+// serving a Persistent store so deployments don't need a separate redis-server.
+type Server struct {
+	Store    *Persistent
+	Password string
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+}
+
+func NewServer(store *Persistent, password string) *Server {
+	return &Server{Store: store, Password: password, conns: make(map[net.Conn]struct{})}
+}
+
+// ListenAndServe accepts connections on addr until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	if err := s.Listen(addr); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// ErrNoPassword is returned when listening on a non-loopback address without a password
+var ErrNoPassword = errors.New("a password is required to listen on a non-loopback address")
+
+// Listen binds addr without accepting connections yet
+func (s *Server) Listen(addr string) error {
+	if s.Password == "" && !isLoopback(addr) {
+		return ErrNoPassword
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	return nil
+}
+
+// Addr returns the bound address, or an empty string before Listen
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return ""
+	}
+	return s.ln.Addr().String()
+}
+
+// Serve accepts connections on the listener bound by Listen until Close is called
+func (s *Server) Serve() error {
+	s.mu.Lock()
+	ln := s.ln
+	s.mu.Unlock()
+	if ln == nil {
+		return errors.New("server is not listening")
+	}
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[nc] = struct{}{}
+		s.mu.Unlock()
+		go s.serve(nc)
+	}
+}
+
+// isLoopback reports whether addr only accepts connections from the same host.
+// Host names other than localhost may resolve to anything and are not trusted.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for nc := range s.conns {
+		nc.Close()
+	}
+	if s.ln != nil {
+		return s.ln.Close()
+	}
+	return nil
+}
+
+type session struct {
+	r      *bufio.Reader
+	w      *bufio.Writer
+	authed bool
+}
+
+func (s *Server) serve(nc net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		nc.Close()
+	}()
+
+	sess := &session{
+		r:      bufio.NewReader(nc),
+		w:      bufio.NewWriter(nc),
+		authed: s.Password == "",
+	}
+
+	for {
+		lim := replyLimits
+		if !sess.authed {
+			lim = preAuthLimits
+		}
+		args, err := readCommand(sess.r, lim)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				writeError(sess.w, "ERR Protocol error: "+err.Error())
+				sess.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.dispatch(sess, args)
+		// Flush once the reader has no pipelined commands left
+		if sess.r.Buffered() == 0 || quit {
+			if err := sess.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// dispatch executes one command and reports whether the connection should close
+func (s *Server) dispatch(sess *session, args []string) bool {
+	w := sess.w
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+
+	if !sess.authed && cmd != "AUTH" && cmd != "PING" && cmd != "QUIT" {
+		writeError(w, "NOAUTH Authentication required.")
+		return false
+	}
+
+	st := s.Store
+	ctx := context.Background()
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			writeBulk(w, args[0])
+		} else {
+			writeSimple(w, "PONG")
+		}
+	case "ECHO":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		writeBulk(w, args[0])
+	case "QUIT":
+		writeSimple(w, "OK")
+		return true
+	case "AUTH":
+		pass := ""
+		if len(args) > 0 {
+			pass = args[len(args)-1]
+		}
+		if s.Password == "" {
+			writeError(w, "ERR AUTH <password> called without any password configured for the default user")
+		} else if subtle.ConstantTimeCompare([]byte(pass), []byte(s.Password)) == 1 {
+			sess.authed = true
+			writeSimple(w, "OK")
+		} else {
+			writeError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+		}
+	case "HELLO":
+		// Only RESP2 is spoken, clients fall back to it on this error
+		if len(args) > 0 && args[0] != "2" {
+			writeError(w, "NOPROTO unsupported protocol version")
+			return false
+		}
+		writeArray(w, 6)
+		writeBulk(w, "server")
+		writeBulk(w, "wa-runtime")
+		writeBulk(w, "proto")
+		writeInt(w, 2)
+		writeBulk(w, "mode")
+		writeBulk(w, "standalone")
+	case "SELECT":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		if args[0] != "0" {
+			writeError(w, "ERR DB index is out of range")
+			return false
+		}
+		writeSimple(w, "OK")
+	case "CLIENT":
+		writeSimple(w, "OK")
+	case "COMMAND":
+		writeArray(w, 0)
+	case "INFO":
+		writeBulk(w, fmt.Sprintf("# Server\r\nredis_version:7.0.0\r\nredis_mode:standalone\r\n# Keyspace\r\ndb0:keys=%d\r\n", st.DBSize()))
+	case "DBSIZE":
+		writeInt(w, int64(st.DBSize()))
+	case "FLUSHDB", "FLUSHALL":
+		st.FlushAll()
+		writeSimple(w, "OK")
+
+	case "GET":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		v, err := st.Get(ctx, args[0])
+		switch {
+		case errors.Is(err, ErrNotFound):
+			writeNull(w)
+		case err != nil:
+			writeError(w, err.Error())
+		default:
+			writeBulk(w, v)
+		}
+	case "SET":
+		s.set(w, args)
+	case "SETEX", "PSETEX":
+		if !arity(w, cmd, args, 3) {
+			return false
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, "ERR invalid expire time in '"+strings.ToLower(cmd)+"' command")
+			return false
+		}
+		ttl := time.Duration(n) * time.Second
+		if cmd == "PSETEX" {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+		st.SetWith(args[0], args[2], SetOptions{TTL: ttl})
+		writeSimple(w, "OK")
+	case "MGET":
+		if len(args) == 0 {
+			writeArityError(w, cmd)
+			return false
+		}
+		vals, oks := st.MGet(args...)
+		writeArray(w, len(vals))
+		for i, v := range vals {
+			if oks[i] {
+				writeBulk(w, v)
+			} else {
+				writeNull(w)
+			}
+		}
+	case "DEL", "UNLINK":
+		if len(args) == 0 {
+			writeArityError(w, cmd)
+			return false
+		}
+		n, _ := st.Del(ctx, args...)
+		writeInt(w, int64(n))
+	case "EXISTS":
+		if len(args) == 0 {
+			writeArityError(w, cmd)
+			return false
+		}
+		writeInt(w, int64(st.Exists(args...)))
+	case "TYPE":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		writeSimple(w, st.Type(args[0]))
+	case "EXPIRE", "PEXPIRE":
+		if len(args) < 2 {
+			writeArityError(w, cmd)
+			return false
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return false
+		}
+		ttl := time.Duration(n) * time.Second
+		if cmd == "PEXPIRE" {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+		writeBool(w, st.Expire(args[0], ttl))
+	case "PERSIST":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		writeBool(w, st.Persist(args[0]))
+	case "TTL", "PTTL":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		ttl := st.TTL(args[0])
+		switch {
+		case ttl < 0:
+			writeInt(w, int64(ttl))
+		case cmd == "PTTL":
+			writeInt(w, ttl.Milliseconds())
+		default:
+			writeInt(w, int64((ttl+time.Second-1)/time.Second))
+		}
+	case "KEYS":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		keys := st.Keys(args[0])
+		writeArray(w, len(keys))
+		for _, k := range keys {
+			writeBulk(w, k)
+		}
+	case "SCAN":
+		s.scan(w, args)
+
+	case "HSET", "HMSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			writeArityError(w, cmd)
+			return false
+		}
+		pairs := make(map[string]string, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			pairs[args[i]] = args[i+1]
+		}
+		n, err := st.HSet(args[0], pairs)
+		switch {
+		case err != nil:
+			writeError(w, err.Error())
+		case cmd == "HMSET":
+			writeSimple(w, "OK")
+		default:
+			writeInt(w, int64(n))
+		}
+	case "HGET":
+		if !arity(w, cmd, args, 2) {
+			return false
+		}
+		v, ok, err := st.HGet(args[0], args[1])
+		switch {
+		case err != nil:
+			writeError(w, err.Error())
+		case !ok:
+			writeNull(w)
+		default:
+			writeBulk(w, v)
+		}
+	case "HMGET":
+		if len(args) < 2 {
+			writeArityError(w, cmd)
+			return false
+		}
+		all, err := st.HGetAll(args[0])
+		if err != nil {
+			writeError(w, err.Error())
+			return false
+		}
+		writeArray(w, len(args)-1)
+		for _, f := range args[1:] {
+			if v, ok := all[f]; ok {
+				writeBulk(w, v)
+			} else {
+				writeNull(w)
+			}
+		}
+	case "HGETALL":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		all, err := st.HGetAll(args[0])
+		if err != nil {
+			writeError(w, err.Error())
+			return false
+		}
+		writeArray(w, len(all)*2)
+		for f, v := range all {
+			writeBulk(w, f)
+			writeBulk(w, v)
+		}
+	case "HDEL":
+		if len(args) < 2 {
+			writeArityError(w, cmd)
+			return false
+		}
+		n, err := st.HDel(args[0], args[1:]...)
+		if err != nil {
+			writeError(w, err.Error())
+			return false
+		}
+		writeInt(w, int64(n))
+	case "HEXISTS":
+		if !arity(w, cmd, args, 2) {
+			return false
+		}
+		_, ok, err := st.HGet(args[0], args[1])
+		if err != nil {
+			writeError(w, err.Error())
+			return false
+		}
+		writeBool(w, ok)
+	case "HLEN":
+		if !arity(w, cmd, args, 1) {
+			return false
+		}
+		all, err := st.HGetAll(args[0])
+		if err != nil {
+			writeError(w, err.Error())
+			return false
+		}
+		writeInt(w, int64(len(all)))
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
+	}
+
+	return false
+}
+
+// set handles SET key value [NX|XX] [GET] [EX s|PX ms|KEEPTTL]
+func (s *Server) set(w *bufio.Writer, args []string) {
+	if len(args) < 2 {
+		writeArityError(w, "SET")
+		return
+	}
+
+	var opts SetOptions
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "GET":
+			opts.Get = true
+		case "KEEPTTL":
+			opts.KeepTTL = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				writeError(w, "ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				writeError(w, "ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if strings.EqualFold(args[i], "PX") {
+				unit = time.Millisecond
+			}
+			opts.TTL = time.Duration(n) * unit
+			i++
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+	if opts.NX && opts.XX {
+		writeError(w, "ERR syntax error")
+		return
+	}
+
+	res, err := s.Store.SetWith(args[0], args[1], opts)
+	switch {
+	case err != nil:
+		writeError(w, err.Error())
+	case opts.Get && res.HadOld:
+		writeBulk(w, res.Old)
+	case opts.Get, !res.Written:
+		writeNull(w)
+	default:
+		writeSimple(w, "OK")
+	}
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT n] [TYPE type]
+func (s *Server) scan(w *bufio.Writer, args []string) {
+	if len(args) < 1 {
+		writeArityError(w, "SCAN")
+		return
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		writeError(w, "ERR invalid cursor")
+		return
+	}
+
+	pattern, count, typ := "", 10, ""
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 {
+				writeError(w, "ERR value is not an integer or out of range")
+				return
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	keys, next, _ := s.Store.Scan(context.Background(), cursor, pattern, count)
+	if typ != "" {
+		filtered := keys[:0]
+		for _, k := range keys {
+			if s.Store.Type(k) == typ {
+				filtered = append(filtered, k)
+			}
+		}
+		keys = filtered
+	}
+
+	writeArray(w, 2)
+	writeBulk(w, strconv.FormatUint(next, 10))
+	writeArray(w, len(keys))
+	for _, k := range keys {
+		writeBulk(w, k)
+	}
+}
+
+func arity(w *bufio.Writer, cmd string, args []string, n int) bool {
+	if len(args) != n {
+		writeArityError(w, cmd)
+		return false
+	}
+	return true
+}
+
+func writeArityError(w *bufio.Writer, cmd string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+func writeSimple(w *bufio.Writer, s string) { fmt.Fprintf(w, "+%s\r\n", s) }
+func writeError(w *bufio.Writer, s string)  { fmt.Fprintf(w, "-%s\r\n", s) }
+func writeInt(w *bufio.Writer, n int64)     { fmt.Fprintf(w, ":%d\r\n", n) }
+func writeBulk(w *bufio.Writer, s string)   { fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s) }
+func writeNull(w *bufio.Writer)             { w.WriteString("$-1\r\n") }
+func writeArray(w *bufio.Writer, n int)     { fmt.Fprintf(w, "*%d\r\n", n) }
+
+func writeBool(w *bufio.Writer, b bool) {
+	if b {
+		writeInt(w, 1)
+	} else {
+		writeInt(w, 0)
+	}
+}
+
+// readCommand reads a RESP array of bulk strings, or an inline command as sent by telnet
+func readCommand(r *bufio.Reader, lim limits) ([]string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		line, err := readLine(r, lim.bulk)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	n, err := readHeader(r, '*', lim.array)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errors.New("expected array of bulk strings")
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readHeader(r, '$', lim.bulk)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, errors.New("expected bulk string")
+		}
+		if args[i], err = readBulk(r, size); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,131 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialRaw opens a plain connection to addr for sending hand written commands
+func dialRaw(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { nc.Close() })
+	return nc, bufio.NewReader(nc)
+}
+
+func TestServerPreAuth(t *testing.T) {
+	addr := newServer(t, "secret")
+
+	tests := []struct {
+		name  string
+		send  string
+		reply string // Prefix of the first reply line
+		close bool   // Whether the server must drop the connection
+	}{
+		{"ping", "*1\r\n$4\r\nPING\r\n", "+PONG", false},
+		{"get", "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "-NOAUTH", false},
+		{"hello", "*2\r\n$5\r\nHELLO\r\n$1\r\n2\r\n", "-NOAUTH", false},
+		{"wrong password", "*2\r\n$4\r\nAUTH\r\n$5\r\nwrong\r\n", "-WRONGPASS", false},
+		{"large bulk", "*2\r\n$4\r\nAUTH\r\n$536870912\r\n", "-ERR Protocol error: bulk string too long", true},
+		{"large array", "*1048576\r\n", "-ERR Protocol error: array too long", true},
+		{"long inline", "AUTH " + strings.Repeat("x", 8<<10) + "\r\n", "-ERR Protocol error: line too long", true},
+		{"long header", "*2\r\n$" + strings.Repeat("1", 64) + "\r\n", "-ERR Protocol error: line too long", true},
+		{"quit", "*1\r\n$4\r\nQUIT\r\n", "+OK", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc, r := dialRaw(t, addr)
+			if _, err := nc.Write([]byte(tt.send)); err != nil {
+				t.Fatal(err)
+			}
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, tt.reply) {
+				t.Fatalf("reply %q, want %q", line, tt.reply)
+			}
+			if tt.close {
+				if _, err := r.ReadByte(); err == nil {
+					t.Fatal("connection still open")
+				}
+			}
+		})
+	}
+}
+
+func TestServerAuthLiftsLimits(t *testing.T) {
+	addr := newServer(t, "secret")
+	c := NewClient(Options{Addr: addr, Password: "secret"})
+	defer c.Close()
+
+	ctx := context.Background()
+	big := strings.Repeat("x", 64<<10)
+	if err := c.Set(ctx, "big", big); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "big"); err != nil || v != big {
+		t.Fatalf("Get(big) returned %d bytes, %v", len(v), err)
+	}
+
+	args := []string{"MGET"}
+	for i := range 100 {
+		args = append(args, fmt.Sprintf("k%d", i))
+	}
+	if reply, err := c.Do(ctx, args...); err != nil || len(reply.([]any)) != 100 {
+		t.Fatalf("MGET = %v, %v", reply, err)
+	}
+
+	bad := NewClient(Options{Addr: addr, Password: "wrong"})
+	defer bad.Close()
+	var redisErr RedisError
+	if _, err := bad.Get(ctx, "big"); !errors.As(err, &redisErr) {
+		t.Fatalf("Get with wrong password = %v, want WRONGPASS", err)
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	tests := []struct {
+		addr     string
+		password string
+		want     error
+	}{
+		{"127.0.0.1:0", "", nil},
+		{"localhost:0", "", nil},
+		{"[::1]:0", "", nil},
+		{":0", "", ErrNoPassword},
+		{"0.0.0.0:0", "", ErrNoPassword},
+		{"0.0.0.0:0", "secret", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr+"/"+tt.password, func(t *testing.T) {
+			srv := NewServer(newPersistent(t), tt.password)
+			defer srv.Close()
+			err := srv.Listen(tt.addr)
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("Listen = %v, want %v", err, tt.want)
+				}
+				return
+			}
+			// Hosts without IPv6 can't bind ::1
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && tt.addr == "[::1]:0" {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
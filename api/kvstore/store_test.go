@@ -0,0 +1,260 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBackend keeps persisted entries in a map
+type memBackend struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func (b *memBackend) LoadEntries() ([]Entry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []Entry
+	for _, e := range b.entries {
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (b *memBackend) SaveEntries(put []Entry, del []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.entries == nil {
+		b.entries = make(map[string]Entry)
+	}
+	for _, e := range put {
+		b.entries[e.Key] = e
+	}
+	for _, k := range del {
+		delete(b.entries, k)
+	}
+	return nil
+}
+
+func newPersistent(t *testing.T) *Persistent {
+	t.Helper()
+	p, err := NewPersistent(&memBackend{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// newServer serves a fresh Persistent store on a loopback port and returns its address
+func newServer(t *testing.T, password string) string {
+	t.Helper()
+	srv := NewServer(newPersistent(t), password)
+	if err := srv.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr()
+}
+
+// stores runs the same tests against every Store implementation
+var stores = map[string]func(t *testing.T) Store{
+	"memory":     func(t *testing.T) Store { return NewMemory() },
+	"persistent": func(t *testing.T) Store { return newPersistent(t) },
+	"client": func(t *testing.T) Store {
+		c := NewClient(Options{Addr: newServer(t, "secret"), Password: "secret"})
+		t.Cleanup(func() { c.Close() })
+		return c
+	},
+}
+
+func forEachStore(t *testing.T, fn func(t *testing.T, s Store)) {
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) { fn(t, open(t)) })
+	}
+}
+
+func TestStoreGetSetDel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		if _, err := s.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(missing) = %v, want ErrNotFound", err)
+		}
+		if err := s.Set(ctx, "a", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set(ctx, "a", "2"); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.Get(ctx, "a"); err != nil || v != "2" {
+			t.Fatalf("Get(a) = %q, %v, want 2", v, err)
+		}
+		if err := s.Set(ctx, "b", ""); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.Get(ctx, "b"); err != nil || v != "" {
+			t.Fatalf("Get(b) = %q, %v, want empty value", v, err)
+		}
+		if n, err := s.Del(ctx, "a", "b", "missing"); err != nil || n != 2 {
+			t.Fatalf("Del = %d, %v, want 2", n, err)
+		}
+		if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(a) after Del = %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreScan(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		var want []string
+		for i := range 25 {
+			k := fmt.Sprintf("scan:%02d", i)
+			want = append(want, k)
+			s.Set(ctx, k, "v")
+		}
+		s.Set(ctx, "other", "v")
+
+		var got []string
+		var cursor uint64
+		for pages := 0; ; pages++ {
+			if pages > 100 {
+				t.Fatal("scan did not terminate")
+			}
+			keys, next, err := s.Scan(ctx, cursor, "scan:*", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, keys...)
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Fatalf("scan returned %v, want %v", got, want)
+		}
+	})
+}
+
+// ResetSession and ClearSession delete the session:{phone}:* keys the core writes
+func TestDeletePattern(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		const phone = "2348012345678"
+		for i := range 1200 {
+			s.Set(ctx, fmt.Sprintf("session:%s:key-%d", phone, i), "v")
+		}
+		s.Set(ctx, "session:"+phone+":creds", "v")
+		keep := []string{
+			"sessions:" + phone,
+			"session:" + phone + "9:creds",
+			"session:234801234567:creds",
+			"session:*:creds",
+		}
+		for _, k := range keep {
+			s.Set(ctx, k, "v")
+		}
+
+		res, err := DeletePattern(ctx, s, fmt.Sprintf("session:%s:*", EscapeGlob(phone)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Matched != 1201 || res.Deleted != 1201 || len(res.Failed) != 0 {
+			t.Fatalf("DeletePattern = %+v, want 1201 matched and deleted", res)
+		}
+		if _, err := s.Get(ctx, "session:"+phone+":creds"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("creds survived: %v", err)
+		}
+		for _, k := range keep {
+			if _, err := s.Get(ctx, k); err != nil {
+				t.Errorf("%s was deleted: %v", k, err)
+			}
+		}
+
+		// Wildcards in the phone are matched literally
+		res, err = DeletePattern(ctx, s, fmt.Sprintf("session:%s:*", EscapeGlob("*")))
+		if err != nil || res.Deleted != 1 {
+			t.Fatalf("DeletePattern(*) = %+v, %v, want 1 deleted", res, err)
+		}
+		if _, err := s.Get(ctx, "sessions:"+phone); err != nil {
+			t.Fatalf("sessions:%s was deleted: %v", phone, err)
+		}
+	})
+}
+
+// The SCAN index follows every way keys come and go
+func TestPersistentScanIndex(t *testing.T) {
+	ctx := context.Background()
+	backend := &memBackend{}
+	p, err := NewPersistent(backend, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	scanAll := func(p *Persistent) []string {
+		t.Helper()
+		var got []string
+		var cursor uint64
+		for {
+			keys, next, err := p.Scan(ctx, cursor, "", 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, keys...)
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+		slices.Sort(got)
+		return got
+	}
+	check := func(step string, p *Persistent) {
+		t.Helper()
+		if got, want := scanAll(p), p.Keys(""); !slices.Equal(got, want) {
+			t.Fatalf("after %s scan returned %v, want %v", step, got, want)
+		}
+	}
+
+	for i := range 40 {
+		p.Set(ctx, fmt.Sprintf("s:%02d", i), "v")
+	}
+	p.SetWith("s:00", "again", SetOptions{}) // Overwriting doesn't add a key
+	p.HSet("h:1", map[string]string{"a": "1", "b": "2"})
+	p.HSet("h:2", map[string]string{"a": "1"})
+	check("writes", p)
+
+	p.Del(ctx, "s:01", "s:02", "missing")
+	p.HDel("h:2", "a")
+	p.Expire("s:03", 0)
+	p.SetWith("s:04", "v", SetOptions{TTL: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+	check("deletes and expiry", p)
+	if slices.Contains(scanAll(p), "s:04") || len(scanAll(p)) != 37 {
+		t.Fatalf("scan returned %v", scanAll(p))
+	}
+
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewPersistent(backend, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	check("reload", reloaded)
+
+	p.FlushAll()
+	check("flushall", p)
+	p.Set(ctx, "fresh", "v")
+	check("write after flushall", p)
+}
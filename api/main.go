@@ -1,81 +1,344 @@
 package main
 
 import (
+	"api/auth"
+	"api/config"
 	"api/database"
+	"api/export"
+	"api/kvstore"
 	"api/manager"
+	"api/ratelimit"
 	"api/routes"
+	"context"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/debug"
-
-	"bufio"
-	"bytes"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-const (
-	// memoryLimitBytes sets a 1GB soft memory limit for the GC
-	// This prevents aggressive GC under memory pressure while allowing
-	// the application to use system memory efficiently
-	memoryLimitBytes = 1024 * 1024 * 1024 // 1 GB
-)
-
 func main() {
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if handled, err := runCommand(cfg, args); handled {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Optimize GC to reduce blocking and ensure smooth process management
 	//
-	// SetGCPercent(200) reduces GC frequency by allowing the heap to grow
-	// to 2x the live set before triggering a collection. This trades increased
-	// memory usage for reduced GC blocking pauses.
+	// A GC percent of 200 (the default) reduces GC frequency by allowing the heap
+	// to grow to 2x the live set before triggering a collection. This trades
+	// increased memory usage for reduced GC blocking pauses.
 	//
 	// Trade-offs:
 	// - Reduces GC frequency and blocking pauses (improves responsiveness)
 	// - Increases memory usage (heap can grow to 2x before collection)
-	// - Adjust this value if memory is constrained or if more frequent GC is needed
-	debug.SetGCPercent(200)
+	// - Lower runtime.gc_percent if memory is constrained or if more frequent GC is needed
+	debug.SetGCPercent(cfg.Runtime.GCPercent)
 
-	// SetMemoryLimit sets a soft limit to prevent aggressive GC under memory pressure
+	// The soft memory limit (1 GB by default) prevents aggressive GC under memory pressure.
 	// This helps maintain predictable performance even when managing multiple WhatsApp instances
 	// The GC will be more aggressive as the application approaches this limit
-	debug.SetMemoryLimit(memoryLimitBytes)
+	debug.SetMemoryLimit(int64(cfg.Runtime.MemoryLimitMB) << 20)
+
+	database.InitDB(dbOptions(cfg))
+
+	bootstrapAdminKey(cfg.Auth.AdminAPIKey)
+
+	indexer, err := database.NewMessageIndexer(time.Duration(cfg.Search.IndexIntervalMS) * time.Millisecond)
+	if err != nil {
+		log.Fatal("Failed to start message indexer:", err)
+	}
+
+	kv, redisURL := openKVStore(cfg)
+
+	sm := manager.CreateSession(kv)
+	sm.CoreDir = cfg.Core.Dir
+	sm.CoreCommand = cfg.Core.Command
+	sm.ResetTimeout = time.Duration(cfg.Limits.ResetTimeoutS) * time.Second
+	if cfg.Limits.BulkConcurrency > 0 {
+		sm.BulkConcurrency = cfg.Limits.BulkConcurrency
+	}
+	sm.CoreEnv = coreEnv(cfg, redisURL)
+	sm.SyncSessionState(startupOptions(cfg))
+
+	rl := rateLimiter(cfg)
+
+	exports, err := export.NewRunner(cfg.Exports.Dir, time.Duration(cfg.Exports.RetentionH)*time.Hour)
+	if err != nil {
+		log.Fatal("Failed to start export runner:", err)
+	}
+
+	janitor := database.NewRetentionJanitor(janitorOptions(cfg))
+
+	app := fiber.New(fiber.Config{BodyLimit: cfg.Server.BodyLimitMB << 20})
+	routes.CastRoutes(app, sm, rl, exports, janitor)
+	setupOIDC(app, cfg)
+
+	// Shut down on SIGINT/SIGTERM so the kv store can flush pending writes
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		app.ShutdownWithTimeout(time.Duration(cfg.Server.ShutdownTimeoutS) * time.Second)
+	}()
 
-	database.InitDB()
+	if err := app.Listen(cfg.Server.Listen); err != nil {
+		log.Println(err)
+	}
+	rl.Quota.Close()
+	indexer.Close()
+	exports.Close()
+	janitor.Close()
+	kv.Close()
+}
 
-	sm := manager.CreateSession()
-	sm.SyncSessionState()
+func dbOptions(cfg *config.Config) database.Options {
+	return database.Options{Driver: cfg.DB.Driver, Path: cfg.DB.Path, DSN: cfg.DB.DSN}
+}
 
-	app := fiber.New()
-	routes.CastRoutes(app, sm)
+// janitorOptions converts the retention settings, keeping an hour between runs and
+// batches of 500 for invalid values
+func janitorOptions(cfg *config.Config) database.JanitorOptions {
+	opts := database.JanitorOptions{
+		Interval:       time.Hour,
+		Batch:          500,
+		Pause:          time.Duration(max(cfg.Retention.PauseMS, 0)) * time.Millisecond,
+		VacuumInterval: time.Duration(max(cfg.Retention.VacuumIntervalH, 0)) * time.Hour,
+		AuditMaxAge:    time.Duration(max(cfg.Retention.AuditDays, 0)) * 24 * time.Hour,
+	}
+	if n := cfg.Retention.IntervalM; n > 0 {
+		opts.Interval = time.Duration(n) * time.Minute
+	}
+	if n := cfg.Retention.BatchSize; n > 0 {
+		opts.Batch = n
+	}
+	return opts
+}
+
+// coreEnv is the environment passed to core processes: where to find the kv store,
+// the database and the API. Each process also gets a key of its own, see manager.
+func coreEnv(cfg *config.Config, redisURL string) []string {
+	dbPath, err := filepath.Abs(cfg.DB.Path)
+	if err != nil {
+		dbPath = cfg.DB.Path
+	}
+
+	addr, err := localAddr(cfg.Server.Listen)
+	if err != nil {
+		log.Fatal("Invalid listen address:", err)
+	}
+
+	env := []string{
+		"REDIS_URL=" + redisURL,
+		"WHATSALY_DB_DRIVER=" + cfg.DB.Driver,
+		"WHATSALY_DB_PATH=" + dbPath,
+		"WHATSALY_API_URL=http://" + addr,
+	}
+	if cfg.DB.DSN != "" {
+		env = append(env, "DATABASE_URL="+cfg.DB.DSN)
+	}
+
+	return env
+}
+
+// localAddr is the address to reach a server listening on listen from this machine
+func localAddr(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
 
-	env, _ := os.ReadFile("../.env")
-	port, ok := parseEnv(env)["PORT"]
-	if !ok {
-		port = "8080"
+// rateLimiter builds the API rate limiter, limits.rates overrides the default per minute
+// limits of route classes, e.g. "lifecycle=10,read=300"
+func rateLimiter(cfg *config.Config) *routes.RateLimiter {
+	defaults := ratelimit.DefaultLimits()
+	overrides, err := ratelimit.ParseLimits(cfg.Limits.Rates)
+	if err != nil {
+		log.Fatal("Invalid WHATSALY_RATE_LIMITS:", err)
+	}
+	for class, n := range overrides {
+		defaults[class] = n
 	}
 
-	log.Fatal(app.Listen(":" + port))
+	quota, err := ratelimit.NewQuota(database.QuotaBackend{}, time.Duration(cfg.Limits.QuotaFlushS)*time.Second)
+	if err != nil {
+		log.Fatal("Failed to load quota usage:", err)
+	}
+	return &routes.RateLimiter{Limiter: ratelimit.New(), Quota: quota, Defaults: defaults}
 }
 
-func parseEnv(buffer []byte) map[string]string {
-	env := make(map[string]string)
-	scanner := bufio.NewScanner(bytes.NewReader(buffer))
+// openKVStore connects to redis.url, or with redis.embedded serves the embedded
+// Redis compatible server on redis.listen backed by the SQLite database.
+// It returns the store and the URL the core should connect to.
+func openKVStore(cfg *config.Config) (kvstore.Store, string) {
+	if !cfg.Redis.Embedded {
+		kv, err := kvstore.Open(cfg.Redis.URL)
+		if err != nil {
+			log.Fatal("Invalid WHATSALY_REDIS_URL:", err)
+		}
+		return kv, cfg.Redis.URL
+	}
+
+	interval := time.Duration(cfg.Redis.FlushIntervalMS) * time.Millisecond
+	store, err := kvstore.NewPersistent(database.KVBackend{}, interval)
+	if err != nil {
+		log.Fatal("Failed to load kv store:", err)
+	}
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	srv := kvstore.NewServer(store, cfg.Redis.Password)
+	if err := srv.Listen(cfg.Redis.Listen); err != nil {
+		log.Fatal("Embedded redis server failed:", err)
+	}
+	go func() {
+		if err := srv.Serve(); err != nil {
+			log.Fatal("Embedded redis server failed:", err)
 		}
+	}()
 
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
+	u := url.URL{Scheme: "redis", Host: cfg.Redis.Listen}
+	if cfg.Redis.Password != "" {
+		u.User = url.UserPassword("default", cfg.Redis.Password)
+	}
+	return embeddedKV{store, srv}, u.String()
+}
+
+// embeddedKV closes the embedded server before the store, so the core's connections
+// are dropped and nothing is written after the last flush
+type embeddedKV struct {
+	*kvstore.Persistent
+	srv *kvstore.Server
+}
+
+func (e embeddedKV) Close() error {
+	if err := e.srv.Close(); err != nil {
+		log.Println("Error closing embedded redis server:", err)
+	}
+	return e.Persistent.Close()
+}
+
+// bootstrapAdminKey registers ADMIN_API_KEY as a super admin key. Without it, a key is
+// generated and printed once when the database has no active keys at all.
+func bootstrapAdminKey(key string) {
+	if key != "" {
+		if len(key) < auth.MinKeyLength {
+			log.Fatalf("WHATSALY_ADMIN_API_KEY must be at least %d characters", auth.MinKeyLength)
+		}
+		record := database.APIKey{
+			Name:     "bootstrap-admin",
+			TenantID: database.DefaultTenant,
+			Prefix:   auth.KeyPrefix(key),
+			Hash:     auth.HashKey(key),
+			Scopes:   auth.ScopeSuperAdmin,
 		}
+		if err := database.EnsureAPIKey(&record); err != nil {
+			log.Fatal("Failed to register WHATSALY_ADMIN_API_KEY:", err)
+		}
+		return
+	}
 
-		key := strings.TrimSpace(parts[0])
-		val := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
-		env[key] = val
+	count, err := database.CountActiveAPIKeys()
+	if err != nil || count > 0 {
+		return
 	}
 
-	return env
+	plain, prefix, err := auth.GenerateKey()
+	if err != nil {
+		log.Fatal("Failed to generate admin key:", err)
+	}
+	record := database.APIKey{
+		Name:     "generated-admin",
+		TenantID: database.DefaultTenant,
+		Prefix:   prefix,
+		Hash:     auth.HashKey(plain),
+		Scopes:   auth.ScopeSuperAdmin,
+	}
+	if err := database.CreateAPIKey(&record); err != nil {
+		log.Fatal("Failed to create admin key:", err)
+	}
+	fmt.Printf("No API keys found, created admin key (shown only once): %s\n", plain)
+}
+
+// setupOIDC enables single sign-on when oidc.issuer is set. Groups from oidc.groups_claim
+// are mapped to roles with oidc.role_map, e.g. "wa-admins=admin,wa-ops=operator".
+func setupOIDC(app *fiber.App, cfg *config.Config) {
+	if cfg.OIDC.Issuer == "" {
+		return
+	}
+
+	roles, err := auth.ParseRoleMap(cfg.OIDC.RoleMap)
+	if err != nil {
+		log.Fatal("Invalid WHATSALY_OIDC_ROLE_MAP:", err)
+	}
+	oc := auth.OIDCConfig{
+		Issuer:       cfg.OIDC.Issuer,
+		ClientID:     cfg.OIDC.ClientID,
+		ClientSecret: cfg.OIDC.ClientSecret,
+		RedirectURL:  cfg.OIDC.RedirectURL,
+		Scopes:       strings.Fields(cfg.OIDC.Scopes),
+		GroupsClaim:  cfg.OIDC.GroupsClaim,
+		RoleMap:      roles,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	provider, err := auth.NewOIDCProvider(ctx, oc)
+	if err != nil {
+		log.Fatal("Failed to set up OIDC:", err)
+	}
+
+	tenant := cfg.OIDC.Tenant
+	if tenant == "" {
+		tenant = database.DefaultTenant
+	}
+	if _, err := database.GetTenant(tenant); err != nil {
+		log.Fatal("Unknown WHATSALY_OIDC_TENANT:", tenant)
+	}
+	if n, err := database.AdoptOIDCUsers(oc.Issuer); err != nil {
+		log.Fatal("Failed to update OIDC users:", err)
+	} else if n > 0 {
+		fmt.Printf("Assigned issuer %s to %d existing OIDC users\n", oc.Issuer, n)
+	}
+	routes.OIDCRoutes(app, provider, tenant)
+}
+
+// startupOptions converts the startup settings, keeping the defaults for invalid values
+func startupOptions(cfg *config.Config) manager.StartupOptions {
+	opts := manager.DefaultStartupOptions()
+
+	if n := cfg.Startup.Concurrency; n > 0 {
+		opts.Concurrency = n
+	}
+	if n := cfg.Startup.DelayMS; n >= 0 {
+		opts.Delay = time.Duration(n) * time.Millisecond
+	}
+	if n := cfg.Startup.JitterMS; n >= 0 {
+		opts.Jitter = time.Duration(n) * time.Millisecond
+	}
+	if n := cfg.Startup.ReadyTimeoutS; n > 0 {
+		opts.ReadyTimeout = time.Duration(n) * time.Second
+	}
+
+	return opts
 }
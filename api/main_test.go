@@ -0,0 +1,49 @@
+package main
+
+import (
+	"api/kvstore"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// Shutting down drops the core's connections and flushes what they wrote
+func TestEmbeddedKVClose(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Redis.FlushIntervalMS = int(time.Hour / time.Millisecond)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redis.Listen = l.Addr().String()
+	l.Close()
+
+	kv, redisURL := openKVStore(cfg)
+	client, err := kvstore.Open(redisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+	if err := client.Set(ctx, "session:"+testPhone+":creds", "{}"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.DialTimeout("tcp", cfg.Redis.Listen, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("embedded server still accepts connections")
+	}
+	if _, err := client.Get(ctx, "session:"+testPhone+":creds"); err == nil {
+		t.Fatal("open connection still served after shutdown")
+	}
+
+	reloaded := openKV(t)
+	defer reloaded.Close()
+	if v, err := reloaded.Get(ctx, "session:"+testPhone+":creds"); err != nil || v != "{}" {
+		t.Fatalf("write lost on shutdown: %q, %v", v, err)
+	}
+}
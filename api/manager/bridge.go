@@ -43,11 +43,13 @@ func (sm *SessionManager) EventStreamData(w *Worker, data GoData) {
 			w.PairingCode = "" // Clear the code once connected
 		case "logged_out":
 			w.Status = "logged_out"
+			defer w.notify() // Let the supervisor stop the process and clear the session
 		default:
 			w.Status = newStatus
 		}
 	}
 	w.mu.Unlock()
 
+	w.markReady()
 	sm.SaveState(w)
 }
@@ -0,0 +1,141 @@
+package manager
+
+import (
+	"api/database"
+	"fmt"
+	"sync"
+)
+
+const (
+	defaultBulkConcurrency = 4
+	maxBulkConcurrency     = 32
+)
+
+// BulkSelector picks instances either by explicit phones or by status and labels
+type BulkSelector struct {
+	Phones []string        `json:"phones"`
+	Status string          `json:"status"`
+	Labels database.Labels `json:"labels"`
+	// TenantID restricts the selection to one tenant, empty selects across all
+	TenantID string `json:"-"`
+}
+
+type BulkResult struct {
+	Phone  string `json:"phone"`
+	OK     bool   `json:"ok"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+var bulkActions = map[string]bool{
+	"start": true, "stop": true, "pause": true, "resume": true, "restart": true, "reset": true,
+}
+
+func IsBulkAction(action string) bool {
+	return bulkActions[action]
+}
+
+// ResolveSelector returns the phones matched by the selector. Explicit phones take
+// precedence over status and label matching, those without a session in the
+// selector's tenant are returned as missing.
+func (sm *SessionManager) ResolveSelector(sel BulkSelector) (phones, missing []string, err error) {
+	if len(sel.Phones) > 0 {
+		sessions, err := database.ListSessions(database.SessionFilter{TenantID: sel.TenantID, Phones: sel.Phones})
+		if err != nil {
+			return nil, nil, err
+		}
+		known := make(map[string]bool, len(sessions))
+		for _, s := range sessions {
+			known[s.Phone] = true
+		}
+
+		seen := make(map[string]bool, len(sel.Phones))
+		for _, p := range sel.Phones {
+			if p == "" || seen[p] {
+				continue
+			}
+			seen[p] = true
+			if known[p] {
+				phones = append(phones, p)
+			} else {
+				missing = append(missing, p)
+			}
+		}
+		return phones, missing, nil
+	}
+
+	if sel.Status == "" && len(sel.Labels) == 0 {
+		return nil, nil, fmt.Errorf("selector must contain phones, status or labels")
+	}
+
+	sessions, err := database.ListSessions(database.SessionFilter{
+		TenantID: sel.TenantID,
+		Status:   sel.Status,
+		Labels:   sel.Labels,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, s := range sessions {
+		phones = append(phones, s.Phone)
+	}
+	return phones, nil, nil
+}
+
+// Bulk applies action to every phone with at most concurrency operations in flight
+func (sm *SessionManager) Bulk(action string, phones []string, concurrency int) []BulkResult {
+	if concurrency <= 0 {
+		concurrency = sm.BulkConcurrency
+	}
+	if concurrency > maxBulkConcurrency {
+		concurrency = maxBulkConcurrency
+	}
+
+	results := make([]BulkResult, len(phones))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, phone := range phones {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res := BulkResult{Phone: phone}
+			if err := sm.applyAction(action, phone); err != nil {
+				res.Error = err.Error()
+			} else {
+				res.OK = true
+				if w, ok := sm.GetWorker(phone); ok {
+					res.Status = w.GetStatus()
+				}
+			}
+			results[i] = res
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (sm *SessionManager) applyAction(action, phone string) error {
+	switch action {
+	case "start":
+		return sm.StartInstance(phone, "starting")
+	case "stop":
+		return sm.StopInstance(phone)
+	case "pause":
+		return sm.PauseInstance(phone, true)
+	case "resume":
+		return sm.PauseInstance(phone, false)
+	case "restart":
+		return sm.RestartInstance(phone)
+	case "reset":
+		_, err := sm.ClearSession(phone)
+		return err
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
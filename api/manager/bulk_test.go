@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"api/database"
+	"slices"
+	"testing"
+)
+
+func TestResolveSelector(t *testing.T) {
+	sm := newTestManager(t)
+	sessions := []database.Session{
+		{Phone: "2348000000001", TenantID: database.DefaultTenant, Status: "stopped", Labels: database.Labels{"env": "prod"}},
+		{Phone: "2348000000002", TenantID: database.DefaultTenant, Status: "running", Labels: database.Labels{"env": "prod"}},
+		{Phone: "2348000000003", TenantID: database.DefaultTenant, Status: "running", Labels: database.Labels{"env": "dev"}},
+		{Phone: "2348000000004", TenantID: "acme", Status: "running", Labels: database.Labels{"env": "prod"}},
+	}
+	for _, s := range sessions {
+		if err := database.DB.Create(&s).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		sel     BulkSelector
+		phones  []string
+		missing []string
+		wantErr bool
+	}{
+		{"phones", BulkSelector{Phones: []string{"2348000000003", "2348000000001"}},
+			[]string{"2348000000003", "2348000000001"}, nil, false},
+		{"phones take precedence", BulkSelector{Phones: []string{"2348000000001"}, Status: "running"},
+			[]string{"2348000000001"}, nil, false},
+		{"unknown and repeated phones", BulkSelector{Phones: []string{"2348000000001", "2348000000009", "", "2348000000001"}},
+			[]string{"2348000000001"}, []string{"2348000000009"}, false},
+		{"another tenant's phone", BulkSelector{Phones: []string{"2348000000002", "2348000000004"}},
+			[]string{"2348000000002"}, []string{"2348000000004"}, false},
+		{"status", BulkSelector{Status: "running"}, []string{"2348000000002", "2348000000003"}, nil, false},
+		{"status and labels", BulkSelector{Status: "running", Labels: database.Labels{"env": "prod"}},
+			[]string{"2348000000002"}, nil, false},
+		{"empty", BulkSelector{}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.sel.TenantID = database.DefaultTenant
+			phones, missing, err := sm.ResolveSelector(tt.sel)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if !slices.Equal(phones, tt.phones) || !slices.Equal(missing, tt.missing) {
+				t.Fatalf("got %v missing %v, want %v missing %v", phones, missing, tt.phones, tt.missing)
+			}
+		})
+	}
+
+	// Without a tenant every tenant is selected
+	phones, missing, err := sm.ResolveSelector(BulkSelector{Phones: []string{"2348000000004"}})
+	if err != nil || !slices.Equal(phones, []string{"2348000000004"}) || missing != nil {
+		t.Fatalf("across tenants got %v missing %v, %v", phones, missing, err)
+	}
+}
+
+func TestBulk(t *testing.T) {
+	sm := newTestManager(t)
+	phones := []string{"2348000000001", "2348000000002", "2348000000003"}
+
+	results := sm.Bulk("start", phones, 2)
+	for i, res := range results {
+		if res.Phone != phones[i] || !res.OK || res.Status != "starting" {
+			t.Errorf("start result %+v", res)
+		}
+	}
+	for _, p := range phones {
+		w, _ := sm.GetWorker(p)
+		eventually(t, p+" to run", running(w))
+	}
+
+	// Results keep the order of the phones, failures don't stop the others
+	results = sm.Bulk("stop", []string{"2348000000002", "2348000000009", "2348000000001"}, 0)
+	want := []BulkResult{
+		{Phone: "2348000000002", OK: true, Status: "stopped"},
+		{Phone: "2348000000009", Error: "instance not found"},
+		{Phone: "2348000000001", OK: true, Status: "stopped"},
+	}
+	if !slices.Equal(results, want) {
+		t.Fatalf("stop results %+v, want %+v", results, want)
+	}
+	if w, _ := sm.GetWorker("2348000000003"); !running(w)() {
+		t.Error("instance outside the selection was stopped")
+	}
+
+	if res := sm.Bulk("explode", phones[:1], 1); res[0].OK || res[0].Error == "" {
+		t.Fatalf("unknown action gave %+v", res[0])
+	}
+}
@@ -1,10 +1,15 @@
 package manager
 
 import (
+	"api/auth"
 	"api/database"
+	"api/kvstore"
+	"api/phone"
+	"context"
+	"errors"
 	"fmt"
-	"os/exec"
 	"sync"
+	"time"
 
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
@@ -13,12 +18,25 @@ import (
 
 type SessionManager struct {
 	Workers map[string]*Worker
-	mu      sync.Mutex
+	KV      kvstore.Store // Auth key cache shared with the core
+	CoreEnv []string      // Extra environment passed to core processes
+
+	CoreDir         string // Working directory of core processes
+	CoreCommand     string // Runtime that runs ./index.js
+	ResetTimeout    time.Duration
+	BulkConcurrency int
+
+	mu sync.Mutex
 }
 
-func CreateSession() *SessionManager {
+func CreateSession(kv kvstore.Store) *SessionManager {
 	return &SessionManager{
-		Workers: make(map[string]*Worker),
+		Workers:         make(map[string]*Worker),
+		KV:              kv,
+		CoreDir:         "../core",
+		CoreCommand:     "bun",
+		ResetTimeout:    30 * time.Second,
+		BulkConcurrency: defaultBulkConcurrency,
 	}
 }
 
@@ -29,29 +47,58 @@ func (sm *SessionManager) GetWorker(phone string) (*Worker, bool) {
 	return w, ok
 }
 
+// StartInstance attaches a supervisor to the worker for phone, creating the worker if needed.
+// It is idempotent: an instance that is already supervised is only taken out of pause.
 func (sm *SessionManager) StartInstance(phone string, status string) error {
 	sm.mu.Lock()
-
 	w, exists := sm.Workers[phone]
-	if exists && w.IsRunning {
-		sm.mu.Unlock()
-		return fmt.Errorf("instance for %s is already running", phone)
-	}
-
 	if !exists {
-		w = &Worker{
-			Phone:  phone,
-			Status: status,
-		}
+		w = newWorker(phone, status)
 		sm.Workers[phone] = w
 	}
 	sm.mu.Unlock()
 
-	go sm.supervisor(w)
+	w.mu.Lock()
+	if w.cancel != nil {
+		changed := w.Status == "paused"
+		if changed {
+			w.Status = status
+		}
+		w.mu.Unlock()
+		if changed {
+			w.notify()
+			sm.SaveState(w)
+		}
+		return nil
+	}
+
+	if exists {
+		w.Status = status
+	}
+	sm.attachLocked(w)
+	w.mu.Unlock()
 
 	return nil
 }
 
+// StopInstance terminates the supervisor and its process without pausing the instance,
+// so it is started again on the next boot.
+func (sm *SessionManager) StopInstance(phone string) error {
+	w, ok := sm.GetWorker(phone)
+	if !ok {
+		return fmt.Errorf("instance not found")
+	}
+
+	// The status changes together with detaching the supervisor, so a concurrent
+	// start either happens before and is stopped, or after and attaches a new one
+	done := w.stop("stopped")
+	sm.SaveState(w)
+	if done != nil {
+		<-done
+	}
+	return nil
+}
+
 func (sm *SessionManager) PauseInstance(phone string, pause bool) error {
 	sm.mu.Lock()
 	w, ok := sm.Workers[phone]
@@ -64,14 +111,43 @@ func (sm *SessionManager) PauseInstance(phone string, pause bool) error {
 	w.mu.Lock()
 	if pause {
 		w.Status = "paused"
-		if w.Process != nil && w.Process.Process != nil {
-			w.Process.Process.Kill()
-		}
 	} else {
 		w.Status = "starting"
+		// Workers restored as paused from the database have no supervisor yet
+		if w.cancel == nil {
+			sm.attachLocked(w)
+		}
 	}
 	w.mu.Unlock()
 
+	// The supervisor kills the process on pause and starts it on resume
+	w.notify()
+	sm.SaveState(w)
+	return nil
+}
+
+// ErrPaused is returned when restarting a paused instance, which would otherwise
+// either do nothing or silently resume it
+var ErrPaused = errors.New("instance is paused, resume it instead")
+
+// RestartInstance replaces the supervisor with a fresh one, which starts the process
+// once the old one has exited
+func (sm *SessionManager) RestartInstance(phone string) error {
+	w, ok := sm.GetWorker(phone)
+	if !ok {
+		return fmt.Errorf("instance not found")
+	}
+
+	w.mu.Lock()
+	if w.Status == "paused" {
+		w.mu.Unlock()
+		return ErrPaused
+	}
+	w.detachLocked()
+	w.Status = "starting"
+	sm.attachLocked(w)
+	w.mu.Unlock()
+
 	sm.SaveState(w)
 	return nil
 }
@@ -94,100 +170,120 @@ func (sm *SessionManager) SaveState(w *Worker) {
 	}
 }
 
-func (sm *SessionManager) ResetSession(phone string) error {
+// coreKey issues the API key a core process calls back into the API with. It only
+// allows writing the settings of the process's own instance, and replaces the key
+// of the previous process.
+func coreKey(phone string) (string, error) {
+	tenant := database.DefaultTenant
+	if s, err := database.GetSession(phone); err == nil {
+		tenant = s.TenantID
+	}
+	plain, prefix, err := auth.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	err = database.ReplaceInstanceKey(&database.APIKey{
+		Name:     "core:" + phone,
+		TenantID: tenant,
+		Phone:    phone,
+		Prefix:   prefix,
+		Hash:     auth.HashKey(plain),
+		Scopes:   auth.ScopeSettingsWrite,
+	})
+	return plain, err
+}
+
+// ResolvePhone normalizes raw to the key of its session. Sessions stored before
+// numbers were normalized keep their original key, raw is used as is when it matches
+// one exactly and no session exists under the normalized form.
+func ResolvePhone(raw string) (string, error) {
+	p, err := phone.Normalize(raw)
+	if p == raw {
+		return p, nil
+	}
+	if err == nil {
+		if _, lookupErr := database.GetSession(p); lookupErr == nil {
+			return p, nil
+		}
+	}
+	if _, lookupErr := database.GetSession(raw); lookupErr == nil {
+		return raw, nil
+	}
+	return p, err
+}
+
+// checkPhone guards the data clearing paths against keys that were not normalized.
+// Sessions stored before numbers were normalized are accepted by their exact key.
+func checkPhone(p string) error {
+	if phone.Valid(p) {
+		return nil
+	}
+	if _, err := database.GetSession(p); err == nil {
+		return nil
+	}
+	return fmt.Errorf("invalid phone number %q", p)
+}
+
+// ResetSession kills the running process and drops the cached auth keys for phone
+func (sm *SessionManager) ResetSession(phone string) (kvstore.DeleteResult, error) {
+	if err := checkPhone(phone); err != nil {
+		return kvstore.DeleteResult{}, err
+	}
+
 	sm.mu.Lock()
 	w, ok := sm.Workers[phone]
 	sm.mu.Unlock()
 
-	if ok && w.Process != nil && w.Process.Process != nil {
-		w.Process.Process.Kill()
+	if ok {
+		w.kill()
 	}
 
-	cmd := exec.Command("redis-cli", "DEL", fmt.Sprintf("sessions:%s", phone))
-	return cmd.Run()
+	return sm.flushKeys(phone)
+}
+
+// flushKeys deletes every session:{phone}:* key from the kv store
+func (sm *SessionManager) flushKeys(phone string) (kvstore.DeleteResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sm.ResetTimeout)
+	defer cancel()
+
+	return kvstore.DeletePattern(ctx, sm.KV, fmt.Sprintf("session:%s:*", kvstore.EscapeGlob(phone)))
 }
 
 // ClearSession removes all user data associated with a phone number from all database tables and Redis
-func (sm *SessionManager) ClearSession(phone string) error {
+func (sm *SessionManager) ClearSession(phone string) (kvstore.DeleteResult, error) {
+	if err := checkPhone(phone); err != nil {
+		return kvstore.DeleteResult{}, err
+	}
+
 	// Kill the process if it's running
 	sm.mu.Lock()
 	w, ok := sm.Workers[phone]
 	if ok {
-		if w.Process != nil && w.Process.Process != nil {
-			w.Process.Process.Kill()
-		}
 		// Remove from workers map
 		delete(sm.Workers, phone)
 	}
 	sm.mu.Unlock()
 
-	// Clear from Go-managed tables (sessions and user_settings)
-	// Delete from sessions table
-	if err := database.DB.Where("phone = ?", phone).Delete(&database.Session{}).Error; err != nil {
-		fmt.Printf("Error deleting from sessions table: %v\n", err)
-	}
-
-	// Delete from user_settings table
-	if err := database.DB.Where("user = ?", phone).Delete(&database.UserSettings{}).Error; err != nil {
-		fmt.Printf("Error deleting from user_settings table: %v\n", err)
-	}
-
-	// Clear from shared SQLite tables (user_contacts, user_messages, group_metadata, auth_data)
-	// These are managed by the TypeScript/Bun side but we can access the same SQLite database
-	db := database.DB
-
-	// Delete from user_contacts table
-	if err := db.Exec("DELETE FROM user_contacts WHERE session_phone = ?", phone).Error; err != nil {
-		fmt.Printf("Error deleting from user_contacts table: %v\n", err)
-	}
-
-	// Delete from user_messages table
-	if err := db.Exec("DELETE FROM user_messages WHERE session_phone = ?", phone).Error; err != nil {
-		fmt.Printf("Error deleting from user_messages table: %v\n", err)
-	}
-
-	// Delete from group_metadata table
-	if err := db.Exec("DELETE FROM group_metadata WHERE session_phone = ?", phone).Error; err != nil {
-		fmt.Printf("Error deleting from group_metadata table: %v\n", err)
+	// Cancelling the supervisor kills the process. We don't wait for it to exit
+	// because ClearSession is also called from the supervisor itself on logout.
+	if ok {
+		w.stop("")
 	}
 
-	// Delete from auth_data table using LIKE pattern to match session:{phone}:*
-	if err := db.Exec("DELETE FROM auth_data WHERE id LIKE ?", fmt.Sprintf("session:%s:%%", phone)).Error; err != nil {
-		fmt.Printf("Error deleting from auth_data table: %v\n", err)
+	// Clear the session, its settings and the core's tables (contacts, messages, groups, auth)
+	if err := database.PurgeSessionData(phone); err != nil {
+		fmt.Printf("Error deleting session data: %v\n", err)
 	}
 
-	// Flush Redis data using KEYS pattern and delete matching keys
-	// We use redis-cli with --scan to safely handle large key sets
-	pattern := fmt.Sprintf("session:%s:*", phone)
-	cmd := exec.Command("bash", "-c", fmt.Sprintf("redis-cli --scan --pattern '%s' | xargs -r redis-cli DEL", pattern))
-	if err := cmd.Run(); err != nil {
+	// Flush Redis data page by page with SCAN
+	res, err := sm.flushKeys(phone)
+	if err != nil {
 		fmt.Printf("Error flushing Redis data: %v\n", err)
-		return err
+		return res, err
 	}
 
-	fmt.Printf("Successfully cleared all data for phone: %s\n", phone)
-	return nil
-}
-
-func (sm *SessionManager) SyncSessionState() {
-	var sessions []database.Session
-	// Load everything that isn't logged out
-	database.DB.Where("status != ?", "logged_out").Find(&sessions)
-
-	for _, s := range sessions {
-		if s.Status != "paused" {
-			// Auto-start active sessions
-			sm.StartInstance(s.Phone, "starting")
-		} else {
-			// Keep paused sessions in memory
-			sm.mu.Lock()
-			sm.Workers[s.Phone] = &Worker{
-				Phone:  s.Phone,
-				Status: "paused",
-			}
-			sm.mu.Unlock()
-		}
-	}
+	fmt.Printf("Successfully cleared all data for phone: %s (%d keys)\n", phone, res.Deleted)
+	return res, nil
 }
 
 type SystemStats struct {
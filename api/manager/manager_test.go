@@ -0,0 +1,322 @@
+package manager
+
+import (
+	"api/auth"
+	"api/database"
+	"api/kvstore"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestManager runs "sh run" as the core, a script that sleeps until killed,
+// against a fresh SQLite database
+func newTestManager(t *testing.T) *SessionManager {
+	t.Helper()
+	dir := t.TempDir()
+	database.Open(database.Options{Driver: "sqlite", Path: filepath.Join(dir, "test.sqlite")})
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if db, err := database.DB.DB(); err == nil {
+			db.Close()
+		}
+	})
+	if err := os.WriteFile(filepath.Join(dir, "run"), []byte("exec sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := CreateSession(kvstore.NewMemory())
+	sm.CoreDir = dir
+	sm.CoreCommand = "sh"
+	t.Cleanup(func() {
+		for phone := range sm.Workers {
+			sm.StopInstance(phone)
+		}
+	})
+	return sm
+}
+
+// eventually polls cond for up to two seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for range 200 {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func running(w *Worker) func() bool {
+	return func() bool { return w.GetData()["is_running"].(bool) }
+}
+
+func storedStatus(t *testing.T, phone string) string {
+	t.Helper()
+	s, err := database.GetSession(phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Status
+}
+
+const testPhone = "2348012345678"
+
+func TestStopInstance(t *testing.T) {
+	sm := newTestManager(t)
+	if err := sm.StartInstance(testPhone, "starting"); err != nil {
+		t.Fatal(err)
+	}
+	w, _ := sm.GetWorker(testPhone)
+	eventually(t, "process start", running(w))
+
+	if err := sm.StopInstance(testPhone); err != nil {
+		t.Fatal(err)
+	}
+	if running(w)() {
+		t.Error("process still running after stop")
+	}
+	if got := w.GetStatus(); got != "stopped" {
+		t.Errorf("status = %q, want stopped", got)
+	}
+	if got := storedStatus(t, testPhone); got != "stopped" {
+		t.Errorf("stored status = %q, want stopped", got)
+	}
+}
+
+// A start racing with a stop must either be undone by it or leave a live supervisor,
+// never a running process under "stopped"
+func TestStopStartRace(t *testing.T) {
+	sm := newTestManager(t)
+	sm.StartInstance(testPhone, "starting")
+	w, _ := sm.GetWorker(testPhone)
+
+	for range 20 {
+		done := make(chan struct{})
+		go func() {
+			sm.StopInstance(testPhone)
+			close(done)
+		}()
+		sm.StartInstance(testPhone, "starting")
+		<-done
+
+		w.mu.RLock()
+		status, supervised := w.Status, w.cancel != nil
+		w.mu.RUnlock()
+		if (status == "stopped") == supervised {
+			t.Fatalf("status %q with supervisor attached = %v", status, supervised)
+		}
+	}
+
+	sm.StartInstance(testPhone, "starting")
+	eventually(t, "process start", running(w))
+}
+
+func TestRestartInstance(t *testing.T) {
+	sm := newTestManager(t)
+	sm.StartInstance(testPhone, "starting")
+	w, _ := sm.GetWorker(testPhone)
+	eventually(t, "process start", running(w))
+
+	w.mu.RLock()
+	first := w.Process
+	w.mu.RUnlock()
+	if err := sm.RestartInstance(testPhone); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "new process", func() bool {
+		w.mu.RLock()
+		defer w.mu.RUnlock()
+		return w.Process != nil && w.Process != first && w.IsRunning
+	})
+}
+
+func TestRestartPausedInstance(t *testing.T) {
+	sm := newTestManager(t)
+	sm.mu.Lock()
+	sm.Workers[testPhone] = newWorker(testPhone, "paused") // Restored from the database
+	sm.mu.Unlock()
+
+	if err := sm.RestartInstance(testPhone); !errors.Is(err, ErrPaused) {
+		t.Fatalf("err = %v, want ErrPaused", err)
+	}
+	w, _ := sm.GetWorker(testPhone)
+	if got := w.GetStatus(); got != "paused" {
+		t.Errorf("status = %q, want paused", got)
+	}
+
+	res := sm.Bulk("restart", []string{testPhone}, 1)
+	if res[0].OK || res[0].Error == "" {
+		t.Errorf("bulk restart of a paused instance = %+v, want an error", res[0])
+	}
+}
+
+func TestResumeRestoredInstance(t *testing.T) {
+	sm := newTestManager(t)
+	sm.mu.Lock()
+	sm.Workers[testPhone] = newWorker(testPhone, "paused")
+	sm.mu.Unlock()
+
+	if err := sm.PauseInstance(testPhone, false); err != nil {
+		t.Fatal(err)
+	}
+	w, _ := sm.GetWorker(testPhone)
+	eventually(t, "process start", running(w))
+}
+
+func TestStaggeredStartSkipsStopped(t *testing.T) {
+	sm := newTestManager(t)
+	queue := []database.Session{{Phone: "2348000000001"}, {Phone: "2348000000002"}, {Phone: "2348000000003"}}
+	sm.mu.Lock()
+	for _, s := range queue {
+		sm.Workers[s.Phone] = newWorker(s.Phone, "starting")
+	}
+	sm.mu.Unlock()
+
+	// Stopped and paused through the API while waiting for a startup slot
+	sm.StopInstance("2348000000002")
+	sm.PauseInstance("2348000000003", true)
+
+	sm.staggeredStart(queue, StartupOptions{Concurrency: 3, ReadyTimeout: time.Millisecond})
+
+	for _, tt := range []struct {
+		phone      string
+		status     string
+		supervised bool
+	}{
+		{"2348000000001", "starting", true},
+		{"2348000000002", "stopped", false},
+		{"2348000000003", "paused", false},
+	} {
+		w, _ := sm.GetWorker(tt.phone)
+		w.mu.RLock()
+		status, supervised := w.Status, w.cancel != nil
+		w.mu.RUnlock()
+		if status != tt.status || supervised != tt.supervised {
+			t.Errorf("%s: status %q supervised %v, want %q %v", tt.phone, status, supervised, tt.status, tt.supervised)
+		}
+	}
+}
+
+// Sessions stored before numbers were normalized can be cleared, and the wildcards
+// their keys may hold don't reach other sessions
+func TestResolvePhone(t *testing.T) {
+	newTestManager(t)
+	for _, p := range []string{"+234 801 234 5678", "2348087654321", "12345"} {
+		if err := database.DB.Create(&database.Session{Phone: p, TenantID: database.DefaultTenant}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"2348087654321", "2348087654321", false},
+		{"+234 808 765 4321", "2348087654321", false},
+		{"+234 801 234 5678", "+234 801 234 5678", false}, // Legacy key, nothing under the normalized form
+		{"12345", "12345", false},
+		{"+234 809 000 0000", "2348090000000", false}, // No session yet
+		{"54321", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ResolvePhone(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClearLegacySession(t *testing.T) {
+	const other = "2348012345678"
+	for _, legacy := range []string{"+234 801 234 5678", "234801234567*", "234801234567%"} {
+		t.Run(legacy, func(t *testing.T) {
+			sm := newTestManager(t)
+			ctx := context.Background()
+			for _, p := range []string{legacy, other} {
+				if err := database.DB.Create(&database.Session{Phone: p, TenantID: database.DefaultTenant}).Error; err != nil {
+					t.Fatal(err)
+				}
+				sm.KV.Set(ctx, "session:"+p+":creds", "{}")
+				if err := database.DB.Exec("INSERT INTO auth_data (id, data) VALUES (?, '{}')", "session:"+p+":creds").Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := sm.ClearSession(legacy); err != nil {
+				t.Fatalf("clear: %v", err)
+			}
+			if _, err := database.GetSession(legacy); err == nil {
+				t.Error("legacy session still stored")
+			}
+			if _, err := sm.KV.Get(ctx, "session:"+legacy+":creds"); !errors.Is(err, kvstore.ErrNotFound) {
+				t.Errorf("legacy key still cached: %v", err)
+			}
+
+			if _, err := database.GetSession(other); err != nil {
+				t.Errorf("other session removed: %v", err)
+			}
+			if _, err := sm.KV.Get(ctx, "session:"+other+":creds"); err != nil {
+				t.Errorf("other session's key removed: %v", err)
+			}
+			var n int64
+			database.DB.Table("auth_data").Where("id = ?", "session:"+other+":creds").Count(&n)
+			if n != 1 {
+				t.Error("other session's auth data removed")
+			}
+		})
+	}
+
+	sm := newTestManager(t)
+	if _, err := sm.ClearSession("not a phone"); err == nil {
+		t.Error("clearing an unknown, invalid number succeeded")
+	}
+}
+
+func TestCoreKey(t *testing.T) {
+	sm := newTestManager(t)
+	if err := database.DB.Create(&database.Session{Phone: testPhone, TenantID: "acme"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := coreKey(testPhone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := coreKey(testPhone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each process gets a key of its own, the previous one stops working
+	if _, err := database.FindActiveAPIKey(auth.HashKey(first)); err == nil {
+		t.Fatal("key of the previous process is still valid")
+	}
+	key, err := database.FindActiveAPIKey(auth.HashKey(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Phone != testPhone || key.TenantID != "acme" || key.Scopes != auth.ScopeSettingsWrite {
+		t.Fatalf("key restricted to %q in %q with scopes %q", key.Phone, key.TenantID, key.Scopes)
+	}
+
+	// Removing the instance revokes its key
+	if _, err := sm.ClearSession(testPhone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.FindActiveAPIKey(auth.HashKey(second)); err == nil {
+		t.Fatal("key survived ClearSession")
+	}
+}
@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"api/database"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StartupOptions controls how SyncSessionState brings sessions back up on boot
+type StartupOptions struct {
+	// Concurrency is the number of instances allowed to be connecting at once
+	Concurrency int
+	// Delay is waited before each start, Jitter adds a random extra delay up to its value
+	Delay  time.Duration
+	Jitter time.Duration
+	// ReadyTimeout releases a startup slot if the instance has not reported a connection state
+	ReadyTimeout time.Duration
+}
+
+func DefaultStartupOptions() StartupOptions {
+	return StartupOptions{
+		Concurrency:  4,
+		Delay:        500 * time.Millisecond,
+		Jitter:       1500 * time.Millisecond,
+		ReadyTimeout: 60 * time.Second,
+	}
+}
+
+// SyncSessionState restores workers from the database. Paused sessions are only kept
+// in memory, the rest are started in the background ordered by startup priority.
+func (sm *SessionManager) SyncSessionState(opts StartupOptions) {
+	var sessions []database.Session
+	// Load everything that isn't logged out
+	database.DB.Where("status != ?", "logged_out").Find(&sessions)
+
+	var queue []database.Session
+	sm.mu.Lock()
+	for _, s := range sessions {
+		if s.Status == "paused" {
+			// Keep paused sessions in memory
+			sm.Workers[s.Phone] = newWorker(s.Phone, "paused")
+			continue
+		}
+		if _, ok := sm.Workers[s.Phone]; !ok {
+			sm.Workers[s.Phone] = newWorker(s.Phone, "starting")
+		}
+		queue = append(queue, s)
+	}
+	sm.mu.Unlock()
+
+	// Higher priority first, phone keeps the order stable
+	sort.SliceStable(queue, func(i, j int) bool {
+		if queue[i].StartupPriority != queue[j].StartupPriority {
+			return queue[i].StartupPriority > queue[j].StartupPriority
+		}
+		return queue[i].Phone < queue[j].Phone
+	})
+
+	go sm.staggeredStart(queue, opts)
+}
+
+func (sm *SessionManager) staggeredStart(queue []database.Session, opts StartupOptions) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+
+	for _, s := range queue {
+		sem <- struct{}{}
+
+		wait := opts.Delay
+		if opts.Jitter > 0 {
+			wait += rand.N(opts.Jitter)
+		}
+		time.Sleep(wait)
+
+		w, ok := sm.GetWorker(s.Phone)
+		if ok {
+			switch w.GetStatus() {
+			case "paused", "stopped":
+				ok = false
+			}
+		}
+		if !ok {
+			// Removed, paused or stopped while queued
+			<-sem
+			continue
+		}
+
+		if err := sm.StartInstance(s.Phone, "starting"); err != nil {
+			fmt.Printf("Error starting %s: %v\n", s.Phone, err)
+			<-sem
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			w.waitReady(opts.ReadyTimeout)
+		}()
+	}
+
+	wg.Wait()
+	fmt.Printf("Startup complete for %d sessions\n", len(queue))
+}
@@ -1,6 +1,9 @@
 package manager
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"os/exec"
 	"sync"
 	"time"
@@ -13,6 +16,44 @@ type Worker struct {
 	IsRunning   bool
 	Status      string
 	mu          sync.RWMutex
+
+	// cancel stops the supervisor goroutine; done is closed once it has exited.
+	// Both are nil while no supervisor is attached to the worker.
+	cancel context.CancelFunc
+	done   chan struct{}
+	// prev is closed once the last detached supervisor has exited, the next one
+	// waits for it so two never run a process for the same phone
+	prev chan struct{}
+
+	// ctrl wakes the supervisor after a status change
+	ctrl chan struct{}
+
+	// ready is closed once the process first reports a pairing code or connection state
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func newWorker(phone, status string) *Worker {
+	return &Worker{
+		Phone:  phone,
+		Status: status,
+		ctrl:   make(chan struct{}, 1),
+		ready:  make(chan struct{}),
+	}
+}
+
+func (w *Worker) markReady() {
+	w.readyOnce.Do(func() { close(w.ready) })
+}
+
+// waitReady blocks until the worker is ready or timeout has elapsed
+func (w *Worker) waitReady(timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-w.ready:
+	case <-t.C:
+	}
 }
 
 func (w *Worker) GetData() map[string]any {
@@ -32,8 +73,77 @@ func (w *Worker) GetStatus() string {
 	return w.Status
 }
 
-func (sm *SessionManager) supervisor(w *Worker) {
-	for {
+// notify signals the supervisor to re-evaluate the worker status.
+// Signals coalesce, so it never blocks.
+func (w *Worker) notify() {
+	select {
+	case w.ctrl <- struct{}{}:
+	default:
+	}
+}
+
+// kill terminates the current process, leaving the supervisor to restart it
+func (w *Worker) kill() {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.Process != nil && w.Process.Process != nil {
+		w.Process.Process.Kill()
+	}
+}
+
+// stop cancels and detaches the supervisor, setting status in the same step unless
+// it is empty. It returns a channel closed once the supervisor has exited, nil if
+// none was attached.
+func (w *Worker) stop(status string) chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if status != "" {
+		w.Status = status
+		w.PairingCode = ""
+	}
+	return w.detachLocked()
+}
+
+// detachLocked cancels the supervisor and forgets it, so a new one can be attached
+// right away. w.mu must be held.
+func (w *Worker) detachLocked() chan struct{} {
+	if w.cancel == nil {
+		return nil
+	}
+	w.cancel()
+	done := w.done
+	w.cancel, w.done, w.prev = nil, nil, done
+	return done
+}
+
+// attachLocked starts a supervisor for the worker. w.mu must be held.
+func (sm *SessionManager) attachLocked(w *Worker) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	prev := w.prev
+	w.cancel, w.done, w.prev = cancel, done, nil
+	go sm.supervisor(ctx, w, done, prev)
+}
+
+func (sm *SessionManager) supervisor(ctx context.Context, w *Worker, done, prev chan struct{}) {
+	// The detached supervisor was cancelled and exits promptly
+	if prev != nil {
+		<-prev
+	}
+
+	defer func() {
+		w.mu.Lock()
+		if w.done == done {
+			w.cancel = nil
+			w.done = nil
+		}
+		w.IsRunning = false
+		w.Process = nil
+		w.mu.Unlock()
+		close(done)
+	}()
+
+	for ctx.Err() == nil {
 		w.mu.RLock()
 		status := w.Status
 		w.mu.RUnlock()
@@ -41,29 +151,43 @@ func (sm *SessionManager) supervisor(w *Worker) {
 		if status == "logged_out" {
 			// Clear all session data when logged out
 			sm.ClearSession(w.Phone)
-			break
+			return
 		}
 
 		if status == "paused" {
-			time.Sleep(2 * time.Second)
+			// Block until resumed or stopped, paused workers cost no wakeups
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.ctrl:
+			}
 			continue
 		}
 
-		cmd := exec.Command("bun", "run", "./index.js", w.Phone)
-		cmd.Dir = "../core"
+		// CommandContext kills the process as soon as the worker is stopped
+		cmd := exec.CommandContext(ctx, sm.CoreCommand, "run", "./index.js", w.Phone)
+		cmd.Dir = sm.CoreDir
+		key, err := coreKey(w.Phone)
+		if err != nil {
+			fmt.Printf("Error issuing API key for %s: %v\n", w.Phone, err)
+			sm.cooldown(ctx, w, 5*time.Second)
+			continue
+		}
+		cmd.Env = append(os.Environ(), sm.CoreEnv...)
+		cmd.Env = append(cmd.Env, "WHATSALY_API_KEY="+key)
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
-			time.Sleep(5 * time.Second)
+			sm.cooldown(ctx, w, 5*time.Second)
 			continue
 		}
-		w.Process = cmd
 
 		if err := cmd.Start(); err != nil {
-			time.Sleep(5 * time.Second)
+			sm.cooldown(ctx, w, 5*time.Second)
 			continue
 		}
 
 		w.mu.Lock()
+		w.Process = cmd
 		w.IsRunning = true
 		w.mu.Unlock()
 
@@ -71,13 +195,54 @@ func (sm *SessionManager) supervisor(w *Worker) {
 		// block the supervisor from hitting cmd.Wait() or the next loop
 		go sm.ExtractStreams(w, stdout)
 
-		// Wait for the process to exit (either crash or killed by pause)
-		cmd.Wait()
+		exited := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(exited)
+		}()
+
+		crashed := sm.watch(ctx, w, cmd, exited)
 
 		w.mu.Lock()
 		w.IsRunning = false
+		w.Process = nil
 		w.mu.Unlock()
 
-		time.Sleep(2 * time.Second) // Small cooldown before restarting
+		if crashed {
+			sm.cooldown(ctx, w, 2*time.Second) // Small cooldown before restarting
+		}
+	}
+}
+
+// watch blocks until the process exits and reports whether it exited on its own.
+// Control signals that leave the worker paused or logged out kill the process immediately.
+func (sm *SessionManager) watch(ctx context.Context, w *Worker, cmd *exec.Cmd, exited chan struct{}) bool {
+	for {
+		select {
+		case <-exited:
+			return true
+		case <-ctx.Done():
+			<-exited
+			return false
+		case <-w.ctrl:
+			status := w.GetStatus()
+			if status != "paused" && status != "logged_out" {
+				continue
+			}
+			cmd.Process.Kill()
+			<-exited
+			return false
+		}
+	}
+}
+
+// cooldown waits before the next start attempt, cut short by any control signal
+func (sm *SessionManager) cooldown(ctx context.Context, w *Worker, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-w.ctrl:
+	case <-t.C:
 	}
 }
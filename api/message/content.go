@@ -0,0 +1,276 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Content is a WAMessage content object. It keeps the document order of its keys
+// because the content type is the first matching key, as in JavaScript.
+type Content struct {
+	keys   []string
+	fields map[string]json.RawMessage
+}
+
+// ParseContent parses a content object, null or empty input gives an empty Content
+func ParseContent(data []byte) (Content, error) {
+	var c Content
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || string(data) == "null" {
+		return c, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return c, err
+	} else if tok != json.Delim('{') {
+		return c, errors.New("message content is not an object")
+	}
+
+	c.fields = make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return c, err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return c, err
+		}
+		if _, dup := c.fields[key]; !dup {
+			c.keys = append(c.keys, key)
+		}
+		c.fields[key] = value
+	}
+	return c, nil
+}
+
+// Keys returns the content keys in document order
+func (c Content) Keys() []string {
+	return c.keys
+}
+
+// Field returns the raw value of key, nil when absent
+func (c Content) Field(key string) json.RawMessage {
+	return c.fields[key]
+}
+
+func (c Content) IsEmpty() bool {
+	return len(c.keys) == 0
+}
+
+// Type is the first key that is conversation or contains Message, skipping
+// senderKeyDistributionMessage, like get_content_type
+func (c Content) Type() string {
+	for _, key := range c.keys {
+		if (key == "conversation" || strings.Contains(key, "Message")) && key != "senderKeyDistributionMessage" {
+			return key
+		}
+	}
+	return ""
+}
+
+// wrappers hold another content object in their message field
+var wrappers = []string{
+	"ephemeralMessage",
+	"viewOnceMessage",
+	"viewOnceMessageV2",
+	"viewOnceMessageV2Extension",
+	"documentWithCaptionMessage",
+	"editedMessage",
+}
+
+// Unwrap returns the content inside disappearing, view once and similar wrappers.
+// The WASM functions don't unwrap, so a wrapped message has the wrapper as its type there.
+func (c Content) Unwrap() Content {
+	for range 8 {
+		inner, ok := c.wrapped()
+		if !ok {
+			break
+		}
+		c = inner
+	}
+	return c
+}
+
+func (c Content) wrapped() (Content, bool) {
+	for _, w := range wrappers {
+		raw := c.fields[w]
+		if raw == nil {
+			continue
+		}
+		var wrapper struct {
+			Message json.RawMessage `json:"message"`
+		}
+		if json.Unmarshal(raw, &wrapper) != nil {
+			continue
+		}
+		inner, err := ParseContent(wrapper.Message)
+		if err != nil || inner.IsEmpty() {
+			continue
+		}
+		return inner, true
+	}
+	return c, false
+}
+
+// textPaths mirrors extract_text_from_message, in order of precedence
+var textPaths = [][]string{
+	{"extendedTextMessage", "text"},
+	{"conversation"},
+	{"imageMessage", "caption"},
+	{"videoMessage", "caption"},
+	{"documentMessage", "caption"},
+	{"buttonsMessage", "contentText"},
+	{"templateMessage", "hydratedTemplate", "hydratedContentText"},
+	{"listMessage", "description"},
+}
+
+// Text returns the text or caption of the message, following edits
+func (c Content) Text() string {
+	for _, path := range textPaths {
+		var s string
+		if c.lookup(path, &s) {
+			return s
+		}
+	}
+
+	var edited json.RawMessage
+	if c.lookup([]string{"protocolMessage", "editedMessage"}, &edited) {
+		if inner, err := ParseContent(edited); err == nil {
+			return inner.Text()
+		}
+	}
+	return ""
+}
+
+// lookup decodes the value at path into out, reporting whether it was present
+// and of the right type
+func (c Content) lookup(path []string, out any) bool {
+	raw := c.fields[path[0]]
+	for _, key := range path[1:] {
+		if raw == nil {
+			return false
+		}
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(raw, &obj) != nil {
+			return false
+		}
+		raw = obj[key]
+	}
+	if raw == nil || string(raw) == "null" {
+		return false
+	}
+	return json.Unmarshal(raw, out) == nil
+}
+
+var mediaKinds = map[string]string{
+	"imageMessage":    "image",
+	"videoMessage":    "video",
+	"ptvMessage":      "video",
+	"audioMessage":    "audio",
+	"documentMessage": "document",
+	"stickerMessage":  "sticker",
+}
+
+// Media describes the attachment of media messages, nil for other types
+func (c Content) Media() *Media {
+	typ := c.Type()
+	kind, ok := mediaKinds[typ]
+	if !ok {
+		return nil
+	}
+
+	var m struct {
+		URL        string `json:"url"`
+		Mimetype   string `json:"mimetype"`
+		FileName   string `json:"fileName"`
+		FileLength Long   `json:"fileLength"`
+		Seconds    Long   `json:"seconds"`
+		Width      Long   `json:"width"`
+		Height     Long   `json:"height"`
+		PTT        bool   `json:"ptt"`
+		DirectPath string `json:"directPath"`
+	}
+	if json.Unmarshal(c.fields[typ], &m) != nil {
+		return &Media{Kind: kind}
+	}
+	return &Media{
+		Kind:       kind,
+		Mimetype:   m.Mimetype,
+		FileName:   m.FileName,
+		FileLength: int64(m.FileLength),
+		Seconds:    int64(m.Seconds),
+		Width:      int64(m.Width),
+		Height:     int64(m.Height),
+		PTT:        m.PTT,
+		URL:        m.URL,
+		DirectPath: m.DirectPath,
+	}
+}
+
+// Quoted returns the message this one replies to, from the contextInfo of its content
+func (c Content) Quoted() *Quoted {
+	var ctx struct {
+		StanzaID      string          `json:"stanzaId"`
+		Participant   string          `json:"participant"`
+		QuotedMessage json.RawMessage `json:"quotedMessage"`
+	}
+	if !c.lookup([]string{c.Type(), "contextInfo"}, &ctx) || ctx.StanzaID == "" {
+		return nil
+	}
+
+	q := &Quoted{ID: ctx.StanzaID, Sender: ctx.Participant}
+	if inner, err := ParseContent(ctx.QuotedMessage); err == nil {
+		inner = inner.Unwrap()
+		q.ContentType = inner.Type()
+		q.Text = inner.Text()
+	}
+	return q
+}
+
+// Long is a protobuf int64 as Baileys serializes it: a number, a decimal string or
+// an object with low and high 32 bit halves
+type Long int64
+
+func (l *Long) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0 || string(data) == "null":
+		*l = 0
+	case data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if s == "" {
+			*l = 0
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		*l = Long(n)
+	case data[0] == '{':
+		var v struct {
+			Low  int64 `json:"low"`
+			High int64 `json:"high"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*l = Long(v.High<<32 | int64(uint32(v.Low)))
+	default:
+		var f float64
+		if err := json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+		*l = Long(f)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package message
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// loadMessage reads a WAMessage from testdata, as the core stores it with JSON.stringify
+func loadMessage(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestContent checks the stored content against get_content_type and
+// extract_text_from_message of util/src/lib.rs, which see the content as stored,
+// and the decoded fields against the content with wrappers removed
+func TestContent(t *testing.T) {
+	tests := []struct {
+		file    string
+		rawType string // get_content_type
+		rawText string // extract_text_from_message
+		typ     string
+		text    string
+		media   *Media
+		quoted  *Quoted
+		sentAt  int64
+	}{
+		{
+			file:    "conversation.json",
+			rawType: "conversation", rawText: "Hello everyone",
+			typ: "conversation", text: "Hello everyone",
+			sentAt: 1709294400,
+		},
+		{
+			file:    "extended_text.json",
+			rawType: "extendedTextMessage", rawText: "See https://example.com",
+			typ: "extendedTextMessage", text: "See https://example.com",
+			sentAt: 1709294460,
+		},
+		{
+			file:    "image_caption.json",
+			rawType: "imageMessage", rawText: "Holiday photo",
+			typ: "imageMessage", text: "Holiday photo",
+			media: &Media{
+				Kind: "image", Mimetype: "image/jpeg", FileLength: 48213, Width: 960, Height: 1280,
+				URL:        "https://mmg.whatsapp.net/v/t62.7118-24/1234_5678.enc",
+				DirectPath: "/v/t62.7118-24/1234_5678.enc?ccb=11-4",
+			},
+			sentAt: 1709294520,
+		},
+		{
+			file:    "video_caption.json",
+			rawType: "videoMessage", rawText: "Look at this",
+			typ: "videoMessage", text: "Look at this",
+			media: &Media{
+				Kind: "video", Mimetype: "video/mp4", FileLength: 5000000000, Seconds: 42, Width: 1280, Height: 720,
+				URL:        "https://mmg.whatsapp.net/v/t62.7161-24/9876_5432.enc",
+				DirectPath: "/v/t62.7161-24/9876_5432.enc?ccb=11-4",
+			},
+			sentAt: 1709294580,
+		},
+		{
+			file:    "document.json",
+			rawType: "documentMessage", rawText: "Receipt",
+			typ: "documentMessage", text: "Receipt",
+			media: &Media{
+				Kind: "document", Mimetype: "application/pdf", FileName: "receipt.pdf", FileLength: 20480,
+				URL:        "https://mmg.whatsapp.net/v/t62.7119-24/3333_4444.enc",
+				DirectPath: "/v/t62.7119-24/3333_4444.enc?ccb=11-4",
+			},
+			sentAt: 1709294650,
+		},
+		{
+			file:    "document_caption.json",
+			rawType: "documentWithCaptionMessage", rawText: "",
+			typ: "documentMessage", text: "March invoice",
+			media: &Media{
+				Kind: "document", Mimetype: "application/pdf", FileName: "invoice.pdf", FileLength: 3000000000,
+				URL:        "https://mmg.whatsapp.net/v/t62.7119-24/1111_2222.enc",
+				DirectPath: "/v/t62.7119-24/1111_2222.enc?ccb=11-4",
+			},
+			sentAt: 1709294640,
+		},
+		{
+			file:    "view_once.json",
+			rawType: "viewOnceMessageV2", rawText: "",
+			typ: "imageMessage", text: "Only once",
+			media: &Media{
+				Kind: "image", Mimetype: "image/jpeg", FileLength: 1024, Width: 480, Height: 640,
+				URL: "https://mmg.whatsapp.net/v/t62.7118-24/5555_6666.enc",
+			},
+			sentAt: 1709294700,
+		},
+		{
+			file:    "ephemeral.json",
+			rawType: "ephemeralMessage", rawText: "",
+			typ: "extendedTextMessage", text: "This will vanish",
+			sentAt: 1709294760,
+		},
+		{
+			file:    "edit.json",
+			rawType: "protocolMessage", rawText: "Fixed the typo",
+			typ: "protocolMessage", text: "Fixed the typo",
+			sentAt: 1709294820,
+		},
+		{
+			file:    "quoted_reply.json",
+			rawType: "extendedTextMessage", rawText: "Where was this?",
+			typ: "extendedTextMessage", text: "Where was this?",
+			quoted: &Quoted{ID: "3A4D0E6F8A2B3C5D7E9F", Sender: "2348011111111@s.whatsapp.net", ContentType: "imageMessage", Text: "Only once"},
+			sentAt: 1709294880,
+		},
+		{
+			file:    "nested_8.json",
+			rawType: "ephemeralMessage", rawText: "",
+			typ: "conversation", text: "Deep inside",
+			sentAt: 1709294940,
+		},
+		{
+			// Unwrapping stops after 8 levels
+			file:    "nested_9.json",
+			rawType: "ephemeralMessage", rawText: "",
+			typ: "ephemeralMessage", text: "",
+			sentAt: 1709294940,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data := loadMessage(t, tt.file)
+			var doc struct {
+				Message json.RawMessage `json:"message"`
+			}
+			if err := json.Unmarshal(data, &doc); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := ParseContent(doc.Message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := raw.Type(); got != tt.rawType {
+				t.Errorf("stored type %q, want %q", got, tt.rawType)
+			}
+			if got := raw.Text(); got != tt.rawText {
+				t.Errorf("stored text %q, want %q", got, tt.rawText)
+			}
+
+			c := raw.Unwrap()
+			if got := c.Type(); got != tt.typ {
+				t.Errorf("type %q, want %q", got, tt.typ)
+			}
+			if got := c.Text(); got != tt.text {
+				t.Errorf("text %q, want %q", got, tt.text)
+			}
+			if got := c.Media(); !reflect.DeepEqual(got, tt.media) {
+				t.Errorf("media %+v, want %+v", got, tt.media)
+			}
+			if got := c.Quoted(); !reflect.DeepEqual(got, tt.quoted) {
+				t.Errorf("quoted %+v, want %+v", got, tt.quoted)
+			}
+
+			m, err := Decode(data, UserJID("2348012345678"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.ContentType != tt.typ || m.Text != tt.text {
+				t.Errorf("decoded %q %q, want %q %q", m.ContentType, m.Text, tt.typ, tt.text)
+			}
+			if want := time.Unix(tt.sentAt, 0).UTC(); !m.Timestamp.Equal(want) {
+				t.Errorf("timestamp %v, want %v", m.Timestamp, want)
+			}
+		})
+	}
+}
+
+func TestDecodeSender(t *testing.T) {
+	own := UserJID("2348012345678")
+	tests := []struct {
+		file   string
+		sender string
+	}{
+		{"conversation.json", "2348011111111@s.whatsapp.net"}, // Group participant
+		{"extended_text.json", own},                           // Own message in a direct chat
+		{"image_caption.json", "2348011111111@s.whatsapp.net"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			m, err := Decode(loadMessage(t, tt.file), own)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Sender != tt.sender {
+				t.Fatalf("sender %q, want %q", m.Sender, tt.sender)
+			}
+		})
+	}
+}
+
+func TestLongUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    Long
+		wantErr bool
+	}{
+		{"number", `1709294400`, 1709294400, false},
+		{"string", `"1709294400"`, 1709294400, false},
+		{"large string", `"5000000000"`, 5000000000, false},
+		{"low and high", `{"low":1709294400,"high":0,"unsigned":true}`, 1709294400, false},
+		{"negative low", `{"low":-1294967296,"high":0,"unsigned":true}`, 3000000000, false},
+		{"high word", `{"low":-102164808,"high":397,"unsigned":false}`, 1709294819000, false},
+		{"null", `null`, 0, false},
+		{"empty string", `""`, 0, false},
+		{"invalid string", `"soon"`, 0, true},
+		{"bool", `true`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := Long(-1)
+			err := json.Unmarshal([]byte(tt.json), &l)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && l != tt.want {
+				t.Fatalf("got %d, want %d", l, tt.want)
+			}
+		})
+	}
+}
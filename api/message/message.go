@@ -0,0 +1,107 @@
+// Package message decodes the Baileys WAMessage JSON stored by the core in
+// user_messages. Text and content type extraction match extract_text_from_message
+// and get_content_type of the util WASM module.
+package message
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type Key struct {
+	RemoteJID   string `json:"remoteJid"`
+	FromMe      bool   `json:"fromMe"`
+	ID          string `json:"id"`
+	Participant string `json:"participant,omitempty"`
+}
+
+// Message is the decoded form of a stored WAMessage
+type Message struct {
+	Key       Key
+	Chat      string // JID of the chat, a group JID for group messages
+	Sender    string // JID of the author, empty for own messages when the own JID is unknown
+	FromMe    bool
+	PushName  string
+	Timestamp time.Time // Zero when the document has no messageTimestamp
+
+	ContentType string // Key of the content after unwrapping, e.g. imageMessage
+	Text        string
+	Media       *Media
+	Quoted      *Quoted
+
+	// Content is the message content with wrappers removed
+	Content Content
+}
+
+type Media struct {
+	Kind       string `json:"kind"` // image, video, audio, document, sticker
+	Mimetype   string `json:"mimetype,omitempty"`
+	FileName   string `json:"file_name,omitempty"`
+	FileLength int64  `json:"file_length,omitempty"`
+	Seconds    int64  `json:"seconds,omitempty"`
+	Width      int64  `json:"width,omitempty"`
+	Height     int64  `json:"height,omitempty"`
+	PTT        bool   `json:"ptt,omitempty"` // Voice note
+	URL        string `json:"url,omitempty"`
+	DirectPath string `json:"direct_path,omitempty"`
+}
+
+// Quoted is the message a reply refers to
+type Quoted struct {
+	ID          string `json:"id"`
+	Sender      string `json:"sender,omitempty"`
+	ContentType string `json:"type"`
+	Text        string `json:"text"`
+}
+
+type document struct {
+	Key              Key             `json:"key"`
+	Message          json.RawMessage `json:"message"`
+	MessageTimestamp Long            `json:"messageTimestamp"`
+	PushName         string          `json:"pushName"`
+}
+
+// Decode parses a stored WAMessage. ownJID is the JID of the instance, used as the
+// sender of its own messages in direct chats.
+func Decode(data []byte, ownJID string) (*Message, error) {
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	content, err := ParseContent(doc.Message)
+	if err != nil {
+		return nil, err
+	}
+	content = content.Unwrap()
+
+	m := &Message{
+		Key:      doc.Key,
+		Chat:     doc.Key.RemoteJID,
+		FromMe:   doc.Key.FromMe,
+		PushName: doc.PushName,
+
+		ContentType: content.Type(),
+		Text:        content.Text(),
+		Media:       content.Media(),
+		Quoted:      content.Quoted(),
+		Content:     content,
+	}
+	switch {
+	case doc.Key.Participant != "":
+		m.Sender = doc.Key.Participant
+	case doc.Key.FromMe:
+		m.Sender = ownJID
+	default:
+		m.Sender = doc.Key.RemoteJID
+	}
+	if doc.MessageTimestamp > 0 {
+		m.Timestamp = time.Unix(int64(doc.MessageTimestamp), 0).UTC()
+	}
+	return m, nil
+}
+
+// UserJID is the JID of a phone number in normalized form
+func UserJID(phone string) string {
+	return phone + "@s.whatsapp.net"
+}
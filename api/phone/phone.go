@@ -0,0 +1,116 @@
+// Package phone parses and normalizes phone numbers to the digits-only E.164
+// form used as the session key across the API, the database and the core.
+package phone
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	minDigits = 7
+	maxDigits = 15 // E.164 limit including the country code
+)
+
+var (
+	ErrEmpty       = errors.New("phone number is empty")
+	ErrCharacters  = errors.New("phone number may only contain digits, spaces, dashes, dots, parentheses and a leading +")
+	ErrLength      = errors.New("phone number must have between 7 and 15 digits")
+	ErrCountryCode = errors.New("phone number has an unknown country code")
+)
+
+// Normalize strips formatting from raw and validates the result, returning
+// the number as digits only with the country code and no leading +.
+func Normalize(raw string) (string, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return "", ErrEmpty
+	}
+
+	if rest, ok := strings.CutPrefix(s, "+"); ok {
+		s = rest
+	} else if rest, ok := strings.CutPrefix(s, "00"); ok {
+		// International dialing prefix
+		s = rest
+	}
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", ErrCharacters
+		}
+	}
+	digits := b.String()
+
+	if len(digits) < minDigits || len(digits) > maxDigits {
+		return "", ErrLength
+	}
+
+	cc := CountryCode(digits)
+	if cc == "" {
+		return "", ErrCountryCode
+	}
+	if len(digits)-len(cc) < 4 {
+		return "", ErrLength
+	}
+
+	return digits, nil
+}
+
+// Valid reports whether s is already in normalized form
+func Valid(s string) bool {
+	n, err := Normalize(s)
+	return err == nil && n == s
+}
+
+// CountryCode returns the calling code prefix of a digits-only number, or "" if none matches
+func CountryCode(digits string) string {
+	for n := 1; n <= 3 && n <= len(digits); n++ {
+		if countryCodes[digits[:n]] {
+			return digits[:n]
+		}
+	}
+	return ""
+}
+
+// countryCodes holds the assigned ITU-T E.164 country calling codes.
+// Codes are prefix-free, so the first match by length is the only one.
+var countryCodes = toSet(
+	"1", "7",
+	"20", "27", "30", "31", "32", "33", "34", "36", "39", "40", "41", "43", "44", "45", "46", "47", "48", "49",
+	"51", "52", "53", "54", "55", "56", "57", "58", "60", "61", "62", "63", "64", "65", "66",
+	"81", "82", "84", "86", "90", "91", "92", "93", "94", "95", "98",
+	"211", "212", "213", "216", "218",
+	"220", "221", "222", "223", "224", "225", "226", "227", "228", "229",
+	"230", "231", "232", "233", "234", "235", "236", "237", "238", "239",
+	"240", "241", "242", "243", "244", "245", "246", "247", "248", "249",
+	"250", "251", "252", "253", "254", "255", "256", "257", "258",
+	"260", "261", "262", "263", "264", "265", "266", "267", "268", "269",
+	"290", "291", "297", "298", "299",
+	"350", "351", "352", "353", "354", "355", "356", "357", "358", "359",
+	"370", "371", "372", "373", "374", "375", "376", "377", "378",
+	"380", "381", "382", "383", "385", "386", "387", "389",
+	"420", "421", "423",
+	"500", "501", "502", "503", "504", "505", "506", "507", "508", "509",
+	"590", "591", "592", "593", "594", "595", "596", "597", "598", "599",
+	"670", "672", "673", "674", "675", "676", "677", "678", "679",
+	"680", "681", "682", "683", "685", "686", "687", "688", "689",
+	"690", "691", "692",
+	"800", "808", "850", "852", "853", "855", "856", "870", "878",
+	"880", "881", "882", "883", "886", "888",
+	"960", "961", "962", "963", "964", "965", "966", "967", "968",
+	"970", "971", "972", "973", "974", "975", "976", "977", "979",
+	"992", "993", "994", "995", "996", "998",
+)
+
+func toSet(codes ...string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		set[c] = true
+	}
+	return set
+}
@@ -0,0 +1,106 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		err  error
+	}{
+		{"2348012345678", "2348012345678", nil},
+		{"+2348012345678", "2348012345678", nil},
+		{"002348012345678", "2348012345678", nil},
+		{"  +234 801 234 5678\n", "2348012345678", nil},
+		{"0044 20 7946 0018", "442079460018", nil},
+		{"+1 (415) 555-0132", "14155550132", nil},
+		{"+44.20.7946.0018", "442079460018", nil},
+		{"+7 912 345-67-89", "79123456789", nil},
+		{"1234567", "1234567", nil},                 // Shortest: 7 digits
+		{"234123456789012", "234123456789012", nil}, // Longest: 15 digits
+		{"", "", ErrEmpty},
+		{"   ", "", ErrEmpty},
+		{"123456", "", ErrLength},
+		{"+234 80", "", ErrLength},
+		{"2341234567890123", "", ErrLength},
+		{"000447946001", "", ErrCountryCode}, // 00 is stripped once, the rest starts with 0
+		{"+0447946001", "", ErrCountryCode},
+		{"2807946001", "", ErrCountryCode}, // 28 is unassigned
+		{"2107946001", "", ErrCountryCode}, // Neither 21 nor 210 is assigned
+		{"9997946001", "", ErrCountryCode}, // 999 is reserved
+		{"++2348012345678", "", ErrCharacters},
+		{"234+8012345678", "", ErrCharacters},
+		{"234\t8012345678", "", ErrCharacters},
+		{"2348012345678x", "", ErrCharacters},
+		{"٢٣٤٨٠١٢٣٤٥٦٧٨", "", ErrCharacters}, // Non ASCII digits
+		{"2348012345678; rm -rf /", "", ErrCharacters},
+		{"$(reboot)2348012345678", "", ErrCharacters},
+		{"`id`2348012345678", "", ErrCharacters},
+		{"2348012345678 | nc host 1", "", ErrCharacters},
+		{"2348012345678&&true", "", ErrCharacters},
+		{"2348012345678' OR '1'='1", "", ErrCharacters},
+		{`2348012345678"; DROP TABLE sessions; --`, "", ErrCharacters},
+		{"234801234567%", "", ErrCharacters},
+		{"234801234567_", "", ErrCharacters},
+		{"234801234567*", "", ErrCharacters},
+		{"../2348012345678", "", ErrCharacters},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := Normalize(tt.raw)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Fatalf("Normalize(%q) = %q, %v, want %q, %v", tt.raw, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"2348012345678", true},
+		{"14155550132", true},
+		{"+2348012345678", false},
+		{"002348012345678", false},
+		{"234 801 234 5678", false},
+		{" 2348012345678", false},
+		{"123456", false},
+		{"2807946001", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := Valid(tt.s); got != tt.want {
+			t.Errorf("Valid(%q) = %t, want %t", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCountryCode(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   string
+	}{
+		{"14155550132", "1"},
+		{"79123456789", "7"},
+		{"442079460018", "44"},
+		{"2348012345678", "234"},
+		{"35312345678", "353"},
+		{"88212345678", "882"},
+		{"2112345678", "211"}, // 21 alone is unassigned
+		{"0123456789", ""},
+		{"2812345678", ""},
+		{"9991234567", ""},
+		{"23", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := CountryCode(tt.digits); got != tt.want {
+			t.Errorf("CountryCode(%q) = %q, want %q", tt.digits, got, tt.want)
+		}
+	}
+}
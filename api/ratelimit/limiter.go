@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route classes, each limited by its own bucket per caller
+const (
+	ClassRead      = "read"      // GET requests
+	ClassWrite     = "write"     // Other mutating requests
+	ClassLifecycle = "lifecycle" // pair, start, stop, restart... which spawn or kill processes
+	ClassMessages  = "messages"
+	ClassAdmin     = "admin" // keys, tenants, users
+)
+
+var Classes = []string{ClassRead, ClassWrite, ClassLifecycle, ClassMessages, ClassAdmin}
+
+// Limits maps a route class to its allowed requests per minute
+type Limits map[string]int
+
+// DefaultLimits are used for classes a key has no own limit for
+func DefaultLimits() Limits {
+	return Limits{
+		ClassRead:      600,
+		ClassWrite:     120,
+		ClassLifecycle: 20,
+		ClassMessages:  60,
+		ClassAdmin:     60,
+	}
+}
+
+// ParseLimits parses "class=n,class2=n2"
+func ParseLimits(s string) (Limits, error) {
+	l := Limits{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		class, v, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		class = strings.TrimSpace(class)
+		if !ok || err != nil || n < 0 || !ValidClass(class) {
+			return nil, fmt.Errorf("invalid rate limit %q", pair)
+		}
+		l[class] = n
+	}
+	return l, nil
+}
+
+func ValidClass(class string) bool {
+	for _, c := range Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Result describes the state of a bucket after a request
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Time     // When the bucket is full again
+	RetryAfter time.Duration // Until the next request is allowed, when denied
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket limiter. Each bucket holds up to limit tokens and refills
+// at limit per minute, so bursts of a full minute's allowance are possible.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func New() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+// Allow takes a token from the bucket key, whose capacity is limit per minute.
+// A limit of 0 disables limiting.
+func (l *Limiter) Allow(key string, limit int) Result {
+	if limit <= 0 {
+		return Result{Allowed: true}
+	}
+
+	now := time.Now()
+	rate := float64(limit) / 60 // Tokens per second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > time.Minute {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(limit), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	res := Result{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = now.Add(time.Duration((float64(limit) - b.tokens) / rate * float64(time.Second)))
+	return res
+}
+
+// sweep drops buckets idle long enough to have refilled. Callers hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > 10*time.Minute {
+			delete(l.buckets, k)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,34 @@
+package ratelimit
+
+import "testing"
+
+func TestAllow(t *testing.T) {
+	l := New()
+	for i := range 5 {
+		if res := l.Allow("a", 5); !res.Allowed || res.Remaining != 4-i {
+			t.Fatalf("request %d: %+v", i, res)
+		}
+	}
+	res := l.Allow("a", 5)
+	if res.Allowed || res.RetryAfter <= 0 {
+		t.Fatalf("request over the limit: %+v", res)
+	}
+	if !l.Allow("b", 5).Allowed {
+		t.Fatal("buckets are shared between keys")
+	}
+	if res := l.Allow("a", 0); !res.Allowed {
+		t.Fatal("a limit of 0 should disable limiting")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	l, err := ParseLimits(" read=10, lifecycle=0 ")
+	if err != nil || l[ClassRead] != 10 || l[ClassLifecycle] != 0 || len(l) != 2 {
+		t.Fatalf("ParseLimits = %v, %v", l, err)
+	}
+	for _, s := range []string{"read", "read=x", "read=-1", "unknown=1"} {
+		if _, err := ParseLimits(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// QuotaBackend persists daily usage counters
+type QuotaBackend interface {
+	LoadUsage(day string) (map[uint]int64, error)
+	AddUsage(day string, delta map[uint]int64) error
+}
+
+// Quota counts requests per API key and UTC day. Counts are kept in memory and
+// added to the backend periodically, so they survive restarts.
+type Quota struct {
+	mu      sync.Mutex
+	backend QuotaBackend
+	day     string
+	used    map[uint]int64
+	pending map[uint]int64
+	// past holds pending counts of earlier days by day, kept until they are written
+	past map[string]map[uint]int64
+	now  func() time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewQuota(backend QuotaBackend, interval time.Duration) (*Quota, error) {
+	return newQuota(backend, interval, time.Now)
+}
+
+func newQuota(backend QuotaBackend, interval time.Duration, now func() time.Time) (*Quota, error) {
+	q := &Quota{backend: backend, past: make(map[string]map[uint]int64), now: now, stop: make(chan struct{})}
+	if err := q.rollover(q.today()); err != nil {
+		return nil, err
+	}
+
+	q.wg.Add(1)
+	go q.run(interval)
+	return q, nil
+}
+
+func (q *Quota) today() string {
+	return q.now().UTC().Format("2006-01-02")
+}
+
+// rollover switches to day, loading its stored usage. Callers hold q.mu or own q.
+func (q *Quota) rollover(day string) error {
+	used, err := q.backend.LoadUsage(day)
+	if err != nil {
+		return err
+	}
+	if used == nil {
+		used = make(map[uint]int64)
+	}
+	q.day = day
+	q.used = used
+	q.pending = make(map[uint]int64)
+	return nil
+}
+
+// Take counts one request for key against limit per day. It returns whether the
+// request is allowed and the remaining requests. A limit of 0 means no quota.
+func (q *Quota) Take(key uint, limit int64) (bool, int64) {
+	if limit <= 0 {
+		return true, 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if day := q.today(); day != q.day {
+		// Counts of the ending day that can't be written now are retried under it
+		for key, n := range q.pending {
+			if q.past[q.day] == nil {
+				q.past[q.day] = make(map[uint]int64)
+			}
+			q.past[q.day][key] += n
+		}
+		q.pending = make(map[uint]int64)
+		q.flushLocked()
+		if err := q.rollover(day); err != nil {
+			log.Printf("Error loading quota usage: %v", err)
+			q.day, q.used, q.pending = day, make(map[uint]int64), make(map[uint]int64)
+		}
+	}
+
+	if q.used[key] >= limit {
+		return false, 0
+	}
+	q.used[key]++
+	q.pending[key]++
+	return true, limit - q.used[key]
+}
+
+// Reset returns when the current quota day ends
+func (q *Quota) Reset() time.Time {
+	return q.now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+func (q *Quota) run(interval time.Duration) {
+	defer q.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-t.C:
+			q.Flush()
+		}
+	}
+}
+
+func (q *Quota) Flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.flushLocked()
+}
+
+// flushLocked writes pending counts. Counts are only dropped once written, failed
+// writes are retried by the next flush. Callers hold q.mu.
+func (q *Quota) flushLocked() {
+	for day, counts := range q.past {
+		if err := q.backend.AddUsage(day, counts); err != nil {
+			log.Printf("Error persisting quota usage of %s: %v", day, err)
+			continue
+		}
+		delete(q.past, day)
+	}
+
+	if len(q.pending) == 0 {
+		return
+	}
+	if err := q.backend.AddUsage(q.day, q.pending); err != nil {
+		log.Printf("Error persisting quota usage: %v", err)
+		return
+	}
+	q.pending = make(map[uint]int64)
+}
+
+// Close stops the flusher and writes pending counts
+func (q *Quota) Close() {
+	select {
+	case <-q.stop:
+		return
+	default:
+		close(q.stop)
+	}
+	q.wg.Wait()
+	q.Flush()
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"errors"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBackend keeps usage in memory and fails every call while failing is set
+type memBackend struct {
+	mu      sync.Mutex
+	usage   map[string]map[uint]int64
+	failing bool
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{usage: make(map[string]map[uint]int64)}
+}
+
+func (b *memBackend) LoadUsage(day string) (map[uint]int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failing {
+		return nil, errors.New("backend down")
+	}
+	return maps.Clone(b.usage[day]), nil
+}
+
+func (b *memBackend) AddUsage(day string, delta map[uint]int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failing {
+		return errors.New("backend down")
+	}
+	if b.usage[day] == nil {
+		b.usage[day] = make(map[uint]int64)
+	}
+	for key, n := range delta {
+		b.usage[day][key] += n
+	}
+	return nil
+}
+
+func (b *memBackend) setFailing(failing bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failing = failing
+}
+
+func (b *memBackend) count(day string, key uint) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.usage[day][key]
+}
+
+// clock is a settable time source
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+func newTestQuota(t *testing.T, b QuotaBackend, c *clock) *Quota {
+	t.Helper()
+	q, err := newQuota(b, time.Hour, c.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Close)
+	return q
+}
+
+func TestQuotaTake(t *testing.T) {
+	b := newMemBackend()
+	c := &clock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	q := newTestQuota(t, b, c)
+
+	for i := range 3 {
+		ok, remaining := q.Take(1, 3)
+		if !ok || remaining != int64(2-i) {
+			t.Fatalf("request %d: %t, %d remaining", i, ok, remaining)
+		}
+	}
+	if ok, _ := q.Take(1, 3); ok {
+		t.Fatal("request over the quota was allowed")
+	}
+	if ok, _ := q.Take(2, 3); !ok {
+		t.Fatal("quota is shared between keys")
+	}
+	if ok, _ := q.Take(1, 0); !ok {
+		t.Fatal("a limit of 0 should disable the quota")
+	}
+
+	// Usage survives a restart once flushed
+	q.Close()
+	if n := b.count("2024-03-01", 1); n != 3 {
+		t.Fatalf("stored %d, want 3", n)
+	}
+	restarted := newTestQuota(t, b, c)
+	if ok, _ := restarted.Take(1, 3); ok {
+		t.Fatal("usage was lost over a restart")
+	}
+
+	// A new day starts from zero
+	c.set(c.now().Add(24 * time.Hour))
+	if ok, remaining := restarted.Take(1, 3); !ok || remaining != 2 {
+		t.Fatalf("next day: %t, %d remaining", ok, remaining)
+	}
+}
+
+func TestQuotaRolloverKeepsUnwrittenCounts(t *testing.T) {
+	b := newMemBackend()
+	c := &clock{t: time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)}
+	q := newTestQuota(t, b, c)
+
+	for range 3 {
+		q.Take(1, 10)
+	}
+	b.setFailing(true)
+	c.set(time.Date(2024, 3, 2, 0, 1, 0, 0, time.UTC))
+	q.Take(1, 10)
+	q.Flush()
+
+	b.setFailing(false)
+	q.Take(1, 10)
+	q.Flush()
+	if n := b.count("2024-03-01", 1); n != 3 {
+		t.Errorf("previous day stored %d, want 3", n)
+	}
+	if n := b.count("2024-03-02", 1); n != 2 {
+		t.Errorf("current day stored %d, want 2", n)
+	}
+
+	// Nothing is written twice
+	q.Flush()
+	if n := b.count("2024-03-01", 1); n != 3 {
+		t.Errorf("previous day stored %d after another flush, want 3", n)
+	}
+}
@@ -0,0 +1,291 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	_ "time/tzdata" // Timezones for hosts without a zoneinfo database
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	maxAnalyticsRange = 400 * 24 * time.Hour
+	maxHourlyRange    = 31 * 24 * time.Hour
+)
+
+func AnalyticsRoutes(api fiber.Router) {
+	analytics := api.Group("/instances/:phone/analytics", requireScope(auth.ScopeMessagesRead), phoneParam)
+
+	analytics.Get("/volume", func(c *fiber.Ctx) error {
+		f, loc, err := analyticsFilter(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		interval := c.Query("interval", "day")
+		if interval != "day" && interval != "hour" {
+			return c.Status(400).JSON(fiber.Map{"error": "interval must be day or hour"})
+		}
+		if interval == "hour" && f.To.Sub(f.From) > maxHourlyRange {
+			return c.Status(400).JSON(fiber.Map{"error": "Hourly volume is limited to 31 days"})
+		}
+
+		counts, err := database.MessageVolume(f, 900)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query message volume"})
+		}
+
+		// Regroup the UTC buckets into calendar days or hours of the timezone
+		bucketStart := func(t time.Time) time.Time {
+			t = t.In(loc)
+			if interval == "day" {
+				return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+			}
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		}
+		type bucket struct {
+			Start    time.Time `json:"start"`
+			Inbound  int64     `json:"inbound"`
+			Outbound int64     `json:"outbound"`
+			Total    int64     `json:"total"`
+		}
+		var buckets []*bucket
+		index := make(map[int64]*bucket)
+		for t := bucketStart(f.From); t.Before(f.To); {
+			b := &bucket{Start: t}
+			buckets = append(buckets, b)
+			index[t.Unix()] = b
+			if interval == "day" {
+				t = t.AddDate(0, 0, 1)
+			} else {
+				t = bucketStart(t.Add(time.Hour))
+			}
+		}
+		for _, v := range counts {
+			b, ok := index[bucketStart(time.Unix(v.Start, 0)).Unix()]
+			if !ok {
+				continue
+			}
+			if v.FromMe {
+				b.Outbound += v.Messages
+			} else {
+				b.Inbound += v.Messages
+			}
+			b.Total += v.Messages
+		}
+
+		return c.JSON(fiber.Map{
+			"interval": interval,
+			"tz":       loc.String(),
+			"from":     f.From.In(loc),
+			"to":       f.To.In(loc),
+			"buckets":  buckets,
+		})
+	})
+
+	analytics.Get("/summary", func(c *fiber.Ctx) error {
+		f, loc, err := analyticsFilter(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		types, err := database.CountBy(f, "content_type", false, 0)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query content types"})
+		}
+		chats, err := database.CountBy(f, "chat", false, 0)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query chats"})
+		}
+
+		var total, inbound, outbound int64
+		for _, t := range types {
+			total += t.Messages
+			inbound += t.Inbound
+			outbound += t.Outbound
+		}
+		return c.JSON(fiber.Map{
+			"tz":            loc.String(),
+			"from":          f.From.In(loc),
+			"to":            f.To.In(loc),
+			"total":         total,
+			"inbound":       inbound,
+			"outbound":      outbound,
+			"active_chats":  len(chats),
+			"content_types": types,
+		})
+	})
+
+	analytics.Get("/top-chats", func(c *fiber.Ctx) error {
+		f, _, err := analyticsFilter(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		f.Chat = ""
+
+		top, err := database.CountBy(f, "chat", false, analyticsLimit(c))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query chats"})
+		}
+		jids := make([]string, len(top))
+		for i, t := range top {
+			jids[i] = t.Key
+		}
+		names, err := database.ChatNames(f.Phone, jids)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve chat names"})
+		}
+
+		out := make([]fiber.Map, 0, len(top))
+		for _, t := range top {
+			out = append(out, fiber.Map{
+				"chat":     t.Key,
+				"name":     names[t.Key],
+				"messages": t.Messages,
+				"inbound":  t.Inbound,
+				"outbound": t.Outbound,
+			})
+		}
+		return c.JSON(out)
+	})
+
+	analytics.Get("/top-senders", func(c *fiber.Ctx) error {
+		f, _, err := analyticsFilter(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !strings.HasSuffix(f.Chat, "@g.us") {
+			return c.Status(400).JSON(fiber.Map{"error": "chat must be a group JID"})
+		}
+
+		top, err := database.CountBy(f, "sender", true, analyticsLimit(c))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query senders"})
+		}
+		senders := make([]string, len(top))
+		for i, t := range top {
+			senders[i] = t.Key
+		}
+		names, err := database.SenderNames(f.Phone, senders)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve sender names"})
+		}
+		pns, err := database.ResolveLIDs(f.Phone, senders)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve contacts"})
+		}
+
+		out := make([]fiber.Map, 0, len(top))
+		for _, t := range top {
+			data := fiber.Map{"sender": t.Key, "name": names[t.Key], "messages": t.Messages}
+			pn := t.Key
+			if resolved, ok := pns[pn]; ok {
+				pn = resolved
+			}
+			if number, ok := strings.CutSuffix(pn, "@s.whatsapp.net"); ok {
+				data["phone"] = number
+			}
+			out = append(out, data)
+		}
+		return c.JSON(out)
+	})
+
+	analytics.Get("/response-times", func(c *fiber.Ctx) error {
+		f, loc, err := analyticsFilter(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		delays, err := database.ResponseTimes(f)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query response times"})
+		}
+
+		res := fiber.Map{
+			"tz":        loc.String(),
+			"from":      f.From.In(loc),
+			"to":        f.To.In(loc),
+			"responses": len(delays),
+		}
+		if len(delays) > 0 {
+			slices.Sort(delays)
+			var sum int64
+			for _, d := range delays {
+				sum += d
+			}
+			res["mean_s"] = math.Round(float64(sum)/float64(len(delays))*10) / 10
+			res["median_s"] = percentile(delays, 50)
+			res["p90_s"] = percentile(delays, 90)
+			res["min_s"] = delays[0]
+			res["max_s"] = delays[len(delays)-1]
+		}
+		return c.JSON(res)
+	})
+}
+
+// analyticsFilter reads the phone, chat, tz, from and to parameters. Dates without
+// a time are midnight in tz, the default range is the last 30 days including today.
+func analyticsFilter(c *fiber.Ctx) (database.AnalyticsFilter, *time.Location, error) {
+	f := database.AnalyticsFilter{
+		Phone: c.Locals("phone").(string),
+		Chat:  jidParam(c.Query("chat")),
+	}
+
+	loc, err := time.LoadLocation(c.Query("tz", "UTC"))
+	if err != nil {
+		return f, nil, errors.New("Unknown timezone")
+	}
+
+	parse := func(s string) (time.Time, error) {
+		if t, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+			return t, nil
+		}
+		return parseTime(s)
+	}
+	if f.From, err = parse(c.Query("from")); err != nil {
+		return f, nil, errors.New("Invalid from time")
+	}
+	if f.To, err = parse(c.Query("to")); err != nil {
+		return f, nil, errors.New("Invalid to time")
+	}
+	if f.To.IsZero() {
+		now := time.Now().In(loc)
+		f.To = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, loc)
+	}
+	if f.From.IsZero() {
+		f.From = f.To.AddDate(0, 0, -30)
+	}
+	if !f.From.Before(f.To) {
+		return f, nil, errors.New("from must be before to")
+	}
+	if f.To.Sub(f.From) > maxAnalyticsRange {
+		return f, nil, errors.New("Range is limited to 400 days")
+	}
+
+	// Rollups are by UTC hour, zones with half or quarter hour offsets need exact counts
+	for t := f.From; t.Before(f.To); t = t.Add(24 * time.Hour) {
+		if _, offset := t.In(loc).Zone(); offset%3600 != 0 {
+			f.Exact = true
+			break
+		}
+	}
+	return f, loc, nil
+}
+
+func analyticsLimit(c *fiber.Ctx) int {
+	limit := c.QueryInt("limit", 10)
+	if limit <= 0 || limit > 100 {
+		return 10
+	}
+	return limit
+}
+
+// percentile of sorted values, nearest rank
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank-1, 0)]
+}
@@ -0,0 +1,119 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"testing"
+)
+
+// newAnalytics stores messages around midnight in India, 18:30 UTC, so days of
+// Asia/Kolkata split them differently than UTC days
+func newAnalytics(t *testing.T) func(path string) (int, map[string]any) {
+	t.Helper()
+	app := newTestApp(t)
+	newSession(t, testPhone, database.DefaultTenant)
+	storeMessage(t, "a1", alice, "", false, 0, "Alice", "hi")             // 12:00
+	storeMessage(t, "a2", alice, "", false, 1, "Alice", "there?")         // 12:01
+	storeMessage(t, "a3", alice, "", true, 4, "", "yes")                  // 12:04
+	storeMessage(t, "a4", alice, "", false, 375, "Alice", "late")         // 18:15
+	storeMessage(t, "a5", alice, "", true, 405, "", "later")              // 18:45
+	storeMessage(t, "g1", family, alice, false, 410, "Alice", "in group") // 18:50
+	if _, err := database.ReindexMessages(testPhone); err != nil {
+		t.Fatal(err)
+	}
+	key := newKey(t, database.DefaultTenant, "", auth.ScopeMessagesRead)
+	base := "/api/instances/" + testPhone + "/analytics"
+	return func(path string) (int, map[string]any) {
+		t.Helper()
+		status, body := call(t, app, "GET", base+path, key, nil)
+		res, _ := body.(map[string]any)
+		return status, res
+	}
+}
+
+func TestAnalyticsVolume(t *testing.T) {
+	get := newAnalytics(t)
+
+	tests := []struct {
+		tz   string
+		want []map[string]any
+	}{
+		{"UTC", []map[string]any{
+			{"start": "2024-03-01T00:00:00Z", "inbound": 4.0, "outbound": 2.0, "total": 6.0},
+			{"start": "2024-03-02T00:00:00Z", "inbound": 0.0, "outbound": 0.0, "total": 0.0},
+		}},
+		{"Asia/Kolkata", []map[string]any{
+			{"start": "2024-03-01T00:00:00+05:30", "inbound": 3.0, "outbound": 1.0, "total": 4.0},
+			{"start": "2024-03-02T00:00:00+05:30", "inbound": 1.0, "outbound": 1.0, "total": 2.0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tz, func(t *testing.T) {
+			status, res := get("/volume?from=2024-03-01&to=2024-03-03&tz=" + tt.tz)
+			if status != 200 {
+				t.Fatalf("status %d: %v", status, res)
+			}
+			buckets := res["buckets"].([]any)
+			if len(buckets) != len(tt.want) {
+				t.Fatalf("buckets %v", buckets)
+			}
+			for i, b := range buckets {
+				for k, v := range tt.want[i] {
+					if got := b.(map[string]any)[k]; got != v {
+						t.Errorf("bucket %d %s = %v, want %v", i, k, got, v)
+					}
+				}
+			}
+
+			// Summaries agree with the volume, from rollups or the index
+			_, sum := get("/summary?from=2024-03-01&to=2024-03-03&tz=" + tt.tz)
+			if sum["total"] != 6.0 || sum["inbound"] != 4.0 || sum["outbound"] != 2.0 || sum["active_chats"] != 2.0 {
+				t.Errorf("summary %v", sum)
+			}
+		})
+	}
+}
+
+func TestAnalyticsHourlyLimit(t *testing.T) {
+	get := newAnalytics(t)
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"interval=hour&from=2024-03-01&to=2024-04-01", 200},
+		{"interval=hour&from=2024-03-01&to=2024-04-02", 400},
+		{"interval=day&from=2024-03-01&to=2024-04-02", 200},
+		{"interval=week", 400},
+		{"from=2024-03-02&to=2024-03-01", 400},
+		{"tz=Mars/Olympus", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if status, res := get("/volume?" + tt.query); status != tt.status {
+				t.Fatalf("status %d, want %d: %v", status, tt.status, res)
+			}
+		})
+	}
+
+	_, res := get("/volume?interval=hour&from=2024-03-01T18:00:00Z&to=2024-03-01T20:00:00Z")
+	buckets := res["buckets"].([]any)
+	if len(buckets) != 2 || buckets[0].(map[string]any)["total"] != 3.0 || buckets[1].(map[string]any)["total"] != 0.0 {
+		t.Fatalf("hourly buckets %v", buckets)
+	}
+}
+
+func TestAnalyticsResponseTimes(t *testing.T) {
+	get := newAnalytics(t)
+
+	// a1 and a2 are answered once by a3, a4 by a5. The group doesn't count.
+	status, res := get("/response-times?from=2024-03-01&to=2024-03-02")
+	if status != 200 {
+		t.Fatalf("status %d: %v", status, res)
+	}
+	want := map[string]any{"responses": 2.0, "min_s": 240.0, "max_s": 1800.0, "median_s": 240.0, "mean_s": 1020.0}
+	for k, v := range want {
+		if res[k] != v {
+			t.Errorf("%s = %v, want %v", k, res[k], v)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"api/manager"
+	"api/ratelimit"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// anonymousAuditLimit caps the entries per minute and client address for requests
+// without a valid principal, so failed authentication can't flood the log
+const anonymousAuditLimit = 10
+
+var anonymousAudits = ratelimit.New()
+
+// auditChange lets a handler attach the before and after state of what it changed
+func auditChange(c *fiber.Ctx, before, after any) {
+	c.Locals("audit_before", before)
+	c.Locals("audit_after", after)
+}
+
+// auditResult is the outcome of a request for one of several instances it acted on
+type auditResult struct {
+	Phone    string
+	TenantID string // Of the instance, the actor's when empty
+	OK       bool
+	After    any
+}
+
+// auditEach records the request once per instance instead of once overall
+func auditEach(c *fiber.Ctx, results []auditResult) {
+	c.Locals("audit_each", results)
+}
+
+// audit records every mutating request once its handlers have run
+func audit(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if fe, ok := err.(*fiber.Error); ok {
+		status = fe.Code
+	} else if err != nil {
+		status = fiber.StatusInternalServerError
+	}
+
+	e := database.AuditEntry{
+		ActorType: "anonymous",
+		Method:    c.Method(),
+		Route:     c.Route().Path,
+		Path:      c.Path(),
+		Status:    status,
+		Outcome:   "success",
+		IP:        c.IP(),
+	}
+	if status >= 400 {
+		e.Outcome = "failure"
+	}
+	if p := principal(c); p != nil {
+		e.ActorType, e.ActorID = "key", p.KeyID
+		if p.KeyID == 0 {
+			e.ActorType, e.ActorID = "user", p.UserID
+		}
+		e.Actor = p.Name
+		e.TenantID = p.TenantID
+	} else if !anonymousAudits.Allow(c.IP(), anonymousAuditLimit).Allowed {
+		return err
+	}
+	if phone, ok := c.Locals("phone").(string); ok {
+		e.Phone = phone
+	}
+	// Changes to an instance belong to its tenant, which differs from the actor's
+	// when a super admin makes them
+	if tenant, ok := c.Locals("phone_tenant").(string); ok {
+		e.TenantID = tenant
+	}
+	if v := c.Locals("audit_before"); v != nil {
+		b, _ := json.Marshal(v)
+		e.Before = string(b)
+	}
+	if v := c.Locals("audit_after"); v != nil {
+		b, _ := json.Marshal(v)
+		e.After = string(b)
+	}
+
+	if results, ok := c.Locals("audit_each").([]auditResult); ok {
+		if dbErr := database.AppendAudits(auditEntries(e, results)); dbErr != nil {
+			fmt.Printf("Error writing audit log: %v\n", dbErr)
+		}
+		return err
+	}
+
+	if dbErr := database.AppendAudit(&e); dbErr != nil {
+		fmt.Printf("Error writing audit log: %v\n", dbErr)
+	}
+	return err
+}
+
+// auditEntries copies e for each result
+func auditEntries(e database.AuditEntry, results []auditResult) []database.AuditEntry {
+	entries := make([]database.AuditEntry, len(results))
+	for i, r := range results {
+		entry := e
+		entry.Phone = r.Phone
+		if r.TenantID != "" {
+			entry.TenantID = r.TenantID
+		}
+		if !r.OK {
+			entry.Outcome = "failure"
+		}
+		if r.After != nil {
+			b, _ := json.Marshal(r.After)
+			entry.After = string(b)
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// AuditRoutes serves the audit log to tenant admins, as JSON pages or a CSV export
+func AuditRoutes(api fiber.Router) {
+	api.Get("/audit", requireScope(auth.ScopeAdmin), func(c *fiber.Ctx) error {
+		f := database.AuditFilter{
+			TenantID: principal(c).TenantFilter(),
+			Actor:    c.Query("actor"),
+		}
+
+		if raw := c.Query("phone"); raw != "" {
+			p, err := manager.ResolvePhone(raw)
+			if err != nil {
+				return invalidPhone(c, err)
+			}
+			f.Phone = p
+		}
+
+		var err error
+		if f.From, err = parseTime(c.Query("from")); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid from time"})
+		}
+		if f.To, err = parseTime(c.Query("to")); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid to time"})
+		}
+
+		if c.Query("format") == "csv" {
+			return auditCSV(c, f)
+		}
+
+		f.Limit = c.QueryInt("limit", 100)
+		if f.Limit <= 0 || f.Limit > 1000 {
+			f.Limit = 100
+		}
+		if before := c.QueryInt("before_id", 0); before > 0 {
+			f.BeforeID = uint(before)
+		}
+
+		entries, err := database.QueryAudit(f)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query audit log"})
+		}
+
+		res := fiber.Map{"entries": entries}
+		if len(entries) == f.Limit {
+			res["next_before_id"] = entries[len(entries)-1].ID
+		}
+		return c.JSON(res)
+	})
+}
+
+func auditCSV(c *fiber.Ctx, f database.AuditFilter) error {
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit_log.csv"`)
+
+	w := csv.NewWriter(c)
+	w.Write([]string{
+		"id", "created_at", "actor_type", "actor_id", "actor", "tenant_id", "method",
+		"route", "path", "phone", "status", "outcome", "ip", "before", "after",
+	})
+	err := database.EachAudit(f, func(e database.AuditEntry) error {
+		return w.Write([]string{
+			strconv.FormatUint(uint64(e.ID), 10), e.CreatedAt.UTC().Format(time.RFC3339),
+			e.ActorType, strconv.FormatUint(uint64(e.ActorID), 10), csvCell(e.Actor), csvCell(e.TenantID),
+			e.Method, csvCell(e.Route), csvCell(e.Path), csvCell(e.Phone), strconv.Itoa(e.Status), e.Outcome, csvCell(e.IP),
+			csvCell(e.Before), csvCell(e.After),
+		})
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to export audit log"})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// csvCell keeps spreadsheets from evaluating s as a formula by quoting it when it
+// starts with a formula character
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// parseTime accepts RFC 3339 timestamps, dates and unix seconds. Empty is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"api/ratelimit"
+	"encoding/csv"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAuditRecordsInstanceTenant(t *testing.T) {
+	app := newTestApp(t)
+	newSession(t, "2348000000001", "acme")
+	admin := newKey(t, database.DefaultTenant, "", auth.ScopeSuperAdmin)
+
+	status, body := call(t, app, "PATCH", "/api/settings/2348000000001", admin, map[string]any{"key": "language", "value": "fr"})
+	if status != 200 {
+		t.Fatalf("status %d: %v", status, body)
+	}
+
+	entries, err := database.QueryAudit(database.AuditFilter{Phone: "2348000000001"})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("audit entries %v, %v", entries, err)
+	}
+	if entries[0].TenantID != "acme" {
+		t.Fatalf("entry recorded under tenant %q, want the instance's tenant acme", entries[0].TenantID)
+	}
+	// Tenant admins of acme see it
+	if acme, _ := database.QueryAudit(database.AuditFilter{TenantID: "acme"}); len(acme) != 1 {
+		t.Fatalf("acme sees %d entries", len(acme))
+	}
+}
+
+func TestAuditBulkPerInstance(t *testing.T) {
+	app := newTestApp(t)
+	newSession(t, "2348000000001", database.DefaultTenant)
+	newSession(t, "2348000000002", "acme")
+	admin := newKey(t, database.DefaultTenant, "", auth.ScopeSuperAdmin)
+
+	status, body := call(t, app, "POST", "/api/instances/bulk", admin, map[string]any{
+		"action":   "reset",
+		"selector": map[string]any{"phones": []string{"2348000000001", "2348000000002", "2348000000003"}},
+	})
+	if status != 200 {
+		t.Fatalf("status %d: %v", status, body)
+	}
+
+	entries, err := database.QueryAudit(database.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]database.AuditEntry)
+	for _, e := range entries {
+		got[e.Phone] = e
+	}
+	if len(entries) != 3 || len(got) != 3 {
+		t.Fatalf("%d entries for %d instances, want one for each of 3", len(entries), len(got))
+	}
+	want := map[string]struct{ tenant, outcome string }{
+		"2348000000001": {database.DefaultTenant, "success"},
+		"2348000000002": {"acme", "success"},
+		"2348000000003": {database.DefaultTenant, "failure"},
+	}
+	for phone, w := range want {
+		if e := got[phone]; e.TenantID != w.tenant || e.Outcome != w.outcome || e.Route != "/api/instances/bulk" {
+			t.Errorf("%s: tenant %q outcome %q route %q, want %q %q", phone, e.TenantID, e.Outcome, e.Route, w.tenant, w.outcome)
+		}
+	}
+}
+
+func TestAuditAnonymousLimit(t *testing.T) {
+	anonymousAudits = ratelimit.New()
+	app := newTestApp(t)
+
+	for range 3 * anonymousAuditLimit {
+		if status, _ := call(t, app, "POST", "/api/instances/bulk", "wak_not-a-key", map[string]any{}); status != 401 {
+			t.Fatalf("status %d, want 401", status)
+		}
+	}
+	entries, err := database.QueryAudit(database.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != anonymousAuditLimit {
+		t.Fatalf("%d entries for failed authentication, want %d", len(entries), anonymousAuditLimit)
+	}
+}
+
+func TestAuditCSVEscapesFormulas(t *testing.T) {
+	app := newTestApp(t)
+	admin := newKey(t, database.DefaultTenant, "", auth.ScopeAdmin)
+	e := database.AuditEntry{
+		ActorType: "user",
+		Actor:     `=HYPERLINK("http://evil.example","x")`,
+		TenantID:  database.DefaultTenant,
+		Method:    "POST",
+		Route:     "/auth/login",
+		Path:      "/auth/login",
+		After:     "@SUM(A1)",
+	}
+	if err := database.AppendAudit(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/audit?format=csv", nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("rows %v, %v", rows, err)
+	}
+	header, row := rows[0], rows[1]
+	for i, name := range header {
+		switch name {
+		case "actor":
+			if row[i] != `'=HYPERLINK("http://evil.example","x")` {
+				t.Errorf("actor %q", row[i])
+			}
+		case "after":
+			if row[i] != "'@SUM(A1)" {
+				t.Errorf("after %q", row[i])
+			}
+		case "path":
+			if row[i] != "/auth/login" {
+				t.Errorf("path %q was changed", row[i])
+			}
+		}
+	}
+}
+
+func TestAuditPhoneFilter(t *testing.T) {
+	app := newTestApp(t)
+	newSession(t, "12345", database.DefaultTenant) // Stored before numbers were normalized
+	admin := newKey(t, database.DefaultTenant, "", auth.ScopeAdmin)
+	for _, phone := range []string{"12345", "2348000000001"} {
+		e := database.AuditEntry{ActorType: "key", TenantID: database.DefaultTenant, Method: "POST", Route: "/api/instances/:phone/start", Phone: phone}
+		if err := database.AppendAudit(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		phone  string
+		status int
+		want   string
+	}{
+		{"12345", 200, "12345"},
+		{"+234 800 000 0001", 200, "2348000000001"},
+		{"54321", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phone, func(t *testing.T) {
+			status, body := call(t, app, "GET", "/api/audit?phone="+url.QueryEscape(tt.phone), admin, nil)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %v", status, tt.status, body)
+			}
+			if tt.status != 200 {
+				return
+			}
+			entries := body.(map[string]any)["entries"].([]any)
+			if len(entries) != 1 || entries[0].(map[string]any)["phone"] != tt.want {
+				t.Fatalf("entries %v, want one for %s", entries, tt.want)
+			}
+		})
+	}
+}
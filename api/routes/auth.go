@@ -0,0 +1,280 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"api/ratelimit"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// authenticate resolves the bearer API key, or failing that the login session cookie,
+// into a Principal stored in c.Locals("principal")
+func authenticate(c *fiber.Ctx) error {
+	key, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok {
+		key = c.Get("X-API-Key")
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		if p := sessionPrincipal(c); p != nil {
+			c.Locals("principal", p)
+			return c.Next()
+		}
+		return c.Status(401).JSON(fiber.Map{"error": "Missing API key"})
+	}
+
+	record, err := database.FindActiveAPIKey(auth.HashKey(key))
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid API key"})
+	}
+	if database.KeyNeedsTouch(record) {
+		go database.TouchAPIKey(record.ID)
+	}
+
+	limits, _ := ratelimit.ParseLimits(record.RateLimits)
+	c.Locals("principal", &auth.Principal{
+		KeyID:      record.ID,
+		Phone:      record.Phone,
+		Name:       record.Name,
+		TenantID:   record.TenantID,
+		Scopes:     auth.SplitScopes(record.Scopes),
+		RateLimits: limits,
+		DailyQuota: record.DailyQuota,
+	})
+	return c.Next()
+}
+
+func principal(c *fiber.Ctx) *auth.Principal {
+	p, _ := c.Locals("principal").(*auth.Principal)
+	return p
+}
+
+// requireScope rejects requests whose principal lacks scope with 403
+func requireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		p := principal(c)
+		if p == nil || !p.HasScope(scope) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Missing required scope",
+				"scope": scope,
+			})
+		}
+		return c.Next()
+	}
+}
+
+func KeyRoutes(api fiber.Router) {
+	keys := api.Group("/keys", requireScope(auth.ScopeKeysManage))
+
+	keys.Get("/", func(c *fiber.Ctx) error {
+		list, err := database.ListAPIKeys(principal(c).TenantFilter())
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list keys"})
+		}
+
+		out := make([]fiber.Map, 0, len(list))
+		for _, k := range list {
+			out = append(out, keyData(k))
+		}
+		return c.JSON(out)
+	})
+
+	keys.Post("/", func(c *fiber.Ctx) error {
+		var req struct {
+			Name     string   `json:"name"`
+			TenantID string   `json:"tenant_id"`
+			Scopes   []string `json:"scopes"`
+
+			RateLimits map[string]int `json:"rate_limits"`
+			DailyQuota int64          `json:"daily_quota"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if req.Name == "" || len(req.Scopes) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "name and scopes are required"})
+		}
+		for _, s := range req.Scopes {
+			if !auth.ValidScope(s) {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid scope", "scope": s})
+			}
+		}
+		limits, err := encodeLimits(req.RateLimits)
+		if err != nil || req.DailyQuota < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid rate limits"})
+		}
+		p := principal(c)
+		if !p.CanGrant(req.Scopes) {
+			return c.Status(403).JSON(fiber.Map{"error": "Cannot grant scopes you do not hold"})
+		}
+
+		// Keys belong to the creator's tenant, only super admins may pick another one
+		tenant := p.TenantID
+		if req.TenantID != "" && req.TenantID != tenant {
+			if !p.IsSuperAdmin() {
+				return c.Status(403).JSON(fiber.Map{"error": "Cannot create keys for another tenant"})
+			}
+			if _, err := database.GetTenant(req.TenantID); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Unknown tenant"})
+			}
+			tenant = req.TenantID
+		}
+
+		plain, prefix, err := auth.GenerateKey()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to generate key"})
+		}
+		record := database.APIKey{
+			Name:     req.Name,
+			TenantID: tenant,
+			Prefix:   prefix,
+			Hash:     auth.HashKey(plain),
+			Scopes:   auth.JoinScopes(req.Scopes),
+
+			RateLimits: limits,
+			DailyQuota: req.DailyQuota,
+		}
+		if err := database.CreateAPIKey(&record); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create key"})
+		}
+
+		data := keyData(record)
+		data["key"] = plain // Only ever returned here
+		return c.Status(201).JSON(data)
+	})
+
+	keys.Patch("/:id", keyParam, func(c *fiber.Ctx) error {
+		id := c.Locals("key").(*database.APIKey).ID
+
+		var req struct {
+			RateLimits map[string]int `json:"rate_limits"`
+			DailyQuota *int64         `json:"daily_quota"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		updates := map[string]any{}
+		if req.RateLimits != nil {
+			limits, err := encodeLimits(req.RateLimits)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid rate limits"})
+			}
+			updates["rate_limits"] = limits
+		}
+		if req.DailyQuota != nil {
+			if *req.DailyQuota < 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid daily quota"})
+			}
+			updates["daily_quota"] = *req.DailyQuota
+		}
+		if len(updates) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Nothing to update"})
+		}
+
+		if err := database.UpdateAPIKeyLimits(id, principal(c).TenantFilter(), updates); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(404).JSON(fiber.Map{"error": "key not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update key"})
+		}
+		key, err := database.GetAPIKey(id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load key"})
+		}
+		return c.JSON(keyData(*key))
+	})
+
+	keys.Delete("/:id", keyParam, func(c *fiber.Ctx) error {
+		id := c.Locals("key").(*database.APIKey).ID
+		if err := database.RevokeAPIKey(id, principal(c).TenantFilter()); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(404).JSON(fiber.Map{"error": "key not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke key"})
+		}
+		return c.JSON(fiber.Map{"status": "revoked", "id": id})
+	})
+}
+
+// keyParam loads the active key :id of the caller's tenant into c.Locals("key").
+// Callers may not change their own key, the keys of core processes, which are
+// restricted to one instance, or keys holding scopes they lack.
+func keyParam(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid key id"})
+	}
+	p := principal(c)
+	key, err := database.GetActiveAPIKey(uint(id), p.TenantFilter())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "key not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load key"})
+	}
+
+	switch {
+	case p.KeyID != 0 && key.ID == p.KeyID:
+		return c.Status(403).JSON(fiber.Map{"error": "Cannot change the key used for this request"})
+	case key.Phone != "":
+		return c.Status(403).JSON(fiber.Map{"error": "Instance keys are managed by the server"})
+	case !p.CanGrant(auth.SplitScopes(key.Scopes)):
+		return c.Status(403).JSON(fiber.Map{"error": "Cannot change keys with scopes you do not hold"})
+	}
+	c.Locals("key", key)
+	return c.Next()
+}
+
+func TenantRoutes(api fiber.Router) {
+	tenants := api.Group("/tenants", requireScope(auth.ScopeSuperAdmin))
+
+	tenants.Get("/", func(c *fiber.Ctx) error {
+		list, err := database.ListTenants()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list tenants"})
+		}
+		return c.JSON(list)
+	})
+
+	tenants.Post("/", func(c *fiber.Ctx) error {
+		var req database.Tenant
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if !tenantID.MatchString(req.ID) || req.Name == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "id (lowercase slug) and name are required"})
+		}
+		if _, err := database.GetTenant(req.ID); err == nil {
+			return c.Status(409).JSON(fiber.Map{"error": "tenant already exists"})
+		}
+		if err := database.CreateTenant(&req); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create tenant"})
+		}
+		return c.Status(201).JSON(req)
+	})
+}
+
+var tenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+func keyData(k database.APIKey) fiber.Map {
+	limits, _ := ratelimit.ParseLimits(k.RateLimits)
+	return fiber.Map{
+		"id":           k.ID,
+		"name":         k.Name,
+		"tenant_id":    k.TenantID,
+		"phone":        k.Phone,
+		"prefix":       k.Prefix,
+		"scopes":       auth.SplitScopes(k.Scopes),
+		"rate_limits":  limits,
+		"daily_quota":  k.DailyQuota,
+		"created_at":   k.CreatedAt,
+		"last_used_at": k.LastUsedAt,
+		"revoked_at":   k.RevokedAt,
+	}
+}
@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInstanceKey(t *testing.T) {
+	app := newTestApp(t)
+	newSession(t, "2348000000001", database.DefaultTenant)
+	newSession(t, "2348000000002", database.DefaultTenant)
+	key := newKey(t, database.DefaultTenant, "2348000000001", auth.ScopeSettingsWrite)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{"own settings", "PATCH", "/api/settings/2348000000001", 200},
+		{"other instance", "PATCH", "/api/settings/2348000000002", 404},
+		{"unknown instance", "PATCH", "/api/settings/2348000000003", 404},
+		{"read scope", "GET", "/api/settings/2348000000001", 403},
+		{"instances", "GET", "/api/instances", 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := call(t, app, tt.method, tt.path, key, map[string]any{"key": "language", "value": "fr"})
+			if status != tt.want {
+				t.Fatalf("status %d, want %d: %v", status, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestTouchAPIKey(t *testing.T) {
+	app := newTestApp(t)
+	key := newKey(t, database.DefaultTenant, "", auth.ScopeInstancesRead)
+
+	lastUsed := func() *time.Time {
+		k, err := database.FindActiveAPIKey(auth.HashKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k.LastUsedAt
+	}
+
+	call(t, app, "GET", "/api/instances", key, nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for lastUsed() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("last_used_at was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	first := *lastUsed()
+
+	// Requests within a minute don't write again
+	for range 5 {
+		call(t, app, "GET", "/api/instances", key, nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := *lastUsed(); !got.Equal(first) {
+		t.Fatalf("last_used_at moved from %v to %v within the touch interval", first, got)
+	}
+}
+
+func TestManageKeys(t *testing.T) {
+	app := newTestApp(t)
+	newSession(t, "2348000000001", database.DefaultTenant)
+	caller := newKey(t, database.DefaultTenant, "", auth.ScopeKeysManage, auth.ScopeInstancesRead, auth.ScopeSettingsWrite)
+
+	keyID := func(plain string) uint {
+		t.Helper()
+		k, err := database.FindActiveAPIKey(auth.HashKey(plain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k.ID
+	}
+	tests := []struct {
+		name   string
+		target func() uint
+		want   int
+	}{
+		{"weaker key", func() uint { return keyID(newKey(t, database.DefaultTenant, "", auth.ScopeInstancesRead)) }, 200},
+		{"same scopes", func() uint {
+			return keyID(newKey(t, database.DefaultTenant, "", auth.ScopeKeysManage, auth.ScopeSettingsWrite))
+		}, 200},
+		{"more privileged key", func() uint { return keyID(newKey(t, database.DefaultTenant, "", auth.ScopeAdmin)) }, 403},
+		{"own key", func() uint { return keyID(caller) }, 403},
+		{"core instance key", func() uint {
+			return keyID(newKey(t, database.DefaultTenant, "2348000000001", auth.ScopeSettingsWrite))
+		}, 403},
+		{"other tenant", func() uint { return keyID(newKey(t, "acme", "", auth.ScopeInstancesRead)) }, 404},
+		{"unknown key", func() uint { return 9999 }, 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := tt.target()
+			path := fmt.Sprintf("/api/keys/%d", id)
+			before, _ := database.GetAPIKey(id)
+
+			status, body := call(t, app, "PATCH", path, caller, map[string]any{"daily_quota": 0, "rate_limits": map[string]int{}})
+			if status != tt.want {
+				t.Fatalf("PATCH status %d, want %d: %v", status, tt.want, body)
+			}
+			if status, body = call(t, app, "DELETE", path, caller, nil); status != tt.want {
+				t.Fatalf("DELETE status %d, want %d: %v", status, tt.want, body)
+			}
+
+			after, _ := database.GetAPIKey(id)
+			if tt.want != 200 && before != nil && (after.RevokedAt != nil || after.DailyQuota != before.DailyQuota) {
+				t.Fatalf("refused key changed: %+v", after)
+			}
+			if tt.want == 200 && after.RevokedAt == nil {
+				t.Fatal("key not revoked")
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func ChatRoutes(api fiber.Router) {
+	chats := api.Group("/instances/:phone/chats", requireScope(auth.ScopeMessagesRead), phoneParam)
+
+	chats.Get("/", func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+
+		limit := c.QueryInt("limit", 50)
+		if limit <= 0 || limit > 200 {
+			limit = 50
+		}
+		offset := max(c.QueryInt("offset", 0), 0)
+
+		list, err := database.ListChats(phone, limit, offset)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list chats"})
+		}
+
+		jids := make([]string, len(list))
+		for i, chat := range list {
+			jids[i] = chat.JID
+		}
+		pns, err := database.ResolveLIDs(phone, jids)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve contacts"})
+		}
+
+		out := make([]fiber.Map, 0, len(list))
+		for _, chat := range list {
+			out = append(out, chatData(chat, pns))
+		}
+
+		res := fiber.Map{"chats": out}
+		if len(list) == limit {
+			res["next_offset"] = offset + limit
+		}
+		return c.JSON(res)
+	})
+
+	chats.Post("/:jid/read", func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		jid, err := url.PathUnescape(c.Params("jid"))
+		if err != nil || !strings.Contains(jid, "@") {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid chat JID"})
+		}
+
+		var req struct {
+			Timestamp string `json:"timestamp"` // Defaults to the newest message
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+			}
+		}
+		at, err := parseTime(req.Timestamp)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid timestamp"})
+		}
+		var readAt int64
+		if !at.IsZero() {
+			readAt = at.Unix()
+		}
+
+		readAt, err = database.MarkChatRead(phone, jid, readAt)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to mark chat read"})
+		}
+		return c.JSON(fiber.Map{"chat": jid, "read_at": time.Unix(readAt, 0).UTC()})
+	})
+}
+
+func chatData(chat database.Chat, pns map[string]string) fiber.Map {
+	kind := "direct"
+	switch {
+	case strings.HasSuffix(chat.JID, "@g.us"):
+		kind = "group"
+	case strings.HasSuffix(chat.JID, "@broadcast"):
+		kind = "broadcast"
+	case strings.HasSuffix(chat.JID, "@newsletter"):
+		kind = "newsletter"
+	}
+
+	data := fiber.Map{
+		"jid":           chat.JID,
+		"kind":          kind,
+		"name":          chat.Name,
+		"last_activity": time.Unix(chat.LastActivity, 0).UTC(),
+		"message_count": chat.MessageCount,
+		"unread_count":  chat.UnreadCount,
+	}
+	if kind == "direct" {
+		pn := chat.JID
+		if resolved, ok := pns[pn]; ok {
+			pn = resolved
+		}
+		if number, ok := strings.CutSuffix(pn, "@s.whatsapp.net"); ok {
+			data["phone"] = number
+		}
+	}
+
+	if m := chat.LastMessage; m.MessageID != "" {
+		data["last_message"] = fiber.Map{
+			"id":        m.MessageID,
+			"sender":    m.Sender,
+			"from_me":   m.FromMe,
+			"type":      m.ContentType,
+			"text":      preview(m.Text, 120),
+			"timestamp": time.Unix(m.SentAt, 0).UTC(),
+		}
+	}
+	return data
+}
+
+// preview shortens text to at most n runes on one line
+func preview(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return text
+}
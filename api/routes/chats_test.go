@@ -0,0 +1,159 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	testPhone = "2348012345678"
+	alice     = "2348011111111@s.whatsapp.net"
+	carol     = "99999999999999@lid"
+	family    = "120363000000000001@g.us"
+)
+
+var testEpoch = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// storeMessage stores a text message the way the core does, sent minutes after testEpoch
+func storeMessage(t *testing.T, id, chat, participant string, fromMe bool, minutes int, pushName, body string) {
+	t.Helper()
+	at := testEpoch.Add(time.Duration(minutes) * time.Minute)
+	key := fmt.Sprintf(`{"remoteJid":%q,"fromMe":%t,"id":%q,"participant":%q}`, chat, fromMe, id, participant)
+	data := fmt.Sprintf(`{"key":%s,"messageTimestamp":%d,"pushName":%q,"message":{"conversation":%q}}`, key, at.Unix(), pushName, body)
+	row := database.UserMessage{ID: id, SessionPhone: testPhone, Data: data, Timestamp: database.FormatMessageTime(at)}
+	if err := database.DB.Create(&row).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newChats serves a direct chat with alice, a group and a chat with carol, known
+// by her LID only
+func newChats(t *testing.T) (*fiber.App, string) {
+	t.Helper()
+	app := newTestApp(t)
+	newSession(t, testPhone, database.DefaultTenant)
+	storeMessage(t, "a1", alice, "", false, 0, "Alice", "hi")
+	storeMessage(t, "a2", alice, "", true, 1, "", "hello")
+	storeMessage(t, "a3", alice, "", false, 2, "Alice", "how   are\nyou")
+	storeMessage(t, "g1", family, alice, false, 3, "Alice", "morning")
+	storeMessage(t, "c1", carol, "", false, 4, "Carol", "it's carol")
+
+	rows := []any{
+		&database.GroupMetadata{ID: family, SessionID: testPhone, MetaData: `{"subject":"Family"}`},
+		&database.UserContact{SessionPhone: testPhone, PN: "2348033333333@s.whatsapp.net", LID: carol},
+	}
+	for _, row := range rows {
+		if err := database.DB.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.ReindexMessages(testPhone); err != nil {
+		t.Fatal(err)
+	}
+	return app, newKey(t, database.DefaultTenant, "", auth.ScopeMessagesRead)
+}
+
+func TestListChatsRoute(t *testing.T) {
+	app, key := newChats(t)
+	path := "/api/instances/" + testPhone + "/chats"
+
+	status, body := call(t, app, "GET", path+"?limit=2", key, nil)
+	if status != 200 {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	res := body.(map[string]any)
+	chats := res["chats"].([]any)
+	if len(chats) != 2 || res["next_offset"] != float64(2) {
+		t.Fatalf("first page %v", res)
+	}
+
+	carolChat := chats[0].(map[string]any)
+	if carolChat["jid"] != carol || carolChat["kind"] != "direct" || carolChat["phone"] != "2348033333333" || carolChat["name"] != "Carol" {
+		t.Errorf("LID chat %v", carolChat)
+	}
+	group := chats[1].(map[string]any)
+	if group["jid"] != family || group["kind"] != "group" || group["name"] != "Family" || group["phone"] != nil {
+		t.Errorf("group %v", group)
+	}
+
+	status, body = call(t, app, "GET", path+"?limit=2&offset=2", key, nil)
+	res = body.(map[string]any)
+	chats = res["chats"].([]any)
+	if status != 200 || len(chats) != 1 || res["next_offset"] != nil {
+		t.Fatalf("last page %d %v", status, res)
+	}
+	direct := chats[0].(map[string]any)
+	last := direct["last_message"].(map[string]any)
+	if direct["jid"] != alice || direct["phone"] != "2348011111111" || direct["name"] != "Alice" ||
+		direct["message_count"] != float64(3) || direct["unread_count"] != float64(2) {
+		t.Errorf("direct chat %v", direct)
+	}
+	if last["id"] != "a3" || last["text"] != "how are you" || last["from_me"] != false ||
+		last["timestamp"] != testEpoch.Add(2*time.Minute).Format(time.RFC3339) {
+		t.Errorf("last message %v", last)
+	}
+
+	// The chats of other tenants' instances stay hidden
+	other := newKey(t, "acme", "", auth.ScopeMessagesRead)
+	if status, _ := call(t, app, "GET", path, other, nil); status != 404 {
+		t.Fatalf("other tenant got status %d, want 404", status)
+	}
+}
+
+func TestMarkChatReadRoute(t *testing.T) {
+	app, key := newChats(t)
+	chats := "/api/instances/" + testPhone + "/chats"
+	read := chats + "/" + url.PathEscape(alice) + "/read"
+	unread := func() float64 {
+		t.Helper()
+		_, body := call(t, app, "GET", chats, key, nil)
+		for _, c := range body.(map[string]any)["chats"].([]any) {
+			if c := c.(map[string]any); c["jid"] == alice {
+				return c["unread_count"].(float64)
+			}
+		}
+		t.Fatal("alice's chat not listed")
+		return 0
+	}
+
+	steps := []struct {
+		name   string
+		body   any
+		readAt time.Time
+		unread float64
+	}{
+		{"up to a message", map[string]string{"timestamp": testEpoch.Format(time.RFC3339)}, testEpoch, 1},
+		{"never backwards", map[string]string{"timestamp": testEpoch.Add(-time.Hour).Format(time.RFC3339)}, testEpoch, 1},
+		{"newest message", nil, testEpoch.Add(2 * time.Minute), 0},
+	}
+	for _, s := range steps {
+		status, body := call(t, app, "POST", read, key, s.body)
+		if status != 200 {
+			t.Fatalf("%s: status %d: %v", s.name, status, body)
+		}
+		if got := body.(map[string]any)["read_at"]; got != s.readAt.Format(time.RFC3339) {
+			t.Fatalf("%s: read at %v, want %v", s.name, got, s.readAt)
+		}
+		if got := unread(); got != s.unread {
+			t.Fatalf("%s: %v unread, want %v", s.name, got, s.unread)
+		}
+	}
+
+	for _, tt := range []struct {
+		path string
+		body any
+	}{
+		{chats + "/not-a-jid/read", nil},
+		{read, map[string]string{"timestamp": "soon"}},
+	} {
+		if status, body := call(t, app, "POST", tt.path, key, tt.body); status != 400 {
+			t.Errorf("%s %v: status %d, want 400: %v", tt.path, tt.body, status, body)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"api/export"
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func ExportRoutes(api fiber.Router, runner *export.Runner) {
+	instance := api.Group("/instances/:phone", requireScope(auth.ScopeMessagesRead), phoneParam)
+
+	// Streams the export in the response, large histories should use an export job
+	instance.Get("/export", func(c *fiber.Ctx) error {
+		opts, err := exportOptions(c, c.Query("format", "jsonl"), c.Query("chat"), c.Query("from"), c.Query("to"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		c.Set(fiber.HeaderContentType, export.ContentType(opts.Format))
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`,
+			export.FileName(opts.Phone, opts.Chat, opts.Format)))
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			if _, err := export.Write(w, opts); err != nil {
+				fmt.Printf("Error streaming export for %s: %v\n", opts.Phone, err)
+			}
+			w.Flush()
+		})
+		return nil
+	})
+
+	jobs := instance.Group("/exports")
+
+	jobs.Post("/", func(c *fiber.Ctx) error {
+		var req struct {
+			Format string `json:"format"`
+			Chat   string `json:"chat"`
+			From   string `json:"from"`
+			To     string `json:"to"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		opts, err := exportOptions(c, req.Format, req.Chat, req.From, req.To)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		p := principal(c)
+		job := database.ExportJob{
+			TenantID:  p.TenantID,
+			Phone:     opts.Phone,
+			Chat:      opts.Chat,
+			Format:    opts.Format,
+			Status:    database.ExportPending,
+			CreatedBy: p.Name,
+		}
+		if !opts.From.IsZero() {
+			job.From = &opts.From
+		}
+		if !opts.To.IsZero() {
+			job.To = &opts.To
+		}
+		if err := database.CreateExportJob(&job); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create export job"})
+		}
+		runner.Notify()
+		return c.Status(202).JSON(exportJobData(job))
+	})
+
+	jobs.Get("/", func(c *fiber.Ctx) error {
+		list, err := database.ListExportJobs(c.Locals("phone").(string))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list export jobs"})
+		}
+		out := make([]fiber.Map, 0, len(list))
+		for _, job := range list {
+			out = append(out, exportJobData(job))
+		}
+		return c.JSON(out)
+	})
+
+	jobs.Get("/:id", func(c *fiber.Ctx) error {
+		job, ok := exportJob(c)
+		if !ok {
+			return nil
+		}
+		return c.JSON(exportJobData(*job))
+	})
+
+	jobs.Get("/:id/download", func(c *fiber.Ctx) error {
+		job, ok := exportJob(c)
+		if !ok {
+			return nil
+		}
+		if job.Status != database.ExportDone {
+			return c.Status(409).JSON(fiber.Map{"error": "export is not finished", "status": job.Status})
+		}
+		path := runner.Path(job)
+		if _, err := os.Stat(path); err != nil {
+			return c.Status(410).JSON(fiber.Map{"error": "export file has expired"})
+		}
+		c.Set(fiber.HeaderContentType, export.ContentType(job.Format))
+		return c.Download(path, export.FileName(job.Phone, job.Chat, job.Format))
+	})
+}
+
+func exportOptions(c *fiber.Ctx, format, chat, from, to string) (export.Options, error) {
+	opts := export.Options{
+		Phone:  c.Locals("phone").(string),
+		Chat:   jidParam(chat),
+		Format: format,
+	}
+	if opts.Format == "" {
+		opts.Format = "jsonl"
+	}
+	if !export.ValidFormat(opts.Format) {
+		return opts, errors.New("format must be jsonl, csv or html")
+	}
+
+	var err error
+	if opts.From, err = parseTime(from); err != nil {
+		return opts, errors.New("Invalid from time")
+	}
+	if opts.To, err = parseTime(to); err != nil {
+		return opts, errors.New("Invalid to time")
+	}
+	return opts, nil
+}
+
+// exportJob loads the :id job of the instance, on failure it writes the error
+// response and reports false
+func exportJob(c *fiber.Ctx) (*database.ExportJob, bool) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		c.Status(400).JSON(fiber.Map{"error": "Invalid export id"})
+		return nil, false
+	}
+	job, err := database.GetExportJob(uint(id), c.Locals("phone").(string))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.Status(404).JSON(fiber.Map{"error": "export not found"})
+		} else {
+			c.Status(500).JSON(fiber.Map{"error": "Failed to load export"})
+		}
+		return nil, false
+	}
+	return job, true
+}
+
+func exportJobData(job database.ExportJob) fiber.Map {
+	data := fiber.Map{
+		"id":         job.ID,
+		"phone":      job.Phone,
+		"chat":       job.Chat,
+		"format":     job.Format,
+		"from":       job.From,
+		"to":         job.To,
+		"status":     job.Status,
+		"error":      job.Error,
+		"messages":   job.Messages,
+		"size":       job.Size,
+		"created_by": job.CreatedBy,
+		"created_at": job.CreatedAt,
+		"started_at": job.StartedAt,
+		"done_at":    job.DoneAt,
+	}
+	if job.Status == database.ExportDone {
+		data["download_url"] = fmt.Sprintf("/api/instances/%s/exports/%d/download", job.Phone, job.ID)
+	}
+	return data
+}
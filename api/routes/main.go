@@ -1,22 +1,27 @@
 package routes
 
 import (
+	"api/auth"
 	"api/database"
+	"api/export"
 	"api/manager"
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
 )
 
-func CastRoutes(app *fiber.App, sm *manager.SessionManager) {
-	api := app.Group("/api")
+func CastRoutes(app *fiber.App, sm *manager.SessionManager, rl *RateLimiter, exports *export.Runner, janitor *database.RetentionJanitor) {
+	app.Use(audit)
+	api := app.Group("/api", authenticate, rl.handler)
 
-	api.Post("/instances/:phone/pair", func(c *fiber.Ctx) error {
-		phone := c.Params("phone")
+	api.Post("/instances/:phone/pair", requireScope(auth.ScopeInstancesWrite), newPhoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
 
 		worker, ok := sm.GetWorker(phone)
 		if ok {
@@ -27,6 +32,10 @@ func CastRoutes(app *fiber.App, sm *manager.SessionManager) {
 			}
 		}
 
+		if _, err := database.ClaimSession(phone, principal(c).TenantID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "failed to initialize pairing"})
+		}
+
 		if err := sm.StartInstance(phone, "pairing"); err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "failed to initialize pairing"})
 		}
@@ -38,66 +47,229 @@ func CastRoutes(app *fiber.App, sm *manager.SessionManager) {
 		})
 	})
 
-	api.Post("/instances/:phone/start", func(c *fiber.Ctx) error {
-		phone := c.Params("phone")
+	api.Post("/instances/:phone/start", requireScope(auth.ScopeInstancesWrite), newPhoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		if _, err := database.ClaimSession(phone, principal(c).TenantID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create instance"})
+		}
 		if err := sm.StartInstance(phone, "starting"); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"status": "starting", "phone": phone})
 	})
 
-	api.Get("/instances/:phone", func(c *fiber.Ctx) error {
-		phone := c.Params("phone")
+	api.Get("/instances", requireScope(auth.ScopeInstancesRead), func(c *fiber.Ctx) error {
+		labels, err := database.ParseLabelSelector(c.Query("labels"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		sessions, err := database.ListSessions(database.SessionFilter{
+			TenantID: principal(c).TenantFilter(),
+			Status:   c.Query("status"),
+			Labels:   labels,
+		})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list instances"})
+		}
+
+		instances := make([]fiber.Map, 0, len(sessions))
+		for _, s := range sessions {
+			worker, _ := sm.GetWorker(s.Phone)
+			instances = append(instances, instanceData(s, worker))
+		}
+		return c.JSON(instances)
+	})
+
+	api.Get("/instances/:phone", requireScope(auth.ScopeInstancesRead), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
 
 		worker, ok := sm.GetWorker(phone)
 		if !ok {
 			return c.Status(404).JSON(fiber.Map{"error": "instance not found"})
 		}
-		return c.JSON(worker.GetData())
+
+		data := worker.GetData()
+		if s, err := database.GetSession(phone); err == nil {
+			data["tenant_id"] = s.TenantID
+			data["display_name"] = s.DisplayName
+			data["notes"] = s.Notes
+			data["labels"] = s.Labels
+			data["startup_priority"] = s.StartupPriority
+		}
+		return c.JSON(data)
+	})
+
+	api.Patch("/instances/:phone", requireScope(auth.ScopeInstancesWrite), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+
+		var req struct {
+			DisplayName *string          `json:"display_name"`
+			Notes       *string          `json:"notes"`
+			Labels      *database.Labels `json:"labels"`
+			Priority    *int             `json:"startup_priority"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		updates := map[string]any{}
+		if req.DisplayName != nil {
+			updates["display_name"] = *req.DisplayName
+		}
+		if req.Notes != nil {
+			updates["notes"] = *req.Notes
+		}
+		if req.Labels != nil {
+			if err := database.ValidateLabels(*req.Labels); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+			}
+			updates["labels"] = *req.Labels
+		}
+		if req.Priority != nil {
+			updates["startup_priority"] = *req.Priority
+		}
+		if len(updates) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Nothing to update"})
+		}
+
+		if err := database.UpdateSessionMeta(phone, updates); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(404).JSON(fiber.Map{"error": "instance not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update instance"})
+		}
+
+		s, err := database.GetSession(phone)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load instance"})
+		}
+		worker, _ := sm.GetWorker(phone)
+		return c.JSON(instanceData(*s, worker))
+	})
+
+	api.Post("/instances/bulk", requireScope(auth.ScopeInstancesWrite), func(c *fiber.Ctx) error {
+		var req struct {
+			Action      string               `json:"action"`
+			Selector    manager.BulkSelector `json:"selector"`
+			Concurrency int                  `json:"concurrency"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if !manager.IsBulkAction(req.Action) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid action"})
+		}
+
+		for i, raw := range req.Selector.Phones {
+			p, err := manager.ResolvePhone(raw)
+			if err != nil {
+				return invalidPhone(c, fmt.Errorf("%s: %w", raw, err))
+			}
+			req.Selector.Phones[i] = p
+		}
+
+		req.Selector.TenantID = principal(c).TenantFilter()
+		phones, missing, err := sm.ResolveSelector(req.Selector)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// Looked up first, reset deletes the sessions
+		tenants, err := database.SessionTenants(phones)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load instances"})
+		}
+
+		results := sm.Bulk(req.Action, phones, req.Concurrency)
+		for _, p := range missing {
+			results = append(results, manager.BulkResult{Phone: p, Error: "instance not found"})
+		}
+
+		succeeded := 0
+		audited := make([]auditResult, len(results))
+		for i, r := range results {
+			if r.OK {
+				succeeded++
+			}
+			audited[i] = auditResult{Phone: r.Phone, TenantID: tenants[r.Phone], OK: r.OK, After: r}
+		}
+		auditEach(c, audited)
+
+		return c.JSON(fiber.Map{
+			"action":    req.Action,
+			"total":     len(results),
+			"succeeded": succeeded,
+			"failed":    len(results) - succeeded,
+			"results":   results,
+		})
 	})
 
-	api.Post("/instances/:phone/pause", func(c *fiber.Ctx) error {
-		phone := c.Params("phone")
+	api.Post("/instances/:phone/pause", requireScope(auth.ScopeInstancesWrite), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
 		if err := sm.PauseInstance(phone, true); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"status": "paused"})
 	})
 
-	api.Post("/instances/:phone/resume", func(c *fiber.Ctx) error {
-		phone := c.Params("phone")
+	api.Post("/instances/:phone/resume", requireScope(auth.ScopeInstancesWrite), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
 		if err := sm.PauseInstance(phone, false); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"status": "resuming"})
 	})
 
-	api.Post("/instances/:phone/reset", func(c *fiber.Ctx) error {
-		phone := c.Params("phone")
-		if err := sm.ClearSession(phone); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to clear Redis"})
+	api.Post("/instances/:phone/restart", requireScope(auth.ScopeInstancesWrite), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		if err := sm.RestartInstance(phone); err != nil {
+			if errors.Is(err, manager.ErrPaused) {
+				return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+			}
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"status": "restarting", "phone": phone})
+	})
+
+	api.Post("/instances/:phone/stop", requireScope(auth.ScopeInstancesWrite), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		if err := sm.StopInstance(phone); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
-		return c.JSON(fiber.Map{"message": "Redis cleared. You can now request a new pairing code."})
+		return c.JSON(fiber.Map{"status": "stopped", "phone": phone})
 	})
 
-	api.Post("instances/:phone/contacts", func(c *fiber.Ctx) error {
-		contact, err := database.GetContacts(c.Params("phone"))
+	api.Post("/instances/:phone/reset", requireScope(auth.ScopeInstancesWrite), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		res, err := sm.ClearSession(phone)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to clear Redis", "keys": res})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Redis cleared. You can now request a new pairing code.",
+			"keys":    res,
+		})
+	})
+
+	api.Post("instances/:phone/contacts", requireScope(auth.ScopeInstancesRead), phoneParam, func(c *fiber.Ctx) error {
+		contact, err := database.GetContacts(c.Locals("phone").(string))
 		if err == nil {
 			return c.JSON(contact)
 		}
 		return c.JSON(fiber.Map{"error": "Unable to get instance contacts"})
 	})
 
-	api.Post("instances/:phone/groups", func(c *fiber.Ctx) error {
-		groups, err := database.GetAllGroups(c.Params("phone"))
+	api.Post("instances/:phone/groups", requireScope(auth.ScopeInstancesRead), phoneParam, func(c *fiber.Ctx) error {
+		groups, err := database.GetAllGroups(c.Locals("phone").(string))
 		if err == nil {
 			return c.JSON(groups)
 		}
 		return c.JSON(fiber.Map{"error": "Unable to get instance groups"})
 	})
 
-	api.Get("/settings/:phone", func(c *fiber.Ctx) error {
-		phone := c.Params("phone")
+	api.Get("/settings/:phone", requireScope(auth.ScopeSettingsRead), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
 
 		settings, err := database.GetUserSettings(phone)
 		if err != nil {
@@ -113,8 +285,8 @@ func CastRoutes(app *fiber.App, sm *manager.SessionManager) {
 		})
 	})
 
-	api.Patch("/settings/:phone", func(c *fiber.Ctx) error {
-		phone := c.Params("phone")
+	api.Patch("/settings/:phone", requireScope(auth.ScopeSettingsWrite), phoneParam, func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
 
 		type UpdateReq struct {
 			Key   string `json:"key"`
@@ -125,20 +297,15 @@ func CastRoutes(app *fiber.App, sm *manager.SessionManager) {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 		}
 
-		allowedKeys := map[string]bool{
-			"language": true, "prefix": true, "mode": true, "afk": true,
-			"bgm": true, "alive_msg": true, "filters": true, "antimsg": true,
-			"antiword": true, "antilink": true, "anticall": true, "antidelete": true,
-			"antilink_spam": true, "welcome_msg": true, "goodbye_msg": true,
-			"group_events": true, "autokick": true,
-		}
-		if !allowedKeys[req.Key] {
+		if !database.SettingKeys[req.Key] {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid setting key"})
 		}
 
+		before, _ := database.GetUserSetting(phone, req.Key)
 		if err := database.UpdateUserSetting(phone, req.Key, req.Value); err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to update setting"})
 		}
+		auditChange(c, fiber.Map{req.Key: before}, fiber.Map{req.Key: req.Value})
 
 		return c.JSON(fiber.Map{
 			"status":  "success",
@@ -146,7 +313,7 @@ func CastRoutes(app *fiber.App, sm *manager.SessionManager) {
 		})
 	})
 
-	api.Get("/system/stream", func(c *fiber.Ctx) error {
+	api.Get("/system/stream", requireScope(auth.ScopeInstancesRead), func(c *fiber.Ctx) error {
 		c.Set("Content-Type", "text/event-stream")
 		c.Set("Cache-Control", "no-cache")
 		c.Set("Connection", "keep-alive")
@@ -171,5 +338,36 @@ func CastRoutes(app *fiber.App, sm *manager.SessionManager) {
 		return nil
 	})
 
+	KeyRoutes(api)
+	TenantRoutes(api)
+	UserRoutes(api)
+	AuditRoutes(api)
+	MessageRoutes(api)
+	ChatRoutes(api)
+	ExportRoutes(api, exports)
+	AnalyticsRoutes(api)
+	RetentionRoutes(api, janitor)
+	LoginRoutes(app, rl)
 	UtilRoutes(app)
 }
+
+// instanceData merges the persisted session with the live worker state
+func instanceData(s database.Session, w *manager.Worker) fiber.Map {
+	data := fiber.Map{
+		"phone":            s.Phone,
+		"tenant_id":        s.TenantID,
+		"status":           s.Status,
+		"pairing_code":     s.PairingCode,
+		"is_running":       false,
+		"display_name":     s.DisplayName,
+		"notes":            s.Notes,
+		"labels":           s.Labels,
+		"startup_priority": s.StartupPriority,
+	}
+	if w != nil {
+		for k, v := range w.GetData() {
+			data[k] = v
+		}
+	}
+	return data
+}
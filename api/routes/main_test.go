@@ -0,0 +1,101 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"api/export"
+	"api/kvstore"
+	"api/manager"
+	"api/ratelimit"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newTestApp serves every route against a fresh SQLite database. Core processes
+// are never started.
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	database.InitDB(database.Options{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "test.sqlite")})
+	t.Cleanup(func() {
+		if db, err := database.DB.DB(); err == nil {
+			db.Close()
+		}
+	})
+
+	sm := manager.CreateSession(kvstore.NewMemory())
+	sm.CoreDir = t.TempDir()
+	sm.CoreCommand = "false"
+
+	exports, err := export.NewRunner(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(exports.Close)
+	janitor := database.NewRetentionJanitor(database.JanitorOptions{Interval: time.Hour, Batch: 100})
+	t.Cleanup(janitor.Close)
+
+	app := fiber.New()
+	CastRoutes(app, sm, &RateLimiter{Limiter: ratelimit.New()}, exports, janitor)
+	return app
+}
+
+// newKey stores a key of tenant restricted to phone, when set, and returns it
+func newKey(t *testing.T, tenant, phone string, scopes ...string) string {
+	t.Helper()
+	plain, prefix, err := auth.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.CreateAPIKey(&database.APIKey{
+		Name:     "test",
+		TenantID: tenant,
+		Phone:    phone,
+		Prefix:   prefix,
+		Hash:     auth.HashKey(plain),
+		Scopes:   auth.JoinScopes(scopes),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func newSession(t *testing.T, phone, tenant string) {
+	t.Helper()
+	if err := database.DB.Create(&database.Session{Phone: phone, TenantID: tenant, Status: "stopped"}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// call sends a request with key as bearer token and returns the status and the
+// decoded JSON body
+func call(t *testing.T, app *fiber.App, method, path, key string, body any) (int, any) {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, r)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out any
+	data, _ := io.ReadAll(resp.Body)
+	json.Unmarshal(data, &out)
+	return resp.StatusCode, out
+}
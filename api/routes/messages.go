@@ -0,0 +1,246 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"api/message"
+	"api/phone"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func MessageRoutes(api fiber.Router) {
+	messages := api.Group("/instances/:phone/messages", requireScope(auth.ScopeMessagesRead), phoneParam)
+
+	messages.Get("/", func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		f := database.MessageFilter{
+			Phone: phone,
+			Chat:  jidParam(c.Query("chat")),
+		}
+
+		if sender := jidParam(c.Query("sender")); sender == message.UserJID(phone) {
+			fromMe := true
+			f.FromMe = &fromMe
+		} else {
+			f.Sender = sender
+		}
+		switch c.Query("direction") {
+		case "":
+		case "in", "out":
+			fromMe := c.Query("direction") == "out"
+			if f.FromMe != nil && *f.FromMe != fromMe {
+				return c.JSON(fiber.Map{"messages": []messageView{}})
+			}
+			f.FromMe = &fromMe
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "direction must be in or out"})
+		}
+		if t := c.Query("type"); t != "" {
+			if !contentType.MatchString(t) {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid content type"})
+			}
+			f.ContentType = t
+		}
+
+		var err error
+		if f.From, err = parseTime(c.Query("from")); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid from time"})
+		}
+		if f.To, err = parseTime(c.Query("to")); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid to time"})
+		}
+		if cursor := c.Query("cursor"); cursor != "" {
+			if f.Before, err = decodeCursor(cursor); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid cursor"})
+			}
+		}
+
+		f.Limit = c.QueryInt("limit", 50)
+		if f.Limit <= 0 || f.Limit > 500 {
+			f.Limit = 50
+		}
+
+		rows, err := database.QueryMessages(f)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query messages"})
+		}
+
+		raw := c.QueryBool("raw")
+		out := make([]messageView, 0, len(rows))
+		for _, row := range rows {
+			out = append(out, decodeMessage(phone, row, raw))
+		}
+
+		res := fiber.Map{"messages": out}
+		if len(rows) == f.Limit {
+			last := rows[len(rows)-1]
+			res["next_cursor"] = encodeCursor(database.MessageCursor{SentAt: last.SentAt, ID: last.ID})
+		}
+		return c.JSON(res)
+	})
+
+	// Registered before /:id, which would match it
+	messages.Get("/search", func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		f := database.SearchFilter{
+			Phone:  phone,
+			Query:  c.Query("q"),
+			Chat:   jidParam(c.Query("chat")),
+			Limit:  c.QueryInt("limit", 20),
+			Offset: c.QueryInt("offset", 0),
+		}
+		if f.Limit <= 0 || f.Limit > 100 {
+			f.Limit = 20
+		}
+		if f.Offset < 0 {
+			f.Offset = 0
+		}
+
+		hits, err := database.SearchMessages(f)
+		if err != nil {
+			if errors.Is(err, database.ErrEmptyQuery) {
+				return c.Status(400).JSON(fiber.Map{"error": "q must contain at least one search term"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to search messages"})
+		}
+
+		ids := make([]string, 0, len(hits))
+		for _, h := range hits {
+			ids = append(ids, h.MessageID)
+		}
+		rows, err := database.GetMessages(phone, ids)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load messages"})
+		}
+
+		type result struct {
+			messageView
+			Snippet string  `json:"snippet"`
+			Rank    float64 `json:"rank"`
+		}
+		out := make([]result, 0, len(hits))
+		for _, h := range hits {
+			row, ok := rows[h.MessageID]
+			if !ok {
+				continue // Deleted since it was indexed
+			}
+			out = append(out, result{
+				messageView: decodeMessage(phone, row, false),
+				Snippet:     highlight(h.Snippet),
+				Rank:        h.Rank,
+			})
+		}
+
+		res := fiber.Map{"results": out}
+		if len(hits) == f.Limit {
+			res["next_offset"] = f.Offset + f.Limit
+		}
+		return c.JSON(res)
+	})
+
+	messages.Get("/:id", func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		row, err := database.GetMessage(phone, c.Params("id"))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(404).JSON(fiber.Map{"error": "message not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load message"})
+		}
+		return c.JSON(decodeMessage(phone, *row, c.QueryBool("raw", true)))
+	})
+}
+
+// highlight escapes a search snippet for HTML and marks the matches with <mark>
+func highlight(snippet string) string {
+	s := html.EscapeString(snippet)
+	s = strings.ReplaceAll(s, database.MarkStart, "<mark>")
+	return strings.ReplaceAll(s, database.MarkEnd, "</mark>")
+}
+
+var contentType = regexp.MustCompile(`^[A-Za-z]{1,64}$`)
+
+// jidParam accepts a full JID or a plain phone number for a user JID
+func jidParam(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.Contains(s, "@") {
+		return s
+	}
+	if p, err := phone.Normalize(s); err == nil {
+		return message.UserJID(p)
+	}
+	return s
+}
+
+// Cursors are opaque to clients, they hold the sent time and id of a message
+func encodeCursor(c database.MessageCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.SentAt, 10) + "\n" + c.ID))
+}
+
+func decodeCursor(s string) (*database.MessageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	ts, id, ok := strings.Cut(string(b), "\n")
+	if !ok || id == "" {
+		return nil, errors.New("malformed cursor")
+	}
+	sentAt, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &database.MessageCursor{SentAt: sentAt, ID: id}, nil
+}
+
+// messageView is the stable response shape of a stored message
+type messageView struct {
+	ID        string          `json:"id"`
+	Chat      string          `json:"chat"`
+	Sender    string          `json:"sender"`
+	FromMe    bool            `json:"from_me"`
+	PushName  string          `json:"push_name,omitempty"`
+	Timestamp *time.Time      `json:"timestamp"`
+	StoredAt  string          `json:"stored_at"`
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	Media     *message.Media  `json:"media,omitempty"`
+	Quoted    *message.Quoted `json:"quoted,omitempty"`
+	Raw       json.RawMessage `json:"raw,omitempty"`
+}
+
+// decodeMessage builds the view of a stored message, documents that fail to parse
+// are returned with only the stored columns set
+func decodeMessage(phone string, row database.UserMessage, raw bool) messageView {
+	v := messageView{ID: row.ID, StoredAt: row.Timestamp}
+	if raw {
+		v.Raw = json.RawMessage(row.Data)
+	}
+
+	m, err := message.Decode([]byte(row.Data), message.UserJID(phone))
+	if err != nil {
+		return v
+	}
+	v.Chat = m.Chat
+	v.Sender = m.Sender
+	v.FromMe = m.FromMe
+	v.PushName = m.PushName
+	if !m.Timestamp.IsZero() {
+		v.Timestamp = &m.Timestamp
+	}
+	v.Type = m.ContentType
+	v.Text = m.Text
+	v.Media = m.Media
+	v.Quoted = m.Quoted
+	return v
+}
@@ -0,0 +1,178 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcCookie   = "wa_oidc"
+	oidcLoginTTL = 10 * time.Minute
+)
+
+// oidcLogins holds in-flight logins by state until the provider redirects back
+type oidcLogins struct {
+	mu      sync.Mutex
+	pending map[string]pendingLogin
+}
+
+type pendingLogin struct {
+	login   *auth.OIDCLogin
+	expires time.Time
+}
+
+func (l *oidcLogins) put(login *auth.OIDCLogin) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for state, p := range l.pending {
+		if now.After(p.expires) {
+			delete(l.pending, state)
+		}
+	}
+	l.pending[login.State] = pendingLogin{login, now.Add(oidcLoginTTL)}
+}
+
+// take returns and forgets the login for state, so each one can only complete once
+func (l *oidcLogins) take(state string) *auth.OIDCLogin {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.pending[state]
+	delete(l.pending, state)
+	if !ok || time.Now().After(p.expires) {
+		return nil
+	}
+	return p.login
+}
+
+// OIDCRoutes adds single sign-on through provider. Users are created on first login
+// in tenant and their role is refreshed from their groups on every login.
+func OIDCRoutes(app *fiber.App, provider *auth.OIDCProvider, tenant string) {
+	logins := &oidcLogins{pending: make(map[string]pendingLogin)}
+	r := app.Group("/auth/oidc")
+
+	r.Get("/login", func(c *fiber.Ctx) error {
+		login, redirect, err := provider.NewLogin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to start login"})
+		}
+		logins.put(login)
+
+		// Bind the state to this browser so a callback link can't be replayed elsewhere
+		c.Cookie(&fiber.Cookie{
+			Name:     oidcCookie,
+			Value:    login.State,
+			Path:     "/auth/oidc",
+			Expires:  time.Now().Add(oidcLoginTTL),
+			HTTPOnly: true,
+			Secure:   c.Protocol() == "https",
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+		return c.Redirect(redirect)
+	})
+
+	r.Get("/callback", func(c *fiber.Ctx) error {
+		if e := c.Query("error"); e != "" {
+			return c.Status(401).JSON(fiber.Map{"error": "Login failed", "detail": e})
+		}
+
+		state := c.Query("state")
+		if state == "" || state != c.Cookies(oidcCookie) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid login state"})
+		}
+		c.ClearCookie(oidcCookie)
+		login := logins.take(state)
+		if login == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Login expired, try again"})
+		}
+
+		id, err := provider.Exchange(c.Context(), login, c.Query("code"))
+		if errors.Is(err, auth.ErrNoRole) {
+			return c.Status(403).JSON(fiber.Map{"error": "Your account has no access"})
+		}
+		if err != nil {
+			fmt.Printf("OIDC login failed: %v\n", err)
+			return c.Status(401).JSON(fiber.Map{"error": "Login failed"})
+		}
+
+		u, err := oidcUser(id, tenant)
+		if err != nil {
+			fmt.Printf("OIDC user sync failed for %s: %v\n", id.Subject, err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to sign in"})
+		}
+		if u.Disabled {
+			return c.Status(403).JSON(fiber.Map{"error": "Account disabled"})
+		}
+
+		if err := startSession(c, u); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to start session"})
+		}
+		return c.Redirect("/")
+	})
+}
+
+// oidcUser finds the user for id, creating it on first login, and syncs its role
+func oidcUser(id *auth.OIDCIdentity, tenant string) (*database.User, error) {
+	u, err := database.GetUserByOIDCSubject(id.Issuer, id.Subject)
+	if err == nil {
+		if u.Role != id.Role {
+			if err := database.UpdateUser(u.ID, map[string]any{"role": id.Role}); err != nil {
+				return nil, err
+			}
+			u.Role = id.Role
+		}
+		return u, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	username, err := freeUsername(id)
+	if err != nil {
+		return nil, err
+	}
+	issuer, sub := id.Issuer, id.Subject
+	u = &database.User{
+		Username:     username,
+		PasswordHash: "!", // Not a bcrypt hash, password login always fails
+		Role:         id.Role,
+		TenantID:     tenant,
+		OIDCIssuer:   &issuer,
+		OIDCSubject:  &sub,
+	}
+	if err := database.CreateUser(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// freeUsername picks the name for a new single sign-on user. Taken names are never
+// reused, so a local account or another provider user can't be taken over; the
+// subject is appended instead, then a counter.
+func freeUsername(id *auth.OIDCIdentity) (string, error) {
+	suffixed := fmt.Sprintf("%s#%s", id.Username, id.Subject[:min(len(id.Subject), 8)])
+	for i := range 20 {
+		name := id.Username
+		switch {
+		case i == 1:
+			name = suffixed
+		case i > 1:
+			name = fmt.Sprintf("%s-%d", suffixed, i)
+		}
+		_, err := database.GetUserByUsername(name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free username for %q", id.Username)
+}
@@ -0,0 +1,289 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	testClientID    = "whatsaly"
+	testRedirectURL = "http://whatsaly.test/auth/oidc/callback"
+)
+
+// mockIdP is an OpenID provider serving discovery, JWKS, authorization and token
+// endpoints. Authorization grants every request for the current user right away.
+type mockIdP struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	user   map[string]any       // Claims of the user signing in
+	nonce  string               // Replaces the requested nonce when set
+	grants map[string]mockGrant // By code
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, grants: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.srv.URL,
+			"authorization_endpoint": idp.srv.URL + "/authorize",
+			"token_endpoint":         idp.srv.URL + "/token",
+			"jwks_uri":               idp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != testClientID {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code, _ := auth.RandomToken(16)
+		idp.mu.Lock()
+		nonce := q.Get("nonce")
+		if idp.nonce != "" {
+			nonce = idp.nonce
+		}
+		idp.grants[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: nonce, claims: idp.user}
+		idp.mu.Unlock()
+		back := url.Values{"code": {code}, "state": {q.Get("state")}}
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		g, ok := idp.grants[r.Form.Get("code")]
+		delete(idp.grants, r.Form.Get("code"))
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := map[string]any{
+			"iss":   idp.srv.URL,
+			"aud":   testClientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": g.nonce,
+		}
+		for k, v := range g.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(claims)})
+	})
+
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+func (idp *mockIdP) sign(claims map[string]any) string {
+	seg := func(v any) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(map[string]string{"alg": "RS256", "kid": "k1"}) + "." + seg(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (idp *mockIdP) signIn(claims map[string]any, nonce string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.user, idp.nonce = claims, nonce
+}
+
+// newOIDCApp serves the routes with single sign-on through idp
+func newOIDCApp(t *testing.T, idp *mockIdP) *fiber.App {
+	t.Helper()
+	app := newTestApp(t)
+	provider, err := auth.NewOIDCProvider(context.Background(), auth.OIDCConfig{
+		Issuer:      idp.srv.URL,
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+		RoleMap:     map[string]string{"*": auth.RoleViewer, "admins": auth.RoleAdmin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	OIDCRoutes(app, provider, database.DefaultTenant)
+	return app
+}
+
+// oidcLogin is a browser that started a login: the callback URL the provider sent
+// it back to and its state cookie
+type oidcLogin struct {
+	callback *url.URL
+	cookie   string
+}
+
+// startOIDCLogin requests /auth/oidc/login and follows the redirect to the provider
+func startOIDCLogin(t *testing.T, app *fiber.App) oidcLogin {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest("GET", "/auth/oidc/login", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var cookie string
+	for _, c := range resp.Cookies() {
+		if c.Name == oidcCookie {
+			cookie = c.Value
+		}
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(callback.String(), testRedirectURL) {
+		t.Fatalf("provider redirected to %q", resp.Header.Get("Location"))
+	}
+	return oidcLogin{callback: callback, cookie: cookie}
+}
+
+// finish sends the callback with query, the browser's state cookie and returns the status
+func (l oidcLogin) finish(t *testing.T, app *fiber.App, query url.Values) int {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/auth/oidc/callback?"+query.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: oidcCookie, Value: l.cookie})
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	alice := map[string]any{"sub": "00u1alice", "preferred_username": "alice", "groups": []string{"admins"}}
+
+	tests := []struct {
+		name  string
+		nonce string
+		query func(l, other oidcLogin) url.Values
+		want  int
+	}{
+		{"valid", "", func(l, _ oidcLogin) url.Values { return l.callback.Query() }, 302},
+		{"state mismatch", "", func(l, other oidcLogin) url.Values {
+			q := l.callback.Query()
+			q.Set("state", other.callback.Query().Get("state"))
+			return q
+		}, 400},
+		{"code of another login", "", func(l, other oidcLogin) url.Values {
+			// The code is bound to the other login's PKCE challenge
+			q := l.callback.Query()
+			q.Set("code", other.callback.Query().Get("code"))
+			return q
+		}, 401},
+		{"nonce mismatch", "replayed-nonce", func(l, _ oidcLogin) url.Values { return l.callback.Query() }, 401},
+		{"provider error", "", func(l, _ oidcLogin) url.Values { return url.Values{"error": {"access_denied"}} }, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newOIDCApp(t, idp)
+			idp.signIn(alice, tt.nonce)
+			l := startOIDCLogin(t, app)
+			other := startOIDCLogin(t, app)
+			if got := l.finish(t, app, tt.query(l, other)); got != tt.want {
+				t.Fatalf("status %d, want %d", got, tt.want)
+			}
+
+			_, err := database.GetUserByOIDCSubject(idp.srv.URL, "00u1alice")
+			if created := err == nil; created != (tt.want == 302) {
+				t.Fatalf("user created %t after status %d", created, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCProvisioning(t *testing.T) {
+	idp := newMockIdP(t)
+	app := newOIDCApp(t, idp)
+	signIn := func(claims map[string]any) *database.User {
+		t.Helper()
+		idp.signIn(claims, "")
+		l := startOIDCLogin(t, app)
+		if got := l.finish(t, app, l.callback.Query()); got != 302 {
+			t.Fatalf("status %d, want 302", got)
+		}
+		u, err := database.GetUserByOIDCSubject(idp.srv.URL, claims["sub"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// Taken names are never reused: a local account, a user of another issuer with
+	// the same subject and the subject suffixed name
+	newUser(t, "alice", "correct horse battery")
+	newUser(t, "alice#00u1alic", "correct horse battery")
+	issuer, sub := "https://other.example", "00u1alice"
+	other := database.User{Username: "alice-other", PasswordHash: "!", Role: auth.RoleAdmin, TenantID: database.DefaultTenant, OIDCIssuer: &issuer, OIDCSubject: &sub}
+	if err := database.CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+
+	u := signIn(map[string]any{"sub": "00u1alice", "preferred_username": "alice", "groups": []string{"admins"}})
+	if u.ID == other.ID || u.Username != "alice#00u1alic-2" || u.Role != auth.RoleAdmin || u.TenantID != database.DefaultTenant {
+		t.Fatalf("provisioned %+v", u)
+	}
+
+	// The role follows the groups on every login, the account stays the same
+	again := signIn(map[string]any{"sub": "00u1alice", "preferred_username": "alice", "groups": []string{}})
+	if again.ID != u.ID || again.Role != auth.RoleViewer {
+		t.Fatalf("second login gave user %d with role %s, want %d with %s", again.ID, again.Role, u.ID, auth.RoleViewer)
+	}
+
+	if u := signIn(map[string]any{"sub": "00u2bob", "email": "bob@example.com"}); u.Username != "bob@example.com" {
+		t.Fatalf("username %q, want the email when no preferred_username is given", u.Username)
+	}
+}
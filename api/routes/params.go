@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"api/database"
+	"api/manager"
+	"errors"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// phoneParam normalizes the :phone route parameter and stores it in c.Locals("phone").
+// Invalid numbers are rejected with 400, and sessions of other tenants or that don't
+// exist yet are reported as 404 so callers can't probe for numbers they don't own.
+func phoneParam(c *fiber.Ctx) error {
+	return resolvePhone(c, false)
+}
+
+// newPhoneParam is phoneParam for routes creating instances, it lets through
+// numbers that don't have a session yet
+func newPhoneParam(c *fiber.Ctx) error {
+	return resolvePhone(c, true)
+}
+
+func resolvePhone(c *fiber.Ctx, allowNew bool) error {
+	raw, err := url.PathUnescape(c.Params("phone"))
+	if err != nil {
+		return invalidPhone(c, err)
+	}
+	p, err := manager.ResolvePhone(raw)
+	if err != nil {
+		return invalidPhone(c, err)
+	}
+
+	caller := principal(c)
+	if caller.Phone != "" && caller.Phone != p {
+		return c.Status(404).JSON(fiber.Map{"error": "instance not found"})
+	}
+	s, err := database.GetSession(p)
+	switch {
+	case err == nil:
+		if !caller.CanAccess(s.TenantID) {
+			return c.Status(404).JSON(fiber.Map{"error": "instance not found"})
+		}
+		c.Locals("phone_tenant", s.TenantID)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if !allowNew && !caller.IsSuperAdmin() {
+			return c.Status(404).JSON(fiber.Map{"error": "instance not found"})
+		}
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load instance"})
+	}
+
+	c.Locals("phone", p)
+	return c.Next()
+}
+
+func invalidPhone(c *fiber.Ctx, err error) error {
+	return c.Status(400).JSON(fiber.Map{
+		"error":  "Invalid phone number",
+		"detail": err.Error(),
+	})
+}
@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"api/ratelimit"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RateLimiter applies per caller token buckets by route class and daily API key quotas
+type RateLimiter struct {
+	Limiter  *ratelimit.Limiter
+	Quota    *ratelimit.Quota // Optional
+	Defaults ratelimit.Limits
+}
+
+var lifecycleActions = map[string]bool{
+	"pair": true, "start": true, "stop": true, "pause": true,
+	"resume": true, "restart": true, "reset": true,
+}
+
+// routeClass groups an /api path by how costly or sensitive its requests are
+func routeClass(method, path string) string {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/api"), "/"), "/")
+
+	switch {
+	case parts[0] == "keys" || parts[0] == "tenants" || parts[0] == "users":
+		return ratelimit.ClassAdmin
+	case parts[0] == "instances" && len(parts) >= 2 && parts[1] == "bulk":
+		return ratelimit.ClassLifecycle
+	case parts[0] == "instances" && len(parts) >= 3 && lifecycleActions[parts[2]] && method == fiber.MethodPost:
+		return ratelimit.ClassLifecycle
+	case parts[0] == "instances" && len(parts) >= 3 && (parts[2] == "messages" || parts[2] == "export" || parts[2] == "exports" || parts[2] == "analytics"):
+		return ratelimit.ClassMessages
+	case method == fiber.MethodGet || method == fiber.MethodHead:
+		return ratelimit.ClassRead
+	default:
+		return ratelimit.ClassWrite
+	}
+}
+
+// handler must run after authenticate
+func (rl *RateLimiter) handler(c *fiber.Ctx) error {
+	p := principal(c)
+	if p == nil {
+		return c.Next()
+	}
+
+	class := routeClass(c.Method(), c.Path())
+	limit, ok := p.RateLimits[class]
+	if !ok {
+		limit = rl.Defaults[class]
+	}
+
+	caller := fmt.Sprintf("key:%d", p.KeyID)
+	if p.KeyID == 0 {
+		caller = fmt.Sprintf("user:%d", p.UserID)
+	}
+
+	res := rl.Limiter.Allow(caller+":"+class, limit)
+	if res.Limit > 0 {
+		c.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+		c.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Set("X-RateLimit-Reset", strconv.FormatInt(res.Reset.Unix(), 10))
+		c.Set("X-RateLimit-Class", class)
+	}
+	if !res.Allowed {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(res.RetryAfter/time.Second)+1))
+		return c.Status(429).JSON(fiber.Map{"error": "Rate limit exceeded", "class": class})
+	}
+
+	if rl.Quota != nil && p.KeyID != 0 && p.DailyQuota > 0 {
+		allowed, remaining := rl.Quota.Take(p.KeyID, p.DailyQuota)
+		reset := rl.Quota.Reset()
+		c.Set("X-Quota-Limit", strconv.FormatInt(p.DailyQuota, 10))
+		c.Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+		c.Set("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if !allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(time.Until(reset)/time.Second)+1))
+			return c.Status(429).JSON(fiber.Map{"error": "Daily quota exceeded"})
+		}
+	}
+
+	return c.Next()
+}
+
+// encodeLimits validates per key limits and stores them in APIKey.RateLimits format
+func encodeLimits(limits map[string]int) (string, error) {
+	var pairs []string
+	for _, class := range ratelimit.Classes {
+		n, ok := limits[class]
+		if !ok {
+			continue
+		}
+		if n < 0 {
+			return "", fmt.Errorf("invalid limit for %s", class)
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%d", class, n))
+	}
+	for class := range limits {
+		if !ratelimit.ValidClass(class) {
+			return "", fmt.Errorf("unknown route class %q", class)
+		}
+	}
+	return strings.Join(pairs, ","), nil
+}
+
+// Login attempts allowed per minute, by client address and by username. They are
+// counted before the password is checked, so failures and successes alike.
+const (
+	loginIPLimit   = 20
+	loginUserLimit = 5
+)
+
+// allowLogin takes a login attempt for username from ip and returns how long to
+// wait when either has run out
+func (rl *RateLimiter) allowLogin(ip, username string) (time.Duration, bool) {
+	if res := rl.Limiter.Allow("login-ip:"+ip, loginIPLimit); !res.Allowed {
+		return res.RetryAfter, false
+	}
+	res := rl.Limiter.Allow("login-user:"+strings.ToLower(username), loginUserLimit)
+	return res.RetryAfter, res.Allowed
+}
@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxRetentionDays keeps max_age_days within what time.AddDate handles sensibly
+const maxRetentionDays = 36500
+
+func RetentionRoutes(api fiber.Router, janitor *database.RetentionJanitor) {
+	retention := api.Group("/instances/:phone/retention", phoneParam)
+
+	retention.Get("/", requireScope(auth.ScopeSettingsRead), func(c *fiber.Ctx) error {
+		policy, err := database.GetRetentionPolicy(c.Locals("phone").(string))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load retention policy"})
+		}
+		return c.JSON(retentionData(*policy))
+	})
+
+	// Zero limits keep messages forever, omitted fields keep their current value
+	retention.Put("/", requireScope(auth.ScopeSettingsWrite), func(c *fiber.Ctx) error {
+		var req struct {
+			MaxAgeDays  *int  `json:"max_age_days"`
+			MaxPerChat  *int  `json:"max_per_chat"`
+			KeepStarred *bool `json:"keep_starred"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if req.MaxAgeDays != nil && (*req.MaxAgeDays < 0 || *req.MaxAgeDays > maxRetentionDays) {
+			return c.Status(400).JSON(fiber.Map{"error": "max_age_days must be between 0 and 36500"})
+		}
+		if req.MaxPerChat != nil && *req.MaxPerChat < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "max_per_chat must not be negative"})
+		}
+
+		policy, err := database.GetRetentionPolicy(c.Locals("phone").(string))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load retention policy"})
+		}
+		before := retentionData(*policy)
+		if req.MaxAgeDays != nil {
+			policy.MaxAgeDays = *req.MaxAgeDays
+		}
+		if req.MaxPerChat != nil {
+			policy.MaxPerChat = *req.MaxPerChat
+		}
+		if req.KeepStarred != nil {
+			policy.KeepStarred = *req.KeepStarred
+		}
+		if err := database.SaveRetentionPolicy(policy); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save retention policy"})
+		}
+		after := retentionData(*policy)
+		auditChange(c, before, after)
+		return c.JSON(after)
+	})
+
+	retention.Delete("/", requireScope(auth.ScopeSettingsWrite), func(c *fiber.Ctx) error {
+		if err := database.DeleteRetentionPolicy(c.Locals("phone").(string)); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete retention policy"})
+		}
+		return c.JSON(fiber.Map{"status": "success", "message": "Messages are kept forever"})
+	})
+
+	// Queues a purge with the current policy, the outcome appears in /runs
+	retention.Post("/run", requireScope(auth.ScopeSettingsWrite), func(c *fiber.Ctx) error {
+		phone := c.Locals("phone").(string)
+		policy, err := database.GetRetentionPolicy(phone)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load retention policy"})
+		}
+		if !policy.Enabled() {
+			return c.Status(409).JSON(fiber.Map{"error": "No retention limits are set"})
+		}
+		if !janitor.Run(phone) {
+			return c.Status(503).JSON(fiber.Map{"error": "Too many purges queued, try again later"})
+		}
+		return c.Status(202).JSON(fiber.Map{"status": "queued"})
+	})
+
+	retention.Get("/runs", requireScope(auth.ScopeSettingsRead), func(c *fiber.Ctx) error {
+		runs, err := database.ListPurgeRuns(c.Locals("phone").(string))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list purge runs"})
+		}
+		out := make([]fiber.Map, 0, len(runs))
+		for _, r := range runs {
+			out = append(out, fiber.Map{
+				"id":           r.ID,
+				"trigger":      r.Trigger,
+				"max_age_days": r.MaxAgeDays,
+				"max_per_chat": r.MaxPerChat,
+				"keep_starred": r.KeepStarred,
+				"by_age":       r.ByAge,
+				"by_count":     r.ByCount,
+				"purged":       r.ByAge + r.ByCount,
+				"chats":        r.Chats,
+				"error":        r.Error,
+				"started_at":   r.StartedAt,
+				"finished_at":  r.FinishedAt,
+			})
+		}
+		return c.JSON(out)
+	})
+}
+
+func retentionData(p database.RetentionPolicy) fiber.Map {
+	return fiber.Map{
+		"phone":        p.SessionPhone,
+		"max_age_days": p.MaxAgeDays,
+		"max_per_chat": p.MaxPerChat,
+		"keep_starred": p.KeepStarred,
+		"enabled":      p.Enabled(),
+	}
+}
@@ -0,0 +1,380 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	sessionCookie = "wa_session"
+	sessionTTL    = 12 * time.Hour
+	totpIssuer    = "Whatsaly"
+)
+
+// sessionPrincipal returns the principal of a valid login session cookie, or nil
+func sessionPrincipal(c *fiber.Ctx) *auth.Principal {
+	token := c.Cookies(sessionCookie)
+	if token == "" {
+		return nil
+	}
+	s, err := database.FindUserSession(auth.HashKey(token))
+	if err != nil {
+		return nil
+	}
+	u, err := database.GetUser(s.UserID)
+	if err != nil || u.Disabled {
+		return nil
+	}
+	return userPrincipal(u)
+}
+
+func userPrincipal(u *database.User) *auth.Principal {
+	return &auth.Principal{
+		UserID:   u.ID,
+		Name:     u.Username,
+		TenantID: u.TenantID,
+		Scopes:   auth.RoleScopes(u.Role),
+	}
+}
+
+// startSession creates a login session for u and sets its cookie
+func startSession(c *fiber.Ctx, u *database.User) error {
+	token, err := auth.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(sessionTTL)
+	go database.PurgeExpiredUserSessions()
+	err = database.CreateUserSession(&database.UserSession{
+		ID:        auth.HashKey(token),
+		UserID:    u.ID,
+		IP:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		ExpiresAt: expires,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	database.UpdateUser(u.ID, map[string]any{"last_login_at": &now})
+	c.Locals("principal", userPrincipal(u))
+
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	return nil
+}
+
+// requireUser rejects requests not made with a login session
+func requireUser(c *fiber.Ctx) error {
+	p := sessionPrincipal(c)
+	if p == nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Not logged in"})
+	}
+	c.Locals("principal", p)
+	return c.Next()
+}
+
+// LoginRoutes serves password and TOTP login for dashboard users
+func LoginRoutes(app *fiber.App, rl *RateLimiter) {
+	r := app.Group("/auth")
+
+	r.Post("/login", func(c *fiber.Ctx) error {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			TOTPCode string `json:"totp_code"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if wait, ok := rl.allowLogin(c.IP(), req.Username); !ok {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(wait/time.Second)+1))
+			return c.Status(429).JSON(fiber.Map{"error": "Too many login attempts"})
+		}
+
+		u, err := database.GetUserByUsername(req.Username)
+		if err != nil {
+			auth.CheckNoPassword(req.Password)
+			return c.Status(401).JSON(fiber.Map{"error": "Invalid username or password"})
+		}
+		if !auth.CheckPassword(u.PasswordHash, req.Password) || u.Disabled {
+			return c.Status(401).JSON(fiber.Map{"error": "Invalid username or password"})
+		}
+		if u.TOTPEnabled {
+			if req.TOTPCode == "" {
+				return c.Status(401).JSON(fiber.Map{"error": "TOTP code required", "totp_required": true})
+			}
+			if !useTOTP(u, req.TOTPCode) {
+				return c.Status(401).JSON(fiber.Map{"error": "Invalid TOTP code", "totp_required": true})
+			}
+		}
+
+		if err := startSession(c, u); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to start session"})
+		}
+		return c.JSON(userData(*u))
+	})
+
+	r.Post("/logout", func(c *fiber.Ctx) error {
+		if token := c.Cookies(sessionCookie); token != "" {
+			database.DeleteUserSession(auth.HashKey(token))
+		}
+		c.ClearCookie(sessionCookie)
+		return c.JSON(fiber.Map{"status": "logged_out"})
+	})
+
+	r.Get("/me", requireUser, func(c *fiber.Ctx) error {
+		u, err := database.GetUser(principal(c).UserID)
+		if err != nil {
+			return c.Status(401).JSON(fiber.Map{"error": "Not logged in"})
+		}
+		data := userData(*u)
+		data["scopes"] = principal(c).Scopes
+		return c.JSON(data)
+	})
+
+	r.Post("/password", requireUser, func(c *fiber.Ctx) error {
+		var req struct {
+			Current string `json:"current_password"`
+			New     string `json:"new_password"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		u, err := database.GetUser(principal(c).UserID)
+		if err != nil || !auth.CheckPassword(u.PasswordHash, req.Current) {
+			return c.Status(401).JSON(fiber.Map{"error": "Invalid password"})
+		}
+		hash, err := auth.HashPassword(req.New)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := database.UpdateUser(u.ID, map[string]any{"password_hash": hash}); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update password"})
+		}
+
+		// Sign out other sessions, then keep this one going
+		database.DeleteUserSessions(u.ID)
+		if err := startSession(c, u); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to start session"})
+		}
+		return c.JSON(fiber.Map{"status": "updated"})
+	})
+
+	r.Post("/totp/setup", requireUser, func(c *fiber.Ctx) error {
+		u, err := database.GetUser(principal(c).UserID)
+		if err != nil {
+			return c.Status(401).JSON(fiber.Map{"error": "Not logged in"})
+		}
+		if u.TOTPEnabled {
+			return c.Status(400).JSON(fiber.Map{"error": "TOTP is already enabled"})
+		}
+
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to generate secret"})
+		}
+		if err := database.UpdateUser(u.ID, map[string]any{"totp_secret": secret}); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save secret"})
+		}
+		return c.JSON(fiber.Map{
+			"secret": secret,
+			"url":    auth.TOTPURL(totpIssuer, u.Username, secret),
+		})
+	})
+
+	r.Post("/totp/enable", requireUser, func(c *fiber.Ctx) error {
+		return setTOTP(c, true)
+	})
+
+	r.Post("/totp/disable", requireUser, func(c *fiber.Ctx) error {
+		return setTOTP(c, false)
+	})
+}
+
+// setTOTP enables or disables the second factor after checking a current code
+func setTOTP(c *fiber.Ctx, enable bool) error {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	u, err := database.GetUser(principal(c).UserID)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Not logged in"})
+	}
+	if u.TOTPSecret == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Run TOTP setup first"})
+	}
+	if !useTOTP(u, req.Code) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid TOTP code"})
+	}
+
+	updates := map[string]any{"totp_enabled": enable}
+	if !enable {
+		updates["totp_secret"] = ""
+	}
+	if err := database.UpdateUser(u.ID, updates); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update TOTP"})
+	}
+	return c.JSON(fiber.Map{"totp_enabled": enable})
+}
+
+// useTOTP checks code for u and marks its time step as used, so it isn't accepted twice
+func useTOTP(u *database.User, code string) bool {
+	step, ok := auth.VerifyTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	ok, err := database.UseTOTPStep(u.ID, step)
+	if err != nil {
+		fmt.Printf("Error saving TOTP step for user %d: %v\n", u.ID, err)
+	}
+	return ok
+}
+
+// UserRoutes lets tenant admins manage dashboard accounts
+func UserRoutes(api fiber.Router) {
+	users := api.Group("/users", requireScope(auth.ScopeAdmin))
+
+	users.Get("/", func(c *fiber.Ctx) error {
+		list, err := database.ListUsers(principal(c).TenantFilter())
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list users"})
+		}
+		out := make([]fiber.Map, 0, len(list))
+		for _, u := range list {
+			out = append(out, userData(u))
+		}
+		return c.JSON(out)
+	})
+
+	users.Post("/", func(c *fiber.Ctx) error {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if req.Username == "" || !auth.ValidRole(req.Role) {
+			return c.Status(400).JSON(fiber.Map{"error": "username and a valid role are required"})
+		}
+		if _, err := database.GetUserByUsername(req.Username); err == nil {
+			return c.Status(409).JSON(fiber.Map{"error": "username already taken"})
+		}
+		hash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		u := database.User{
+			Username:     req.Username,
+			PasswordHash: hash,
+			Role:         req.Role,
+			TenantID:     principal(c).TenantID,
+		}
+		if err := database.CreateUser(&u); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create user"})
+		}
+		return c.Status(201).JSON(userData(u))
+	})
+
+	users.Patch("/:id", func(c *fiber.Ctx) error {
+		u, err := tenantUser(c)
+		if err != nil {
+			return err
+		}
+
+		var req struct {
+			Role     *string `json:"role"`
+			Disabled *bool   `json:"disabled"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		updates := map[string]any{}
+		if req.Role != nil {
+			if !auth.ValidRole(*req.Role) {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid role"})
+			}
+			updates["role"] = *req.Role
+		}
+		if req.Disabled != nil {
+			updates["disabled"] = *req.Disabled
+		}
+		if len(updates) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Nothing to update"})
+		}
+		if err := database.UpdateUser(u.ID, updates); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update user"})
+		}
+		if req.Disabled != nil && *req.Disabled {
+			database.DeleteUserSessions(u.ID)
+		}
+
+		u, _ = database.GetUser(u.ID)
+		return c.JSON(userData(*u))
+	})
+
+	users.Delete("/:id", func(c *fiber.Ctx) error {
+		u, err := tenantUser(c)
+		if err != nil {
+			return err
+		}
+		if err := database.DeleteUser(u.ID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete user"})
+		}
+		return c.JSON(fiber.Map{"status": "deleted", "id": u.ID})
+	})
+}
+
+// tenantUser loads the :id user if it belongs to the caller's tenant. On failure the
+// response has been written and the returned error should be passed back to fiber.
+func tenantUser(c *fiber.Ctx) (*database.User, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return nil, c.Status(400).JSON(fiber.Map{"error": "Invalid user id"})
+	}
+	u, err := database.GetUser(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !principal(c).CanAccess(u.TenantID)) {
+		return nil, c.Status(404).JSON(fiber.Map{"error": "user not found"})
+	}
+	if err != nil {
+		return nil, c.Status(500).JSON(fiber.Map{"error": "Failed to load user"})
+	}
+	return u, nil
+}
+
+func userData(u database.User) fiber.Map {
+	return fiber.Map{
+		"id":            u.ID,
+		"username":      u.Username,
+		"role":          u.Role,
+		"tenant_id":     u.TenantID,
+		"totp_enabled":  u.TOTPEnabled,
+		"disabled":      u.Disabled,
+		"created_at":    u.CreatedAt,
+		"last_login_at": u.LastLoginAt,
+	}
+}
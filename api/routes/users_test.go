@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"api/auth"
+	"api/database"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func newUser(t *testing.T, username, password string) *database.User {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := database.User{Username: username, PasswordHash: hash, Role: auth.RoleAdmin, TenantID: database.DefaultTenant}
+	if err := database.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	return &u
+}
+
+func login(t *testing.T, app *fiber.App, username, password, code string) int {
+	t.Helper()
+	status, _ := call(t, app, "POST", "/auth/login", "", map[string]any{"username": username, "password": password, "totp_code": code})
+	return status
+}
+
+func TestLogin(t *testing.T) {
+	app := newTestApp(t)
+	newUser(t, "alice", "correct horse battery")
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     int
+	}{
+		{"valid", "alice", "correct horse battery", 200},
+		{"wrong password", "alice", "wrong", 401},
+		{"unknown user", "mallory", "correct horse battery", 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := login(t, app, tt.username, tt.password, ""); got != tt.want {
+				t.Errorf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	app := newTestApp(t)
+	newUser(t, "alice", "correct horse battery")
+
+	for i := range loginUserLimit - 1 {
+		if got := login(t, app, "alice", "wrong", ""); got != 401 {
+			t.Fatalf("attempt %d: status %d, want 401", i, got)
+		}
+	}
+	// The last attempt of the minute still succeeds, the next is refused even with
+	// the right password
+	if got := login(t, app, "Alice", "wrong", ""); got != 401 {
+		t.Fatalf("status %d, want 401", got)
+	}
+	if got := login(t, app, "alice", "correct horse battery", ""); got != 429 {
+		t.Fatalf("status %d, want 429 once the user is throttled", got)
+	}
+
+	// Guessing across many usernames runs into the per address limit
+	var status int
+	for i := range loginIPLimit {
+		if status = login(t, app, fmt.Sprintf("user%d", i), "wrong", ""); status == 429 {
+			break
+		}
+	}
+	if status != 429 {
+		t.Fatal("attempts from one address were not throttled")
+	}
+}
+
+func TestLoginTOTPReplay(t *testing.T) {
+	app := newTestApp(t)
+	u := newUser(t, "alice", "correct horse battery")
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.UpdateUser(u.ID, map[string]any{"totp_secret": secret, "totp_enabled": true}); err != nil {
+		t.Fatal(err)
+	}
+	code, err := auth.TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := login(t, app, "alice", "correct horse battery", code); got != 200 {
+		t.Fatalf("first use: status %d, want 200", got)
+	}
+	if got := login(t, app, "alice", "correct horse battery", code); got != 401 {
+		t.Fatalf("replay: status %d, want 401", got)
+	}
+}
@@ -10,53 +10,21 @@ import type {
   WAMessageKey,
 } from "baileys";
 
-const isProd = process.env.NODE_ENV === "production";
+// The API passes its database driver, standalone runs use Postgres in production
+const usePostgres = process.env.WHATSALY_DB_DRIVER
+  ? process.env.WHATSALY_DB_DRIVER.startsWith("postgres")
+  : process.env.NODE_ENV === "production";
 
 export const getDb = () => {
-  if (isProd) {
+  if (usePostgres) {
     return new SQL(process.env.DATABASE_URL!);
   } else {
-    const sqlite = new Database("../whatsaly_dev.sqlite");
+    const sqlite = new Database(
+      process.env.WHATSALY_DB_PATH ?? "../whatsaly_dev.sqlite"
+    );
     sqlite.run("PRAGMA journal_mode = WAL;");
     sqlite.run("PRAGMA synchronous = NORMAL;");
-    sqlite.run(
-      `CREATE TABLE IF NOT EXISTS sessions (phone TEXT PRIMARY KEY, status TEXT, updated_at TEXT);`
-    );
-    sqlite.run(
-      `CREATE TABLE IF NOT EXISTS auth_data (id TEXT PRIMARY KEY, data TEXT, updated_at TEXT);`
-    );
-    sqlite.run(`
-      CREATE TABLE IF NOT EXISTS user_messages (
-        id TEXT, 
-        session_phone TEXT, 
-        data TEXT, 
-        timestamp TEXT, 
-        PRIMARY KEY (id, session_phone)
-      );
-    `);
-    sqlite.run(`
-      CREATE TABLE IF NOT EXISTS user_contacts (
-        pn TEXT, 
-        session_phone TEXT, 
-        lid TEXT, 
-        PRIMARY KEY (pn, session_phone)
-      );
-    `);
-    sqlite.run(
-      `CREATE INDEX IF NOT EXISTS idx_user_contacts_lid ON user_contacts (lid);`
-    );
-    sqlite.run(
-      `CREATE INDEX IF NOT EXISTS idx_user_messages_timestamp ON user_messages (timestamp);`
-    );
-    sqlite.run(`
-  CREATE TABLE IF NOT EXISTS group_metadata (
-    id TEXT, 
-    session_phone TEXT, 
-    metadata TEXT, 
-    updated_at TEXT, 
-    PRIMARY KEY (id, session_phone)
-  );
-`);
+    // Tables are created and migrated by the Go API before it starts the core
     return sqlite;
   }
 };
@@ -70,7 +38,7 @@ export const useHybridAuthState = async (client: any, phone: string) => {
     const data = JSON.stringify(value, BufferJSON.replacer);
     const now = new Date().toISOString();
     const id = `${keyPrefix}${key}`;
-    if (isProd) {
+    if (usePostgres) {
       await (db as any)`
         INSERT INTO auth_data (id, data, updated_at) 
         VALUES (${id}, ${data}, ${now})
@@ -96,11 +64,12 @@ export const useHybridAuthState = async (client: any, phone: string) => {
     saveCreds: async () => {
       await redisAuth.saveCreds();
       const now = new Date().toISOString();
-      if (isProd) {
+      if (usePostgres) {
         await (db as any)`INSERT INTO sessions (phone, status, updated_at) VALUES (${phone}, 'connected', ${now}) ON CONFLICT (phone) DO UPDATE SET updated_at = EXCLUDED.updated_at`;
       } else {
+        // Never REPLACE: the row holds columns owned by the API (tenant, labels, ...)
         (db as Database).run(
-          "INSERT OR REPLACE INTO sessions (phone, status, updated_at) VALUES (?, ?, ?)",
+          "INSERT INTO sessions (phone, status, updated_at) VALUES (?, ?, ?) ON CONFLICT (phone) DO UPDATE SET updated_at = excluded.updated_at",
           [phone, "connected", now]
         );
       }
@@ -184,7 +153,7 @@ export const saveMessage = async (msg: any, sessionPhone: string) => {
   const data = JSON.stringify(msg);
   const id = msg.key.id;
   const time = new Date().toISOString();
-  if (isProd) {
+  if (usePostgres) {
     await (db as any)`INSERT INTO user_messages (id, session_phone, data, timestamp) VALUES (${id}, ${sessionPhone}, ${data}, ${time}) ON CONFLICT (id, session_phone) DO NOTHING`;
   } else {
     (db as Database).run(
@@ -199,7 +168,7 @@ export const saveContact = async (
   lid: string,
   sessionPhone: string
 ) => {
-  if (isProd) {
+  if (usePostgres) {
     await (db as any)`INSERT INTO user_contacts (pn, session_phone, lid) VALUES (${pn}, ${sessionPhone}, ${lid}) ON CONFLICT (pn, session_phone) DO UPDATE SET lid = EXCLUDED.lid`;
   } else {
     (db as Database).run(
@@ -214,7 +183,7 @@ export async function getMessage(
 ): Promise<WAMessageContent | undefined> {
   const id = key.id;
   let rawData: string | undefined;
-  if (isProd) {
+  if (usePostgres) {
     const result =
       await (db as any)`SELECT data FROM user_messages WHERE id = ${id} LIMIT 1`;
     rawData = result[0]?.data;
@@ -264,7 +233,7 @@ export async function cachedGroupMetadata(
   const id = jid;
   let raw: any;
 
-  if (isProd) {
+  if (usePostgres) {
     raw =
       await (db as any)`SELECT metadata FROM group_metadata WHERE id = ${id} LIMIT 1`;
     raw = raw[0]?.metadata;
@@ -285,7 +254,7 @@ export const cacheGroupMetadata = async (
   const data = JSON.stringify(metadata);
   const now = new Date().toISOString();
 
-  if (isProd) {
+  if (usePostgres) {
     await (db as any)`
       INSERT INTO group_metadata (id, session_phone, metadata, updated_at) 
       VALUES (${metadata.id}, ${sessionPhone}, ${data}, ${now}) 
@@ -334,7 +303,7 @@ export async function getAlternateId(
   const isLid = id?.endsWith("@lid");
   let result: any;
 
-  if (isProd) {
+  if (usePostgres) {
     if (isLid) {
       result = await (db as any)`
         SELECT pn FROM user_contacts 
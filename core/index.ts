@@ -31,7 +31,9 @@ const logger = pino({
   },
 });
 
-const redis = createClient({ url: "redis://localhost:6379" });
+const redis = createClient({
+  url: process.env.REDIS_URL ?? "redis://localhost:6379",
+});
 redis.on("error", (err) => console.log("Redis Client Error", err));
 
 await redis.connect();
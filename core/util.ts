@@ -52,16 +52,18 @@ export const updateSetting = async (
   key: string,
   value: string | number
 ) => {
-  const env = readFileSync("../.env");
+  // The API passes its address and a key when it spawns the core
+  const apiUrl =
+    process.env.WHATSALY_API_URL ??
+    `http://127.0.0.1:${parseEnv(readFileSync("../.env"))["PORT"] || "8080"}`;
   try {
     const response = await fetch(
-      `http://127.0.0.1:${
-        parseEnv(env)["PORT"] || "8080"
-      }/api/settings/${phone}`,
+      `${apiUrl}/api/settings/${phone}`,
       {
         method: "PATCH",
         headers: {
           "Content-Type": "application/json",
+          Authorization: `Bearer ${process.env.WHATSALY_API_KEY ?? ""}`,
         },
         body: JSON.stringify({ key, value }),
       }